@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"genflux/internal/capture"
+	"genflux/internal/pcapio"
+)
+
+func newCaptureCommand() *command {
+	return &command{
+		name:    "capture",
+		summary: "record the traffic of an interface to pcap files (AF_PACKET)",
+		examples: []string{
+			"sudo genflux capture --iface eth0 --out lab.pcap",
+			"sudo genflux capture --iface eth1 --out dut.pcapng --filter 'udp and port 4789' --duration 5m",
+			"sudo genflux capture --iface eth0 --out ring.pcap --rotate-size 1g --snaplen 128",
+		},
+		run: runCapture,
+	}
+}
+
+func runCapture(cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	iface := fs.String("iface", "", "network interface to capture on")
+	out := fs.String("out", "", "capture file, or - to stream to stdout; rotated files are <out>_000000.pcap onwards")
+	format := fs.String("format", "", "output format: pcap|pcapng (default: pcapng if out ends in .pcapng, else pcap)")
+	filterExpr := fs.String("filter", "", "write only the frames matching this capture filter in tcpdump syntax, e.g. 'tcp and port 443'")
+	snaplen := fs.Int("snaplen", capture.DefaultSnaplen, "bytes kept of every frame")
+	promisc := fs.Bool("promisc", true, "put the interface in promiscuous mode while capturing")
+	fs.group("Rotation and limits")
+	rotateSize := fs.String("rotate-size", "", "start a new file once this many frame bytes are written, e.g. 100m (headers not counted, like pcap split --size)")
+	rotateEvery := fs.Duration("rotate-every", 0, "start a new file every span of this long, e.g. 1h (spans without frames get no file)")
+	duration := fs.Duration("duration", 0, "stop after this long, e.g. 10m (0=until Ctrl-C)")
+	count := fs.Int64("count", 0, "stop after writing this many frames (0=no limit)")
+	if err := fs.parse(args); err != nil {
+		return err
+	}
+
+	cfg := capture.Config{
+		Iface:       *iface,
+		Out:         *out,
+		Filter:      *filterExpr,
+		Snaplen:     *snaplen,
+		Promisc:     *promisc,
+		RotateEvery: *rotateEvery,
+		Duration:    *duration,
+		Count:       *count,
+	}
+	if *format != "" {
+		f, err := pcapio.ParseFormat(*format)
+		if err != nil {
+			return fmt.Errorf("invalid format: %v", err)
+		}
+		cfg.Format = f
+	}
+	if *rotateSize != "" {
+		n, err := parseSize(*rotateSize)
+		if err != nil {
+			return fmt.Errorf("invalid rotate-size: %v", err)
+		}
+		cfg.RotateBytes = n
+	}
+	// Keep stdout for the capture when it streams there.
+	log := io.Writer(os.Stdout)
+	if cfg.Out == "-" {
+		log = os.Stderr
+	}
+
+	// Ctrl-C ends the capture as its limits do.
+	ctx, cancel := runContext(0, true)
+	defer cancel()
+	stats, err := capture.Capture(ctx, cfg, log)
+	if len(stats.Files) > 0 {
+		fmt.Fprintf(log, "Captured %d packets (%d bytes) to %d file(s); %d filtered out, %d dropped by the kernel\n",
+			stats.Packets, stats.Bytes, len(stats.Files), stats.Filtered, stats.Dropped)
+	}
+	return err
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+)
+
+// command is a node in the CLI tree. Leaf commands set run; group commands
+// set children and dispatch to them by name.
+type command struct {
+	name     string
+	summary  string
+	args     string
+	examples []string
+	children []*command
+	parent   *command
+	run      func(cmd *command, args []string) error
+}
+
+func (c *command) add(children ...*command) *command {
+	for _, child := range children {
+		child.parent = c
+		c.children = append(c.children, child)
+	}
+	return c
+}
+
+func (c *command) path() string {
+	if c.parent == nil {
+		return c.name
+	}
+	return c.parent.path() + " " + c.name
+}
+
+func (c *command) child(name string) *command {
+	for _, child := range c.children {
+		if child.name == name {
+			return child
+		}
+	}
+	return nil
+}
+
+func (c *command) execute(args []string) error {
+	if c.run != nil {
+		return c.run(c, args)
+	}
+	if len(args) < 1 {
+		c.printUsage(os.Stderr, nil)
+		return fmt.Errorf("missing %s subcommand", c.path())
+	}
+	switch args[0] {
+	case "-h", "--help":
+		c.printUsage(os.Stdout, nil)
+		return nil
+	case "help":
+		return c.help(args[1:])
+	}
+	child := c.child(args[0])
+	if child == nil {
+		names := make([]string, 0, len(c.children))
+		for _, ch := range c.children {
+			names = append(names, ch.name)
+		}
+		msg := fmt.Sprintf("unknown %s subcommand: %s", c.path(), args[0])
+		if s := suggest(args[0], names); s != "" {
+			msg += fmt.Sprintf(" (did you mean %q?)", s)
+		}
+		c.printUsage(os.Stderr, nil)
+		return errors.New(msg)
+	}
+	return child.execute(args[1:])
+}
+
+// help prints usage for the command found by following args from c.
+func (c *command) help(args []string) error {
+	target := c
+	for _, name := range args {
+		next := target.child(name)
+		if next == nil {
+			return fmt.Errorf("unknown help topic: %s", strings.Join(args, " "))
+		}
+		target = next
+	}
+	if target.run != nil {
+		// Leaf commands own their flags; asking them for -h prints the
+		// full usage including flag groups.
+		if err := target.run(target, []string{"-h"}); err != nil && !errors.Is(err, flag.ErrHelp) {
+			return err
+		}
+		return nil
+	}
+	target.printUsage(os.Stdout, nil)
+	return nil
+}
+
+func (c *command) flagSet() *flagSet {
+	fs := &flagSet{FlagSet: flag.NewFlagSet(c.path(), flag.ContinueOnError), cmd: c}
+	fs.SetOutput(io.Discard)
+	return fs
+}
+
+func (c *command) printUsage(w io.Writer, fs *flagSet) {
+	fmt.Fprintf(w, "%s - %s\n\n", c.path(), c.summary)
+	fmt.Fprintln(w, "Usage:")
+	if len(c.children) > 0 {
+		fmt.Fprintf(w, "  %s <command> [flags]\n", c.path())
+	} else {
+		line := c.path() + " [flags]"
+		if c.args != "" {
+			line += " " + c.args
+		}
+		fmt.Fprintf(w, "  %s\n", line)
+	}
+	if len(c.children) > 0 {
+		fmt.Fprintln(w, "\nCommands:")
+		width := 0
+		for _, child := range c.children {
+			if len(child.name) > width {
+				width = len(child.name)
+			}
+		}
+		for _, child := range c.children {
+			fmt.Fprintf(w, "  %-*s  %s\n", width, child.name, child.summary)
+		}
+		fmt.Fprintf(w, "\nRun '%s help <command>' for details on a command.\n", c.path())
+	}
+	if len(c.examples) > 0 {
+		fmt.Fprintln(w, "\nExamples:")
+		for _, ex := range c.examples {
+			fmt.Fprintf(w, "  %s\n", ex)
+		}
+	}
+	if fs != nil {
+		fs.printDefaults(w)
+	}
+}
+
+// flagSet wraps flag.FlagSet with titled groups for usage output and
+// suggestions for mistyped flags.
+type flagSet struct {
+	*flag.FlagSet
+	cmd    *command
+	groups []flagGroup
+}
+
+type flagGroup struct {
+	title string
+	// defined holds the flags registered before the group started.
+	defined map[string]bool
+}
+
+// group starts a new titled group; flags defined afterwards belong to it.
+func (fs *flagSet) group(title string) {
+	defined := map[string]bool{}
+	fs.VisitAll(func(f *flag.Flag) { defined[f.Name] = true })
+	fs.groups = append(fs.groups, flagGroup{title: title, defined: defined})
+}
+
+// parse parses args and handles -h and unknown flags. It returns
+// flag.ErrHelp after printing usage when help was requested.
+func (fs *flagSet) parse(args []string) error {
+	err := fs.Parse(args)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, flag.ErrHelp) {
+		fs.cmd.printUsage(os.Stdout, fs)
+		return flag.ErrHelp
+	}
+	msg := err.Error()
+	const undefined = "flag provided but not defined: "
+	if strings.HasPrefix(msg, undefined) {
+		name := strings.TrimLeft(strings.TrimPrefix(msg, undefined), "-")
+		names := []string{}
+		fs.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+		msg = "unknown flag --" + name
+		if s := suggest(name, names); s != "" {
+			msg += fmt.Sprintf(" (did you mean --%s?)", s)
+		}
+	}
+	return fmt.Errorf("%s: %s\nRun '%s -h' for usage.", fs.cmd.path(), msg, fs.cmd.path())
+}
+
+// isSet reports whether the flag was given on the command line.
+func (fs *flagSet) isSet(name string) bool {
+	set := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
+}
+
+func (fs *flagSet) printDefaults(w io.Writer) {
+	var all []*flag.Flag
+	fs.VisitAll(func(f *flag.Flag) { all = append(all, f) })
+	if len(all) == 0 {
+		return
+	}
+	groups := fs.groups
+	if len(groups) == 0 || len(groups[0].defined) > 0 {
+		groups = append([]flagGroup{{title: "Flags", defined: map[string]bool{}}}, groups...)
+	}
+	for i, g := range groups {
+		var members []*flag.Flag
+		for _, f := range all {
+			if g.defined[f.Name] {
+				continue
+			}
+			if i+1 < len(groups) && groups[i+1].defined[f.Name] {
+				members = append(members, f)
+			} else if i+1 == len(groups) {
+				members = append(members, f)
+			}
+		}
+		if len(members) == 0 {
+			continue
+		}
+		fmt.Fprintf(w, "\n%s:\n", g.title)
+		for _, f := range members {
+			typ, usage := flag.UnquoteUsage(f)
+			name := "--" + f.Name
+			if typ != "" {
+				name += " " + typ
+			}
+			line := fmt.Sprintf("  %-28s %s", name, usage)
+			if f.DefValue != "" && f.DefValue != "0" && f.DefValue != "false" {
+				line += fmt.Sprintf(" (default %s)", f.DefValue)
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+}
+
+// suggest returns the candidate closest to name, or "" when nothing is
+// close enough to be a plausible typo.
+func suggest(name string, candidates []string) string {
+	sort.Strings(candidates)
+	best, bestDist := "", len(name)/2+2
+	for _, c := range candidates {
+		if strings.HasPrefix(c, name) && len(name) >= 3 {
+			return c
+		}
+		if d := levenshtein(name, c); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+	return best
+}
+
+func levenshtein(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
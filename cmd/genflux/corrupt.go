@@ -0,0 +1,26 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"genflux/internal/pcapio"
+)
+
+// corruptOptions reads captures as --skip-corrupt says, reporting each
+// record skipped to out.
+func corruptOptions(skip bool, out io.Writer) pcapio.ReaderOptions {
+	return pcapio.ReaderOptions{SkipCorrupt: skip, OnCorrupt: func(e *pcapio.CorruptError) {
+		fmt.Fprintf(out, "Skipped %v\n", e)
+	}}
+}
+
+// corruptHint points at --skip-corrupt when err is a damaged record.
+func corruptHint(err error) error {
+	var cerr *pcapio.CorruptError
+	if errors.As(err, &cerr) {
+		return fmt.Errorf("%v (--skip-corrupt steps over it)", err)
+	}
+	return err
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"genflux/internal/pcaptool"
+)
+
+func newPcapInfoCommand() *command {
+	return &command{
+		name:    "info",
+		summary: "summarise a capture: size, timing, flows, protocols and top talkers",
+		args:    "<file>",
+		examples: []string{
+			"genflux pcap info realistic_1g.pcap",
+			"genflux pcap info --top 20 --json out/file_0001.pcapng",
+		},
+		run: runPcapInfo,
+	}
+}
+
+func runPcapInfo(cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	top := fs.Int("top", 10, "list this many hosts by bytes sent and received")
+	asJSON := fs.Bool("json", false, "print the summary as JSON")
+	skipCorrupt := fs.Bool("skip-corrupt", false, "step over damaged records, reporting each, instead of failing")
+	if err := fs.parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() != 1 {
+		return errors.New("pcap info takes exactly one capture file")
+	}
+
+	// Keep stdout valid JSON.
+	notes := io.Writer(os.Stdout)
+	if *asJSON {
+		notes = os.Stderr
+	}
+	info, err := pcaptool.Summarize(pcaptool.InfoConfig{InPath: fs.Arg(0), Top: *top, Read: corruptOptions(*skipCorrupt, notes)})
+	if err != nil {
+		return corruptHint(err)
+	}
+	if *asJSON {
+		data, err := json.MarshalIndent(info, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = os.Stdout.Write(append(data, '\n'))
+		return err
+	}
+	printInfo(os.Stdout, info)
+	return nil
+}
+
+func printInfo(w io.Writer, info pcaptool.Info) {
+	fmt.Fprintf(w, "File:      %s (%s, %s, %s on disk)\n", info.Path, info.Format, info.LinkType, formatBytes(float64(info.FileBytes)))
+	fmt.Fprintf(w, "Packets:   %d\n", info.Packets)
+	fmt.Fprintf(w, "Bytes:     %d (%s)", info.Bytes, formatBytes(float64(info.Bytes)))
+	if info.Captured != info.Bytes {
+		fmt.Fprintf(w, ", %d captured", info.Captured)
+	}
+	fmt.Fprintln(w)
+	if info.Packets > 0 {
+		fmt.Fprintf(w, "First:     %s\n", info.First.Format(time.RFC3339Nano))
+		fmt.Fprintf(w, "Last:      %s\n", info.Last.Format(time.RFC3339Nano))
+	}
+	fmt.Fprintf(w, "Duration:  %s\n", info.Duration)
+	fmt.Fprintf(w, "Rate:      %.1f pps, %.3f Mbps\n", info.PPS, info.Mbps)
+	fmt.Fprintf(w, "Flows:     %d\n", info.Flows)
+	if len(info.Protocols) > 0 {
+		fmt.Fprintln(w, "\nProtocols:")
+		for _, p := range info.Protocols {
+			fmt.Fprintf(w, "  %-20s %10d pkts %6.2f%%  %12d bytes %6.2f%%\n", p.Protocol,
+				p.Packets, percent(p.Packets, info.Packets), p.Bytes, percent(p.Bytes, info.Bytes))
+		}
+	}
+	if len(info.Talkers) > 0 {
+		fmt.Fprintln(w, "\nTop talkers (sent and received):")
+		for _, t := range info.Talkers {
+			fmt.Fprintf(w, "  %-39s %10d pkts  %12d bytes %6.2f%%\n", t.Address, t.Packets, t.Bytes, percent(t.Bytes, info.Bytes))
+		}
+	}
+}
+
+func percent(part, whole int64) float64 {
+	if whole == 0 {
+		return 0
+	}
+	return 100 * float64(part) / float64(whole)
+}
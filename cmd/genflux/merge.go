@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"genflux/internal/pcapio"
+	"genflux/internal/pcaptool"
+)
+
+func newPcapMergeCommand() *command {
+	return &command{
+		name:    "merge",
+		summary: "interleave several captures into one in timestamp order",
+		args:    "<file>...",
+		examples: []string{
+			"genflux pcap merge --out merged.pcap a.pcap b.pcap",
+			"genflux pcap merge --out merged.pcapng --offsets 0,-2h30m real.pcapng synthetic.pcap",
+		},
+		run: runPcapMerge,
+	}
+}
+
+func runPcapMerge(cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	outPath := fs.String("out", "", "output path, or - for stdout")
+	offsets := fs.String("offsets", "", "shift each input's timestamps by these durations, in input order, e.g. 0,90s,-1h (missing ones are 0)")
+	format := fs.String("format", "", "output format: pcap|pcapng (default: that of the first input)")
+	skipCorrupt := fs.Bool("skip-corrupt", false, "step over damaged records, reporting each, instead of failing")
+	if err := fs.parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("pcap merge needs at least one input file")
+	}
+
+	cfg := pcaptool.MergeConfig{InPaths: fs.Args(), OutPath: *outPath}
+	if *offsets != "" {
+		for _, part := range strings.Split(*offsets, ",") {
+			d, err := time.ParseDuration(strings.TrimSpace(part))
+			if err != nil {
+				return fmt.Errorf("invalid offsets: %v", err)
+			}
+			cfg.Offsets = append(cfg.Offsets, d)
+		}
+	}
+	if *format != "" {
+		f, err := pcapio.ParseFormat(*format)
+		if err != nil {
+			return fmt.Errorf("invalid format: %v", err)
+		}
+		cfg.Format = f
+	}
+	// Keep stdout clean when the capture is streamed there.
+	out := os.Stdout
+	if cfg.OutPath == pcaptool.StdoutPath {
+		out = os.Stderr
+	}
+	cfg.Read = corruptOptions(*skipCorrupt, out)
+	stats, err := pcaptool.Merge(cfg)
+	if err != nil {
+		return corruptHint(err)
+	}
+	for i, path := range cfg.InPaths {
+		fmt.Fprintf(out, "  %s: %d packets\n", path, stats.PerInput[i])
+	}
+	fmt.Fprintf(out, "Merged %d packets from %d files: %s to %s\n", stats.Packets, len(cfg.InPaths),
+		stats.First.Format(time.RFC3339Nano), stats.Last.Format(time.RFC3339Nano))
+	return nil
+}
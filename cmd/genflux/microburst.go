@@ -0,0 +1,27 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"genflux/internal/microburst"
+)
+
+// addMicroburstFlags defines the microburst flags gen and replay share. The
+// returned func reads them once fs is parsed.
+func addMicroburstFlags(fs *flagSet) func() (microburst.Config, error) {
+	rate := fs.Float64("microbursts", 0, "line-rate microbursts per second on average, each followed by the lull it leaves (0=none)")
+	length := fs.Duration("microburst-length", 2*time.Millisecond, "longest a microburst lasts")
+	lineRate := fs.String("microburst-line-rate", "10g", "link rate a microburst saturates, in Mbps or with SI unit")
+	return func() (microburst.Config, error) {
+		cfg := microburst.Config{Rate: *rate, Length: *length}
+		if cfg.Rate == 0 {
+			return cfg, nil
+		}
+		var err error
+		if cfg.LineRate, err = parseRate(*lineRate, "bps", 1e6); err != nil {
+			return cfg, fmt.Errorf("invalid microburst-line-rate: %v", err)
+		}
+		return cfg, nil
+	}
+}
@@ -0,0 +1,534 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+
+	"genflux/internal/pcapgen"
+	"genflux/internal/pcapio"
+)
+
+func newPcapGenCommand() *command {
+	return &command{
+		name:    "gen",
+		summary: "generate synthetic pcap files",
+		examples: []string{
+			"genflux pcap gen --file-count 1 --exact-size 1g --out-file ./realistic_1g.pcap",
+			"genflux pcap gen --flow-count 2000000 --packets-per-flow 10 --exact-size 1.5g --out-file ./flows.pcap",
+			"genflux pcap gen --config profile.yaml --seed 7",
+		},
+		run: runPcapGen,
+	}
+}
+
+// genOptions are the flags of pcap gen that shape the run rather than
+// the traffic.
+type genOptions struct {
+	fs         *flagSet
+	emitConfig string
+	progress   string
+	timeout    time.Duration
+}
+
+func runPcapGen(cmd *command, args []string) error {
+	cfg, opts, err := parseGenConfig(cmd, args)
+	if err != nil {
+		return err
+	}
+
+	// When streaming to stdout there is no output path to put the profile
+	// next to, so it is only written when asked for.
+	if opts.emitConfig != "none" && (opts.emitConfig != "" || cfg.OutFile != pcapgen.StdoutPath) {
+		path := opts.emitConfig
+		if path == "" {
+			path = defaultProfilePath(cfg)
+		}
+		if err := writeProfile(path, effectiveProfile(opts.fs, cfg)); err != nil {
+			return fmt.Errorf("write effective config: %v", err)
+		}
+	}
+
+	reporter, err := newGenProgress(opts.progress, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("invalid progress: %v", err)
+	}
+	if reporter != nil {
+		cfg.Progress = reporter.report
+		if !reporter.json {
+			log.SetOutput(reporter)
+			defer log.SetOutput(os.Stderr)
+		}
+	}
+
+	ctx, cancel := runContext(opts.timeout, true)
+	defer cancel()
+	if err := pcapgen.Generate(ctx, cfg); err != nil {
+		return stopReason(err, opts.timeout)
+	}
+	return nil
+}
+
+// parseGenConfig parses the flags of pcap gen, and the profiles they
+// name, into the configuration of the generator.
+func parseGenConfig(cmd *command, args []string) (pcapgen.Config, genOptions, error) {
+	cfg := pcapgen.DefaultConfig()
+	fs := cmd.flagSet()
+	config := fs.String("config", "", "load flags from YAML or JSON profiles, comma-separated with later ones overriding earlier; profiles can include others; command-line flags take precedence")
+	emitConfig := fs.String("emit-config", "", "write the effective configuration to this file (default: next to the output; none disables)")
+	fs.group("Hosts")
+	internal := fs.Int("internal-hosts", cfg.InternalHosts, "number of internal hosts")
+	external := fs.Int("external-hosts", cfg.ExternalHosts, "number of external hosts")
+	vlan := fs.String("vlan", "", "802.1Q tags on every frame, outermost first (e.g. 100, or 10,100 for QinQ)")
+	vlanPool := fs.String("vlan-pool", "", "innermost VLAN chosen per internal /24 subnet (e.g. 100-163 or 100,200,300)")
+	mpls := fs.String("mpls", "", "MPLS labels pushed onto every frame below its VLAN tags, top of the stack first; as many labels as given, at most 8 (e.g. 16001 or 16001,24005)")
+	macOUIs := fs.String("mac-ouis", "", "give internal hosts MACs from vendor prefixes: vendor (built-in Intel/Dell/HP/Apple/... list) or OUIs such as 00:1b:21,f8:bc:12")
+	gatewayMAC := fs.String("gateway-mac", "", "MAC of the edge router that all traffic to and from external hosts passes through (default: a random MAC per external host)")
+	tenants := fs.Int("tenants", 0, "render the traffic once per tenant with overlapping addressing (0=disabled)")
+	tenantEncap := fs.String("tenant-encap", string(pcapgen.TenantVXLAN), "how tenants are separated: vlan|vxlan")
+	tenantBaseID := fs.Int("tenant-base-id", 100, "VLAN ID or VNI of the first tenant; tenant i uses base+i")
+	encap := fs.String("encap", "none", "carry every frame in a tunnel between two underlay endpoints, outside any tenant encapsulation: gre (key = vni, as NVGRE)|vxlan (UDP 4789)|geneve (UDP 6081)|none")
+	vni := fs.Int("vni", 0, "with encap: VXLAN or Geneve VNI, or GRE virtual subnet ID")
+	underlaySrc := fs.String("underlay-src", "", "with encap: outer source address, IPv4 or IPv6 (default 172.16.0.1)")
+	underlayDst := fs.String("underlay-dst", "", "with encap: outer destination address, of the same family (default 172.16.0.2)")
+	fs.group("Timing")
+	minDur := fs.Int("min-duration", int(cfg.MinDuration.Seconds()), "min duration seconds")
+	maxDur := fs.Int("max-duration", int(cfg.MaxDuration.Seconds()), "max duration seconds")
+	startTime := fs.String("start-time", cfg.StartTime.Format("Mon Jan 2 15:04:05 2006"), "start time (Mon Jan 2 15:04:05 2006 or RFC3339)")
+	microbursts := addMicroburstFlags(fs)
+	fs.group("Output")
+	trafficModel := fs.String("traffic-model", "", "how busy the network is over the day: flat|diurnal (built-in weekday/weekend curves)|FILE.csv (lines HOUR,LEVEL or HOUR,WEEKDAY,WEEKEND, levels 0..1); shapes the packet rate within files and, with file-count>1, the file durations (default: diurnal file durations only)")
+	fileCount := fs.Int("file-count", cfg.FileCount, "number of files to generate")
+	outDir := fs.String("out-dir", cfg.OutDir, "output directory")
+	outFile := fs.String("out-file", cfg.OutFile, "output file path, or - to stream to stdout (requires file-count=1)")
+	format := fs.String("format", string(cfg.Format), "output format: pcap|pcapng (pcapng adds per-packet comments and ns timestamps)")
+	snaplen := fs.Int("snaplen", 0, "snap length of the captures: frames are stored cut to this many bytes with their original length kept, e.g. 96 for headers only (0=65535); exact-size and max-size still count whole frames")
+	link := fs.String("link", string(pcapgen.LinkEthernet), "link layer: ethernet|wifi (radiotap + 802.11 with beacons and probe requests)")
+	workers := fs.Int("workers", cfg.Workers, "packets built in parallel by this many workers; output is identical for any value")
+	sizeSplit := fs.String("size-split", string(pcapgen.SplitEven), "how exact-size is shared out with file-count>1: even|traffic (by each file's traffic under the traffic model; durations then follow min/max-duration)")
+	maxSize := fs.String("max-size", "", "instead of exact-size: fill each file with as many packets as fit in this size, same units (works with file-count>1)")
+	rotate := fs.Bool("rotate", false, "like tcpdump -C: write numbered files of exactly max-size one after another until exact-size in total or total-duration is reached; the last file takes the rest")
+	totalDuration := fs.Duration("total-duration", 0, "with rotate: stop once the files cover this much capture time (e.g. 24h)")
+	progress := fs.String("progress", "none", "report progress on stderr: bar (percentage of the size written, rate and ETA)|json (one object per line)|none")
+	timeout := fs.Duration("timeout", 0, "stop after this long, removing the file being written (0=no limit)")
+	exactSize := fs.String("exact-size", "", "exact total file size with unit (e.g. 1g, 1gib, 1gb; k/m/g/t and KiB/MiB/GiB/TiB are 1024-based, KB/MB/GB/TB are 1000-based)")
+	labels := fs.String("labels", "none", "write every flow of each file with its ground truth to <file>.labels.json or .csv: json|csv|none (5-tuple, packets, bytes, first and last packet, label benign|noise|portscan|sweep|bruteforce)")
+	flowExport := fs.String("flow-export", "none", "also export the flows of each file as NetFlow v9 or IPFIX records, to <file>.nf9 or .ipfix or to flow-collector: netflow9|ipfix|none")
+	flowCollector := fs.String("flow-collector", "", "with flow-export: send the export to this HOST:PORT over UDP instead of a file")
+	flowActive := fs.Duration("flow-active-timeout", cfg.FlowExport.ActiveTimeout, "with flow-export: end flow records that have lasted this long")
+	flowInactive := fs.Duration("flow-inactive-timeout", cfg.FlowExport.InactiveTimeout, "with flow-export: end flow records idle this long (TCP FIN or RST ends them at once)")
+	fs.group("Traffic")
+	flowCount := fs.Int("flow-count", cfg.FlowCount, "number of unique 5-tuples to generate (0=disabled)")
+	packetsPerFlow := fs.Int("packets-per-flow", cfg.PacketsPerFlow, "packets per 5-tuple when flow-count is set")
+	packetsDist := fs.String("packets-dist", string(pcapgen.PacketsFixed), "how packets are spread over the flows, packets-per-flow being the mean: fixed|lognormal[:SIGMA] (default sigma 1.5)|pareto[:ALPHA] (heavier tail, default alpha 1.2); totals are unchanged")
+	concurrency := fs.Int("concurrency", 1, "with flow-count: how many flows are open at once, their packets interleaved over the file (1=one flow after another)")
+	protoDist := fs.String("proto-dist", "", "protocol distribution (e.g. tcp=70,udp=25,icmp=5)")
+	protocols := fs.String("protocols", "", "protocol mix as a list with optional weights (e.g. tcp,udp,icmp or tcp:70,udp:25,icmp:5)")
+	tcpPortDist := fs.String("tcp-port-dist", "", "TCP dst port distribution (e.g. 443=40,80=20,1024-65535=10)")
+	udpPortDist := fs.String("udp-port-dist", "", "UDP dst port distribution (e.g. 53=30,443=25,1024-65535=10)")
+	services := fs.String("services", "", "service mix as dst ports with weights, replacing protocols and port dists (e.g. 80:0.4,443:0.3,53:0.2,22:0.1; PORT/udp forces UDP)")
+	ephemeralPorts := fs.String("ephemeral-ports", "32768-60999", "range client source ports are drawn from; the default is Linux's, ephemeral is the IANA range 49152-65535")
+	pktSizeDist := fs.String("pkt-size-dist", "", "packet size distribution in bytes; sizes may be ranges (e.g. 64=25,128=15,512-1024=15,1500=20)")
+	sizeDist := fs.String("size-dist", "", "packet size model: fixed:N, uniform:MIN-MAX or imix")
+	mtu := fs.Int("mtu", 0, "largest IP packet written (e.g. 1500, or 9000 for jumbo frames); packets are sized to fit it and TCP sessions announce the matching MSS (0=packets up to 64 KiB, MSS for 1500)")
+	fragment := fs.Bool("fragment", false, "with mtu: keep planned sizes and write packets over the mtu as IP fragments instead")
+	respRatio := fs.Float64("resp-ratio", cfg.ResponseRatio, "response packet ratio within a flow [0..1]")
+	ipv6Ratio := fs.Float64("ipv6-ratio", cfg.IPv6Ratio, "fraction of flows/packets sent over IPv6 [0..1]")
+	tunnel := fs.String("tunnel", "", "carry some IPv6 traffic over IPv4 transition mechanisms: 6in4,teredo,isatap")
+	tunnelRatio := fs.Float64("tunnel-ratio", 0.05, "fraction of flows/packets tunnelled with one of the tunnel mechanisms (0..1]")
+	uniqueFlows := fs.Bool("unique-flows", cfg.UniqueFlows, "give every packet a distinct 5-tuple in random mode (without flow-count)")
+	sessionModel := fs.String("session-model", "", "render TCP flows as sessions: handshake|full (requires flow-count)")
+	zeroWindowRate := fs.Float64("zero-window-rate", cfg.ZeroWindowRate, "chance a TCP session data segment finds the receiver's window closed [0..1) (requires session-model)")
+	seed := fs.Int64("seed", cfg.Seed, "random seed (int64)")
+	evasion := fs.String("evasion", "", "tamper with the first data segment of some TCP sessions: overlap,urgent,ttl-insert (requires session-model)")
+	l7Ratio := fs.Float64("l7-ratio", 0, "share of flows turned into HTTP GET/200, DNS query/answer or TLS ClientHello+SNI exchanges with realistic payloads [0..1] (requires flow-count)")
+	encryptedDNSRatio := fs.Float64("encrypted-dns-ratio", 0, "share of DNS flows (UDP 53) carried over DoT (TCP 853) or DoH (HTTPS on TCP 443) to a public resolver instead [0..1] (requires flow-count)")
+	payloadTemplates := fs.String("payload-templates", "", "bind app payloads to their flow: builtin (HTTP Host, TLS SNI and DNS answers agree per server) and/or APP=FILE templates with {{hostname}}, {{src_ip}}, {{flow_id}}, {{timestamp}}... (e.g. http=req.txt,http-response=resp.txt)")
+	domainList := fs.String("domain-list", "", "file of domains (one per line) that HTTP Host, TLS SNI and DNS names are drawn from, one per server")
+	pathList := fs.String("url-path-list", "", "file of URL paths (one per line) that HTTP requests are drawn from")
+	userAgentList := fs.String("user-agent-list", "", "file of User-Agent strings (one per line) that HTTP requests are drawn from, one per client")
+	osPersonas := fs.String("os-personas", "", "give every host an OS persona that sets its TTL, TCP window, SYN options (with session-model), User-Agent and, with flow-count, some of its services: default (windows=55,linux=20,macos=15,iot=10) or a mix such as windows=60,linux=40; hosts are listed with theirs in the manifest")
+	evasionRatio := fs.Float64("evasion-ratio", 0.05, "fraction of TCP sessions given evasion segments (0..1]")
+	noiseRate := fs.Float64("noise-rate", cfg.Noise.Rate, "background internet noise in packets per second: scans, backscatter and spoofed junk hitting internal hosts from outside (0=none)")
+	background := fs.String("background", "", "link-local chatter of every internal host with its gateway (the .254 of its /24): arp (resolving it about once a minute), dhcp (renewing its lease about every 10 minutes), ndp (IPv6 neighbor solicitation about every 30 seconds); a list such as arp,dhcp,ndp")
+	fs.group("Profile")
+	profile := fs.String("profile", "", "replace the traffic mix with that of one application: dns (internal hosts resolving names through public resolvers, shaped by the flags below; max-size caps the files, default 300m)")
+	qps := fs.Float64("qps", cfg.DNS.QPS, "with profile dns: queries per second of capture time")
+	dnsZipf := fs.Float64("dns-zipf", cfg.DNS.Zipf, "with profile dns: Zipf exponent (> 1) of the popularity of the names queried; names come from domain-list, most popular first, or a built-in list")
+	nxdomainRatio := fs.Float64("nxdomain-ratio", cfg.DNS.NXDomainRatio, "with profile dns: share of queries for names that do not exist, answered NXDOMAIN [0..1]")
+	dnsTCPRatio := fs.Float64("dns-tcp-ratio", cfg.DNS.TCPRatio, "with profile dns: share of queries sent over TCP; answers over 1232 bytes are truncated over UDP and asked again over TCP regardless [0..1]")
+	dnsResponseSizes := fs.String("dns-response-sizes", "", "with profile dns: distribution of answer lengths in DNS message bytes, reached with EDNS padding, as in pkt-size-dist (e.g. 100-200=80,512-1200=15,1500-4000=5; default: natural lengths)")
+	fs.group("Scenarios")
+	scenario := fs.String("scenario", "", "mix attacks with their ground truth in the manifest into every file: portscan (SYN scan of every port, one target after another), sweep (each port across all targets), bruteforce (failed logins to the first target with the port open, one connection each, in bursts); a list such as portscan,bruteforce")
+	scannerIP := fs.String("scanner-ip", "", "IPv4 address the scenarios attack from (default: a random public address per file)")
+	targets := fs.String("targets", "", "IPv4 addresses and prefixes the scenarios attack (e.g. 192.168.0.0/28,192.168.1.5; default: the first 16 internal hosts)")
+	scenarioPorts := fs.String("scenario-ports", "", "ports the scenarios attack, as a list with ranges (e.g. 22,80,8000-8100; default: 1-1024 for portscan, 445 for sweep, 22 for bruteforce, which takes the first)")
+	scenarioRate := fs.Float64("scenario-rate", 0, "probes or login attempts per second of each scenario (0=500 for scans, 4 for bruteforce)")
+	fs.group("Capture artifacts")
+	dropRate := fs.Float64("drop-rate", cfg.Loss.DropRate, "fraction of packets omitted at random, as by a lossy sensor [0..1)")
+	gaps := fs.Int("gaps", cfg.Loss.Gaps, "number of capture gaps in which all packets are omitted")
+	gapLength := fs.Duration("gap-length", 3*time.Second, "length of each capture gap")
+	flowTiming := fs.Bool("flow-timing", cfg.FlowTiming, "record per-flow inter-packet gap and burst statistics in the manifest (requires flow-count)")
+	burstGap := fs.Duration("burst-gap", cfg.BurstGap, "packets of a flow at most this far apart belong to one burst")
+	sample := fs.Int("sample", 0, "write only a random 1-in-N sample of the frames, as a sampling monitor sees them; sizes and manifest cover the full traffic (0=off)")
+	sampleFormat := fs.String("sample-format", string(pcapgen.SamplePcap), "pcap (the sampled frames) or sflow (sFlow v5 datagrams from agent 192.0.2.1 to collector 192.0.2.2:6343)")
+	if err := fs.parse(args); err != nil {
+		return cfg, genOptions{}, err
+	}
+	if *config != "" {
+		if err := applyProfile(fs, *config); err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid config: %v", err)
+		}
+	}
+
+	parsedStart, err := parseTime(*startTime)
+	if err != nil {
+		return cfg, genOptions{}, fmt.Errorf("invalid start-time: %v", err)
+	}
+
+	cfg.InternalHosts = *internal
+	cfg.ExternalHosts = *external
+	cfg.MinDuration = time.Duration(*minDur) * time.Second
+	cfg.MaxDuration = time.Duration(*maxDur) * time.Second
+	cfg.FileCount = *fileCount
+	cfg.OutDir = *outDir
+	cfg.OutFile = *outFile
+	cfg.StartTime = parsedStart
+	cfg.Seed = *seed
+	cfg.FlowCount = *flowCount
+	cfg.PacketsPerFlow = *packetsPerFlow
+	if cfg.PacketsDist, err = pcapgen.ParsePacketsDist(*packetsDist); err != nil {
+		return cfg, genOptions{}, fmt.Errorf("invalid packets-dist: %v", err)
+	}
+	cfg.Concurrency = *concurrency
+	cfg.ResponseRatio = *respRatio
+	cfg.IPv6Ratio = *ipv6Ratio
+	if *tunnel != "" {
+		kinds, err := pcapgen.ParseTunnels(*tunnel)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid tunnel: %v", err)
+		}
+		cfg.Tunnels = pcapgen.TunnelConfig{Kinds: kinds, Ratio: *tunnelRatio}
+	}
+	cfg.UniqueFlows = *uniqueFlows
+	cfg.Workers = *workers
+	cfg.Loss = pcapgen.LossConfig{DropRate: *dropRate, Gaps: *gaps, GapLength: *gapLength}
+	cfg.FlowTiming = *flowTiming
+	cfg.BurstGap = *burstGap
+	cfg.L7Ratio = *l7Ratio
+	cfg.EncryptedDNSRatio = *encryptedDNSRatio
+	cfg.Noise = pcapgen.NoiseConfig{Rate: *noiseRate}
+	cfg.Sample.Rate = *sample
+	if cfg.Sample.Format, err = pcapgen.ParseSampleFormat(*sampleFormat); err != nil {
+		return cfg, genOptions{}, fmt.Errorf("invalid sample-format: %v", err)
+	}
+	if cfg.Microbursts, err = microbursts(); err != nil {
+		return cfg, genOptions{}, err
+	}
+	if cfg.TrafficModel, err = pcapgen.ParseTrafficModel(*trafficModel); err != nil {
+		return cfg, genOptions{}, fmt.Errorf("invalid traffic-model: %v", err)
+	}
+	if *exactSize != "" {
+		size, err := parseSize(*exactSize)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid exact-size: %v", err)
+		}
+		if size > math.MaxInt {
+			return cfg, genOptions{}, fmt.Errorf("exact-size too large: %d", size)
+		}
+		cfg.ExactBytes = int(size)
+	}
+	if cfg.SizeSplit, err = pcapgen.ParseSizeSplit(*sizeSplit); err != nil {
+		return cfg, genOptions{}, fmt.Errorf("invalid size-split: %v", err)
+	}
+	cfg.Rotate = *rotate
+	cfg.TotalDuration = *totalDuration
+	if cfg.Rotate && cfg.FileCount != 1 {
+		return cfg, genOptions{}, errors.New("rotate decides the number of files; drop file-count")
+	}
+	if *maxSize != "" {
+		if *exactSize != "" && !cfg.Rotate {
+			return cfg, genOptions{}, errors.New("exact-size and max-size are mutually exclusive (except with rotate)")
+		}
+		size, err := parseSize(*maxSize)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid max-size: %v", err)
+		}
+		if size > math.MaxInt {
+			return cfg, genOptions{}, fmt.Errorf("max-size too large: %d", size)
+		}
+		cfg.MaxSizeBytes = int(size)
+	}
+	if cfg.Profile, err = pcapgen.ParseProfile(*profile); err != nil {
+		return cfg, genOptions{}, fmt.Errorf("invalid profile: %v", err)
+	}
+	cfg.DNS.QPS = *qps
+	cfg.DNS.Zipf = *dnsZipf
+	cfg.DNS.NXDomainRatio = *nxdomainRatio
+	cfg.DNS.TCPRatio = *dnsTCPRatio
+	if *dnsResponseSizes != "" {
+		if cfg.DNS.ResponseSizes, err = pcapgen.ParseSizeDist(*dnsResponseSizes); err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid dns-response-sizes: %v", err)
+		}
+	}
+	if *background != "" {
+		if cfg.Background, err = pcapgen.ParseBackground(*background); err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid background: %v", err)
+		}
+	}
+	if *scenario != "" {
+		if cfg.Scenarios.Kinds, err = pcapgen.ParseScenarios(*scenario); err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid scenario: %v", err)
+		}
+	}
+	if *scannerIP != "" {
+		if cfg.Scenarios.Scanner = net.ParseIP(*scannerIP); cfg.Scenarios.Scanner == nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid scanner-ip %q", *scannerIP)
+		}
+	}
+	if *targets != "" {
+		if cfg.Scenarios.Targets, err = pcapgen.ParseTargets(*targets); err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid targets: %v", err)
+		}
+	}
+	if *scenarioPorts != "" {
+		if cfg.Scenarios.Ports, err = pcapgen.ParsePortList(*scenarioPorts); err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid scenario-ports: %v", err)
+		}
+	}
+	cfg.Scenarios.Rate = *scenarioRate
+	if cfg.Labels, err = pcapgen.ParseLabelFormat(*labels); err != nil {
+		return cfg, genOptions{}, fmt.Errorf("invalid labels: %v", err)
+	}
+	if cfg.FlowExport.Format, err = pcapgen.ParseFlowExportFormat(*flowExport); err != nil {
+		return cfg, genOptions{}, fmt.Errorf("invalid flow-export: %v", err)
+	}
+	cfg.FlowExport.Collector = *flowCollector
+	cfg.FlowExport.ActiveTimeout, cfg.FlowExport.InactiveTimeout = *flowActive, *flowInactive
+	if cfg.ExactBytes <= 0 && *maxSize == "" && cfg.Profile != pcapgen.ProfileDNS {
+		return cfg, genOptions{}, errors.New("exact-size or max-size is required")
+	}
+	if *protoDist != "" {
+		dist, err := pcapgen.ParseProtoDist(*protoDist)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid proto-dist: %v", err)
+		}
+		cfg.ProtoDist = dist
+	}
+	outFormat, err := pcapio.ParseFormat(*format)
+	if err != nil {
+		return cfg, genOptions{}, fmt.Errorf("invalid format: %v", err)
+	}
+	cfg.Format = outFormat
+	if cfg.Link, err = pcapgen.ParseLink(*link); err != nil {
+		return cfg, genOptions{}, fmt.Errorf("invalid link: %v", err)
+	}
+	if *sessionModel != "" {
+		model, err := pcapgen.ParseSessionModel(*sessionModel)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid session-model: %v", err)
+		}
+		cfg.SessionModel = model
+	}
+	cfg.ZeroWindowRate = *zeroWindowRate
+	if *vlan != "" {
+		ids, err := pcapgen.ParseVLANList(*vlan)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid vlan: %v", err)
+		}
+		cfg.VLAN.Stack = ids
+	}
+	if *vlanPool != "" {
+		ids, err := pcapgen.ParseVLANList(*vlanPool)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid vlan-pool: %v", err)
+		}
+		cfg.VLAN.Pool = ids
+	}
+	if *mpls != "" {
+		if cfg.MPLS, err = pcapgen.ParseMPLSLabels(*mpls); err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid mpls: %v", err)
+		}
+	}
+	if *macOUIs != "" {
+		ouis, err := pcapgen.ParseOUIs(*macOUIs)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid mac-ouis: %v", err)
+		}
+		cfg.MACs.OUIs = ouis
+	}
+	if *gatewayMAC != "" {
+		mac, err := net.ParseMAC(*gatewayMAC)
+		if err != nil || len(mac) != 6 || mac[0]&0x01 != 0 {
+			return cfg, genOptions{}, fmt.Errorf("invalid gateway-mac %q: want a unicast Ethernet address", *gatewayMAC)
+		}
+		cfg.MACs.GatewayMAC = mac
+	}
+	if *evasion != "" {
+		techniques, err := pcapgen.ParseEvasion(*evasion)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid evasion: %v", err)
+		}
+		cfg.Evasion = pcapgen.EvasionConfig{Techniques: techniques, Ratio: *evasionRatio}
+	}
+	if *payloadTemplates != "" {
+		templates, err := pcapgen.LoadPayloadTemplates(*payloadTemplates)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid payload-templates: %v", err)
+		}
+		cfg.PayloadTemplates = templates
+	}
+	for _, list := range []struct {
+		name, path string
+		words      *[]string
+	}{
+		{"domain-list", *domainList, &cfg.Wordlists.Domains},
+		{"url-path-list", *pathList, &cfg.Wordlists.Paths},
+		{"user-agent-list", *userAgentList, &cfg.Wordlists.UserAgents},
+	} {
+		if list.path == "" {
+			continue
+		}
+		words, err := pcapgen.LoadWordlist(list.path)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid %s: %v", list.name, err)
+		}
+		*list.words = words
+	}
+	if *osPersonas != "" {
+		if cfg.Personas, err = pcapgen.ParsePersonaMix(*osPersonas); err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid os-personas: %v", err)
+		}
+	}
+	if *tenants != 0 {
+		encap, err := pcapgen.ParseTenantEncap(*tenantEncap)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid tenant-encap: %v", err)
+		}
+		cfg.Tenants = pcapgen.TenantConfig{Count: *tenants, Encap: encap, BaseID: *tenantBaseID}
+	}
+	if cfg.Encap.Kind, err = pcapgen.ParseEncap(*encap); err != nil {
+		return cfg, genOptions{}, fmt.Errorf("invalid encap: %v", err)
+	}
+	cfg.Encap.VNI = *vni
+	if *underlaySrc != "" {
+		if cfg.Encap.UnderlaySrc = net.ParseIP(*underlaySrc); cfg.Encap.UnderlaySrc == nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid underlay-src %q", *underlaySrc)
+		}
+	}
+	if *underlayDst != "" {
+		if cfg.Encap.UnderlayDst = net.ParseIP(*underlayDst); cfg.Encap.UnderlayDst == nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid underlay-dst %q", *underlayDst)
+		}
+	}
+	if *protocols != "" {
+		if *protoDist != "" {
+			return cfg, genOptions{}, errors.New("protocols and proto-dist are mutually exclusive")
+		}
+		dist, err := pcapgen.ParseProtocols(*protocols)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid protocols: %v", err)
+		}
+		cfg.ProtoDist = dist
+	}
+	if *tcpPortDist != "" {
+		dist, err := pcapgen.ParsePortDist(*tcpPortDist)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid tcp-port-dist: %v", err)
+		}
+		cfg.TCPPortDist = dist
+	}
+	if *udpPortDist != "" {
+		dist, err := pcapgen.ParsePortDist(*udpPortDist)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid udp-port-dist: %v", err)
+		}
+		cfg.UDPPortDist = dist
+	}
+	if *services != "" {
+		if *protocols != "" || *protoDist != "" || *tcpPortDist != "" || *udpPortDist != "" {
+			return cfg, genOptions{}, errors.New("services replaces protocols, proto-dist, tcp-port-dist and udp-port-dist")
+		}
+		proto, tcp, udp, err := pcapgen.ParseServices(*services)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid services: %v", err)
+		}
+		cfg.ProtoDist = proto
+		if len(tcp.Items) > 0 {
+			cfg.TCPPortDist = tcp
+		}
+		if len(udp.Items) > 0 {
+			cfg.UDPPortDist = udp
+		}
+	}
+	ports, err := pcapgen.ParsePortRange(*ephemeralPorts)
+	if err != nil {
+		return cfg, genOptions{}, fmt.Errorf("invalid ephemeral-ports: %v", err)
+	}
+	cfg.EphemeralPorts = ports
+	if *pktSizeDist != "" {
+		dist, err := pcapgen.ParseSizeDist(*pktSizeDist)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid pkt-size-dist: %v", err)
+		}
+		cfg.PktSizeDist = dist
+	}
+	if *sizeDist != "" {
+		if *pktSizeDist != "" {
+			return cfg, genOptions{}, errors.New("size-dist and pkt-size-dist are mutually exclusive")
+		}
+		dist, err := pcapgen.ParseSizeModel(*sizeDist)
+		if err != nil {
+			return cfg, genOptions{}, fmt.Errorf("invalid size-dist: %v", err)
+		}
+		cfg.PktSizeDist = dist
+	}
+	cfg.MTU = *mtu
+	cfg.Fragment = *fragment
+	cfg.Snaplen = *snaplen
+
+	return cfg, genOptions{fs: fs, emitConfig: *emitConfig, progress: *progress, timeout: *timeout}, nil
+}
+
+// effectiveProfile returns the flag values of this run with defaults and
+// random choices resolved, so that replaying them reproduces the output.
+func effectiveProfile(fs *flagSet, cfg pcapgen.Config) map[string]string {
+	values := map[string]string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if !profileOnly[f.Name] {
+			values[f.Name] = f.Value.String()
+		}
+	})
+	values["start-time"] = cfg.StartTime.Format(time.RFC3339Nano)
+	values["protocols"] = ""
+	values["services"] = ""
+	values["proto-dist"] = cfg.ProtoDist.String()
+	values["tcp-port-dist"] = cfg.TCPPortDist.String()
+	values["udp-port-dist"] = cfg.UDPPortDist.String()
+	values["size-dist"] = ""
+	values["pkt-size-dist"] = cfg.PktSizeDist.String()
+	return values
+}
+
+func defaultProfilePath(cfg pcapgen.Config) string {
+	if cfg.OutFile != "" {
+		return cfg.OutFile + ".yaml"
+	}
+	return filepath.Join(cfg.OutDir, "genflux-config.yaml")
+}
+
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, fmt.Errorf("empty time")
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("Mon Jan 2 15:04:05 2006", value, time.Local)
+}
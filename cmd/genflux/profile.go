@@ -0,0 +1,234 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Profiles are YAML (or JSON, which YAML accepts) mappings from flag names
+// to values written in the same syntax as on the command line:
+//
+//	internal-hosts: 2000
+//	exact-size: 1.5g
+//	proto-dist: {tcp: 70, udp: 25, icmp: 5}
+//	protocols: [tcp, udp]
+//
+// Mappings are rendered as "k=v,..." and lists as "a,b,...", so
+// distributions can be written either way.
+
+// profileOnly lists flags that only make sense on the command line.
+var profileOnly = map[string]bool{"config": true, "emit-config": true, "progress": true, "timeout": true}
+
+// profileOverrides maps flags to alternatives that replace them, so that
+// e.g. --protocols on the command line overrides a profile's proto-dist.
+var profileOverrides = map[string]string{
+	"proto-dist":    "protocols",
+	"protocols":     "proto-dist",
+	"pkt-size-dist": "size-dist",
+	"size-dist":     "pkt-size-dist",
+}
+
+// profileInclude is the profile key naming the profiles it builds on.
+// They are applied in order, each overriding those before it, and the
+// including profile overrides them all: a base profile, an overlay and
+// site sizing compose as
+//
+//	include: [base.yaml, attack-overlay.yaml]
+//	internal-hosts: 512
+//
+// Relative paths are taken from the including profile's directory. A null
+// value (key: ~) drops what an included profile set for that key.
+const profileInclude = "include"
+
+// profileSetting is one flag value a profile sets, with the position it
+// came from for error messages. unset marks a null that drops the value.
+type profileSetting struct {
+	value string
+	unset bool
+	pos   string
+}
+
+// applyProfile loads the profiles at paths, a comma-separated list where
+// later profiles override earlier ones, and sets every flag they name
+// that was not given explicitly on the command line.
+func applyProfile(fs *flagSet, paths string) error {
+	names := []string{}
+	fs.VisitAll(func(f *flag.Flag) {
+		if !profileOnly[f.Name] {
+			names = append(names, f.Name)
+		}
+	})
+	settings := map[string]profileSetting{}
+	var order []string
+	for _, path := range strings.Split(paths, ",") {
+		if path = strings.TrimSpace(path); path == "" {
+			continue
+		}
+		if err := loadProfile(fs, path, names, nil, settings, &order); err != nil {
+			return err
+		}
+	}
+
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	for _, key := range order {
+		set, ok := settings[key]
+		if !ok || set.unset || explicit[key] || explicit[profileOverrides[key]] {
+			continue
+		}
+		if err := fs.Set(key, set.value); err != nil {
+			return fmt.Errorf("%s: %s: %v", set.pos, key, err)
+		}
+	}
+	return nil
+}
+
+// loadProfile merges the profile at path, after the profiles it includes,
+// into settings. stack holds the profiles including it, to catch cycles.
+func loadProfile(fs *flagSet, path string, names, stack []string, settings map[string]profileSetting, order *[]string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	for _, p := range stack {
+		if p == abs {
+			return fmt.Errorf("include cycle: %s", strings.Join(append(stack, abs), " -> "))
+		}
+	}
+	stack = append(stack, abs)
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(data, &doc); err != nil {
+		return fmt.Errorf("%s: %v", path, err)
+	}
+	if len(doc.Content) == 0 {
+		return nil
+	}
+	root := doc.Content[0]
+	if root.Kind != yaml.MappingNode {
+		return fmt.Errorf("%s: profile must be a mapping of flag names to values", path)
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value != profileInclude {
+			continue
+		}
+		value, err := profileValue(root.Content[i+1])
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s: %v", path, root.Content[i+1].Line, profileInclude, err)
+		}
+		for _, inc := range strings.Split(value, ",") {
+			if inc = strings.TrimSpace(inc); inc == "" {
+				continue
+			}
+			if !filepath.IsAbs(inc) {
+				inc = filepath.Join(filepath.Dir(path), inc)
+			}
+			if err := loadProfile(fs, inc, names, stack, settings, order); err != nil {
+				return fmt.Errorf("%s:%d: %v", path, root.Content[i+1].Line, err)
+			}
+		}
+	}
+
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == profileInclude {
+			continue
+		}
+		key := strings.ReplaceAll(root.Content[i].Value, "_", "-")
+		f := fs.Lookup(key)
+		if f == nil || profileOnly[key] {
+			msg := fmt.Sprintf("%s:%d: unknown key %q", path, root.Content[i].Line, key)
+			if s := suggest(key, names); s != "" {
+				msg += fmt.Sprintf(" (did you mean %q?)", s)
+			}
+			return fmt.Errorf("%s", msg)
+		}
+		set := profileSetting{pos: fmt.Sprintf("%s:%d", path, root.Content[i+1].Line)}
+		if n := root.Content[i+1]; n.Kind == yaml.ScalarNode && n.Tag == "!!null" {
+			set.unset = true
+		} else if set.value, err = profileValue(n); err != nil {
+			return fmt.Errorf("%s: %s: %v", set.pos, key, err)
+		}
+		if _, ok := settings[key]; !ok {
+			*order = append(*order, key)
+		}
+		settings[key] = set
+		// A profile choosing e.g. protocols replaces a proto-dist it
+		// inherited, as the command line does.
+		if alt := profileOverrides[key]; alt != "" {
+			delete(settings, alt)
+		}
+	}
+	return nil
+}
+
+// profileValue renders a profile value in flag syntax.
+func profileValue(n *yaml.Node) (string, error) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		return n.Value, nil
+	case yaml.SequenceNode:
+		parts := make([]string, 0, len(n.Content))
+		for _, item := range n.Content {
+			if item.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("list items must be scalars")
+			}
+			parts = append(parts, item.Value)
+		}
+		return strings.Join(parts, ","), nil
+	case yaml.MappingNode:
+		parts := make([]string, 0, len(n.Content)/2)
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			k, v := n.Content[i], n.Content[i+1]
+			if v.Kind != yaml.ScalarNode {
+				return "", fmt.Errorf("mapping values must be scalars")
+			}
+			parts = append(parts, k.Value+"="+v.Value)
+		}
+		return strings.Join(parts, ","), nil
+	default:
+		return "", fmt.Errorf("unsupported value")
+	}
+}
+
+// writeProfile writes values as a profile that reproduces the run when
+// passed back via --config. Empty values are left out.
+func writeProfile(path string, values map[string]string) error {
+	keys := make([]string, 0, len(values))
+	for k, v := range values {
+		if v != "" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	root := &yaml.Node{
+		Kind:        yaml.MappingNode,
+		HeadComment: "Effective genflux pcap gen configuration.\nReproduce with: genflux pcap gen --config " + filepath.Base(path),
+	}
+	for _, k := range keys {
+		root.Content = append(root.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: k},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: values[k]},
+		)
+	}
+	data, err := yaml.Marshal(root)
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(path); dir != "." {
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			return err
+		}
+	}
+	return os.WriteFile(path, data, 0o644)
+}
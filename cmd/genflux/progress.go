@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"genflux/internal/pcapgen"
+	"genflux/internal/stats"
+)
+
+// genProgress prints the progress of pcap gen as a bar redrawn in place
+// or as one JSON object per line. Rates and ETAs are per file, from when
+// the file was started.
+type genProgress struct {
+	w     io.Writer
+	json  bool
+	every time.Duration
+	file  int
+	start time.Time
+	last  time.Time
+	// drawn is set while the bar is on the last line, unterminated.
+	drawn bool
+}
+
+// Write passes log output through, moving it below the bar. The log is
+// pointed here while the bar is shown.
+func (g *genProgress) Write(p []byte) (int, error) {
+	if g.drawn {
+		g.drawn = false
+		if _, err := io.WriteString(g.w, "\n"); err != nil {
+			return 0, err
+		}
+	}
+	return g.w.Write(p)
+}
+
+// newGenProgress returns the reporter of --progress, or nil for none.
+func newGenProgress(mode string, w io.Writer) (*genProgress, error) {
+	switch mode {
+	case "", "none":
+		return nil, nil
+	case "bar":
+		return &genProgress{w: w, every: 200 * time.Millisecond}, nil
+	case "json":
+		return &genProgress{w: w, json: true, every: time.Second}, nil
+	}
+	return nil, fmt.Errorf("unknown progress %q (want bar, json or none)", mode)
+}
+
+type progressLine struct {
+	File    string  `json:"file"`
+	Index   int     `json:"index"`
+	Files   int     `json:"files"`
+	Packets int     `json:"packets"`
+	Bytes   int     `json:"bytes"`
+	Target  int     `json:"target"`
+	Percent float64 `json:"percent"`
+	Rate    float64 `json:"bytes_per_sec"`
+	ETA     float64 `json:"eta_sec"`
+	Done    bool    `json:"done"`
+}
+
+func (g *genProgress) report(p pcapgen.Progress) error {
+	now := time.Now()
+	if g.start.IsZero() {
+		g.start = now
+	}
+	if !p.Done && now.Sub(g.last) < g.every {
+		return nil
+	}
+	g.last = now
+	line := progressLine{File: p.File, Index: g.file + 1, Files: p.Files, Packets: p.Packets, Bytes: p.Bytes, Target: p.Target, Done: p.Done}
+	if p.Target > 0 {
+		line.Percent = min(100*float64(p.Bytes)/float64(p.Target), 100)
+	}
+	rate := stats.Snapshot{Packets: int64(p.Packets), Bytes: int64(p.Bytes)}.Rate(now.Sub(g.start))
+	line.Rate = rate.Mbps * 1e6 / 8
+	if line.Rate > 0 && p.Target > p.Bytes && !p.Done {
+		line.ETA = float64(p.Target-p.Bytes) / line.Rate
+	}
+	if p.Done {
+		g.file++
+		g.start = time.Time{}
+	}
+	if g.json {
+		data, err := json.Marshal(line)
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(g.w, "%s\n", data)
+		return err
+	}
+	const width = 30
+	filled := int(line.Percent / 100 * width)
+	end := ""
+	if p.Done {
+		end = "\n"
+	}
+	g.drawn = !p.Done
+	_, err := fmt.Fprintf(g.w, "\r[%s%s] %5.1f%% %s/%s %s/s ETA %s file %d/%d%s",
+		strings.Repeat("#", filled), strings.Repeat(".", width-filled), line.Percent,
+		formatBytes(float64(p.Bytes)), formatBytes(float64(p.Target)), formatBytes(line.Rate),
+		time.Duration(line.ETA*float64(time.Second)).Round(time.Second), line.Index, line.Files, end)
+	return err
+}
+
+// formatBytes renders n with a 1024-based unit.
+func formatBytes(n float64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB"}
+	i := 0
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	if i == 0 {
+		return fmt.Sprintf("%.0f %s", n, units[i])
+	}
+	return fmt.Sprintf("%.1f %s", n, units[i])
+}
@@ -0,0 +1,404 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"time"
+
+	"genflux/internal/replay"
+)
+
+func newReplayCommand() *command {
+	return &command{
+		name:    "replay",
+		summary: "replay a pcap onto an interface (AF_PACKET)",
+		examples: []string{
+			"sudo genflux replay --in input.pcap --iface eth0 --mode timestamp",
+			"sudo genflux replay --in input.pcap --iface eth0 --speed 2",
+			"sudo genflux replay --in input.pcap --iface eth0 --mode mbps --mbps 1000",
+			"sudo genflux replay --in input.pcap --iface eth0 --mode pps --pps 50000 --loop 10",
+			"sudo genflux replay --in 'generated_*.pcap' --iface eth0 --merge",
+			"sudo genflux replay --in input.pcap --iface eth0,eth1 --mode mbps --mbps 20000",
+			"genflux replay --in input.pcap --mode mbps --mbps 1000 --loop 3 --dry-run",
+			"sudo genflux replay --in input.pcap --iface eth0 --loop 0 --rate-schedule 0s:100mbps,60s:500mbps,120s:1gbps",
+			"sudo genflux replay --in input.pcap --iface eth0 --filter 'tcp and port 443'",
+			"sudo genflux replay --in input.pcap --iface eth0 --mode search --monitor-iface eth1 --search-max 10g",
+			"sudo genflux replay --in input.pcap --iface veth0 --mode pps --pps 10k --verify veth1 --verify-payload",
+		},
+		run: runReplay,
+	}
+}
+
+func runReplay(cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	fs.group("Input/Output")
+	inPath := fs.String("in", "", "input pcap path(s): comma-separated list and/or glob, e.g. 'generated_*.pcap'")
+	merge := fs.Bool("merge", false, "with several inputs, interleave them by timestamp instead of playing them in turn")
+	iface := fs.String("iface", "", "network interface, or a comma-separated list to send over several (e.g. eth0 or eth0,eth1)")
+	balance := fs.String("balance", string(replay.BalanceFlowHash), "how packets are spread over several interfaces: flow-hash|round-robin, or tee to send every packet on all of them")
+	shuffle := fs.Int("shuffle", 0, "reorder packets at random within a window of this many packets (0=off)")
+	shuffleSeed := fs.Int64("shuffle-seed", 1, "seed for --shuffle; the same seed gives the same order")
+	skipCorrupt := fs.Bool("skip-corrupt", false, "step over damaged records of the inputs, reporting each, instead of stopping the replay")
+	filterExpr := fs.String("filter", "", "replay only the packets matching this capture filter in tcpdump syntax, e.g. 'tcp and port 443'")
+	direction := fs.String("direction", string(replay.DirectionBoth), "send only one side of every session: client|server|both; the client is the side in --client-net, else the sender of the SYN or first packet")
+	clientNet := fs.String("client-net", "", "with --direction, CIDRs or addresses where the clients are, e.g. 10.0.0.0/8")
+	pairListen := fs.String("pair-listen", "", "lead a paired replay: wait for a peer genflux (--pair) on this address, e.g. :7700, and start every loop together with it")
+	pair := fs.String("pair", "", "follow a paired replay led at this address, e.g. 10.0.0.1:7700; the leader's loop count and limits end both")
+	dryRun := fs.Bool("dry-run", false, "read and schedule the packets without sending; report projected duration and rates (no iface or root needed)")
+	scrub := fs.String("scrub-payload", "", "rewrite L4 payloads before sending: zero|random (lengths kept, checksums fixed)")
+	tee := fs.String("tee", "", "record every frame sent, as sent and when, to this capture (pcapng if it ends in .pcapng)")
+	fs.group("Rewrite")
+	rewriteSrcIP := fs.String("rewrite-src-ip", "", "map source addresses: FROM=TO pairs of CIDRs or addresses (host bits kept, first match wins), or one address for all of its family, e.g. 10.0.0.0/8=198.18.0.0/16")
+	rewriteDstIP := fs.String("rewrite-dst-ip", "", "map destination addresses, like --rewrite-src-ip")
+	rewriteIP := fs.String("rewrite-ip", "", "map source and destination addresses alike, after --rewrite-src-ip and --rewrite-dst-ip, e.g. 192.168.0.0/16=10.99.0.0/16")
+	rewriteSrcMAC := fs.String("rewrite-src-mac", "", "source MAC of every frame, e.g. the sending interface's")
+	rewriteDstMAC := fs.String("rewrite-dst-mac", "", "destination MAC of every frame, e.g. the device under test or its gateway")
+	fs.group("Pacing")
+	mode := fs.String("mode", string(replay.ModeTimestamp), "timestamp|mbps|pps|burst|topspeed|search (RFC 2544 style search for the highest lossless rate)")
+	speed := fs.Float64("speed", 1, "scale the capture's inter-packet gaps in mode=timestamp: 2 replays twice as fast, 0.5 at half speed")
+	timeShift := fs.Duration("time-shift", 0, "send each packet when the clock reads its capture timestamp plus this (mode=timestamp), e.g. 87600h")
+	rebaseNow := fs.Bool("rebase-now", false, "like --time-shift, with the shift that makes the capture's first packet due now")
+	mbps := fs.String("mbps", "", "rate limit in Mbps, or with SI unit e.g. 2.5g, 500mbps (mode=mbps)")
+	pps := fs.String("pps", "", "rate limit in packets per second, or with SI unit e.g. 50k (mode=pps, or the average rate in mode=burst)")
+	burst := fs.Int("burst", 0, "packets sent back to back per burst (mode=burst)")
+	preserveBursts := fs.Bool("preserve-bursts", false, "in mode=mbps or pps, keep the capture's gaps scaled to the rate instead of spacing packets evenly, so bursts keep their shape")
+	rateSchedule := fs.String("rate-schedule", "", "change the rate over time, e.g. '0s:100mbps,60s:500mbps,120s:1gbps' or in pps '0s:10kpps,30s:50kpps' (sets the mode)")
+	rateRamp := fs.Bool("rate-ramp", false, "with --rate-schedule, move linearly between the points instead of stepping")
+	microbursts := addMicroburstFlags(fs)
+	txBackend := fs.String("tx-backend", string(replay.DefaultBackend), "how frames reach the kernel: socket (sendto per frame), ring (PACKET_MMAP TX ring, batched) or xdp (AF_XDP, zero-copy where supported) on linux; pcap (libpcap/Npcap inject) on macOS and Windows")
+	txtime := fs.Bool("txtime", false, "hand packets to the kernel with SO_TXTIME deadlines (needs an etf qdisc on iface)")
+	txtimeLead := fs.Duration("txtime-lead", 500*time.Microsecond, "how early packets are handed to the kernel with --txtime")
+	sendBatch := fs.Int("send-batch", 0, "hand up to this many frames already due to the kernel in one sendmmsg call with --tx-backend socket (0=32, or 1 with --txtime; 1=one sendto per frame)")
+	sndbuf := fs.String("sndbuf", "", "send buffer of the socket, e.g. 64m (default 16m; above net.core.wmem_max needs CAP_NET_ADMIN)")
+	qdiscBypass := fs.Bool("qdisc-bypass", false, "hand frames straight to the driver, skipping the qdisc (PACKET_QDISC_BYPASS); not with --txtime or --tx-backend xdp")
+	schedPolicy := fs.String("sched-policy", string(replay.SchedHybrid), "how to wait for each packet's time: sleep (least CPU; packets due within --spin-threshold go at once), hybrid (sleep, then spin through the last --spin-threshold) or busy (spin, pinning a core)")
+	spinThreshold := fs.Duration("spin-threshold", replay.DefaultSpinThreshold, "with --sched-policy hybrid, how long before a packet is due to stop sleeping and spin; with sleep, how close to due a packet is sent at once")
+	mtuCheck := fs.Bool("mtu-check", false, "fail the send of a frame larger than the MTU of its interface instead of leaving it to the driver")
+	fragment := fs.Bool("fragment", false, "send an IP packet larger than the MTU of its interface as IP fragments that fit it instead (other frames larger than the MTU then fail as with --mtu-check)")
+	linkFraction := fs.Float64("link-fraction", 0, "rate as a fraction of the interface link speed (overrides mode, e.g. 0.01)")
+	fs.group("Throughput search")
+	monitorIface := fs.String("monitor-iface", "", "interface whose receive counter tells how many frames arrived (mode=search)")
+	searchMin := fs.String("search-min", "", "lowest rate to search, in Mbps or with SI unit (default 0)")
+	searchMax := fs.String("search-max", "", "highest rate to search, tried first (default: link speed of iface)")
+	searchRes := fs.String("search-resolution", "", "stop when the rate is known to within this much (default 1% of search-max)")
+	lossTolerance := fs.Float64("loss-tolerance", 0, "fraction of frames a trial may lose and still pass [0..1)")
+	trialDuration := fs.Duration("trial-duration", 10*time.Second, "how long each trial sends")
+	fs.group("Run mode")
+	background := fs.Bool("background", false, "run indefinitely as a background traffic source (infinite loop, reopen replaced input, ride out read errors)")
+	startAt := fs.String("start-at", "", "wait and start at an absolute time (15:04:05 today/tomorrow, or RFC3339)")
+	fs.group("Limits")
+	loop := fs.Int("loop", 1, "loop count (0=infinite)")
+	loopGap := fs.Duration("loop-gap", 0, "pause between loops, e.g. 2s")
+	continuous := fs.Bool("continuous-timestamps", false, "start each loop one mean inter-packet gap after the previous one ended, as if the capture went on, instead of at once")
+	limit := fs.Int("limit", 0, "packet limit across all loops (0=unlimited)")
+	limitPerLoop := fs.Int("limit-per-loop", 0, "send only the first N packets of each loop (0=unlimited)")
+	duration := fs.Duration("duration", 0, "stop sending this long after the replay starts and finish as completed, e.g. 5m (0=no limit)")
+	limitFlows := fs.Int("limit-flows", 0, "replay only the packets of the first N flows (both directions of a session count once); every loop replays the same flows (0=unlimited)")
+	timeout := fs.Duration("timeout", 0, "stop after this long, as on Ctrl-C (0=no limit)")
+	maxSendErrors := fs.Int("max-send-errors", 0, "step over up to N failed sends, dropping those packets, before aborting; the replay then exits with code 2 (0=abort on the first)")
+	sendRetries := fs.Int("send-retries", 0, "retry a send that fails for want of buffer space (ENOBUFS, EAGAIN) up to N times before it counts as a send error (0=no retries)")
+	retryBackoff := fs.Duration("retry-backoff", 100*time.Microsecond, "wait before the first retry of --send-retries, doubled for each further one")
+	maxSkipped := fs.Int("max-skipped", 0, "step over up to N damaged records of the inputs before aborting, exiting with code 2 (0=none; --skip-corrupt allows any number)")
+	tuneFile := fs.String("tune", "", "YAML file of mbps, pps, speed, limit, limit-per-loop and duration that overrides the flags, re-read on SIGHUP to retune the running replay")
+	fs.group("Reporting")
+	stats := fs.Int("stats-interval", 1, "stats interval in seconds")
+	statsFormat := fs.String("stats-format", string(replay.StatsText), "text, or json for one JSON record per interval, pass and summary")
+	metricsListen := fs.String("metrics-listen", "", "serve Prometheus counters (packets, bytes, send errors, drops) at /metrics on this address while replaying, e.g. :9090")
+	logFile := fs.String("log-file", "", "write stats to this file, rotated daily to <file>.YYYY-MM-DD")
+	flowStats := fs.String("flow-stats", "", "count packets/bytes sent per 5-tuple and write them as CSV to this file at the end (- for the stats output)")
+	verify := fs.String("verify", "", "capture on this interface while replaying (the far side of the wiring or DUT) and report the frames lost and reordered; loss fails the replay")
+	verifyWait := fs.Duration("verify-wait", time.Second, "with --verify, how long to listen on after the last frame is sent")
+	verifyPayload := fs.Bool("verify-payload", false, "with --verify, also compare the payloads of the frames received with those sent")
+	if err := fs.parse(args); err != nil {
+		return err
+	}
+
+	var mbpsValue, ppsValue float64
+	if *mbps != "" {
+		v, err := parseRate(*mbps, "bps", 1e6)
+		if err != nil {
+			return fmt.Errorf("invalid mbps: %v", err)
+		}
+		mbpsValue = v
+	}
+	if *pps != "" {
+		v, err := parseRate(*pps, "pps", 1)
+		if err != nil {
+			return fmt.Errorf("invalid pps: %v", err)
+		}
+		ppsValue = v
+	}
+
+	modeValue := replay.Mode(*mode)
+	var schedule []replay.RatePoint
+	if *rateSchedule != "" {
+		points, schedMode, err := parseRateSchedule(*rateSchedule)
+		if err != nil {
+			return fmt.Errorf("invalid rate-schedule: %v", err)
+		}
+		schedule, modeValue = points, schedMode
+	}
+
+	var searchValues [3]float64
+	for i, v := range []struct{ name, value string }{{"search-min", *searchMin}, {"search-max", *searchMax}, {"search-resolution", *searchRes}} {
+		if v.value == "" {
+			continue
+		}
+		rate, err := parseRate(v.value, "bps", 1e6)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %v", v.name, err)
+		}
+		searchValues[i] = rate
+	}
+
+	var startAtValue time.Time
+	if *startAt != "" {
+		t, err := parseStartAt(*startAt, time.Now())
+		if err != nil {
+			return fmt.Errorf("invalid start-at: %v", err)
+		}
+		startAtValue = t
+	}
+
+	balanceValue, err := replay.ParseBalance(*balance)
+	if err != nil {
+		return fmt.Errorf("invalid balance: %v", err)
+	}
+
+	backend, err := replay.ParseTxBackend(*txBackend)
+	if err != nil {
+		return fmt.Errorf("invalid tx-backend: %v", err)
+	}
+	sndbufValue := 0
+	if *sndbuf != "" {
+		v, err := parseSize(*sndbuf)
+		if err != nil {
+			return fmt.Errorf("invalid sndbuf: %v", err)
+		}
+		if v > math.MaxInt32 {
+			return fmt.Errorf("invalid sndbuf: %s is over 2g", *sndbuf)
+		}
+		sndbufValue = int(v)
+	}
+
+	schedPolicyValue, err := replay.ParseSchedPolicy(*schedPolicy)
+	if err != nil {
+		return fmt.Errorf("invalid sched-policy: %v", err)
+	}
+	directionValue, err := replay.ParseDirection(*direction)
+	if err != nil {
+		return fmt.Errorf("invalid direction: %v", err)
+	}
+	var clientNets []*net.IPNet
+	if *clientNet != "" {
+		if clientNets, err = replay.ParseNets(*clientNet); err != nil {
+			return fmt.Errorf("invalid client-net: %v", err)
+		}
+	}
+
+	statsFormatValue, err := replay.ParseStatsFormat(*statsFormat)
+	if err != nil {
+		return fmt.Errorf("invalid stats-format: %v", err)
+	}
+
+	scrubMode, err := replay.ParseScrubMode(*scrub)
+	if err != nil {
+		return fmt.Errorf("invalid scrub-payload: %v", err)
+	}
+
+	var rewrite replay.Rewrite
+	for _, m := range []struct {
+		name  string
+		value string
+		maps  *[]replay.IPMap
+	}{
+		{"rewrite-src-ip", *rewriteSrcIP, &rewrite.SrcIP},
+		{"rewrite-dst-ip", *rewriteDstIP, &rewrite.DstIP},
+		{"rewrite-ip", *rewriteIP, &rewrite.IP},
+	} {
+		if m.value == "" {
+			continue
+		}
+		if *m.maps, err = replay.ParseIPMaps(m.value); err != nil {
+			return fmt.Errorf("invalid %s: %v", m.name, err)
+		}
+	}
+	for _, m := range []struct {
+		name  string
+		value string
+		mac   *net.HardwareAddr
+	}{
+		{"rewrite-src-mac", *rewriteSrcMAC, &rewrite.SrcMAC},
+		{"rewrite-dst-mac", *rewriteDstMAC, &rewrite.DstMAC},
+	} {
+		if m.value == "" {
+			continue
+		}
+		mac, err := net.ParseMAC(m.value)
+		if err != nil || len(mac) != 6 || mac[0]&0x01 != 0 {
+			return fmt.Errorf("invalid %s %q: want a unicast Ethernet address", m.name, m.value)
+		}
+		*m.mac = mac
+	}
+
+	microburstValue, err := microbursts()
+	if err != nil {
+		return err
+	}
+
+	cfg := replay.Config{
+		InPath:               *inPath,
+		Merge:                *merge,
+		Iface:                *iface,
+		Balance:              balanceValue,
+		Mode:                 modeValue,
+		Mbps:                 mbpsValue,
+		Pps:                  ppsValue,
+		Loop:                 *loop,
+		Limit:                *limit,
+		StatsInterval:        time.Duration(*stats) * time.Second,
+		StartAt:              startAtValue,
+		Background:           *background,
+		LinkFraction:         *linkFraction,
+		LogFile:              *logFile,
+		DryRun:               *dryRun,
+		TxBackend:            backend,
+		TxTime:               *txtime,
+		TxTimeLead:           *txtimeLead,
+		ScrubPayload:         scrubMode,
+		Shuffle:              *shuffle,
+		ShuffleSeed:          *shuffleSeed,
+		FlowStats:            *flowStats,
+		RateSchedule:         schedule,
+		RateRamp:             *rateRamp,
+		Speed:                *speed,
+		Burst:                *burst,
+		TimeShift:            *timeShift,
+		TimeShiftSet:         fs.isSet("time-shift"),
+		RebaseNow:            *rebaseNow,
+		SkipCorrupt:          *skipCorrupt,
+		Tee:                  *tee,
+		Microbursts:          microburstValue,
+		Rewrite:              rewrite,
+		Filter:               *filterExpr,
+		LimitFlows:           *limitFlows,
+		LimitPerLoop:         *limitPerLoop,
+		Duration:             *duration,
+		LoopGap:              *loopGap,
+		ContinuousTimestamps: *continuous,
+		MaxSendErrors:        *maxSendErrors,
+		MaxSkipped:           *maxSkipped,
+		StatsFormat:          statsFormatValue,
+		MetricsListen:        *metricsListen,
+		Direction:            directionValue,
+		ClientNets:           clientNets,
+		SendRetries:          *sendRetries,
+		RetryBackoff:         *retryBackoff,
+		PairListen:           *pairListen,
+		Pair:                 *pair,
+		SndBuf:               sndbufValue,
+		QdiscBypass:          *qdiscBypass,
+		MTUCheck:             *mtuCheck,
+		Verify:               *verify,
+		VerifyWait:           *verifyWait,
+		VerifyPayload:        *verifyPayload,
+		PreserveBursts:       *preserveBursts,
+		SchedPolicy:          schedPolicyValue,
+		SpinThreshold:        *spinThreshold,
+		SendBatch:            *sendBatch,
+		Fragment:             *fragment,
+
+		MonitorIface:     *monitorIface,
+		SearchMin:        searchValues[0],
+		SearchMax:        searchValues[1],
+		SearchResolution: searchValues[2],
+		LossTolerance:    *lossTolerance,
+		TrialDuration:    *trialDuration,
+	}
+	if *tuneFile != "" {
+		base := replay.Tuning{Mbps: mbpsValue, Pps: ppsValue, Speed: *speed, Limit: *limit, LimitPerLoop: *limitPerLoop, Duration: *duration}
+		t, err := loadTuning(cmd, *tuneFile, base)
+		if err != nil {
+			return fmt.Errorf("invalid tune: %v", err)
+		}
+		cfg.Mbps, cfg.Pps, cfg.Speed = t.Mbps, t.Pps, t.Speed
+		cfg.Limit, cfg.LimitPerLoop, cfg.Duration = t.Limit, t.LimitPerLoop, t.Duration
+		tune, stop := watchTuning(cmd, *tuneFile, base)
+		defer stop()
+		cfg.Tune = tune
+	}
+	// The replay handles SIGINT itself, printing its summary before it
+	// stops; a timeout stops it the same way and is not an error.
+	ctx, cancel := runContext(*timeout, false)
+	defer cancel()
+	err = replay.Replay(ctx, cfg)
+	if errors.Is(err, context.DeadlineExceeded) {
+		return nil
+	}
+	return corruptHint(err)
+}
+
+// parseRateSchedule parses "OFFSET:RATE,..." where every rate is in Mbps
+// (a plain number or with a bps unit) or, all of them, in pps.
+func parseRateSchedule(value string) ([]replay.RatePoint, replay.Mode, error) {
+	var points []replay.RatePoint
+	mode := replay.Mode("")
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		at, rate, ok := strings.Cut(item, ":")
+		if !ok {
+			return nil, "", fmt.Errorf("expected OFFSET:RATE, got %q", item)
+		}
+		offset, err := time.ParseDuration(strings.TrimSpace(at))
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid offset %q", at)
+		}
+		itemMode, unit, scale := replay.ModeMbps, "bps", 1e6
+		if strings.HasSuffix(strings.ToLower(strings.TrimSpace(rate)), "pps") {
+			itemMode, unit, scale = replay.ModePps, "pps", 1
+		}
+		if mode != "" && itemMode != mode {
+			return nil, "", fmt.Errorf("rates mix Mbps and pps")
+		}
+		mode = itemMode
+		r, err := parseRate(rate, unit, scale)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid rate %q: %v", rate, err)
+		}
+		points = append(points, replay.RatePoint{At: offset, Rate: r})
+	}
+	if len(points) == 0 {
+		return nil, "", fmt.Errorf("no rates")
+	}
+	return points, mode, nil
+}
+
+// parseStartAt accepts RFC3339 or a local time of day. A time of day that
+// has already passed today refers to tomorrow.
+func parseStartAt(value string, now time.Time) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		if t.Before(now) {
+			return time.Time{}, fmt.Errorf("%s is in the past", value)
+		}
+		return t, nil
+	}
+	for _, layout := range []string{"15:04:05", "15:04"} {
+		clock, err := time.ParseInLocation(layout, value, now.Location())
+		if err != nil {
+			continue
+		}
+		t := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), clock.Second(), 0, now.Location())
+		if t.Before(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("expected HH:MM[:SS] or RFC3339, got %q", value)
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"genflux/internal/pcaptool"
+)
+
+func newPcapRetimeCommand() *command {
+	return &command{
+		name:    "retime",
+		summary: "compress or stretch a capture's timing",
+		examples: []string{
+			"genflux pcap retime --in a.pcap --scale 0.1 --out b.pcap",
+			"genflux pcap retime --in a.pcap --scale 2 --start 2024-05-01T09:00:00Z --out b.pcap",
+			"genflux pcap retime --in old.pcap --start today --speed 4 --out b.pcap",
+		},
+		run: runPcapRetime,
+	}
+}
+
+func runPcapRetime(cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	inPath := fs.String("in", "", "input pcap or pcapng")
+	outPath := fs.String("out", "", "output path in the input's format, or - for stdout")
+	scale := fs.Float64("scale", 1, "multiply every packet's offset from the first by this (0.1 = ten times shorter, 2 = twice as long)")
+	speed := fs.Float64("speed", 0, "play the capture this many times faster, as replay --speed: 4 is --scale 0.25")
+	start := fs.String("start", "", "move the first packet to this time (Mon Jan 2 15:04:05 2006 or RFC3339), to now, or with today to today at its own time of day (default: keep)")
+	startTime := fs.String("start-time", "", "same as --start")
+	skipCorrupt := fs.Bool("skip-corrupt", false, "step over damaged records, reporting each, instead of failing")
+	if err := fs.parse(args); err != nil {
+		return err
+	}
+
+	cfg := pcaptool.RetimeConfig{InPath: *inPath, OutPath: *outPath, Scale: *scale}
+	if fs.isSet("speed") {
+		if fs.isSet("scale") {
+			return errors.New("scale and speed are mutually exclusive")
+		}
+		if *speed <= 0 {
+			return errors.New("speed must be > 0")
+		}
+		cfg.Scale = 1 / *speed
+	}
+	if *startTime != "" {
+		if *start != "" {
+			return errors.New("start and start-time are mutually exclusive")
+		}
+		*start = *startTime
+	}
+	switch *start {
+	case "":
+	case "now":
+		cfg.StartTime = time.Now()
+	case "today":
+		cfg.StartDay = time.Now()
+	default:
+		t, err := parseTime(*start)
+		if err != nil {
+			return fmt.Errorf("invalid start: %v", err)
+		}
+		cfg.StartTime = t
+	}
+	// Keep stdout clean when the capture is streamed there.
+	out := os.Stdout
+	if cfg.OutPath == pcaptool.StdoutPath {
+		out = os.Stderr
+	}
+	cfg.Read = corruptOptions(*skipCorrupt, out)
+	stats, err := pcaptool.Retime(cfg)
+	if err != nil {
+		return corruptHint(err)
+	}
+	fmt.Fprintf(out, "Retimed %d packets: duration %s -> %s, start %s\n", stats.Packets,
+		stats.OldDuration, stats.NewDuration, stats.NewStart.Format(time.RFC3339Nano))
+	return nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"genflux/internal/pcapgen"
+	"genflux/internal/pcaptool"
+)
+
+func newPcapSelftestCommand() *command {
+	return &command{
+		name:    "selftest",
+		summary: "check generated captures against the configuration they were generated from",
+		args:    "<file>...",
+		examples: []string{
+			"genflux pcap selftest realistic_1g.pcap",
+			"genflux pcap selftest --config out/genflux-config.yaml out/generated_*.pcap",
+		},
+		run: runPcapSelftest,
+	}
+}
+
+func runPcapSelftest(cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	config := fs.String("config", "", "effective configuration the captures were generated with (default: the one pcap gen wrote next to them)")
+	sizeTolerance := fs.Float64("size-tolerance", 0, "fraction of exact-size the total frame bytes may be off by")
+	mixTolerance := fs.Float64("mix-tolerance", 0, "how far a protocol's share may stray from proto-dist, e.g. 0.02 (0=three standard errors, at least 0.01)")
+	asJSON := fs.Bool("json", false, "print the checks as JSON")
+	if err := fs.parse(args); err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("pcap selftest takes the captures of one pcap gen run")
+	}
+	paths := fs.Args()
+	if *config == "" {
+		// pcap gen writes <out-file>.yaml, or genflux-config.yaml in the
+		// output directory.
+		*config = filepath.Join(filepath.Dir(paths[0]), "genflux-config.yaml")
+		if _, err := os.Stat(paths[0] + ".yaml"); err == nil && len(paths) == 1 {
+			*config = paths[0] + ".yaml"
+		}
+	}
+	cfg, _, err := parseGenConfig(newPcapGenCommand(), []string{"--config", *config})
+	if err != nil {
+		return err
+	}
+
+	test := selfTestConfig(cfg, paths)
+	test.SizeTolerance, test.MixTolerance = *sizeTolerance, *mixTolerance
+	report, err := pcaptool.SelfTest(test)
+	if err != nil {
+		return corruptHint(err)
+	}
+	if *asJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		os.Stdout.Write(append(data, '\n'))
+	} else {
+		printSelfTest(os.Stdout, report)
+	}
+	if n := report.Failed(); n > 0 {
+		return fmt.Errorf("self-test failed: %d of %d checks against %s", n, len(report.Checks), *config)
+	}
+	return nil
+}
+
+// selfTestConfig works out what the captures at paths should hold under
+// cfg, and which checks its features make moot.
+func selfTestConfig(cfg pcapgen.Config, paths []string) pcaptool.SelfTestConfig {
+	test := pcaptool.SelfTestConfig{
+		Paths:      paths,
+		Files:      cfg.FileCount,
+		ExactBytes: int64(cfg.ExactBytes),
+		Flows:      cfg.FlowCount,
+		Mix:        map[string]float64{},
+		MixByFlows: cfg.FlowCount > 0,
+		Skip:       map[string]string{},
+	}
+	switch {
+	case cfg.Rotate:
+		// The last file takes what is left, and the run may end on
+		// total-duration first.
+		test.ExactBytes, test.MaxBytes = 0, int64(cfg.MaxSizeBytes)
+	case cfg.ExactBytes <= 0:
+		test.MaxBytes = int64(cfg.MaxSizeBytes)
+	}
+	for _, item := range cfg.ProtoDist.Items {
+		name := strings.ToLower(item.Proto.String())
+		if strings.HasPrefix(name, "icmp") {
+			name = "icmp"
+		}
+		test.Mix[name] += float64(item.Weight) / float64(cfg.ProtoDist.Total)
+	}
+
+	skip := func(reason string, checks ...string) {
+		for _, name := range checks {
+			if _, ok := test.Skip[name]; !ok {
+				test.Skip[name] = reason
+			}
+		}
+	}
+	if cfg.Sample.Rate > 0 {
+		skip("sample writes 1 frame in "+fmt.Sprint(cfg.Sample.Rate), "size", "flows", "mix")
+	}
+	if cfg.Loss.DropRate > 0 || cfg.Loss.Gaps > 0 {
+		skip("drop-rate and gaps leave packets out", "size", "flows")
+	}
+	if cfg.Noise.Rate > 0 {
+		skip("noise-rate adds flows of its own", "flows", "mix")
+	}
+	if len(cfg.Scenarios.Kinds) > 0 {
+		skip("scenario adds flows of its own", "flows", "mix")
+	}
+	if len(cfg.Background) > 0 {
+		skip("background adds link-local chatter", "flows", "mix")
+	}
+	if cfg.Encap.Kind != pcapgen.EncapNone {
+		skip("encap carries every frame in a tunnel", "flows", "mix")
+	}
+	if cfg.Tenants.Count > 0 && cfg.Tenants.Encap == pcapgen.TenantVXLAN {
+		skip("tenant-encap vxlan carries every frame over udp", "mix")
+	}
+	if cfg.Link == pcapgen.LinkWiFi {
+		skip("link wifi adds beacons and probe requests", "packets")
+	}
+	if cfg.Fragment {
+		skip("fragment writes packets over the mtu as several frames", "packets", "mix")
+	}
+	if cfg.FlowCount > 0 {
+		switch {
+		case cfg.L7Ratio > 0:
+			skip("l7-ratio moves flows to the protocol of their service", "mix")
+		case cfg.EncryptedDNSRatio > 0:
+			skip("encrypted-dns-ratio moves DNS flows to tcp", "mix")
+		case cfg.Personas.Total > 0:
+			skip("os-personas moves flows to the protocol of their service", "mix")
+		}
+	}
+
+	for _, path := range paths {
+		data, err := os.ReadFile(path + ".manifest.json")
+		if err != nil {
+			continue
+		}
+		var m pcapgen.Manifest
+		if json.Unmarshal(data, &m) != nil {
+			continue
+		}
+		if test.Packets == nil {
+			test.Packets = map[string]int64{}
+		}
+		switch {
+		case m.Sample == nil:
+			test.Packets[path] = int64(m.Written)
+			// The scenarios' frames are written around the pipeline.
+			for _, s := range m.Scenarios {
+				test.Packets[path] += int64(s.Packets)
+			}
+		case m.Sample.Format == pcapgen.SampleSFlow:
+			test.Packets[path] = int64(m.Sample.Datagrams)
+		default:
+			test.Packets[path] = m.Sample.Sampled
+		}
+	}
+	return test
+}
+
+func printSelfTest(w io.Writer, report pcaptool.SelfTestReport) {
+	passed, skipped := 0, 0
+	for _, c := range report.Checks {
+		detail := c.Detail
+		if c.File != "" {
+			detail = c.File + ": " + detail
+		}
+		fmt.Fprintf(w, "%-4s %-8s %s\n", strings.ToUpper(c.Status), c.Name, detail)
+		switch c.Status {
+		case "pass":
+			passed++
+		case "skip":
+			skipped++
+		}
+	}
+	if report.Failed() == 0 {
+		fmt.Fprintf(w, "Self-test passed: %d checks, %d skipped\n", passed, skipped)
+	}
+}
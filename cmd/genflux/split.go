@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"genflux/internal/pcaptool"
+)
+
+func newPcapSplitCommand() *command {
+	return &command{
+		name:    "split",
+		summary: "cut a capture into numbered chunks by packets, size or time",
+		examples: []string{
+			"genflux pcap split --in realistic_1g.pcap --packets 1000000 --out-dir chunks",
+			"genflux pcap split --in realistic_1g.pcap --size 100m",
+			"genflux pcap split --in day.pcapng --window 1h --prefix hour",
+		},
+		run: runPcapSplit,
+	}
+}
+
+func runPcapSplit(cmd *command, args []string) error {
+	fs := cmd.flagSet()
+	inPath := fs.String("in", "", "input pcap or pcapng")
+	outDir := fs.String("out-dir", "", "directory for the chunks (default: that of the input)")
+	prefix := fs.String("prefix", "", "chunk name before _000000.<ext> (default: input name without extension)")
+	packets := fs.Int64("packets", 0, "packets per chunk")
+	size := fs.String("size", "", "most frame bytes per chunk, e.g. 100m (headers not counted, like --max-size)")
+	window := fs.Duration("window", 0, "capture time per chunk, from the first packet on, e.g. 10m")
+	skipCorrupt := fs.Bool("skip-corrupt", false, "step over damaged records, reporting each, instead of failing")
+	if err := fs.parse(args); err != nil {
+		return err
+	}
+
+	cfg := pcaptool.SplitConfig{InPath: *inPath, OutDir: *outDir, Prefix: *prefix, Packets: *packets, Window: *window}
+	if *size != "" {
+		n, err := parseSize(*size)
+		if err != nil {
+			return fmt.Errorf("invalid size: %v", err)
+		}
+		cfg.Bytes = n
+	}
+	cfg.Read = corruptOptions(*skipCorrupt, os.Stdout)
+	stats, err := pcaptool.Split(cfg)
+	if err != nil {
+		return corruptHint(err)
+	}
+	for _, path := range stats.Files {
+		fmt.Printf("  %s\n", path)
+	}
+	fmt.Printf("Split %d packets into %d files\n", stats.Packets, len(stats.Files))
+	return nil
+}
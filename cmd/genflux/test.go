@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"genflux/internal/bench"
+	"genflux/internal/replay"
+)
+
+func newTestCommand() *command {
+	test := &command{name: "test", summary: "run RFC 2544 benchmarks through a device under test"}
+	for _, t := range []struct {
+		test    bench.Test
+		summary string
+	}{
+		{bench.TestThroughput, "find the highest lossless rate per frame size"},
+		{bench.TestLatency, "measure latency at the throughput rate per frame size"},
+		{bench.TestFrameLoss, "measure frame loss from line rate down in 10% steps"},
+	} {
+		t := t
+		test.add(&command{
+			name:    string(t.test),
+			summary: t.summary,
+			examples: []string{
+				fmt.Sprintf("sudo genflux test %s --tx-iface eth0 --rx-iface eth1 --report %s.json", t.test, t.test),
+			},
+			run: func(cmd *command, args []string) error {
+				return runBenchTest(cmd, args, t.test)
+			},
+		})
+	}
+	return test
+}
+
+func runBenchTest(cmd *command, args []string, test bench.Test) error {
+	fs := cmd.flagSet()
+	fs.group("Interfaces")
+	txIface := fs.String("tx-iface", "", "interface that sends the test frames into the device under test")
+	rxIface := fs.String("rx-iface", "", "interface that receives them back")
+	dstMAC := fs.String("dst-mac", "", "destination MAC of the test frames (default: the rx-iface MAC; set the DUT's MAC for a router)")
+	lineRate := fs.String("line-rate", "", "line rate in Mbps or with SI unit, e.g. 10g (default: link speed of tx-iface)")
+	txBackend := fs.String("tx-backend", string(replay.DefaultBackend), "how frames reach the kernel: socket|ring|xdp")
+	fs.group("Trials")
+	frameSizes := fs.String("frame-sizes", "64,128,256,512,1024,1280,1518", "Ethernet frame sizes in bytes, FCS included")
+	trialDuration := fs.Duration("trial-duration", 60*time.Second, "how long each trial sends")
+	resolution := fs.Float64("resolution", 0.5, "throughput search resolution in percent of line rate")
+	lossTolerance := fs.Float64("loss-tolerance", 0, "fraction of frames a trial may lose and still pass [0..1)")
+	var rate *float64
+	if test == bench.TestLatency {
+		rate = fs.Float64("rate", 0, "send at this percent of line rate instead of searching for the throughput first")
+	}
+	fs.group("Output")
+	report := fs.String("report", "", "write the results as JSON to this file (- for stdout; progress then goes to stderr)")
+	if err := fs.parse(args); err != nil {
+		return err
+	}
+
+	cfg := bench.Config{
+		Test:          test,
+		TxIface:       *txIface,
+		RxIface:       *rxIface,
+		TrialDuration: *trialDuration,
+		Resolution:    *resolution,
+		LossTolerance: *lossTolerance,
+		Report:        *report,
+	}
+	if rate != nil {
+		cfg.Rate = *rate
+	}
+	var err error
+	if cfg.FrameSizes, err = bench.ParseFrameSizes(*frameSizes); err != nil {
+		return fmt.Errorf("invalid frame-sizes: %v", err)
+	}
+	if *lineRate != "" {
+		if cfg.LineRate, err = parseRate(*lineRate, "bps", 1e6); err != nil {
+			return fmt.Errorf("invalid line-rate: %v", err)
+		}
+	}
+	if *dstMAC != "" {
+		if cfg.DstMAC, err = net.ParseMAC(strings.TrimSpace(*dstMAC)); err != nil {
+			return fmt.Errorf("invalid dst-mac: %v", err)
+		}
+	}
+	if cfg.TxBackend, err = replay.ParseTxBackend(*txBackend); err != nil {
+		return fmt.Errorf("invalid tx-backend: %v", err)
+	}
+	out := os.Stdout
+	if *report == "-" {
+		out = os.Stderr
+	}
+	return bench.Run(cfg, out)
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// runContext returns the context a command runs under: it ends after
+// timeout (0 means never) and, with signals, on SIGINT or SIGTERM.
+// Commands that handle the signals themselves leave signals off.
+func runContext(timeout time.Duration, signals bool) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.Background(), context.CancelFunc(func() {})
+	if signals {
+		ctx, cancel = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	}
+	if timeout > 0 {
+		stopSignals := cancel
+		var stopTimer context.CancelFunc
+		ctx, stopTimer = context.WithTimeout(ctx, timeout)
+		cancel = func() { stopTimer(); stopSignals() }
+	}
+	return ctx, cancel
+}
+
+// stopReason turns the end of a run's context into a message.
+func stopReason(err error, timeout time.Duration) error {
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		return fmt.Errorf("timed out after %s", timeout)
+	case errors.Is(err, context.Canceled):
+		return errors.New("interrupted")
+	}
+	return err
+}
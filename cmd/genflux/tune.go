@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"genflux/internal/replay"
+)
+
+// A tune file is a profile of the replay settings that can change while
+// it runs:
+//
+//	mbps: 2.5g
+//	limit-per-loop: 100000
+//
+// It overrides the command line at start and is read again on SIGHUP,
+// when the running replay switches to what it then says. Keys it leaves
+// out fall back to the command line.
+
+// loadTuning reads the tune file at path over base, the settings of the
+// command line.
+func loadTuning(cmd *command, path string, base replay.Tuning) (replay.Tuning, error) {
+	fs := cmd.flagSet()
+	mbps := fs.String("mbps", "", "")
+	pps := fs.String("pps", "", "")
+	speed := fs.Float64("speed", base.Speed, "")
+	limit := fs.Int("limit", base.Limit, "")
+	limitPerLoop := fs.Int("limit-per-loop", base.LimitPerLoop, "")
+	duration := fs.Duration("duration", base.Duration, "")
+	names := []string{}
+	fs.VisitAll(func(f *flag.Flag) { names = append(names, f.Name) })
+
+	settings := map[string]profileSetting{}
+	var order []string
+	if err := loadProfile(fs, path, names, nil, settings, &order); err != nil {
+		return replay.Tuning{}, err
+	}
+	for _, key := range order {
+		set := settings[key]
+		if set.unset {
+			continue
+		}
+		if err := fs.Set(key, set.value); err != nil {
+			return replay.Tuning{}, fmt.Errorf("%s: %s: %v", set.pos, key, err)
+		}
+	}
+
+	t := replay.Tuning{Mbps: base.Mbps, Pps: base.Pps, Speed: *speed, Limit: *limit, LimitPerLoop: *limitPerLoop, Duration: *duration}
+	if *mbps != "" {
+		v, err := parseRate(*mbps, "bps", 1e6)
+		if err != nil {
+			return replay.Tuning{}, fmt.Errorf("%s: invalid mbps: %v", path, err)
+		}
+		t.Mbps = v
+	}
+	if *pps != "" {
+		v, err := parseRate(*pps, "pps", 1)
+		if err != nil {
+			return replay.Tuning{}, fmt.Errorf("%s: invalid pps: %v", path, err)
+		}
+		t.Pps = v
+	}
+	return t, nil
+}
+
+// watchTuning re-reads the tune file at path on every SIGHUP and sends
+// what it says on the returned channel. A file that does not load is
+// reported and leaves the replay as it is. stop ends the watch.
+func watchTuning(cmd *command, path string, base replay.Tuning) (tune <-chan replay.Tuning, stop func()) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	ch := make(chan replay.Tuning, 1)
+	go func() {
+		for range hup {
+			t, err := loadTuning(cmd, path, base)
+			if err != nil {
+				log.Printf("tune: %v (settings unchanged)", err)
+				continue
+			}
+			// Only the latest tuning matters.
+			select {
+			case <-ch:
+			default:
+			}
+			ch <- t
+		}
+	}()
+	return ch, func() {
+		signal.Stop(hup)
+		close(hup)
+	}
+}
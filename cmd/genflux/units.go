@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// parseSize parses a byte size. KiB/MiB/GiB/TiB are binary (1024^n) and
+// KB/MB/GB/TB are SI (1000^n); a bare k/m/g/t keeps the historical binary
+// meaning.
+func parseSize(value string) (int64, error) {
+	v := strings.TrimSpace(strings.ToLower(value))
+	if v == "" {
+		return 0, fmt.Errorf("empty size")
+	}
+
+	base := 1024.0
+	if strings.HasSuffix(v, "b") {
+		v = strings.TrimSuffix(v, "b")
+		base = 1000
+	}
+	num, _, err := parseScaled(v, base)
+	if err != nil {
+		return 0, err
+	}
+	if num <= 0 {
+		return 0, fmt.Errorf("size must be > 0")
+	}
+	return int64(math.Round(num)), nil
+}
+
+// parseRate parses a rate expressed in the flag's own unit (a plain number)
+// or with an SI prefix and optional unit suffix, e.g. "2.5g" or "2.5gbps"
+// for --mbps. scale is the size of the flag's unit (1e6 for Mbps, 1 for pps).
+func parseRate(value string, unit string, scale float64) (float64, error) {
+	v := strings.TrimSpace(strings.ToLower(value))
+	if v == "" {
+		return 0, fmt.Errorf("empty rate")
+	}
+	absolute := false
+	if strings.HasSuffix(v, unit) {
+		v = strings.TrimSuffix(v, unit)
+		absolute = true
+	}
+	num, scaled, err := parseScaled(v, 1000)
+	if err != nil {
+		return 0, err
+	}
+	if num <= 0 {
+		return 0, fmt.Errorf("rate must be > 0")
+	}
+	if scaled || absolute {
+		return num / scale, nil
+	}
+	return num, nil
+}
+
+// parseScaled parses a number with an optional k/m/g/t prefix. A prefix
+// followed by "i" is binary; otherwise it scales by powers of base. The
+// returned bool reports whether a prefix was present.
+func parseScaled(v string, base float64) (float64, bool, error) {
+	v = strings.TrimSpace(v)
+	binary := false
+	if strings.HasSuffix(v, "i") {
+		v = strings.TrimSuffix(v, "i")
+		base = 1024
+		binary = true
+	}
+	exp := 0
+	if v != "" {
+		switch v[len(v)-1] {
+		case 'k':
+			exp = 1
+		case 'm':
+			exp = 2
+		case 'g':
+			exp = 3
+		case 't':
+			exp = 4
+		}
+	}
+	if exp > 0 {
+		v = v[:len(v)-1]
+	} else if binary {
+		return 0, false, fmt.Errorf("binary unit requires a k/m/g/t prefix")
+	}
+	v = strings.TrimSpace(v)
+	if v == "" {
+		return 0, false, fmt.Errorf("missing numeric value")
+	}
+	num, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return 0, false, err
+	}
+	return num * math.Pow(base, float64(exp)), exp > 0, nil
+}
@@ -5,6 +5,7 @@ go 1.21
 require (
 	github.com/google/gopacket v1.1.19
 	golang.org/x/sys v0.17.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require golang.org/x/net v0.0.0-20190620200207-3b0461eec859 // indirect
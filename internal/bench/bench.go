@@ -0,0 +1,177 @@
+// Package bench runs RFC 2544 style benchmarks: test frames are sent on
+// one interface through the device under test and counted, with their
+// latency, as they come back on another.
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"genflux/internal/replay"
+)
+
+// Test selects the benchmark.
+type Test string
+
+const (
+	// TestThroughput searches, per frame size, for the highest rate at
+	// which no frame is lost (RFC 2544 section 26.1).
+	TestThroughput Test = "throughput"
+	// TestLatency measures latency at the throughput rate, or at Rate
+	// when it is set (section 26.2).
+	TestLatency Test = "latency"
+	// TestFrameLoss measures the loss at 100% of line rate and then in
+	// 10% steps down, until two steps in a row lose nothing (section
+	// 26.3).
+	TestFrameLoss Test = "frameloss"
+)
+
+// StandardFrameSizes are the Ethernet frame sizes of RFC 2544 section 9.1,
+// FCS included.
+var StandardFrameSizes = []int{64, 128, 256, 512, 1024, 1280, 1518}
+
+const (
+	// ethOverhead is what every frame occupies on the wire beyond its own
+	// bytes: preamble, start delimiter and inter-frame gap.
+	ethOverhead = 20
+	fcsLen      = 4
+	// settleTime is how long a trial waits for its last frames, as RFC
+	// 2544 section 23 asks.
+	settleTime = 2 * time.Second
+)
+
+type Config struct {
+	Test    Test
+	TxIface string
+	RxIface string
+	// LineRate is the link speed in Mbps; 0 reads it from the TX
+	// interface.
+	LineRate      float64
+	FrameSizes    []int
+	TrialDuration time.Duration
+	// Resolution is how closely the throughput search brackets the rate,
+	// in percent of line rate.
+	Resolution    float64
+	LossTolerance float64
+	// Rate fixes the latency test rate in percent of line rate instead of
+	// searching for the throughput first.
+	Rate float64
+	// DstMAC addresses the frames; nil sends them to the RX interface,
+	// as through a switch. A router under test needs its own MAC here.
+	DstMAC    net.HardwareAddr
+	TxBackend replay.TxBackend
+	// Report is where the JSON results go; "-" is stdout.
+	Report string
+}
+
+// ParseFrameSizes parses a comma-separated list of frame sizes in bytes,
+// FCS included.
+func ParseFrameSizes(value string) ([]int, error) {
+	var sizes []int
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		n, err := strconv.Atoi(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid frame size %q", item)
+		}
+		if n < minFrameSize || n > 9018 {
+			return nil, fmt.Errorf("frame size %d outside %d-9018", n, minFrameSize)
+		}
+		sizes = append(sizes, n)
+	}
+	if len(sizes) == 0 {
+		return nil, fmt.Errorf("no frame sizes")
+	}
+	sort.Ints(sizes)
+	return sizes, nil
+}
+
+// lineRateFPS is the frame rate that fills a link of mbps with frames of
+// size bytes.
+func lineRateFPS(mbps float64, size int) float64 {
+	return mbps * 1e6 / float64((size+ethOverhead)*8)
+}
+
+// Trial is the outcome of sending at one rate for one trial duration.
+type Trial struct {
+	RatePercent float64 `json:"rate_percent"`
+	OfferedFPS  float64 `json:"offered_fps"`
+	Sent        int64   `json:"sent"`
+	Received    int64   `json:"received"`
+	LossPercent float64 `json:"loss_percent"`
+	Pass        bool    `json:"pass"`
+	// Note explains a failure that is the tester's rather than the
+	// device's: the sender fell behind or the receiver dropped frames.
+	Note    string   `json:"note,omitempty"`
+	Latency *Latency `json:"latency,omitempty"`
+}
+
+// Latency summarises the one-way delay of the frames of a trial, from
+// the moment each was handed to the TX backend to its receive timestamp.
+type Latency struct {
+	MinUs  float64 `json:"min_us"`
+	MeanUs float64 `json:"mean_us"`
+	MaxUs  float64 `json:"max_us"`
+}
+
+// Result is the outcome of a test for one frame size.
+type Result struct {
+	FrameSize int `json:"frame_size"`
+	// Throughput, for the throughput and latency tests, is the highest
+	// rate that passed.
+	ThroughputPercent float64  `json:"throughput_percent,omitempty"`
+	ThroughputFPS     float64  `json:"throughput_fps,omitempty"`
+	ThroughputMbps    float64  `json:"throughput_mbps,omitempty"`
+	Latency           *Latency `json:"latency,omitempty"`
+	Trials            []Trial  `json:"trials"`
+}
+
+// Report is the machine-readable record of a test run.
+type Report struct {
+	Test          Test      `json:"test"`
+	TxIface       string    `json:"tx_iface"`
+	RxIface       string    `json:"rx_iface"`
+	LineRateMbps  float64   `json:"line_rate_mbps"`
+	TrialDuration string    `json:"trial_duration"`
+	LossTolerance float64   `json:"loss_tolerance"`
+	Started       time.Time `json:"started"`
+	Results       []Result  `json:"results"`
+}
+
+func (r *Report) write(path string) error {
+	data, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if path == "-" {
+		_, err = os.Stdout.Write(data)
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func logTrial(out io.Writer, size int, t Trial) {
+	verdict := "pass"
+	if !t.Pass {
+		verdict = "fail"
+	}
+	fmt.Fprintf(out, "%5dB %6.2f%% %12.0f fps sent=%d received=%d loss=%.4f%% %s", size, t.RatePercent, t.OfferedFPS, t.Sent, t.Received, t.LossPercent, verdict)
+	if t.Note != "" {
+		fmt.Fprintf(out, " (%s)", t.Note)
+	}
+	if t.Latency != nil {
+		fmt.Fprintf(out, " latency min/mean/max=%.1f/%.1f/%.1f us", t.Latency.MinUs, t.Latency.MeanUs, t.Latency.MaxUs)
+	}
+	fmt.Fprintln(out)
+}
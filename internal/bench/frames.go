@@ -0,0 +1,81 @@
+package bench
+
+import (
+	"bytes"
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+// Test frames are UDP to the discard port from the RFC 2544 benchmarking
+// range 198.18.0.0/15. The payload starts with a marker, the trial number
+// and the time the frame was handed to the TX backend.
+const (
+	frameHdrLen  = 14 + 20 + 8
+	markerLen    = 4
+	trialOff     = frameHdrLen + markerLen
+	stampOff     = trialOff + 4
+	testDataLen  = markerLen + 4 + 8
+	minFrameSize = frameHdrLen + testDataLen + fcsLen
+)
+
+var (
+	frameMarker = []byte("GFXB")
+	benchSrcIP  = net.IP{198, 18, 0, 1}
+	benchDstIP  = net.IP{198, 19, 0, 1}
+)
+
+// newTestFrame builds a frame of size bytes, FCS excluded from the
+// buffer, for trial.
+func newTestFrame(size int, src, dst net.HardwareAddr, trial uint32) []byte {
+	frame := make([]byte, size-fcsLen)
+	copy(frame[0:6], dst)
+	copy(frame[6:12], src)
+	binary.BigEndian.PutUint16(frame[12:14], 0x0800)
+
+	ip := frame[14:34]
+	ip[0] = 0x45
+	binary.BigEndian.PutUint16(ip[2:4], uint16(len(frame)-14))
+	binary.BigEndian.PutUint16(ip[6:8], 0x4000) // DF
+	ip[8] = 64
+	ip[9] = 17
+	copy(ip[12:16], benchSrcIP)
+	copy(ip[16:20], benchDstIP)
+	binary.BigEndian.PutUint16(ip[10:12], ipChecksum(ip))
+
+	udp := frame[34:42]
+	binary.BigEndian.PutUint16(udp[0:2], 49184)
+	binary.BigEndian.PutUint16(udp[2:4], 9)
+	binary.BigEndian.PutUint16(udp[4:6], uint16(len(frame)-34))
+	// A zero UDP checksum means none, so the stamp can change per frame.
+
+	copy(frame[frameHdrLen:], frameMarker)
+	binary.BigEndian.PutUint32(frame[trialOff:], trial)
+	return frame
+}
+
+// stamp records the TX time in frame.
+func stamp(frame []byte, t time.Time) {
+	binary.BigEndian.PutUint64(frame[stampOff:], uint64(t.UnixNano()))
+}
+
+// parseTestFrame returns the trial and TX time of a test frame.
+func parseTestFrame(frame []byte) (trial uint32, sent time.Time, ok bool) {
+	if len(frame) < frameHdrLen+testDataLen || !bytes.Equal(frame[frameHdrLen:trialOff], frameMarker) {
+		return 0, time.Time{}, false
+	}
+	trial = binary.BigEndian.Uint32(frame[trialOff:])
+	sent = time.Unix(0, int64(binary.BigEndian.Uint64(frame[stampOff:])))
+	return trial, sent, true
+}
+
+func ipChecksum(hdr []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(hdr); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(hdr[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
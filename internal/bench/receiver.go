@@ -0,0 +1,101 @@
+//go:build linux
+
+package bench
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"genflux/internal/capture"
+)
+
+// receiver counts the test frames of the current trial arriving on the
+// RX interface and tracks their latency from the kernel receive stamps.
+type receiver struct {
+	l       *capture.Listener
+	closing atomic.Bool
+	done    chan struct{}
+
+	mu       sync.Mutex
+	trial    uint32
+	received int64
+	latSum   float64
+	latMin   time.Duration
+	latMax   time.Duration
+	// dropped is the listener's drop count when the trial started.
+	dropped int64
+}
+
+func newReceiver(iface string) (*receiver, error) {
+	l, err := capture.Listen(iface, false)
+	if err != nil {
+		return nil, err
+	}
+	r := &receiver{l: l, done: make(chan struct{})}
+	go r.loop()
+	return r, nil
+}
+
+func (r *receiver) loop() {
+	defer close(r.done)
+	buf := make([]byte, 10000)
+	for !r.closing.Load() {
+		n, f, err := r.l.Read(buf)
+		if err != nil || f.Outgoing {
+			continue
+		}
+		trial, sent, ok := parseTestFrame(buf[:n])
+		if !ok {
+			continue
+		}
+		r.record(trial, f.Time.Sub(sent))
+	}
+}
+
+func (r *receiver) record(trial uint32, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if trial != r.trial {
+		return
+	}
+	if r.received == 0 || latency < r.latMin {
+		r.latMin = latency
+	}
+	r.latMax = max(r.latMax, latency)
+	r.latSum += float64(latency)
+	r.received++
+}
+
+// start begins counting the frames of trial.
+func (r *receiver) start(trial uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trial = trial
+	r.received, r.latSum, r.latMin, r.latMax = 0, 0, 0, 0
+	r.dropped = r.l.Dropped()
+}
+
+// finish stops counting and returns the frames received, their latency
+// and the frames the receive socket itself dropped.
+func (r *receiver) finish() (int64, *Latency, uint32) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.trial = 0
+	drops := uint32(r.l.Dropped() - r.dropped)
+	if r.received == 0 {
+		return 0, nil, drops
+	}
+	us := func(d float64) float64 { return d / float64(time.Microsecond) }
+	return r.received, &Latency{
+		MinUs:  us(float64(r.latMin)),
+		MeanUs: us(r.latSum / float64(r.received)),
+		MaxUs:  us(float64(r.latMax)),
+	}, drops
+}
+
+func (r *receiver) Close() error {
+	r.closing.Store(true)
+	<-r.done
+	return r.l.Close()
+}
@@ -0,0 +1,245 @@
+//go:build linux
+
+package bench
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+
+	"genflux/internal/replay"
+)
+
+// behindSlack is how far past the trial duration the sender may finish
+// before the trial is blamed on the tester.
+const behindSlack = 1.01
+
+type runner struct {
+	cfg      Config
+	out      io.Writer
+	sender   *replay.Sender
+	recv     *receiver
+	src, dst net.HardwareAddr
+	trialID  uint32
+}
+
+// Run performs cfg.Test for every frame size, logging each trial to out.
+func Run(cfg Config, out io.Writer) error {
+	if cfg.TxIface == "" || cfg.RxIface == "" {
+		return errors.New("tx-iface and rx-iface required")
+	}
+	if len(cfg.FrameSizes) == 0 {
+		cfg.FrameSizes = StandardFrameSizes
+	}
+	if cfg.TrialDuration <= 0 {
+		return errors.New("trial-duration must be > 0")
+	}
+	if cfg.Resolution <= 0 || cfg.Resolution >= 100 {
+		return errors.New("resolution must be within (0,100)")
+	}
+	if cfg.LossTolerance < 0 || cfg.LossTolerance >= 1 {
+		return errors.New("loss-tolerance must be within [0,1)")
+	}
+	if cfg.Rate < 0 || cfg.Rate > 100 {
+		return errors.New("rate must be within (0,100]")
+	}
+	if cfg.LineRate <= 0 {
+		speed, err := replay.LinkSpeedMbps(cfg.TxIface)
+		if err != nil {
+			return fmt.Errorf("%v; use --line-rate", err)
+		}
+		cfg.LineRate = speed
+	}
+
+	txIfi, err := net.InterfaceByName(cfg.TxIface)
+	if err != nil {
+		return err
+	}
+	rxIfi, err := net.InterfaceByName(cfg.RxIface)
+	if err != nil {
+		return err
+	}
+	r := &runner{cfg: cfg, out: out, src: txIfi.HardwareAddr, dst: cfg.DstMAC, trialID: rand.Uint32()}
+	if r.dst == nil {
+		r.dst = rxIfi.HardwareAddr
+	}
+	if r.recv, err = newReceiver(cfg.RxIface); err != nil {
+		return fmt.Errorf("open %s: %v", cfg.RxIface, err)
+	}
+	defer r.recv.Close()
+	if r.sender, err = replay.NewSender(replay.Config{TxBackend: cfg.TxBackend}, cfg.TxIface); err != nil {
+		return fmt.Errorf("open %s: %v", cfg.TxIface, err)
+	}
+	defer r.sender.Close()
+
+	report := Report{
+		Test:          cfg.Test,
+		TxIface:       cfg.TxIface,
+		RxIface:       cfg.RxIface,
+		LineRateMbps:  cfg.LineRate,
+		TrialDuration: cfg.TrialDuration.String(),
+		LossTolerance: cfg.LossTolerance,
+		Started:       time.Now(),
+	}
+	fmt.Fprintf(out, "%s test %s -> %s at %.0f Mbps line rate, %s trials\n", cfg.Test, cfg.TxIface, cfg.RxIface, cfg.LineRate, cfg.TrialDuration)
+	for _, size := range cfg.FrameSizes {
+		res := Result{FrameSize: size}
+		switch cfg.Test {
+		case TestThroughput:
+			err = r.throughput(&res)
+		case TestLatency:
+			err = r.latency(&res)
+		case TestFrameLoss:
+			err = r.frameLoss(&res)
+		default:
+			err = fmt.Errorf("unknown test %q", cfg.Test)
+		}
+		if err != nil {
+			return err
+		}
+		report.Results = append(report.Results, res)
+	}
+	if cfg.Report == "" {
+		return nil
+	}
+	return report.write(cfg.Report)
+}
+
+// throughput bisects the rate, starting from line rate, until it is
+// bracketed within the resolution.
+func (r *runner) throughput(res *Result) error {
+	t, err := r.trial(res, 100)
+	if err != nil {
+		return err
+	}
+	best := 0.0
+	if t.Pass {
+		best = 100
+	} else {
+		lo, hi := 0.0, 100.0
+		for hi-lo > r.cfg.Resolution {
+			mid := (lo + hi) / 2
+			if t, err = r.trial(res, mid); err != nil {
+				return err
+			}
+			if t.Pass {
+				lo, best = mid, mid
+			} else {
+				hi = mid
+			}
+		}
+	}
+	if best == 0 {
+		fmt.Fprintf(r.out, "%5dB no lossless rate above %.2f%%\n", res.FrameSize, r.cfg.Resolution)
+		return nil
+	}
+	res.ThroughputPercent = best
+	res.ThroughputFPS = lineRateFPS(r.cfg.LineRate, res.FrameSize) * best / 100
+	res.ThroughputMbps = res.ThroughputFPS * float64(res.FrameSize) * 8 / 1e6
+	fmt.Fprintf(r.out, "%5dB throughput %.2f%% = %.0f fps = %.2f Mbps\n", res.FrameSize, best, res.ThroughputFPS, res.ThroughputMbps)
+	return nil
+}
+
+// latency runs one trial at the throughput rate, found first unless a
+// rate is given, and reports the latency of all its frames.
+func (r *runner) latency(res *Result) error {
+	rate := r.cfg.Rate
+	if rate == 0 {
+		if err := r.throughput(res); err != nil {
+			return err
+		}
+		if rate = res.ThroughputPercent; rate == 0 {
+			return nil
+		}
+	}
+	t, err := r.trial(res, rate)
+	if err != nil {
+		return err
+	}
+	res.Latency = t.Latency
+	return nil
+}
+
+// frameLoss steps down from line rate by 10% until two trials in a row
+// lose nothing.
+func (r *runner) frameLoss(res *Result) error {
+	clean := 0
+	for rate := 100; rate > 0 && clean < 2; rate -= 10 {
+		t, err := r.trial(res, float64(rate))
+		if err != nil {
+			return err
+		}
+		if t.Received >= t.Sent && t.Note == "" {
+			clean++
+		} else {
+			clean = 0
+		}
+	}
+	return nil
+}
+
+// trial sends frames of res.FrameSize at percent of line rate for the
+// trial duration and records the outcome in res.
+func (r *runner) trial(res *Result, percent float64) (Trial, error) {
+	size := res.FrameSize
+	fps := lineRateFPS(r.cfg.LineRate, size) * percent / 100
+	t := Trial{RatePercent: percent, OfferedFPS: fps}
+	count := max(int64(fps*r.cfg.TrialDuration.Seconds()), 1)
+	interval := float64(time.Second) / fps
+
+	r.trialID++
+	frame := newTestFrame(size, r.src, r.dst, r.trialID)
+	r.recv.start(r.trialID)
+	var txDrops int64
+	start := time.Now()
+	// A sender that cannot keep up gives up at the deadline rather than
+	// stretching the trial.
+	deadline := start.Add(time.Duration(float64(r.cfg.TrialDuration) * behindSlack))
+	for i := int64(0); i < count; i++ {
+		if i%1024 == 0 && time.Now().After(deadline) {
+			break
+		}
+		replay.SleepUntil(start.Add(time.Duration(float64(i) * interval)))
+		stamp(frame, time.Now())
+		if err := r.sender.Send(frame, time.Time{}); err != nil {
+			if errors.Is(err, unix.ENOBUFS) {
+				txDrops++
+				continue
+			}
+			return t, err
+		}
+		t.Sent++
+	}
+	if err := r.sender.Flush(); err != nil {
+		return t, err
+	}
+	elapsed := time.Since(start)
+	time.Sleep(settleTime)
+	var rxDrops uint32
+	t.Received, t.Latency, rxDrops = r.recv.finish()
+
+	if t.Sent > 0 && t.Received < t.Sent {
+		t.LossPercent = float64(t.Sent-t.Received) / float64(t.Sent) * 100
+	}
+	var notes []string
+	if t.Sent+txDrops < count || elapsed > deadline.Sub(start) {
+		notes = append(notes, fmt.Sprintf("sender reached only %.0f fps", float64(t.Sent)/elapsed.Seconds()))
+	}
+	if txDrops > 0 {
+		notes = append(notes, fmt.Sprintf("TX queue dropped %d frames", txDrops))
+	}
+	if rxDrops > 0 {
+		notes = append(notes, fmt.Sprintf("receive socket dropped %d frames", rxDrops))
+	}
+	t.Note = strings.Join(notes, "; ")
+	t.Pass = t.Note == "" && t.Sent > 0 && t.LossPercent <= r.cfg.LossTolerance*100
+	res.Trials = append(res.Trials, t)
+	logTrial(r.out, size, t)
+	return t, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+
+package bench
+
+import (
+	"errors"
+	"io"
+)
+
+func Run(cfg Config, out io.Writer) error {
+	_, _ = cfg, out
+	return errors.New("benchmarks are only supported on linux (requires AF_PACKET raw sockets)")
+}
@@ -0,0 +1,99 @@
+// Package capture records the traffic of an interface to pcap or pcapng
+// files, as tcpdump -w does, for labs that generate, replay and capture
+// with the one binary.
+package capture
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"genflux/internal/pcapio"
+)
+
+// DefaultSnaplen is how much of every frame is kept when Config.Snaplen
+// is 0, enough for any frame, as in tcpdump.
+const DefaultSnaplen = 262144
+
+// Config describes a capture. It runs until the context ends, Duration
+// has passed or Count packets are written, whichever comes first.
+type Config struct {
+	Iface string
+	// Out is the capture file, or "-" for stdout. With RotateBytes or
+	// RotateEvery the capture goes to numbered files instead, named
+	// <Out without extension>_000000<ext> onwards.
+	Out    string
+	Format pcapio.Format
+	// Filter, when set, is a capture filter in tcpdump syntax; only the
+	// frames it matches are written.
+	Filter string
+	// Snaplen is how many bytes of every frame are kept; 0 is
+	// DefaultSnaplen.
+	Snaplen int
+	Promisc bool
+	// RotateBytes starts a new file before a frame that would take the
+	// current one past this many captured frame bytes, headers not
+	// counted; a larger frame gets a file of its own. RotateEvery starts
+	// one for every span of this long from the start, skipping spans
+	// without frames.
+	RotateBytes int64
+	RotateEvery time.Duration
+	Duration    time.Duration
+	Count       int64
+}
+
+// Stats summarises a capture.
+type Stats struct {
+	// Packets and Bytes count the frames written, Bytes as long as they
+	// were on the wire; Filtered counts those the filter left out.
+	Packets  int64
+	Bytes    int64
+	Filtered int64
+	// Dropped counts the frames the kernel dropped for want of room in
+	// the socket's buffer.
+	Dropped int64
+	// Files are the files written, in order.
+	Files []string
+}
+
+func (cfg Config) rotates() bool {
+	return cfg.RotateBytes > 0 || cfg.RotateEvery > 0
+}
+
+func (cfg Config) validate() error {
+	switch {
+	case cfg.Iface == "":
+		return fmt.Errorf("iface required")
+	case cfg.Out == "":
+		return fmt.Errorf("out required")
+	case cfg.Snaplen < 0:
+		return fmt.Errorf("snaplen must be >= 0")
+	case cfg.RotateBytes < 0 || cfg.RotateEvery < 0 || cfg.Duration < 0 || cfg.Count < 0:
+		return fmt.Errorf("rotate-size, rotate-every, duration and count must be >= 0")
+	case cfg.Out == "-" && cfg.rotates():
+		return fmt.Errorf("rotation needs files; out - writes one stream")
+	}
+	return nil
+}
+
+// FormatFor returns the format of a capture written to path: pcapng
+// when it ends in .pcapng, else pcap.
+func FormatFor(path string) pcapio.Format {
+	if strings.HasSuffix(strings.ToLower(path), ".pcapng") {
+		return pcapio.FormatPcapNG
+	}
+	return pcapio.FormatPcap
+}
+
+// filePath returns the path of rotated file n.
+func (cfg Config) filePath(n int) string {
+	dir, name := filepath.Split(cfg.Out)
+	for _, ext := range []string{".pcapng", ".pcap", ".cap"} {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			name = name[:len(name)-len(ext)]
+			break
+		}
+	}
+	return filepath.Join(dir, fmt.Sprintf("%s_%06d%s", name, n, cfg.Format.Ext()))
+}
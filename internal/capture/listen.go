@@ -0,0 +1,183 @@
+//go:build linux
+
+package capture
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	"unsafe"
+
+	"github.com/google/gopacket/layers"
+	"golang.org/x/sys/unix"
+)
+
+// Linux hardware types of the interfaces a capture can record.
+const (
+	arphrdEther    = 1
+	arphrdLoopback = 772
+	arphrdNone     = 65534
+)
+
+// ErrIdle is returned by Listener.Read when no frame arrived for a tenth
+// of a second, so that callers can look up from the wait.
+var ErrIdle = errors.New("no frame received")
+
+// Listener receives every frame of an interface on an AF_PACKET socket.
+type Listener struct {
+	fd     int
+	iface  string
+	hwType int
+	link   layers.LinkType
+	oob    []byte
+	// dropped totals the kernel's drop counter, which every read resets.
+	dropped int64
+}
+
+// Frame describes a frame received by a Listener.
+type Frame struct {
+	// Len is the length of the frame on the wire, which may be more than
+	// what the buffer given to Read held.
+	Len  int
+	Time time.Time
+	// Outgoing marks a frame this host sent.
+	Outgoing bool
+}
+
+// Listen opens a listener on iface, in promiscuous mode if promisc. It
+// takes Ethernet, loopback and raw IP interfaces.
+func Listen(iface string, promisc bool) (*Listener, error) {
+	hwType, err := hardwareType(iface)
+	if err != nil {
+		return nil, err
+	}
+	link := layers.LinkTypeEthernet
+	switch hwType {
+	case arphrdEther, arphrdLoopback:
+	case arphrdNone:
+		link = layers.LinkTypeRaw
+	default:
+		return nil, fmt.Errorf("%s: unsupported hardware type %d (want Ethernet, loopback or raw IP)", iface, hwType)
+	}
+	fd, err := openSocket(iface, promisc)
+	if err != nil {
+		return nil, err
+	}
+	oob := make([]byte, unix.CmsgSpace(int(unsafe.Sizeof(unix.Timespec{}))))
+	return &Listener{fd: fd, iface: iface, hwType: hwType, link: link, oob: oob}, nil
+}
+
+// LinkType is the link layer of the frames received.
+func (l *Listener) LinkType() layers.LinkType {
+	return l.link
+}
+
+// Read receives the next frame into buf, keeping as much of it as fits.
+// A loopback interface delivers every frame it sends back to itself, so
+// there only that copy is returned, as tcpdump does.
+func (l *Listener) Read(buf []byte) (int, Frame, error) {
+	for {
+		// With MSG_TRUNC n is the length of the frame, not what fitted.
+		n, oobn, _, from, err := unix.Recvmsg(l.fd, buf, l.oob, unix.MSG_TRUNC)
+		if err != nil {
+			if errors.Is(err, unix.EAGAIN) || errors.Is(err, unix.EINTR) {
+				return 0, Frame{}, ErrIdle
+			}
+			return 0, Frame{}, fmt.Errorf("receive on %s: %v", l.iface, err)
+		}
+		var outgoing bool
+		if sa, ok := from.(*unix.SockaddrLinklayer); ok && sa.Pkttype == unix.PACKET_OUTGOING {
+			if l.hwType == arphrdLoopback {
+				continue
+			}
+			outgoing = true
+		}
+		return min(n, len(buf)), Frame{Len: n, Time: receiveTime(l.oob[:oobn]), Outgoing: outgoing}, nil
+	}
+}
+
+// Dropped returns the frames the kernel dropped for want of room in the
+// socket's buffer since the listener opened.
+func (l *Listener) Dropped() int64 {
+	if st, err := unix.GetsockoptTpacketStats(l.fd, unix.SOL_PACKET, unix.PACKET_STATISTICS); err == nil {
+		l.dropped += int64(st.Drops)
+	}
+	return l.dropped
+}
+
+func (l *Listener) Close() error {
+	return unix.Close(l.fd)
+}
+
+// openSocket opens an AF_PACKET socket receiving every frame of iface.
+func openSocket(iface string, promisc bool) (int, error) {
+	ifi, err := net.InterfaceByName(iface)
+	if err != nil {
+		return -1, err
+	}
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return -1, err
+	}
+	if err := unix.Bind(fd, &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: ifi.Index}); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	if promisc {
+		mreq := unix.PacketMreq{Ifindex: int32(ifi.Index), Type: unix.PACKET_MR_PROMISC}
+		if err := unix.SetsockoptPacketMreq(fd, unix.SOL_PACKET, unix.PACKET_ADD_MEMBERSHIP, &mreq); err != nil {
+			unix.Close(fd)
+			return -1, fmt.Errorf("enter promiscuous mode on %s: %v", iface, err)
+		}
+	}
+	// A deep buffer rides out bursts while the files are written.
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUFFORCE, 64<<20); err != nil {
+		unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_RCVBUF, 64<<20)
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_TIMESTAMPNS, 1); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	tv := unix.NsecToTimeval(int64(100 * time.Millisecond))
+	if err := unix.SetsockoptTimeval(fd, unix.SOL_SOCKET, unix.SO_RCVTIMEO, &tv); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	// Counting drops from here on.
+	unix.GetsockoptTpacketStats(fd, unix.SOL_PACKET, unix.PACKET_STATISTICS)
+	return fd, nil
+}
+
+// hardwareType returns the ARPHRD type of iface.
+func hardwareType(iface string) (int, error) {
+	data, err := os.ReadFile("/sys/class/net/" + iface + "/type")
+	if err != nil {
+		if _, ierr := net.InterfaceByName(iface); ierr != nil {
+			return 0, ierr
+		}
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// receiveTime returns the kernel receive stamp, or now without one.
+func receiveTime(oob []byte) time.Time {
+	msgs, err := unix.ParseSocketControlMessage(oob)
+	if err == nil {
+		for _, m := range msgs {
+			if m.Header.Level == unix.SOL_SOCKET && m.Header.Type == unix.SCM_TIMESTAMPNS && len(m.Data) >= int(unsafe.Sizeof(unix.Timespec{})) {
+				ts := (*unix.Timespec)(unsafe.Pointer(&m.Data[0]))
+				return time.Unix(ts.Unix())
+			}
+		}
+	}
+	return time.Now()
+}
+
+func htons(i uint16) uint16 {
+	return (i<<8)&0xff00 | i>>8
+}
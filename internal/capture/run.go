@@ -0,0 +1,184 @@
+//go:build linux
+
+package capture
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"genflux/internal/filter"
+	"genflux/internal/pcapio"
+	"genflux/internal/stats"
+)
+
+// Capture records cfg.Iface until ctx ends or a limit of cfg is reached,
+// noting the files it opens to log. An ended ctx stops it as a limit
+// does, not as an error.
+func Capture(ctx context.Context, cfg Config, log io.Writer) (Stats, error) {
+	var st Stats
+	if err := cfg.validate(); err != nil {
+		return st, err
+	}
+	if cfg.Snaplen == 0 {
+		cfg.Snaplen = DefaultSnaplen
+	}
+	if cfg.Format == "" {
+		cfg.Format = FormatFor(cfg.Out)
+	}
+	l, err := Listen(cfg.Iface, cfg.Promisc)
+	if err != nil {
+		return st, err
+	}
+	defer l.Close()
+	link := l.LinkType()
+	var match func([]byte) bool
+	if cfg.Filter != "" {
+		if link != layers.LinkTypeEthernet {
+			return st, fmt.Errorf("filter needs an Ethernet interface; %s carries raw IP", cfg.Iface)
+		}
+		f, err := filter.Compile(cfg.Filter)
+		if err != nil {
+			return st, err
+		}
+		match = f.Match
+	}
+
+	start := time.Now()
+	w := &rotator{cfg: cfg, opts: pcapio.WriterOptions{Snaplen: uint32(cfg.Snaplen), LinkType: link, IfName: cfg.Iface}, log: log, window: start}
+	fmt.Fprintf(log, "Capturing on %s (%s, snaplen %d)\n", cfg.Iface, link, cfg.Snaplen)
+	if err := w.next(start); err != nil {
+		return st, err
+	}
+
+	var deadline time.Time
+	if cfg.Duration > 0 {
+		deadline = start.Add(cfg.Duration)
+	}
+	var written stats.Counter
+	done := func(err error) (Stats, error) {
+		total := written.Snapshot()
+		st.Packets, st.Bytes, st.Dropped = total.Packets, total.Bytes, l.Dropped()
+		return w.finish(st, err)
+	}
+	buf := make([]byte, cfg.Snaplen)
+	for ctx.Err() == nil && (cfg.Count == 0 || written.Snapshot().Packets < cfg.Count) {
+		if !deadline.IsZero() && !time.Now().Before(deadline) {
+			break
+		}
+		n, frame, err := l.Read(buf)
+		if err != nil {
+			if err == ErrIdle {
+				// Let what is buffered reach the file.
+				if err := w.flush(); err != nil {
+					return done(err)
+				}
+				continue
+			}
+			return done(err)
+		}
+		data := buf[:n]
+		if match != nil && !match(data) {
+			st.Filtered++
+			continue
+		}
+		dir := pcapio.DirectionInbound
+		if frame.Outgoing {
+			dir = pcapio.DirectionOutbound
+		}
+		ci := gopacket.CaptureInfo{Timestamp: frame.Time, CaptureLength: n, Length: frame.Len}
+		if err := w.write(ci, data, pcapio.PacketMeta{Direction: dir}); err != nil {
+			return done(err)
+		}
+		written.Add(frame.Len)
+	}
+	return done(nil)
+}
+
+// rotator writes the capture to cfg.Out, or to numbered files when the
+// capture rotates.
+type rotator struct {
+	cfg  Config
+	opts pcapio.WriterOptions
+	log  io.Writer
+
+	file   *os.File
+	w      pcapio.Writer
+	bytes  int64
+	window time.Time
+	files  []string
+}
+
+func (r *rotator) write(ci gopacket.CaptureInfo, data []byte, meta pcapio.PacketMeta) error {
+	full := r.cfg.RotateBytes > 0 && r.bytes > 0 && r.bytes+int64(len(data)) > r.cfg.RotateBytes
+	late := r.cfg.RotateEvery > 0 && !ci.Timestamp.Before(r.window.Add(r.cfg.RotateEvery))
+	if full || late {
+		if err := r.next(ci.Timestamp); err != nil {
+			return err
+		}
+	}
+	r.bytes += int64(len(data))
+	return r.w.WritePacket(ci, data, meta)
+}
+
+// next closes the current file and opens the one for a frame at ts.
+func (r *rotator) next(ts time.Time) error {
+	if err := r.close(); err != nil {
+		return err
+	}
+	if every := r.cfg.RotateEvery; every > 0 && !ts.Before(r.window.Add(every)) {
+		r.window = r.window.Add(ts.Sub(r.window) / every * every)
+	}
+	path := r.cfg.Out
+	if r.cfg.rotates() {
+		path = r.cfg.filePath(len(r.files))
+	}
+	var out io.Writer = os.Stdout
+	if path != "-" {
+		f, err := os.Create(path)
+		if err != nil {
+			return err
+		}
+		r.file, out = f, f
+		fmt.Fprintf(r.log, "Writing %s\n", path)
+	}
+	w, err := pcapio.NewWriter(out, r.cfg.Format, r.opts)
+	if err != nil {
+		return err
+	}
+	r.w, r.bytes = w, 0
+	r.files = append(r.files, path)
+	return nil
+}
+
+func (r *rotator) flush() error {
+	return r.w.Flush()
+}
+
+func (r *rotator) close() error {
+	if r.w == nil {
+		return nil
+	}
+	err := r.w.Flush()
+	if r.file != nil {
+		if cerr := r.file.Close(); err == nil {
+			err = cerr
+		}
+	}
+	r.w, r.file = nil, nil
+	return err
+}
+
+// finish closes the last file and completes stats, keeping err when set.
+func (r *rotator) finish(stats Stats, err error) (Stats, error) {
+	if cerr := r.close(); err == nil {
+		err = cerr
+	}
+	stats.Files = r.files
+	return stats, err
+}
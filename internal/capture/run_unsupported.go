@@ -0,0 +1,14 @@
+//go:build !linux
+
+package capture
+
+import (
+	"context"
+	"errors"
+	"io"
+)
+
+func Capture(ctx context.Context, cfg Config, log io.Writer) (Stats, error) {
+	_, _, _ = ctx, cfg, log
+	return Stats{}, errors.New("capture is only supported on linux (requires AF_PACKET raw sockets)")
+}
@@ -0,0 +1,83 @@
+// Package clock is the time source of replay pacing. The system clock is
+// the one that sends packets; a virtual clock stands in for it where time
+// is only simulated, as in dry runs and tests, so hours of schedule pass
+// at once. Generation has no use for one: pcapgen derives every timestamp,
+// the traffic model's day curve included, from Config.StartTime.
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Clock tells the time and waits for it.
+type Clock interface {
+	Now() time.Time
+	// WaitUntil blocks until the clock reads t or stop is closed and
+	// reports whether t was reached.
+	WaitUntil(t time.Time, stop <-chan struct{}) bool
+}
+
+// Real is the system clock.
+var Real Clock = realClock{}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time { return time.Now() }
+
+func (realClock) WaitUntil(t time.Time, stop <-chan struct{}) bool {
+	d := time.Until(t)
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-stop:
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// Virtual is a clock that only moves when it is waited on or advanced:
+// WaitUntil jumps straight to the time waited for. It is safe for
+// concurrent use.
+type Virtual struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+// NewVirtual returns a virtual clock reading start.
+func NewVirtual(start time.Time) *Virtual {
+	return &Virtual{now: start}
+}
+
+func (v *Virtual) Now() time.Time {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.now
+}
+
+// WaitUntil moves the clock on to t, unless stop is closed. A t in the
+// past leaves the clock where it is.
+func (v *Virtual) WaitUntil(t time.Time, stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return false
+	default:
+	}
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if t.After(v.now) {
+		v.now = t
+	}
+	return true
+}
+
+// Advance moves the clock on by d.
+func (v *Virtual) Advance(d time.Duration) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.now = v.now.Add(d)
+}
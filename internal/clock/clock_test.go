@@ -0,0 +1,42 @@
+package clock
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVirtual(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	v := NewVirtual(start)
+
+	// A wait jumps to the time waited for.
+	if !v.WaitUntil(start.Add(time.Hour), nil) {
+		t.Fatal("wait for an hour on did not reach it")
+	}
+	if got, want := v.Now(), start.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("after the wait the clock reads %v, want %v", got, want)
+	}
+
+	// A time in the past leaves the clock where it is.
+	if !v.WaitUntil(start, nil) {
+		t.Error("wait for the past did not return at once")
+	}
+	if got, want := v.Now(), start.Add(time.Hour); !got.Equal(want) {
+		t.Errorf("after waiting for the past the clock reads %v, want %v", got, want)
+	}
+
+	v.Advance(time.Minute)
+	if got, want := v.Now(), start.Add(time.Hour+time.Minute); !got.Equal(want) {
+		t.Errorf("after advancing the clock reads %v, want %v", got, want)
+	}
+
+	// A closed stop ends the wait without moving the clock.
+	stop := make(chan struct{})
+	close(stop)
+	if v.WaitUntil(start.Add(24*time.Hour), stop) {
+		t.Error("wait with stop closed reported the time reached")
+	}
+	if got, want := v.Now(), start.Add(time.Hour+time.Minute); !got.Equal(want) {
+		t.Errorf("after a stopped wait the clock reads %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,469 @@
+// Package filter selects packets by capture filter expressions in the
+// tcpdump (pcap-filter) syntax, without libpcap:
+//
+//	tcp and port 443
+//	src net 10.0.0.0/8 and not dst port 53
+//	udp dst port domain or ntp
+//	vlan 100 and (icmp or icmp6)
+//
+// It covers the protocol, host, net, port and length primitives, with
+// and/or/not (also &&, ||, !) and parentheses. Only the outer IP header of
+// a tunnel is matched, as by tcpdump; VLAN tags are looked through.
+package filter
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Filter is a compiled expression. Match reuses decoding state, so a
+// Filter must not be shared between goroutines; compile one per user.
+type Filter struct {
+	expr  string
+	match matcher
+	pkt   packet
+	eth   layers.Ethernet
+	dot1q layers.Dot1Q
+	arp   layers.ARP
+	ip4   layers.IPv4
+	ip6   layers.IPv6
+	tcp   layers.TCP
+	udp   layers.UDP
+}
+
+// Compile parses expr. An empty expression matches every packet.
+func Compile(expr string) (*Filter, error) {
+	f := &Filter{expr: strings.TrimSpace(expr)}
+	if f.expr == "" {
+		f.match = func(*packet) bool { return true }
+		return f, nil
+	}
+	p := &parser{tokens: tokenize(f.expr)}
+	m, err := p.expr()
+	if err == nil && p.pos < len(p.tokens) {
+		err = fmt.Errorf("unexpected %q", p.tokens[p.pos])
+	}
+	if err != nil {
+		return nil, fmt.Errorf("filter %q: %v", f.expr, err)
+	}
+	f.match = m
+	return f, nil
+}
+
+func (f *Filter) String() string {
+	return f.expr
+}
+
+// Match reports whether the Ethernet frame data passes the filter.
+func (f *Filter) Match(data []byte) bool {
+	f.decode(data)
+	return f.match(&f.pkt)
+}
+
+// packet is what the primitives look at.
+type packet struct {
+	length         int
+	srcMAC, dstMAC net.HardwareAddr
+	vlans          []uint16
+	// ipv is 4 or 6 once an IP header (or ARP, whose addresses host and
+	// net match) is found; proto is the protocol it carries.
+	ipv      int
+	arp      bool
+	src, dst net.IP
+	proto    layers.IPProtocol
+	// ports is set for the first (or only) fragment of TCP and UDP.
+	ports            bool
+	srcPort, dstPort uint16
+}
+
+func (f *Filter) decode(data []byte) {
+	p := &f.pkt
+	*p = packet{length: len(data), vlans: p.vlans[:0]}
+	typ := layers.LayerTypeEthernet
+	for len(data) > 0 {
+		var layer gopacket.DecodingLayer
+		switch typ {
+		case layers.LayerTypeEthernet:
+			layer = &f.eth
+		case layers.LayerTypeDot1Q:
+			layer = &f.dot1q
+		case layers.LayerTypeARP:
+			layer = &f.arp
+		case layers.LayerTypeIPv4:
+			layer = &f.ip4
+		case layers.LayerTypeIPv6:
+			layer = &f.ip6
+		case layers.LayerTypeTCP:
+			layer = &f.tcp
+		case layers.LayerTypeUDP:
+			layer = &f.udp
+		}
+		if layer == nil || p.ipv != 0 && (typ == layers.LayerTypeIPv4 || typ == layers.LayerTypeIPv6) {
+			return
+		}
+		if layer.DecodeFromBytes(data, gopacket.NilDecodeFeedback) != nil {
+			return
+		}
+		switch typ {
+		case layers.LayerTypeEthernet:
+			p.srcMAC, p.dstMAC = f.eth.SrcMAC, f.eth.DstMAC
+		case layers.LayerTypeDot1Q:
+			p.vlans = append(p.vlans, f.dot1q.VLANIdentifier)
+		case layers.LayerTypeARP:
+			p.ipv, p.arp = 4, true
+			p.src, p.dst = f.arp.SourceProtAddress, f.arp.DstProtAddress
+		case layers.LayerTypeIPv4:
+			p.ipv, p.src, p.dst, p.proto = 4, f.ip4.SrcIP, f.ip4.DstIP, f.ip4.Protocol
+		case layers.LayerTypeIPv6:
+			p.ipv, p.src, p.dst, p.proto = 6, f.ip6.SrcIP, f.ip6.DstIP, f.ip6.NextHeader
+		case layers.LayerTypeTCP:
+			p.ports, p.proto = true, layers.IPProtocolTCP
+			p.srcPort, p.dstPort = uint16(f.tcp.SrcPort), uint16(f.tcp.DstPort)
+			return
+		case layers.LayerTypeUDP:
+			p.ports, p.proto = true, layers.IPProtocolUDP
+			p.srcPort, p.dstPort = uint16(f.udp.SrcPort), uint16(f.udp.DstPort)
+			return
+		}
+		typ, data = layer.NextLayerType(), layer.LayerPayload()
+	}
+}
+
+type matcher func(*packet) bool
+
+// protocols are the names that stand alone as primitives and qualify
+// host, net and port primitives.
+var protocols = map[string]matcher{
+	"ether": func(p *packet) bool { return p.srcMAC != nil },
+	"arp":   func(p *packet) bool { return p.arp },
+	"ip":    func(p *packet) bool { return p.ipv == 4 && !p.arp },
+	"ip6":   func(p *packet) bool { return p.ipv == 6 },
+	"tcp":   ipProto(layers.IPProtocolTCP),
+	"udp":   ipProto(layers.IPProtocolUDP),
+	"icmp":  func(p *packet) bool { return p.ipv == 4 && !p.arp && p.proto == layers.IPProtocolICMPv4 },
+	"icmp6": func(p *packet) bool { return p.ipv == 6 && p.proto == layers.IPProtocolICMPv6 },
+}
+
+func ipProto(proto layers.IPProtocol) matcher {
+	return func(p *packet) bool { return p.ipv != 0 && !p.arp && p.proto == proto }
+}
+
+// protoNumbers name the values of "proto".
+var protoNumbers = map[string]layers.IPProtocol{
+	"icmp": 1, "igmp": 2, "tcp": 6, "udp": 17, "gre": 47, "esp": 50, "ah": 51, "icmp6": 58, "sctp": 132,
+}
+
+// portNames name well-known ports, as in /etc/services.
+var portNames = map[string]uint16{
+	"ftp-data": 20, "ftp": 21, "ssh": 22, "telnet": 23, "smtp": 25, "domain": 53,
+	"bootps": 67, "bootpc": 68, "http": 80, "pop3": 110, "ntp": 123, "imap": 143,
+	"snmp": 161, "ldap": 389, "https": 443, "microsoft-ds": 445, "isakmp": 500,
+	"syslog": 514, "mysql": 3306, "ms-wbt-server": 3389,
+}
+
+// qualifiers are the keywords before a value. A value after and/or with
+// none of its own takes those of the primitive before it, as in
+// "port 80 or 443".
+type qualifiers struct {
+	proto string
+	dir   string
+	kind  string
+}
+
+type parser struct {
+	tokens []string
+	pos    int
+	last   qualifiers
+}
+
+func tokenize(expr string) []string {
+	var tokens []string
+	for i := 0; i < len(expr); {
+		switch c := expr[i]; {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case c == '(' || c == ')' || c == '!':
+			tokens = append(tokens, expr[i:i+1])
+			i++
+		case strings.HasPrefix(expr[i:], "&&") || strings.HasPrefix(expr[i:], "||"):
+			tokens = append(tokens, expr[i:i+2])
+			i += 2
+		default:
+			j := i
+			for j < len(expr) && !strings.ContainsRune(" \t\n()!&|", rune(expr[j])) {
+				j++
+			}
+			if j == i {
+				// A lone & or |.
+				j++
+			}
+			tokens = append(tokens, expr[i:j])
+			i = j
+		}
+	}
+	return tokens
+}
+
+func (p *parser) peek() string {
+	if p.pos < len(p.tokens) {
+		return p.tokens[p.pos]
+	}
+	return ""
+}
+
+func (p *parser) next() string {
+	tok := p.peek()
+	if tok != "" {
+		p.pos++
+	}
+	return tok
+}
+
+// expr parses a chain of primitives joined by and/or which, as in tcpdump,
+// bind equally from left to right: "a or b and c" is "(a or b) and c".
+func (p *parser) expr() (matcher, error) {
+	m, err := p.unary()
+	for err == nil {
+		op := p.peek()
+		if op != "and" && op != "&&" && op != "or" && op != "||" {
+			break
+		}
+		p.next()
+		var r matcher
+		if r, err = p.unary(); err == nil {
+			l := m
+			if op == "and" || op == "&&" {
+				m = func(pk *packet) bool { return l(pk) && r(pk) }
+			} else {
+				m = func(pk *packet) bool { return l(pk) || r(pk) }
+			}
+		}
+	}
+	return m, err
+}
+
+func (p *parser) unary() (matcher, error) {
+	switch p.peek() {
+	case "not", "!":
+		p.next()
+		m, err := p.unary()
+		if err != nil {
+			return nil, err
+		}
+		return func(pk *packet) bool { return !m(pk) }, nil
+	case "(":
+		p.next()
+		m, err := p.expr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, fmt.Errorf("missing )")
+		}
+		return m, nil
+	case "":
+		return nil, fmt.Errorf("unexpected end")
+	}
+	return p.primitive()
+}
+
+func (p *parser) primitive() (matcher, error) {
+	switch tok := p.peek(); tok {
+	case "less", "greater":
+		p.next()
+		n, err := strconv.Atoi(p.next())
+		if err != nil {
+			return nil, fmt.Errorf("%s needs a length", tok)
+		}
+		if tok == "less" {
+			return func(pk *packet) bool { return pk.length <= n }, nil
+		}
+		return func(pk *packet) bool { return pk.length >= n }, nil
+	case "vlan":
+		p.next()
+		id, err := strconv.ParseUint(p.peek(), 10, 12)
+		if err != nil {
+			return func(pk *packet) bool { return len(pk.vlans) > 0 }, nil
+		}
+		p.next()
+		return func(pk *packet) bool {
+			for _, v := range pk.vlans {
+				if v == uint16(id) {
+					return true
+				}
+			}
+			return false
+		}, nil
+	}
+
+	var q qualifiers
+	if _, ok := protocols[p.peek()]; ok {
+		q.proto = p.next()
+	}
+	switch p.peek() {
+	case "src", "dst":
+		q.dir = p.next()
+		if j := p.peek(); (j == "or" || j == "and") && p.pos+1 < len(p.tokens) && p.tokens[p.pos+1] == "dst" && q.dir == "src" {
+			q.dir = "src " + j + " dst"
+			p.pos += 2
+		}
+	}
+	switch p.peek() {
+	case "host", "net", "port", "portrange", "proto":
+		q.kind = p.next()
+	}
+	if q == (qualifiers{}) {
+		if !isValue(p.peek()) {
+			return nil, fmt.Errorf("unexpected %q", p.peek())
+		}
+		// A bare value, as in "host a or b".
+		q = p.last
+		if q.kind == "" {
+			q.kind = "host"
+		}
+	} else if q.dir == "" && q.kind == "" {
+		if q.proto == "ether" {
+			return nil, fmt.Errorf("ether needs host, src or dst")
+		}
+		return protocols[q.proto], nil
+	}
+	if q.kind == "" {
+		q.kind = "host"
+	}
+	value := p.next()
+	if _, name := protoNumbers[value]; !isValue(value) && !(q.kind == "proto" && name) {
+		return nil, fmt.Errorf("%s needs a value", q.kind)
+	}
+	p.last = q
+	return q.build(value)
+}
+
+// isValue tells values from keywords and operators.
+func isValue(tok string) bool {
+	switch tok {
+	case "", "(", ")", "!", "&&", "||", "and", "or", "not", "src", "dst", "host", "net", "port", "portrange", "proto", "less", "greater", "vlan":
+		return false
+	}
+	_, proto := protocols[tok]
+	return !proto
+}
+
+// build returns the matcher of q applied to value.
+func (q qualifiers) build(value string) (matcher, error) {
+	dir := q.dir
+	pair := func(src, dst bool) bool {
+		switch dir {
+		case "src":
+			return src
+		case "dst":
+			return dst
+		case "src and dst":
+			return src && dst
+		}
+		return src || dst
+	}
+	var m matcher
+	switch q.kind {
+	case "host":
+		if q.proto == "ether" {
+			mac, err := net.ParseMAC(value)
+			if err != nil {
+				return nil, err
+			}
+			return func(pk *packet) bool {
+				return pk.srcMAC != nil && pair(string(pk.srcMAC) == string(mac), string(pk.dstMAC) == string(mac))
+			}, nil
+		}
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid host %q", value)
+		}
+		m = func(pk *packet) bool { return pk.ipv != 0 && pair(ip.Equal(pk.src), ip.Equal(pk.dst)) }
+	case "net":
+		n, err := parseNet(value)
+		if err != nil {
+			return nil, err
+		}
+		m = func(pk *packet) bool { return pk.ipv != 0 && pair(n.Contains(pk.src), n.Contains(pk.dst)) }
+	case "port", "portrange":
+		lo, hi, err := parsePorts(value, q.kind == "portrange")
+		if err != nil {
+			return nil, err
+		}
+		in := func(port uint16) bool { return port >= lo && port <= hi }
+		m = func(pk *packet) bool { return pk.ports && pair(in(pk.srcPort), in(pk.dstPort)) }
+	case "proto":
+		if dir != "" {
+			return nil, fmt.Errorf("proto takes no direction")
+		}
+		proto, ok := protoNumbers[value]
+		if !ok {
+			n, err := strconv.ParseUint(value, 10, 8)
+			if err != nil {
+				return nil, fmt.Errorf("invalid protocol %q", value)
+			}
+			proto = layers.IPProtocol(n)
+		}
+		m = ipProto(proto)
+	}
+	if q.proto == "" || q.proto == "ether" {
+		return m, nil
+	}
+	proto := protocols[q.proto]
+	return func(pk *packet) bool { return proto(pk) && m(pk) }, nil
+}
+
+// parseNet parses a CIDR, or an address standing for itself alone.
+func parseNet(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, n, err := net.ParseCIDR(value)
+		return n, err
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid net %q", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// parsePorts parses a port, or with ranges set a range lo-hi.
+func parsePorts(value string, ranges bool) (uint16, uint16, error) {
+	port := func(s string) (uint16, error) {
+		if n, ok := portNames[s]; ok {
+			return n, nil
+		}
+		n, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return 0, fmt.Errorf("invalid port %q", s)
+		}
+		return uint16(n), nil
+	}
+	if !ranges {
+		n, err := port(value)
+		return n, n, err
+	}
+	a, b, ok := strings.Cut(value, "-")
+	if !ok {
+		return 0, 0, fmt.Errorf("invalid port range %q (want lo-hi)", value)
+	}
+	lo, err := port(a)
+	if err != nil {
+		return 0, 0, err
+	}
+	hi, err := port(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	if lo > hi {
+		return 0, 0, fmt.Errorf("invalid port range %q", value)
+	}
+	return lo, hi, nil
+}
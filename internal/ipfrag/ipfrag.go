@@ -0,0 +1,217 @@
+// Package ipfrag splits the IP packet of an Ethernet frame into fragments
+// that fit an MTU, the way a host fragments a datagram too large for its
+// link. Generation uses it to write packets over the MTU and replay to
+// send them.
+package ipfrag
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// minFrame is the shortest Ethernet frame, without FCS; no fragment but
+// the only one is left shorter.
+const minFrame = 60
+
+// fragmentHeaderLen is the length of the IPv6 Fragment header.
+const fragmentHeaderLen = 8
+
+// Headers returns the length of what precedes the IP header of frame, an
+// Ethernet header and any VLAN tags and MPLS labels, and of the IP header
+// every fragment of it carries: IPv4's own, or IPv6's with a Fragment
+// header.
+func Headers(frame []byte) (link, ip int, err error) {
+	if len(frame) < 14 {
+		return 0, 0, errors.New("frame shorter than an Ethernet header")
+	}
+	off := 12
+	etherType := binary.BigEndian.Uint16(frame[off:])
+	for (etherType == 0x8100 || etherType == 0x88a8) && len(frame) >= off+6 {
+		off += 4
+		etherType = binary.BigEndian.Uint16(frame[off:])
+	}
+	link = off + 2
+	if etherType == 0x8847 || etherType == 0x8848 {
+		// Below the bottom of the label stack the version tells the
+		// packet's protocol.
+		for len(frame) >= link+4 {
+			link += 4
+			if frame[link-2]&1 != 0 {
+				break
+			}
+		}
+		etherType = 0
+		if len(frame) > link {
+			switch frame[link] >> 4 {
+			case 4:
+				etherType = 0x0800
+			case 6:
+				etherType = 0x86dd
+			}
+		}
+	}
+	switch {
+	case etherType == 0x0800 && len(frame) >= link+20 && frame[link]>>4 == 4:
+		ihl := int(frame[link]&0x0f) * 4
+		if ihl < 20 || len(frame) < link+ihl {
+			return 0, 0, errors.New("bad IPv4 header length")
+		}
+		return link, ihl, nil
+	case etherType == 0x86dd && len(frame) >= link+40 && frame[link]>>4 == 6:
+		switch frame[link+6] {
+		case 0, 43, 44:
+			// Hop-by-hop options and routing headers would have to stay
+			// in every fragment, and a fragment cannot be split again.
+			return 0, 0, fmt.Errorf("IPv6 next header %d cannot be fragmented here", frame[link+6])
+		}
+		return link, 40 + fragmentHeaderLen, nil
+	default:
+		return 0, 0, errors.New("frame does not carry IPv4 or IPv6")
+	}
+}
+
+// payloadLen is the length of the IP payload of frame, the part split
+// over the fragments.
+func payloadLen(frame []byte, link int) int {
+	if frame[link]>>4 == 6 {
+		return len(frame) - link - 40
+	}
+	return len(frame) - link - int(frame[link]&0x0f)*4
+}
+
+// Count returns the fewest fragments the IP packet of frame is split into
+// to fit mtu: 1 if it fits already.
+func Count(frame []byte, mtu int) (int, error) {
+	link, ip, err := Headers(frame)
+	if err != nil {
+		return 0, err
+	}
+	if len(frame)-link <= mtu {
+		return 1, nil
+	}
+	per := (mtu - ip) &^ 7
+	if per <= 0 {
+		return 0, fmt.Errorf("MTU %d leaves no room for fragment data", mtu)
+	}
+	data := payloadLen(frame, link)
+	return (data + per - 1) / per, nil
+}
+
+// Split splits the IP packet of frame into n fragments of at most mtu
+// bytes, each behind a copy of the frame's link header. All but the last
+// carry as much as fits, the last at least enough for a minimum-size
+// frame, so the fragments together are n-1 link and IP headers longer
+// than frame (an IPv6 Fragment header more each). id identifies the
+// datagram: an IPv4 packet keeps its own identification unless it is 0.
+// Don't Fragment is cleared; a packet that is a fragment already is split
+// further.
+func Split(frame []byte, n, mtu int, id uint32) ([][]byte, error) {
+	link, ip, err := Headers(frame)
+	if err != nil {
+		return nil, err
+	}
+	if n <= 1 {
+		return [][]byte{frame}, nil
+	}
+	v6 := frame[link]>>4 == 6
+	hdr := ip
+	if v6 {
+		hdr = 40
+	}
+	data := frame[link+hdr:]
+	per := (mtu - ip) &^ 7
+	if per <= 0 {
+		return nil, fmt.Errorf("MTU %d leaves no room for fragment data", mtu)
+	}
+	sizes := make([]int, n)
+	for i := range sizes[:n-1] {
+		sizes[i] = per
+	}
+	last := len(data) - (n-1)*per
+	if last > mtu-ip {
+		return nil, fmt.Errorf("%d bytes do not fit %d fragments of MTU %d", len(data), n, mtu)
+	}
+	// Take what the last fragment is short of from the others, 8 bytes at
+	// a time, so that every offset stays a multiple of 8.
+	need := max(minFrame-link-ip, 8) - last
+	for i := 0; need > 0 && i < n-1; i++ {
+		take := min((need+7)&^7, sizes[i]-8)
+		sizes[i] -= take
+		last += take
+		need -= take
+	}
+	if need > 0 {
+		return nil, fmt.Errorf("%d bytes are too few for %d fragments", len(data), n)
+	}
+	sizes[n-1] = last
+
+	frags := make([][]byte, n)
+	pos := 0
+	for i, size := range sizes {
+		f := make([]byte, 0, link+ip+size)
+		f = append(f, frame[:link]...)
+		more := i < n-1
+		if v6 {
+			f = appendIPv6(f, frame[link:link+40], pos, size, more, id)
+		} else {
+			f = appendIPv4(f, frame[link:link+hdr], pos, size, more, id)
+		}
+		frags[i] = append(f, data[pos:pos+size]...)
+		pos += size
+	}
+	return frags, nil
+}
+
+// appendIPv4 appends the header of the fragment of h's packet at offset
+// pos of its payload.
+func appendIPv4(f, h []byte, pos, size int, more bool, id uint32) []byte {
+	start := len(f)
+	f = append(f, h...)
+	hdr := f[start:]
+	binary.BigEndian.PutUint16(hdr[2:], uint16(len(h)+size))
+	if binary.BigEndian.Uint16(hdr[4:]) == 0 {
+		binary.BigEndian.PutUint16(hdr[4:], uint16(id))
+	}
+	flags := binary.BigEndian.Uint16(h[6:])
+	offset := flags&0x1fff + uint16(pos/8)
+	// The last fragment keeps the packet's own More Fragments flag.
+	mf := flags & 0x2000
+	if more {
+		mf = 0x2000
+	}
+	binary.BigEndian.PutUint16(hdr[6:], mf|offset)
+	hdr[10], hdr[11] = 0, 0
+	binary.BigEndian.PutUint16(hdr[10:], checksum(hdr))
+	return f
+}
+
+// appendIPv6 appends the fixed header h and a Fragment header for the
+// fragment of its packet at offset pos of its payload.
+func appendIPv6(f, h []byte, pos, size int, more bool, id uint32) []byte {
+	start := len(f)
+	f = append(f, h...)
+	hdr := f[start:]
+	binary.BigEndian.PutUint16(hdr[4:], uint16(fragmentHeaderLen+size))
+	next := hdr[6]
+	hdr[6] = 44
+	offset := uint16(pos/8) << 3
+	if more {
+		offset |= 1
+	}
+	f = append(f, next, 0)
+	f = binary.BigEndian.AppendUint16(f, offset)
+	return binary.BigEndian.AppendUint32(f, id)
+}
+
+// checksum is the Internet checksum of an IPv4 header.
+func checksum(h []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(h); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(h[i:]))
+	}
+	for sum > 0xffff {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
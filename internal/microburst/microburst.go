@@ -0,0 +1,111 @@
+// Package microburst squeezes stretches of smooth traffic into bursts a
+// few milliseconds long at line rate, each followed by the lull the burst
+// left behind. The average rate is kept; only timing changes, so both
+// generation and replay pacing can run their packets through it.
+package microburst
+
+import (
+	"errors"
+	"math/rand"
+	"time"
+)
+
+// wireOverhead is what Ethernet adds to a captured frame on the wire:
+// FCS, preamble and the inter-frame gap.
+const wireOverhead = 4 + 8 + 12
+
+// Config describes the bursts; the zero value has none.
+type Config struct {
+	// Rate is the mean number of bursts per second. Bursts come at random
+	// (a Poisson process), so analytics cannot lock onto a period.
+	Rate float64
+	// Length is the longest a burst lasts.
+	Length time.Duration
+	// LineRate is the rate in Mbps of the link the burst saturates.
+	LineRate float64
+}
+
+func (c Config) Enabled() bool {
+	return c.Rate > 0
+}
+
+func (c Config) Validate() error {
+	switch {
+	case c.Rate < 0:
+		return errors.New("microburst rate must be >= 0")
+	case !c.Enabled():
+		return nil
+	case c.Length <= 0:
+		return errors.New("microburst length must be > 0")
+	case c.LineRate <= 0:
+		return errors.New("microburst line rate must be > 0")
+	case c.Length.Seconds()*c.Rate >= 0.5:
+		return errors.New("microbursts must cover less than half of the time; lower the rate or length")
+	}
+	return nil
+}
+
+// Shaper moves packets into bursts as they come. A burst starting at T
+// takes the packets due in the half of the mean gap after T and sends them
+// back to back from T until Length is used up; the packets after it keep
+// their times. A nil Shaper leaves every time as it is.
+type Shaper struct {
+	cfg Config
+	r   *rand.Rand
+	// next is when the next burst starts. While one is open, end is the
+	// end of the stretch it draws from, cursor when its next packet goes
+	// out and limit when it must stop.
+	next, end, cursor, limit time.Time
+	last                     time.Time
+}
+
+// New returns the shaper of traffic starting at start, or nil when cfg
+// has no bursts. r places the bursts.
+func New(cfg Config, r *rand.Rand, start time.Time) *Shaper {
+	if !cfg.Enabled() {
+		return nil
+	}
+	s := &Shaper{cfg: cfg, r: r, next: start}
+	s.next = s.next.Add(s.gap())
+	return s
+}
+
+// gap draws the time from one burst to the next.
+func (s *Shaper) gap() time.Duration {
+	return time.Duration(s.r.ExpFloat64() / s.cfg.Rate * float64(time.Second))
+}
+
+// At returns when a frame of frameLen bytes due at t goes out. Times must
+// come in order; the result never goes back either.
+func (s *Shaper) At(t time.Time, frameLen int) time.Time {
+	if s == nil {
+		return t
+	}
+	for {
+		if s.end.IsZero() {
+			if t.Before(s.next) {
+				break
+			}
+			s.cursor, s.limit = s.next, s.next.Add(s.cfg.Length)
+			s.end = s.next.Add(time.Duration(float64(time.Second) / (2 * s.cfg.Rate)))
+		}
+		tx := time.Duration(float64((frameLen+wireOverhead)*8) / (s.cfg.LineRate * 1e6) * float64(time.Second))
+		if t.Before(s.end) && !s.cursor.Add(tx).After(s.limit) {
+			t = s.cursor
+			s.cursor = s.cursor.Add(tx)
+			break
+		}
+		// The burst is full or has drawn its whole stretch. The next one
+		// comes no sooner than the end of that stretch.
+		s.next = s.next.Add(s.gap())
+		if s.next.Before(s.end) {
+			s.next = s.end
+		}
+		s.end = time.Time{}
+	}
+	if t.Before(s.last) {
+		t = s.last
+	}
+	s.last = t
+	return t
+}
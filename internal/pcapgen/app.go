@@ -2,6 +2,7 @@ package pcapgen
 
 import (
 	"bytes"
+	"encoding/binary"
 	"math/rand"
 
 	"github.com/google/gopacket/layers"
@@ -10,28 +11,37 @@ import (
 type appKind string
 
 const (
-	appHTTP  appKind = "http"
-	appHTTPS appKind = "https"
-	appDNS   appKind = "dns"
-	appQUIC  appKind = "quic"
-	appNTP   appKind = "ntp"
-	appSTUN  appKind = "stun"
-	appIPSEC appKind = "ipsec"
-	appSSDP  appKind = "ssdp"
-	appMDNS  appKind = "mdns"
-	appSSH   appKind = "ssh"
-	appRDP   appKind = "rdp"
-	appSMB   appKind = "smb"
-	appDB    appKind = "db"
-	appOther appKind = "other"
+	appHTTP   appKind = "http"
+	appHTTPS  appKind = "https"
+	appDNS    appKind = "dns"
+	appQUIC   appKind = "quic"
+	appNTP    appKind = "ntp"
+	appSTUN   appKind = "stun"
+	appIPSEC  appKind = "ipsec"
+	appSSDP   appKind = "ssdp"
+	appMDNS   appKind = "mdns"
+	appSSH    appKind = "ssh"
+	appRDP    appKind = "rdp"
+	appSMB    appKind = "smb"
+	appDB     appKind = "db"
+	appBACnet appKind = "bacnet"
+	appS7comm appKind = "s7comm"
+	appOther  appKind = "other"
+	appDoT    appKind = "dot"
+	appDoH    appKind = "doh"
 )
 
-func buildAppPayload(r *rand.Rand, plan PacketPlan, isResponse bool, payloadLen int) []byte {
+func buildAppPayload(r *rand.Rand, plan PacketPlan, isResponse bool, payloadLen int, flow *flowContext) []byte {
 	if payloadLen <= 0 {
 		return nil
 	}
 	app := identifyApp(plan)
-	template := appTemplate(app, isResponse)
+	var template []byte
+	if flow != nil {
+		template = flow.payload(app)
+	} else {
+		template = appTemplate(app, isResponse)
+	}
 	if len(template) == 0 {
 		return nil
 	}
@@ -43,10 +53,23 @@ func buildAppPayload(r *rand.Rand, plan PacketPlan, isResponse bool, payloadLen
 	if _, err := r.Read(payload[len(template):]); err != nil {
 		return template
 	}
+	switch app {
+	case appBACnet, appS7comm:
+		// The BVLC and TPKT headers both carry the message length at
+		// offset 2; keep it in step with the padded payload.
+		binary.BigEndian.PutUint16(payload[2:4], uint16(payloadLen))
+	case appDoT, appDoH:
+		if payload[0] == tlsAppData[0] {
+			binary.BigEndian.PutUint16(payload[3:5], uint16(payloadLen-len(tlsAppData)))
+		}
+	}
 	return payload
 }
 
 func identifyApp(plan PacketPlan) appKind {
+	if plan.encryptedDNS != "" {
+		return plan.encryptedDNS
+	}
 	switch plan.Proto {
 	case layers.IPProtocolUDP:
 		switch plan.DstPort {
@@ -64,6 +87,8 @@ func identifyApp(plan PacketPlan) appKind {
 			return appSSDP
 		case 5353:
 			return appMDNS
+		case 47808:
+			return appBACnet
 		default:
 			return appOther
 		}
@@ -81,6 +106,8 @@ func identifyApp(plan PacketPlan) appKind {
 			return appSMB
 		case 3306, 5432, 6379:
 			return appDB
+		case 102:
+			return appS7comm
 		default:
 			return appOther
 		}
@@ -128,6 +155,22 @@ func appTemplate(app appKind, isResponse bool) []byte {
 		return []byte{0xfe, 0x53, 0x4d, 0x42, 0x40, 0x00, 0x00, 0x00}
 	case appDB:
 		return []byte("SELECT 1;")
+	case appBACnet:
+		// BVLC Original-Unicast-NPDU carrying ReadProperty of
+		// analog-input 0 present-value, or its ComplexACK with 1.0.
+		if isResponse {
+			return []byte{0x81, 0x0a, 0x00, 0x16, 0x01, 0x00, 0x30, 0x01, 0x0c, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x19, 0x55, 0x3e, 0x44, 0x3f, 0x80, 0x00, 0x00, 0x3f}
+		}
+		return []byte{0x81, 0x0a, 0x00, 0x11, 0x01, 0x04, 0x00, 0x05, 0x01, 0x0c, 0x0c, 0x00, 0x00, 0x00, 0x00, 0x19, 0x55}
+	case appS7comm:
+		// TPKT + COTP data + S7 Job reading one byte of DB1, or its
+		// Ack_Data.
+		if isResponse {
+			return []byte{0x03, 0x00, 0x00, 0x1a, 0x02, 0xf0, 0x80, 0x32, 0x03, 0x00, 0x00, 0x00, 0x01, 0x00, 0x02, 0x00, 0x05, 0x00, 0x00, 0x04, 0x01, 0xff, 0x04, 0x00, 0x08, 0x2a}
+		}
+		return []byte{0x03, 0x00, 0x00, 0x1f, 0x02, 0xf0, 0x80, 0x32, 0x01, 0x00, 0x00, 0x00, 0x01, 0x00, 0x0e, 0x00, 0x00, 0x04, 0x01, 0x12, 0x0a, 0x10, 0x02, 0x00, 0x01, 0x00, 0x01, 0x84, 0x00, 0x00, 0x00}
+	case appDoT, appDoH:
+		return tlsAppData
 	default:
 		return nil
 	}
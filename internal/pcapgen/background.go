@@ -0,0 +1,343 @@
+package pcapgen
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"genflux/internal/pcapio"
+)
+
+// Background is a kind of link-local chatter that the internal hosts keep
+// up whatever else they do. It is addressed to each host's gateway, the
+// .254 of its /24, whose MAC is the gateway MAC when one is set.
+type Background string
+
+const (
+	// BackgroundARP has every host resolve its gateway about once a
+	// minute, and the gateway answer.
+	BackgroundARP Background = "arp"
+	// BackgroundDHCP has every host renew its lease with the gateway
+	// about every ten minutes; one renewal in four is a full
+	// discover-offer-request-ack exchange, as after a reboot.
+	BackgroundDHCP Background = "dhcp"
+	// BackgroundNDP has every host solicit its router's link-layer
+	// address from its IPv6 link-local address about every 30 seconds.
+	BackgroundNDP Background = "ndp"
+)
+
+// backgroundKinds lists the kinds in the order their random streams are
+// numbered.
+var backgroundKinds = []Background{BackgroundARP, BackgroundDHCP, BackgroundNDP}
+
+// interval is how often a host chatters, on average.
+func (b Background) interval() time.Duration {
+	switch b {
+	case BackgroundARP:
+		return time.Minute
+	case BackgroundDHCP:
+		return 10 * time.Minute
+	default:
+		return 30 * time.Second
+	}
+}
+
+// ParseBackground parses a list of chatter kinds such as "arp,dhcp".
+func ParseBackground(value string) ([]Background, error) {
+	var out []Background
+	for _, part := range strings.Split(value, ",") {
+		b := Background(strings.ToLower(strings.TrimSpace(part)))
+		switch b {
+		case "":
+			continue
+		case BackgroundARP, BackgroundDHCP, BackgroundNDP:
+			out = append(out, b)
+		default:
+			return nil, fmt.Errorf("unknown background %q (want arp|dhcp|ndp)", part)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("empty background list")
+	}
+	return out, nil
+}
+
+func validateBackground(kinds []Background) error {
+	for _, b := range kinds {
+		if !hasBackground(backgroundKinds, b) {
+			return fmt.Errorf("unknown background %q (want arp|dhcp|ndp)", b)
+		}
+	}
+	return nil
+}
+
+// planBackground lays out the chatter of every internal host over the
+// capture: at random phases, then on average once per interval.
+func planBackground(cfg Config, fileSeed int64, start time.Time, duration time.Duration, internal hostPool) (noisePlan, error) {
+	var plan noisePlan
+	if len(cfg.Background) == 0 || duration <= 0 {
+		return plan, nil
+	}
+	// Every host keeps up each kind of chatter on its own, from a stream
+	// of its own.
+	open := func() []noiseSource {
+		c := &chatter{cfg: &cfg, internal: internal, start: start, duration: duration}
+		var sources []noiseSource
+		for i := 0; i < internal.count; i++ {
+			for k, kind := range backgroundKinds {
+				if !hasBackground(cfg.Background, kind) {
+					continue
+				}
+				src := &chatterSource{c: c, idx: i, kind: kind}
+				src.r = streamBackground.rand(fileSeed, int64(i)*int64(len(backgroundKinds))+int64(k))
+				src.off = time.Duration(src.r.Int63n(int64(kind.interval())))
+				sources = append(sources, src)
+			}
+		}
+		return sources
+	}
+	for _, src := range open() {
+		bytes, _, err := drain(cfg, src)
+		if err != nil {
+			return plan, err
+		}
+		plan.bytes += bytes
+	}
+	plan.sources = []func() []noiseSource{open}
+	return plan, nil
+}
+
+func hasBackground(kinds []Background, kind Background) bool {
+	for _, k := range kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// gatewayOf returns the gateway of the internal host h.
+func gatewayOf(cfg Config, h host) host {
+	gw := host{side: sideExternal, ip: net.IP{h.ip[0], h.ip[1], h.ip[2], 254}, vlans: h.vlans}
+	gw.mac = cfg.MACs.GatewayMAC
+	if gw.mac == nil {
+		// One router interface per /24.
+		gw.mac = net.HardwareAddr{0x02, 0x00, 0x5e, 0x01, h.ip[1], h.ip[2]}
+	}
+	return gw
+}
+
+// chatter lays out an exchange between an internal host and its gateway.
+// It is shared by the sources of a capture's chatter, so that each holds
+// little while it waits for its next exchange.
+type chatter struct {
+	cfg           *Config
+	internal      hostPool
+	start         time.Time
+	duration      time.Duration
+	r             *rand.Rand
+	host, gateway host
+	at            time.Time
+	frames        []noiseFrame
+}
+
+// chatterSource is the chatter of one kind of the internal host idx, an
+// exchange a unit; off is when the next one starts.
+type chatterSource struct {
+	c    *chatter
+	idx  int
+	kind Background
+	r    *rand.Rand
+	off  time.Duration
+}
+
+func (s *chatterSource) next() (time.Time, bool) {
+	return s.c.start.Add(s.off).Truncate(time.Microsecond), s.off < s.c.duration
+}
+
+func (s *chatterSource) step(frames []noiseFrame) ([]noiseFrame, error) {
+	c := s.c
+	c.r, c.host = s.r, c.internal.at(s.idx)
+	c.gateway = gatewayOf(*c.cfg, c.host)
+	c.at, c.frames = c.start.Add(s.off).Truncate(time.Microsecond), frames
+	var err error
+	switch s.kind {
+	case BackgroundARP:
+		err = c.arp()
+	case BackgroundDHCP:
+		err = c.dhcp()
+	default:
+		err = c.ndp()
+	}
+	every := s.kind.interval()
+	s.off += every/2 + time.Duration(s.r.Int63n(int64(every)))
+	return c.frames, err
+}
+
+var (
+	broadcastMAC = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	// routerLinkLocal is the gateway's IPv6 link-local address, and
+	// routerSolicitedNode the multicast group a host asks it in.
+	routerLinkLocal     = net.ParseIP("fe80::1")
+	routerSolicitedNode = net.ParseIP("ff02::1:ff00:1")
+)
+
+// add appends a frame of the host, or of its gateway when fromGateway,
+// sent the gateway's answer time after the previous one.
+func (c *chatter) add(kind Background, fromGateway bool, stack ...gopacket.SerializableLayer) error {
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, stack...); err != nil {
+		return err
+	}
+	frame := buf.Bytes()
+	if len(frame) < minFrameLen {
+		frame = append(frame, make([]byte, minFrameLen-len(frame))...)
+	}
+	if fromGateway {
+		c.at = c.at.Add(time.Duration(200+c.r.Intn(600)) * time.Microsecond)
+	}
+	meta := pcapio.PacketMeta{Comment: "background=" + string(kind), Direction: tapDirection(!fromGateway)}
+	c.frames = append(c.frames, noiseFrame{ts: c.at, data: frame, meta: meta})
+	return nil
+}
+
+// link returns the Ethernet header and VLAN tags of a frame between the
+// host and its gateway.
+func (c *chatter) link(src, dst net.HardwareAddr, inner layers.EthernetType) []gopacket.SerializableLayer {
+	eth := &layers.Ethernet{SrcMAC: src, DstMAC: dst}
+	out := []gopacket.SerializableLayer{eth}
+	for _, tag := range vlanLayers(eth, c.host.vlans, inner) {
+		out = append(out, tag)
+	}
+	return out
+}
+
+func (c *chatter) arp() error {
+	h, gw := c.host, c.gateway
+	request := &layers.ARP{
+		AddrType: layers.LinkTypeEthernet, Protocol: layers.EthernetTypeIPv4, HwAddressSize: 6, ProtAddressSize: 4,
+		Operation: layers.ARPRequest, SourceHwAddress: h.mac, SourceProtAddress: h.ip.To4(),
+		DstHwAddress: make(net.HardwareAddr, 6), DstProtAddress: gw.ip,
+	}
+	if err := c.add(BackgroundARP, false, append(c.link(h.mac, broadcastMAC, layers.EthernetTypeARP), request)...); err != nil {
+		return err
+	}
+	reply := *request
+	reply.Operation = layers.ARPReply
+	reply.SourceHwAddress, reply.SourceProtAddress = gw.mac, gw.ip
+	reply.DstHwAddress, reply.DstProtAddress = h.mac, h.ip.To4()
+	return c.add(BackgroundARP, true, append(c.link(gw.mac, h.mac, layers.EthernetTypeARP), &reply)...)
+}
+
+func (c *chatter) dhcp() error {
+	h, gw := c.host, c.gateway
+	xid := c.r.Uint32()
+	// Hosts renew at half the lease.
+	lease := binary.BigEndian.AppendUint32(nil, uint32(2*BackgroundDHCP.interval()/time.Second))
+	client := func(msg layers.DHCPMsgType, extra ...layers.DHCPOption) *layers.DHCPv4 {
+		opts := []layers.DHCPOption{
+			layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msg)}),
+			layers.NewDHCPOption(layers.DHCPOptClientID, append([]byte{1}, h.mac...)),
+		}
+		opts = append(opts, extra...)
+		opts = append(opts, layers.NewDHCPOption(layers.DHCPOptParamsRequest, []byte{1, 3, 6, 15, 51}))
+		return &layers.DHCPv4{Operation: layers.DHCPOpRequest, HardwareType: layers.LinkTypeEthernet, Xid: xid, ClientHWAddr: h.mac, Options: opts}
+	}
+	server := func(msg layers.DHCPMsgType) *layers.DHCPv4 {
+		return &layers.DHCPv4{
+			Operation: layers.DHCPOpReply, HardwareType: layers.LinkTypeEthernet, Xid: xid, YourClientIP: h.ip, ClientHWAddr: h.mac,
+			Options: []layers.DHCPOption{
+				layers.NewDHCPOption(layers.DHCPOptMessageType, []byte{byte(msg)}),
+				layers.NewDHCPOption(layers.DHCPOptServerID, gw.ip),
+				layers.NewDHCPOption(layers.DHCPOptLeaseTime, lease),
+				layers.NewDHCPOption(layers.DHCPOptSubnetMask, []byte{255, 255, 255, 0}),
+				layers.NewDHCPOption(layers.DHCPOptRouter, gw.ip),
+				layers.NewDHCPOption(layers.DHCPOptDNS, gw.ip),
+			},
+		}
+	}
+	fromServer := func(dhcp *layers.DHCPv4) error {
+		ip, udp := c.ipv4(gw.ip, h.ip, 67, 68)
+		return c.add(BackgroundDHCP, true, append(c.link(gw.mac, h.mac, layers.EthernetTypeIPv4), ip, udp, dhcp)...)
+	}
+
+	if c.r.Intn(4) != 0 {
+		// A renewal: unicast, from the address held.
+		request := client(layers.DHCPMsgTypeRequest)
+		request.ClientIP = h.ip
+		ip, udp := c.ipv4(h.ip, gw.ip, 68, 67)
+		if err := c.add(BackgroundDHCP, false, append(c.link(h.mac, gw.mac, layers.EthernetTypeIPv4), ip, udp, request)...); err != nil {
+			return err
+		}
+		return fromServer(server(layers.DHCPMsgTypeAck))
+	}
+	broadcast := func(dhcp *layers.DHCPv4) error {
+		ip, udp := c.ipv4(net.IPv4zero, net.IPv4bcast, 68, 67)
+		return c.add(BackgroundDHCP, false, append(c.link(h.mac, broadcastMAC, layers.EthernetTypeIPv4), ip, udp, dhcp)...)
+	}
+	if err := broadcast(client(layers.DHCPMsgTypeDiscover)); err != nil {
+		return err
+	}
+	if err := fromServer(server(layers.DHCPMsgTypeOffer)); err != nil {
+		return err
+	}
+	// The client takes a moment to pick the offer.
+	c.at = c.at.Add(time.Duration(1+c.r.Intn(10)) * time.Millisecond)
+	request := client(layers.DHCPMsgTypeRequest,
+		layers.NewDHCPOption(layers.DHCPOptRequestIP, h.ip.To4()),
+		layers.NewDHCPOption(layers.DHCPOptServerID, gw.ip))
+	if err := broadcast(request); err != nil {
+		return err
+	}
+	return fromServer(server(layers.DHCPMsgTypeAck))
+}
+
+func (c *chatter) ipv4(src, dst net.IP, sport, dport layers.UDPPort) (*layers.IPv4, *layers.UDP) {
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Id: uint16(c.r.Intn(65536)), Protocol: layers.IPProtocolUDP, SrcIP: src.To4(), DstIP: dst.To4()}
+	udp := &layers.UDP{SrcPort: sport, DstPort: dport}
+	udp.SetNetworkLayerForChecksum(ip)
+	return ip, udp
+}
+
+func (c *chatter) ndp() error {
+	h, gw := c.host, c.gateway
+	src := linkLocal(h.mac)
+	group := routerSolicitedNode
+	groupMAC := net.HardwareAddr{0x33, 0x33, group[12], group[13], group[14], group[15]}
+
+	ip := &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolICMPv6, SrcIP: src, DstIP: group}
+	icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborSolicitation, 0)}
+	icmp.SetNetworkLayerForChecksum(ip)
+	ns := &layers.ICMPv6NeighborSolicitation{
+		TargetAddress: routerLinkLocal,
+		Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptSourceAddress, Data: h.mac}},
+	}
+	if err := c.add(BackgroundNDP, false, append(c.link(h.mac, groupMAC, layers.EthernetTypeIPv6), ip, icmp, ns)...); err != nil {
+		return err
+	}
+	ip = &layers.IPv6{Version: 6, HopLimit: 255, NextHeader: layers.IPProtocolICMPv6, SrcIP: routerLinkLocal, DstIP: src}
+	icmp = &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(layers.ICMPv6TypeNeighborAdvertisement, 0)}
+	icmp.SetNetworkLayerForChecksum(ip)
+	na := &layers.ICMPv6NeighborAdvertisement{
+		Flags:         0xe0, // router, solicited, override
+		TargetAddress: routerLinkLocal,
+		Options:       layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: gw.mac}},
+	}
+	return c.add(BackgroundNDP, true, append(c.link(gw.mac, h.mac, layers.EthernetTypeIPv6), ip, icmp, na)...)
+}
+
+// linkLocal returns the IPv6 link-local address a host forms from mac, by
+// modified EUI-64.
+func linkLocal(mac net.HardwareAddr) net.IP {
+	ip := make(net.IP, net.IPv6len)
+	ip[0], ip[1] = 0xfe, 0x80
+	copy(ip[8:], []byte{mac[0] ^ 0x02, mac[1], mac[2], 0xff, 0xfe, mac[3], mac[4], mac[5]})
+	return ip
+}
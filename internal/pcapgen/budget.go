@@ -0,0 +1,130 @@
+package pcapgen
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/google/gopacket"
+
+	"genflux/internal/pcapio"
+	"genflux/internal/stats"
+)
+
+// SizeSplit is how exact-size is shared out over several files.
+type SizeSplit string
+
+const (
+	// SplitEven gives every file the same size.
+	SplitEven SizeSplit = "even"
+	// SplitTraffic sizes each file by the traffic its span of time
+	// carries under the traffic model; the files keep the configured
+	// durations rather than being stretched over quiet hours.
+	SplitTraffic SizeSplit = "traffic"
+)
+
+// ParseSizeSplit parses even or traffic; empty means even.
+func ParseSizeSplit(value string) (SizeSplit, error) {
+	switch SizeSplit(strings.ToLower(strings.TrimSpace(value))) {
+	case "", SplitEven:
+		return SplitEven, nil
+	case SplitTraffic:
+		return SplitTraffic, nil
+	default:
+		return SplitEven, fmt.Errorf("unknown size split %q (want even|traffic)", value)
+	}
+}
+
+// sizeBudget is the size a file is generated to. Sizes count frame bytes;
+// the file and record headers of the capture format come on top. An exact
+// budget is met to the byte, any other is an upper bound the file may stop
+// short of by up to tolerance.
+type sizeBudget struct {
+	target    int
+	exact     bool
+	tolerance int
+}
+
+// fileBudget returns the budget of a file given its exact or maximum size
+// per tenant; an exact size takes precedence.
+func fileBudget(cfg Config, exactBytes, maxSize int) sizeBudget {
+	n := max(cfg.Tenants.Count, 1)
+	if exactBytes > 0 {
+		return sizeBudget{target: exactBytes * n, exact: true}
+	}
+	return sizeBudget{target: maxSize * n, tolerance: maxSize * n}
+}
+
+// met reports whether a file of achieved frame bytes keeps to b.
+func (b sizeBudget) met(achieved int) bool {
+	if b.exact {
+		return achieved == b.target
+	}
+	return achieved <= b.target && achieved >= b.target-b.tolerance
+}
+
+// report logs how the file at path came out against b. Loss drops packets
+// after they were planned, so a lossy file is not held to its budget.
+func (b sizeBudget) report(path string, achieved int, lossy bool) {
+	kind, status := "max-size", "ok"
+	if b.exact {
+		kind = "exact-size"
+	}
+	switch {
+	case lossy:
+		status = "after loss"
+	case !b.met(achieved):
+		status = "missed"
+	}
+	log.Printf("Size %s %s=%d tolerance=%d achieved=%d (%s)", path, kind, b.target, b.tolerance, achieved, status)
+}
+
+// fitPackets returns how many packets of a random-mode file fit in budget
+// frame bytes, and the length of the first that does not.
+func fitPackets(cfg Config, budget int, fileSeed int64) (n int, next int) {
+	used := 0
+	for i := 0; ; i++ {
+		planRand := streamTraffic.rand(fileSeed, int64(i))
+		plan := planPacket(planRand, cfg)
+		payloadLen, _, _ := planPayloadLen(planRand, cfg, plan)
+		size := basePacketLen(plan) + payloadLen
+		if used+size > budget {
+			return i, size
+		}
+		used += size
+	}
+}
+
+// frameCounter counts the frame bytes written to a capture. The pipeline
+// writes from its own goroutine, so the count is read with written. With
+// sample set, every frame is counted but only the sampled ones written.
+// labels and export are the capture's labelWriter and flowMeter, if any,
+// further out.
+type frameCounter struct {
+	pcapio.Writer
+	count  stats.Counter
+	sample *sampler
+	labels *labelWriter
+	export *flowMeter
+}
+
+func (c *frameCounter) WritePacket(ci gopacket.CaptureInfo, data []byte, meta pcapio.PacketMeta) error {
+	c.count.Add(len(data))
+	if c.sample != nil {
+		return c.sample.write(c.Writer, ci, data, meta)
+	}
+	return c.Writer.WritePacket(ci, data, meta)
+}
+
+func (c *frameCounter) Flush() error {
+	if c.sample != nil {
+		if err := c.sample.flush(c.Writer); err != nil {
+			return err
+		}
+	}
+	return c.Writer.Flush()
+}
+
+func (c *frameCounter) written() int {
+	return int(c.count.Snapshot().Bytes)
+}
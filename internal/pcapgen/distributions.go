@@ -2,6 +2,7 @@ package pcapgen
 
 import (
 	"fmt"
+	"math"
 	"math/rand"
 	"strconv"
 	"strings"
@@ -59,27 +60,89 @@ func ParseProtoDist(value string) (ProtoDist, error) {
 		if len(pieces) != 2 {
 			return ProtoDist{}, fmt.Errorf("invalid proto item: %q", part)
 		}
-		name := strings.ToLower(strings.TrimSpace(pieces[0]))
+		proto, err := parseProtoName(pieces[0])
+		if err != nil {
+			return ProtoDist{}, err
+		}
 		weight, err := parseWeight(pieces[1])
 		if err != nil {
 			return ProtoDist{}, err
 		}
-		var proto layers.IPProtocol
-		switch name {
-		case "tcp":
-			proto = layers.IPProtocolTCP
-		case "udp":
-			proto = layers.IPProtocolUDP
-		case "icmp", "icmpv4":
-			proto = layers.IPProtocolICMPv4
-		default:
-			return ProtoDist{}, fmt.Errorf("unknown proto %q", name)
+		items = append(items, WeightedProto{Proto: proto, Weight: weight})
+	}
+	return buildProtoDist(items)
+}
+
+// ParseProtocols parses a protocol list such as "tcp,udp,icmp" (equal
+// weights) or "tcp:70,udp:25,icmp:5". Items without a weight count as 1.
+func ParseProtocols(value string) (ProtoDist, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return ProtoDist{}, fmt.Errorf("empty protocol list")
+	}
+	parts := strings.Split(value, ",")
+	items := make([]WeightedProto, 0, len(parts))
+	for _, part := range parts {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, weightStr, hasWeight := strings.Cut(part, ":")
+		if !hasWeight {
+			name, weightStr, hasWeight = strings.Cut(part, "=")
+		}
+		proto, err := parseProtoName(name)
+		if err != nil {
+			return ProtoDist{}, err
+		}
+		weight := 1
+		if hasWeight {
+			weight, err = parseWeight(weightStr)
+			if err != nil {
+				return ProtoDist{}, err
+			}
 		}
 		items = append(items, WeightedProto{Proto: proto, Weight: weight})
 	}
 	return buildProtoDist(items)
 }
 
+// String renders the distribution in the syntax accepted by ParseProtoDist.
+func (d ProtoDist) String() string {
+	parts := make([]string, 0, len(d.Items))
+	for _, item := range d.Items {
+		parts = append(parts, fmt.Sprintf("%s=%d", protoName(item.Proto), item.Weight))
+	}
+	return strings.Join(parts, ",")
+}
+
+func protoName(proto layers.IPProtocol) string {
+	switch proto {
+	case layers.IPProtocolTCP:
+		return "tcp"
+	case layers.IPProtocolUDP:
+		return "udp"
+	case layers.IPProtocolICMPv4:
+		return "icmp"
+	default:
+		return strconv.Itoa(int(proto))
+	}
+}
+
+func parseProtoName(value string) (layers.IPProtocol, error) {
+	name := strings.ToLower(strings.TrimSpace(value))
+	switch name {
+	case "tcp":
+		return layers.IPProtocolTCP, nil
+	case "udp":
+		return layers.IPProtocolUDP, nil
+	case "icmp", "icmpv4":
+		return layers.IPProtocolICMPv4, nil
+	default:
+		return 0, fmt.Errorf("unknown proto %q", name)
+	}
+}
+
 func buildProtoDist(items []WeightedProto) (ProtoDist, error) {
 	total := 0
 	for _, item := range items {
@@ -189,7 +252,7 @@ func ParsePortDist(value string) (PortDist, error) {
 		if len(pieces) != 2 {
 			return PortDist{}, fmt.Errorf("invalid port item: %q", part)
 		}
-		rng, err := parsePortRange(pieces[0])
+		rng, err := ParsePortRange(pieces[0])
 		if err != nil {
 			return PortDist{}, err
 		}
@@ -202,6 +265,88 @@ func ParsePortDist(value string) (PortDist, error) {
 	return buildPortDist(items)
 }
 
+// String renders the distribution in the syntax accepted by ParsePortDist.
+func (d PortDist) String() string {
+	parts := make([]string, 0, len(d.Items))
+	for _, item := range d.Items {
+		if item.Range.Min == item.Range.Max {
+			parts = append(parts, fmt.Sprintf("%d=%d", item.Range.Min, item.Weight))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d=%d", item.Range.Min, item.Range.Max, item.Weight))
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// ParseServices parses a service mix such as "80:0.4,443:0.3,53:0.2,22:0.1":
+// destination ports (or ranges) with weights, which may be fractions. A
+// port is TCP unless it is suffixed /udp or is a well-known UDP service
+// such as 53 or 123. It returns the protocol mix the weights imply and the
+// port distribution of each protocol.
+func ParseServices(value string) (ProtoDist, PortDist, PortDist, error) {
+	var tcp, udp []WeightedPort
+	var tcpWeight, udpWeight int
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		portStr, weightStr, ok := strings.Cut(part, ":")
+		if !ok {
+			return ProtoDist{}, PortDist{}, PortDist{}, fmt.Errorf("invalid service item: %q (want PORT[/tcp|/udp]:WEIGHT)", part)
+		}
+		portStr, protoStr, hasProto := strings.Cut(strings.TrimSpace(portStr), "/")
+		rng, err := ParsePortRange(portStr)
+		if err != nil {
+			return ProtoDist{}, PortDist{}, PortDist{}, err
+		}
+		weight, err := strconv.ParseFloat(strings.TrimSpace(weightStr), 64)
+		if err != nil || weight <= 0 {
+			return ProtoDist{}, PortDist{}, PortDist{}, fmt.Errorf("invalid weight %q", weightStr)
+		}
+		// Distributions weigh in integers; fractions keep three digits.
+		item := WeightedPort{Range: rng, Weight: max(int(math.Round(weight*1000)), 1)}
+		isUDP := rng.Min == rng.Max && udpServices[rng.Min]
+		if hasProto {
+			proto, err := parseProtoName(protoStr)
+			if err != nil || proto == layers.IPProtocolICMPv4 {
+				return ProtoDist{}, PortDist{}, PortDist{}, fmt.Errorf("invalid service protocol %q", protoStr)
+			}
+			isUDP = proto == layers.IPProtocolUDP
+		}
+		if isUDP {
+			udp = append(udp, item)
+			udpWeight += item.Weight
+		} else {
+			tcp = append(tcp, item)
+			tcpWeight += item.Weight
+		}
+	}
+	var protos []WeightedProto
+	var tcpDist, udpDist PortDist
+	var err error
+	if len(tcp) > 0 {
+		protos = append(protos, WeightedProto{Proto: layers.IPProtocolTCP, Weight: tcpWeight})
+		if tcpDist, err = buildPortDist(tcp); err != nil {
+			return ProtoDist{}, PortDist{}, PortDist{}, err
+		}
+	}
+	if len(udp) > 0 {
+		protos = append(protos, WeightedProto{Proto: layers.IPProtocolUDP, Weight: udpWeight})
+		if udpDist, err = buildPortDist(udp); err != nil {
+			return ProtoDist{}, PortDist{}, PortDist{}, err
+		}
+	}
+	if len(protos) == 0 {
+		return ProtoDist{}, PortDist{}, PortDist{}, fmt.Errorf("empty service list")
+	}
+	proto, err := buildProtoDist(protos)
+	return proto, tcpDist, udpDist, err
+}
+
+// udpServices are the ports ParseServices takes as UDP without a suffix.
+var udpServices = map[uint16]bool{53: true, 67: true, 68: true, 69: true, 123: true, 137: true, 161: true, 162: true, 500: true, 514: true, 1900: true, 3478: true, 4500: true, 5353: true, 47808: true}
+
 func buildPortDist(items []WeightedPort) (PortDist, error) {
 	total := 0
 	for _, item := range items {
@@ -222,7 +367,9 @@ func buildPortDist(items []WeightedPort) (PortDist, error) {
 	return PortDist{Items: items, Total: total}, nil
 }
 
-func parsePortRange(value string) (PortRange, error) {
+// ParsePortRange parses a port, a range such as 32768-60999, or one of
+// the names ephemeral (49152-65535) and any.
+func ParsePortRange(value string) (PortRange, error) {
 	value = strings.TrimSpace(strings.ToLower(value))
 	if value == "" {
 		return PortRange{}, fmt.Errorf("empty port range")
@@ -266,8 +413,11 @@ type SizeDist struct {
 	Total int
 }
 
+// WeightedSize is a frame size, or a uniform range Size..Max when Max is
+// set.
 type WeightedSize struct {
 	Size   int
+	Max    int
 	Weight int
 }
 
@@ -278,11 +428,18 @@ func (d SizeDist) Pick(r *rand.Rand) int {
 	n := r.Intn(d.Total)
 	for _, item := range d.Items {
 		if n < item.Weight {
-			return item.Size
+			return item.pick(r)
 		}
 		n -= item.Weight
 	}
-	return d.Items[len(d.Items)-1].Size
+	return d.Items[len(d.Items)-1].pick(r)
+}
+
+func (w WeightedSize) pick(r *rand.Rand) int {
+	if w.Max <= w.Size {
+		return w.Size
+	}
+	return w.Size + r.Intn(w.Max-w.Size+1)
 }
 
 func DefaultPktSizeDist() SizeDist {
@@ -314,22 +471,95 @@ func ParseSizeDist(value string) (SizeDist, error) {
 		if len(pieces) != 2 {
 			return SizeDist{}, fmt.Errorf("invalid size item: %q", part)
 		}
-		size, err := strconv.Atoi(strings.TrimSpace(pieces[0]))
+		item, err := parseSizeRange(pieces[0])
 		if err != nil {
-			return SizeDist{}, fmt.Errorf("invalid size: %v", err)
-		}
-		if size <= 0 {
-			return SizeDist{}, fmt.Errorf("size must be > 0")
+			return SizeDist{}, err
 		}
-		weight, err := parseWeight(pieces[1])
+		item.Weight, err = parseWeight(pieces[1])
 		if err != nil {
 			return SizeDist{}, err
 		}
-		items = append(items, WeightedSize{Size: size, Weight: weight})
+		items = append(items, item)
 	}
 	return buildSizeDist(items)
 }
 
+// parseSizeRange parses "512" or a uniform range "64-1500".
+func parseSizeRange(value string) (WeightedSize, error) {
+	value = strings.TrimSpace(value)
+	lo, hi, isRange := strings.Cut(value, "-")
+	size, err := strconv.Atoi(strings.TrimSpace(lo))
+	if err != nil {
+		return WeightedSize{}, fmt.Errorf("invalid size: %v", err)
+	}
+	if size <= 0 {
+		return WeightedSize{}, fmt.Errorf("size must be > 0")
+	}
+	if !isRange {
+		return WeightedSize{Size: size}, nil
+	}
+	max, err := strconv.Atoi(strings.TrimSpace(hi))
+	if err != nil {
+		return WeightedSize{}, fmt.Errorf("invalid size: %v", err)
+	}
+	if max < size {
+		return WeightedSize{}, fmt.Errorf("invalid size range: %q", value)
+	}
+	return WeightedSize{Size: size, Max: max}, nil
+}
+
+// imixSizes is the simple IMIX: 40, 576 and 1500 byte IP packets in a
+// 7:4:1 ratio, as Ethernet frames.
+var imixSizes = []WeightedSize{
+	{Size: 54, Weight: 7},
+	{Size: 590, Weight: 4},
+	{Size: 1514, Weight: 1},
+}
+
+// ParseSizeModel parses a named size model: "fixed:N", "uniform:MIN-MAX"
+// or "imix".
+func ParseSizeModel(value string) (SizeDist, error) {
+	name, arg, _ := strings.Cut(strings.TrimSpace(value), ":")
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "fixed":
+		size, err := strconv.Atoi(strings.TrimSpace(arg))
+		if err != nil {
+			return SizeDist{}, fmt.Errorf("invalid fixed size %q", arg)
+		}
+		return buildSizeDist([]WeightedSize{{Size: size, Weight: 1}})
+	case "uniform":
+		if !strings.Contains(arg, "-") {
+			return SizeDist{}, fmt.Errorf("uniform wants MIN-MAX, got %q", arg)
+		}
+		item, err := parseSizeRange(arg)
+		if err != nil {
+			return SizeDist{}, err
+		}
+		item.Weight = 1
+		return buildSizeDist([]WeightedSize{item})
+	case "imix":
+		if arg != "" {
+			return SizeDist{}, fmt.Errorf("imix takes no argument")
+		}
+		return buildSizeDist(append([]WeightedSize(nil), imixSizes...))
+	default:
+		return SizeDist{}, fmt.Errorf("unknown size model %q (want fixed:N|uniform:MIN-MAX|imix)", value)
+	}
+}
+
+// String renders the distribution in the syntax accepted by ParseSizeDist.
+func (d SizeDist) String() string {
+	parts := make([]string, 0, len(d.Items))
+	for _, item := range d.Items {
+		if item.Max > item.Size {
+			parts = append(parts, fmt.Sprintf("%d-%d=%d", item.Size, item.Max, item.Weight))
+			continue
+		}
+		parts = append(parts, fmt.Sprintf("%d=%d", item.Size, item.Weight))
+	}
+	return strings.Join(parts, ",")
+}
+
 func buildSizeDist(items []WeightedSize) (SizeDist, error) {
 	total := 0
 	for _, item := range items {
@@ -339,8 +569,8 @@ func buildSizeDist(items []WeightedSize) (SizeDist, error) {
 		if item.Size <= 0 {
 			return SizeDist{}, fmt.Errorf("size must be > 0")
 		}
-		if item.Size > 65535 {
-			return SizeDist{}, fmt.Errorf("size exceeds 65535: %d", item.Size)
+		if item.Size > 65535 || item.Max > 65535 {
+			return SizeDist{}, fmt.Errorf("size exceeds 65535: %d", max(item.Size, item.Max))
 		}
 		total += item.Weight
 	}
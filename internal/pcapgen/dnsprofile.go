@@ -0,0 +1,564 @@
+package pcapgen
+
+import (
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"genflux/internal/pcapio"
+)
+
+// Profile replaces the traffic mix with that of one application, for
+// testing what analyses it.
+type Profile string
+
+const (
+	// ProfileNone is the mix the traffic flags describe.
+	ProfileNone Profile = ""
+	// ProfileDNS is clients resolving names; see DNSConfig.
+	ProfileDNS Profile = "dns"
+)
+
+// ParseProfile parses dns or none; empty means none.
+func ParseProfile(value string) (Profile, error) {
+	switch p := Profile(strings.ToLower(strings.TrimSpace(value))); p {
+	case ProfileNone, "none":
+		return ProfileNone, nil
+	case ProfileDNS:
+		return p, nil
+	default:
+		return ProfileNone, fmt.Errorf("unknown profile %q (want dns|none)", value)
+	}
+}
+
+// DNSConfig shapes the traffic of ProfileDNS. The internal hosts query
+// public resolvers, each client always the same one, mostly over UDP;
+// a share of the queries, and those whose answers are too long for UDP,
+// go over TCP.
+type DNSConfig struct {
+	// QPS is the queries a second of capture time. They arrive at random,
+	// shaped by the traffic model.
+	QPS float64
+	// Zipf is the exponent, > 1, of the Zipf law query names are drawn
+	// by: the higher, the more the most popular names dominate. Names
+	// come from Wordlists.Domains, most popular first, or a built-in list.
+	Zipf float64
+	// NXDomainRatio is the share of queries for names that do not exist,
+	// answered NXDOMAIN.
+	NXDomainRatio float64
+	// TCPRatio is the share of queries sent over TCP from the start.
+	TCPRatio float64
+	// ResponseSizes is the distribution of the lengths of the answers, as
+	// DNS messages, which EDNS(0) padding brings them up to; the zero
+	// value keeps their natural length.
+	ResponseSizes SizeDist
+}
+
+func (c DNSConfig) validate() error {
+	if c.QPS <= 0 {
+		return errors.New("qps must be > 0")
+	}
+	if c.Zipf <= 1 {
+		return errors.New("dns-zipf must be > 1")
+	}
+	if c.NXDomainRatio < 0 || c.NXDomainRatio > 1 {
+		return errors.New("nxdomain-ratio must be within [0,1]")
+	}
+	if c.TCPRatio < 0 || c.TCPRatio > 1 {
+		return errors.New("dns-tcp-ratio must be within [0,1]")
+	}
+	for _, item := range c.ResponseSizes.Items {
+		if max(item.Size, item.Max) > 65535 {
+			return errors.New("dns-response-sizes must be <= 65535")
+		}
+	}
+	return nil
+}
+
+// validateProfile checks the flags that do not apply to cfg.Profile.
+func (cfg Config) validateProfile() error {
+	if cfg.Profile != ProfileDNS {
+		return nil
+	}
+	switch {
+	case cfg.FlowCount > 0:
+		return errors.New("profile dns decides the flows itself; drop flow-count")
+	case cfg.ExactBytes > 0:
+		return errors.New("profile dns sizes files by qps and duration; cap them with max-size instead of exact-size")
+	case cfg.Rotate:
+		return errors.New("rotate is not supported with profile dns")
+	case cfg.Microbursts.Enabled():
+		return errors.New("microbursts do not apply to profile dns")
+	}
+	return cfg.DNS.validate()
+}
+
+const (
+	dnsTypeA    = 1
+	dnsTypeSOA  = 6
+	dnsTypeAAAA = 28
+	dnsTypeOPT  = 41
+
+	// dnsUDPSize is the EDNS(0) UDP payload size both sides announce, the
+	// DNS Flag Day 2020 value; longer answers are truncated over UDP.
+	dnsUDPSize = 1232
+)
+
+// dnsBaseNames and dnsPrefixes make up the built-in names, the base names
+// most popular first.
+var (
+	dnsBaseNames = []string{
+		"google.com", "googleapis.com", "gstatic.com", "microsoft.com", "apple.com",
+		"facebook.com", "fbcdn.net", "amazonaws.com", "icloud.com", "windowsupdate.com",
+		"youtube.com", "cloudflare.com", "akamaized.net", "live.com", "office.com",
+		"instagram.com", "whatsapp.net", "netflix.com", "doubleclick.net", "azureedge.net",
+		"amazon.com", "bing.com", "linkedin.com", "twitter.com", "github.com",
+		"zoom.us", "slack.com", "wikipedia.org", "yahoo.com", "dropbox.com",
+		"adobe.com", "salesforce.com", "spotify.com", "reddit.com", "tiktokcdn.com",
+		"twitch.tv", "paypal.com", "ebay.com", "msftconnecttest.com", "ntp.org",
+	}
+	dnsPrefixes = []string{"", "www.", "api.", "cdn.", "login.", "static.", "mail.", "update."}
+)
+
+// dnsNames returns the names queries are drawn from, most popular first.
+func dnsNames(cfg Config) []string {
+	if len(cfg.Wordlists.Domains) > 0 {
+		return cfg.Wordlists.Domains
+	}
+	names := make([]string, 0, len(dnsPrefixes)*len(dnsBaseNames))
+	for _, p := range dnsPrefixes {
+		for _, b := range dnsBaseNames {
+			names = append(names, p+b)
+		}
+	}
+	return names
+}
+
+// dnsFrame is a frame of a DNS transaction, built and waiting for its
+// time to be written.
+type dnsFrame struct {
+	ts   time.Time
+	data []byte
+	meta pcapio.PacketMeta
+	// seq orders frames of the same time by when they were made.
+	seq int
+}
+
+// dnsFrames is a heap of frames by time: answers come back after the
+// queries made after their own.
+type dnsFrames []dnsFrame
+
+func (h dnsFrames) Len() int { return len(h) }
+func (h dnsFrames) Less(i, j int) bool {
+	if !h[i].ts.Equal(h[j].ts) {
+		return h[i].ts.Before(h[j].ts)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h dnsFrames) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *dnsFrames) Push(x any)   { *h = append(*h, x.(dnsFrame)) }
+func (h *dnsFrames) Pop() any {
+	old := *h
+	f := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return f
+}
+
+// dnsTransaction is one query and what answers it.
+type dnsTransaction struct {
+	idx            int
+	client, server host
+	plan           PacketPlan
+	name           string
+	qtype          uint16
+	nx             bool
+	// netRTT is the round trip to the resolver and lookup how long it
+	// takes to answer.
+	netRTT, lookup time.Duration
+	// tcp is set once the query goes over TCP, truncated once its answer
+	// came back truncated over UDP.
+	tcp, truncated bool
+	frames         []dnsFrame
+	cfg            Config
+	r              *rand.Rand
+}
+
+// dnsStats counts what a file's transactions came to.
+type dnsStats struct {
+	queries, nxdomain, tcp, truncated int
+}
+
+func (s *dnsStats) add(t *dnsTransaction) {
+	s.queries++
+	if t.nx {
+		s.nxdomain++
+	}
+	if t.tcp {
+		s.tcp++
+	}
+	if t.truncated {
+		s.truncated++
+	}
+}
+
+// createDNSFile writes a capture of ProfileDNS: cfg.DNS.QPS queries a
+// second over duration, fewer if maxSize is reached first.
+func createDNSFile(ctx context.Context, path string, start time.Time, duration time.Duration, cfg Config, maxSize int, fileSeed int64, internal, external hostPool) error {
+	log.Printf("Creating %s profile=dns qps=%g duration=%s", path, cfg.DNS.QPS, duration)
+
+	noise, scenarios, err := planInjected(cfg, fileSeed, start, duration, internal, external)
+	if err != nil {
+		return err
+	}
+	f, writer, frames, err := openOutput(path, cfg, start, duration, internal, noise)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	budget := fileBudget(cfg, 0, maxSize)
+	pipe := newFilePipeline(ctx, writer, cfg, path, fileSeed, start, duration, frames, budget)
+	defer pipe.close()
+	if maxSize, err = reserveMgmt(cfg, maxSize, duration, internal); err != nil {
+		return err
+	}
+	if maxSize, err = reserveNoise(maxSize, noise); err != nil {
+		return err
+	}
+
+	n := int(cfg.DNS.QPS * duration.Seconds())
+	if n <= 0 {
+		return fmt.Errorf("qps %g gives no queries in %s", cfg.DNS.QPS, duration)
+	}
+	timing := streamTiming.rand(fileSeed, 0)
+	offsets := make([]time.Duration, n)
+	for i := range offsets {
+		offsets[i] = time.Duration(timing.Int63n(int64(duration))).Truncate(time.Microsecond)
+	}
+	sort.Slice(offsets, func(a, b int) bool { return offsets[a] < offsets[b] })
+	warp := cfg.TrafficModel.warp(start, duration)
+
+	names := dnsNames(cfg)
+	hosts := newPersonaLog(cfg)
+	framing := cfg.wrapLen()
+	var pending dnsFrames
+	var stats dnsStats
+	used, seq := 0, 0
+	flush := func(until time.Time) error {
+		for len(pending) > 0 && (until.IsZero() || !pending[0].ts.After(until)) {
+			fr := heap.Pop(&pending).(dnsFrame)
+			if err := pipe.write(gopacket.CaptureInfo{Timestamp: fr.ts}, fr.meta, func() ([]byte, error) { return fr.data, nil }); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for i, off := range offsets {
+		if i%100000 == 0 && cfg.Progress == nil {
+			log.Printf("Creating query %d", i)
+		}
+		t := &dnsTransaction{idx: i, cfg: cfg, r: streamDNS.rand(fileSeed, int64(i))}
+		t.choose(names, internal, external)
+		if err := t.build(warp.at(start.Add(off))); err != nil {
+			return err
+		}
+		size := 0
+		for _, fr := range t.frames {
+			size += len(fr.data) + framing
+		}
+		if used+size > maxSize {
+			budget.tolerance = size * max(cfg.Tenants.Count, 1)
+			break
+		}
+		used += size
+		hosts.add(t.client, t.server)
+		stats.add(t)
+		if err := flush(t.frames[0].ts); err != nil {
+			return err
+		}
+		for _, fr := range t.frames {
+			fr.seq = seq
+			seq++
+			heap.Push(&pending, fr)
+		}
+	}
+	if stats.queries == 0 {
+		return errors.New("max-size too small for a single DNS transaction")
+	}
+	if err := flush(time.Time{}); err != nil {
+		return err
+	}
+	if err := finishFile(pipe, path, cfg, start, duration, nil, nil, hosts.result(), scenarios); err != nil {
+		return err
+	}
+	return flushFile(pipe, path, cfg, budget, frames, fmt.Sprintf("queries=%d nxdomain=%d tcp=%d truncated=%d", stats.queries, stats.nxdomain, stats.tcp, stats.truncated))
+}
+
+// choose picks the client, its resolver and the question.
+func (t *dnsTransaction) choose(names []string, internal, external hostPool) {
+	r, cfg := t.r, t.cfg
+	t.client = internal.at(r.Intn(internal.count))
+	// Each client has its resolver, reached through the external host of
+	// the same pick for the link layer.
+	resolver := &dnsResolvers[pickWord(t.client.ip, len(dnsResolvers))]
+	t.server = resolver.serve(external.at(pickWord(t.client.ip, external.count)))
+
+	t.plan = PacketPlan{Proto: layers.IPProtocolUDP, SrcPort: randomEphemeralPort(r, cfg.EphemeralPorts), DstPort: 53, VLANTags: cfg.VLAN.tagCount(), EncapLen: cfg.wrapLen()}
+	if cfg.IPv6Ratio > 0 {
+		t.plan.IPv6 = r.Float64() < cfg.IPv6Ratio
+	}
+	rank := int(rand.NewZipf(r, cfg.DNS.Zipf, 1, uint64(len(names)-1)).Uint64())
+	t.name = names[rank]
+	t.qtype = dnsTypeA
+	if r.Intn(10) < 3 {
+		t.qtype = dnsTypeAAAA
+	}
+	t.nx = r.Float64() < cfg.DNS.NXDomainRatio
+	cached := r.Float64() < 0.9
+	if t.nx {
+		// A made-up label under a real name, as typos and DGAs give.
+		t.name = randomLabel(r) + "." + t.name
+		cached = r.Float64() < 0.2
+	} else if rank >= 100 {
+		cached = r.Float64() < 0.4
+	}
+	t.netRTT = time.Duration(2000+pickWord(t.client.ip, 28000)) * time.Microsecond
+	t.lookup = time.Duration(100+r.Intn(900)) * time.Microsecond
+	if !cached {
+		t.lookup += time.Duration(10+r.Intn(110)) * time.Millisecond
+	}
+}
+
+// build lays out the frames of the transaction, starting at ts.
+func (t *dnsTransaction) build(ts time.Time) error {
+	r := t.r
+	id := uint16(r.Uint32())
+	query := dnsQueryMessage(id, t.name, t.qtype)
+	target := 0
+	if t.cfg.DNS.ResponseSizes.Total > 0 {
+		target = t.cfg.DNS.ResponseSizes.Pick(r)
+	}
+	answer := dnsAnswerMessage(id, t.name, t.qtype, t.nx, target)
+	if r.Float64() < t.cfg.DNS.TCPRatio {
+		return t.exchangeTCP(ts, query, answer)
+	}
+	at := ts.Add(t.netRTT + t.lookup)
+	if err := t.add(ts, false, query, nil); err != nil {
+		return err
+	}
+	if len(answer) <= dnsUDPSize {
+		return t.add(at, true, answer, nil)
+	}
+	// Too long for UDP: the client gets the header and question with TC
+	// set and asks again over TCP.
+	t.truncated = true
+	if err := t.add(at, true, dnsTruncated(answer, len(query)), nil); err != nil {
+		return err
+	}
+	t.lookup = time.Duration(100+r.Intn(400)) * time.Microsecond
+	t.plan.SrcPort = randomEphemeralPort(r, t.cfg.EphemeralPorts)
+	return t.exchangeTCP(at.Add(time.Duration(50+r.Intn(200))*time.Microsecond), query, answer)
+}
+
+// exchangeTCP lays out a query and its answer over a connection of its
+// own, from the handshake to the client's close.
+func (t *dnsTransaction) exchangeTCP(ts time.Time, query, answer []byte) error {
+	r := t.r
+	t.tcp = true
+	t.plan.Proto = layers.IPProtocolTCP
+	cseq, sseq := r.Uint32(), r.Uint32()
+	half := t.netRTT / 2
+	// Over TCP every message is prefixed by its length.
+	query = append(binary.BigEndian.AppendUint16(nil, uint16(len(query))), query...)
+	answer = append(binary.BigEndian.AppendUint16(nil, uint16(len(answer))), answer...)
+
+	steps := []tcpStep{
+		{0, false, tcpFlags{SYN: true}, nil},
+		{half, true, tcpFlags{SYN: true, ACK: true}, nil},
+		{t.netRTT, false, tcpFlags{ACK: true}, nil},
+		{t.netRTT + time.Microsecond, false, tcpFlags{PSH: true, ACK: true}, query},
+	}
+	at := t.netRTT + half + t.lookup
+	mss := tcpMSS(t.plan)
+	for off := 0; off < len(answer); off += mss {
+		end := min(off+mss, len(answer))
+		steps = append(steps, tcpStep{at, true, tcpFlags{PSH: end == len(answer), ACK: true}, answer[off:end]})
+		at += time.Microsecond
+	}
+	done := at + half
+	steps = append(steps,
+		tcpStep{done, false, tcpFlags{FIN: true, ACK: true}, nil},
+		tcpStep{done + t.netRTT, true, tcpFlags{FIN: true, ACK: true}, nil},
+		tcpStep{done + t.netRTT + half, false, tcpFlags{ACK: true}, nil},
+	)
+
+	for i, seg := range scriptSegments(steps, cseq, sseq) {
+		if err := t.add(ts.Add(steps[i].at), steps[i].server, steps[i].payload, seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// add builds a frame of the transaction: from the client, or from the
+// server when fromServer.
+func (t *dnsTransaction) add(ts time.Time, fromServer bool, payload []byte, seg *tcpSegment) error {
+	if seg == nil {
+		seg = &tcpSegment{payload: payload}
+	}
+	src, dst := t.client, t.server
+	if fromServer {
+		src, dst = dst, src
+	}
+	data, err := buildPacket(t.r, src, dst, t.plan, fromServer, len(payload), seg, nil)
+	if err != nil {
+		return err
+	}
+	meta := pcapio.PacketMeta{Direction: tapDirection(src.side == sideInternal)}
+	if t.cfg.Format == pcapio.FormatPcapNG {
+		dir := "request"
+		if fromServer {
+			dir = "response"
+		}
+		meta.Comment = fmt.Sprintf("txn=%d pkt=%d app=dns dir=%s", t.idx, len(t.frames), dir)
+		if t.nx {
+			meta.Comment += " rcode=nxdomain"
+		}
+	}
+	t.frames = append(t.frames, dnsFrame{ts: ts.Truncate(time.Microsecond), data: data, meta: meta})
+	return nil
+}
+
+// randomLabel is a label such as a typo or a DGA makes up.
+func randomLabel(r *rand.Rand) string {
+	const chars = "abcdefghijklmnopqrstuvwxyz0123456789"
+	b := make([]byte, 8+r.Intn(13))
+	for i := range b {
+		b[i] = chars[r.Intn(len(chars))]
+	}
+	return string(b)
+}
+
+// dnsHeader is the header of a message with one question.
+func dnsHeader(id, flags, answers, authority uint16) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	b = binary.BigEndian.AppendUint16(b, flags)
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = binary.BigEndian.AppendUint16(b, answers)
+	b = binary.BigEndian.AppendUint16(b, authority)
+	return binary.BigEndian.AppendUint16(b, 1)
+}
+
+// dnsOPT is an EDNS(0) OPT record, with a padding option of pad bytes
+// when pad >= 0.
+func dnsOPT(pad int) []byte {
+	b := []byte{0x00}
+	b = binary.BigEndian.AppendUint16(b, dnsTypeOPT)
+	b = binary.BigEndian.AppendUint16(b, dnsUDPSize)
+	b = append(b, 0, 0, 0, 0)
+	if pad < 0 {
+		return binary.BigEndian.AppendUint16(b, 0)
+	}
+	b = binary.BigEndian.AppendUint16(b, uint16(4+pad))
+	b = append(b, 0x00, 0x0c)
+	b = binary.BigEndian.AppendUint16(b, uint16(pad))
+	return append(b, make([]byte, pad)...)
+}
+
+// dnsQueryMessage is a recursive query for name, announcing EDNS(0).
+func dnsQueryMessage(id uint16, name string, qtype uint16) []byte {
+	b := dnsHeader(id, 0x0100, 0, 0)
+	b = append(b, dnsName(name)...)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	b = binary.BigEndian.AppendUint16(b, 1)
+	return append(b, dnsOPT(-1)...)
+}
+
+// dnsAnswerMessage answers a query for name: with its addresses, or with
+// NXDOMAIN and the SOA of its zone when nx. Padding brings it up to
+// target bytes where it is shorter. The same name always gets the same
+// addresses and TTL.
+func dnsAnswerMessage(id uint16, name string, qtype uint16, nx bool, target int) []byte {
+	h := fnv.New64a()
+	h.Write([]byte(name))
+	sum := h.Sum64()
+	rs := &splitMix64{state: sum}
+	ttl := uint32(60 + sum%3540)
+
+	var records []byte
+	var answers, authority uint16
+	if nx {
+		// The zone is what follows the made-up label, pointed to in the
+		// question at offset 12.
+		label, _, _ := strings.Cut(name, ".")
+		zone := 0xc000 | uint16(12+1+len(label))
+		records = binary.BigEndian.AppendUint16(records, zone)
+		records = binary.BigEndian.AppendUint16(records, dnsTypeSOA)
+		records = binary.BigEndian.AppendUint16(records, 1)
+		records = binary.BigEndian.AppendUint32(records, 900)
+		rdata := append([]byte{3, 'n', 's', '1'}, byte(zone>>8), byte(zone))
+		rdata = append(rdata, 10)
+		rdata = append(rdata, "hostmaster"...)
+		rdata = append(rdata, byte(zone>>8), byte(zone))
+		for _, v := range []uint32{uint32(2024000000 + sum%1000000), 7200, 3600, 1209600, 900} {
+			rdata = binary.BigEndian.AppendUint32(rdata, v)
+		}
+		records = binary.BigEndian.AppendUint16(records, uint16(len(rdata)))
+		records = append(records, rdata...)
+		authority = 1
+	} else {
+		answers = uint16(1 + sum%4)
+		if qtype == dnsTypeAAAA {
+			answers = uint16(1 + sum%2)
+		}
+		r := rand.New(rs)
+		for i := uint16(0); i < answers; i++ {
+			records = append(records, 0xc0, 0x0c)
+			records = binary.BigEndian.AppendUint16(records, qtype)
+			records = binary.BigEndian.AppendUint16(records, 1)
+			records = binary.BigEndian.AppendUint32(records, ttl)
+			addr := []byte(publicIPv4(r))
+			if qtype == dnsTypeAAAA {
+				addr = hashedIPv6(rs, []byte{0x26, 0x06})
+			}
+			records = binary.BigEndian.AppendUint16(records, uint16(len(addr)))
+			records = append(records, addr...)
+		}
+	}
+	flags := uint16(0x8180)
+	if nx {
+		flags |= 3
+	}
+	b := dnsHeader(id, flags, answers, authority)
+	b = append(b, dnsName(name)...)
+	b = binary.BigEndian.AppendUint16(b, qtype)
+	b = binary.BigEndian.AppendUint16(b, 1)
+	b = append(b, records...)
+	pad := -1
+	if natural := len(b) + len(dnsOPT(-1)); target > natural {
+		// The padding option takes 4 bytes of its own.
+		pad = max(target-natural-4, 0)
+	}
+	return append(b, dnsOPT(pad)...)
+}
+
+// dnsTruncated is the UDP answer to a query of queryLen bytes whose full
+// answer is too long: its header, with TC set and no records, the
+// question and the OPT record.
+func dnsTruncated(answer []byte, queryLen int) []byte {
+	b := append([]byte(nil), answer[:queryLen-len(dnsOPT(-1))]...)
+	b[2] |= 0x02
+	binary.BigEndian.PutUint16(b[6:], 0)
+	binary.BigEndian.PutUint16(b[8:], 0)
+	return append(b, dnsOPT(-1)...)
+}
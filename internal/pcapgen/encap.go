@@ -0,0 +1,197 @@
+package pcapgen
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"genflux/internal/pcapio"
+)
+
+// Encap is the tunnel every generated frame is carried in, as an overlay
+// network's underlay sees it.
+type Encap string
+
+const (
+	EncapNone Encap = ""
+	// EncapGRE carries the frame over GRE with its VNI as the key, the
+	// way NVGRE does.
+	EncapGRE Encap = "gre"
+	// EncapVXLAN carries it over UDP port 4789.
+	EncapVXLAN Encap = "vxlan"
+	// EncapGeneve carries it over UDP port 6081, without options.
+	EncapGeneve Encap = "geneve"
+)
+
+// ParseEncap parses gre, vxlan, geneve or none.
+func ParseEncap(value string) (Encap, error) {
+	switch e := Encap(strings.ToLower(strings.TrimSpace(value))); e {
+	case "", "none":
+		return EncapNone, nil
+	case EncapGRE, EncapVXLAN, EncapGeneve:
+		return e, nil
+	default:
+		return EncapNone, fmt.Errorf("unknown encapsulation %q (want gre|vxlan|geneve|none)", value)
+	}
+}
+
+// EncapConfig wraps every frame in a tunnel between two underlay
+// endpoints, after any tenant encapsulation. The zero value leaves frames
+// as they are.
+type EncapConfig struct {
+	Kind Encap
+	// VNI is the VXLAN or Geneve network identifier, or the GRE key's
+	// virtual subnet ID.
+	VNI int
+	// UnderlaySrc and UnderlayDst are the tunnel endpoints, both IPv4 or
+	// both IPv6; nil takes 172.16.0.1 and 172.16.0.2.
+	UnderlaySrc, UnderlayDst net.IP
+}
+
+func (e EncapConfig) enabled() bool { return e.Kind != EncapNone }
+
+func (e EncapConfig) validate() error {
+	if !e.enabled() {
+		if e.VNI != 0 || e.UnderlaySrc != nil || e.UnderlayDst != nil {
+			return errors.New("vni, underlay-src and underlay-dst require encap")
+		}
+		return nil
+	}
+	if e.VNI < 0 || e.VNI > 1<<24-1 {
+		return fmt.Errorf("vni %d out of range [0,%d]", e.VNI, 1<<24-1)
+	}
+	src, dst := e.endpoints()
+	if (src.To4() == nil) != (dst.To4() == nil) {
+		return errors.New("underlay-src and underlay-dst must both be IPv4 or both IPv6")
+	}
+	return nil
+}
+
+// endpoints returns the underlay addresses, defaults filled in.
+func (e EncapConfig) endpoints() (src, dst net.IP) {
+	src, dst = e.UnderlaySrc, e.UnderlayDst
+	if src == nil {
+		src = vtepSrcIP
+	}
+	if dst == nil {
+		dst = vtepDstIP
+	}
+	return src, dst
+}
+
+// overhead is the number of bytes the tunnel adds to a frame: the outer
+// Ethernet and IP headers, and GRE with a key or UDP and the VXLAN or
+// Geneve header.
+func (e EncapConfig) overhead() int {
+	if !e.enabled() {
+		return 0
+	}
+	n := 14 + 20 + 8
+	if src, _ := e.endpoints(); src.To4() == nil {
+		n = 14 + 40 + 8
+	}
+	if e.Kind != EncapGRE {
+		n += 8
+	}
+	return n
+}
+
+// encapWriter writes every frame wrapped in the configured tunnel.
+type encapWriter struct {
+	pcapio.Writer
+	encap    EncapConfig
+	src, dst net.IP
+}
+
+func newEncapWriter(w pcapio.Writer, e EncapConfig) *encapWriter {
+	src, dst := e.endpoints()
+	if src.To4() != nil {
+		src, dst = src.To4(), dst.To4()
+	}
+	return &encapWriter{Writer: w, encap: e, src: src, dst: dst}
+}
+
+func (w *encapWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, meta pcapio.PacketMeta) error {
+	frame, err := w.wrap(data)
+	if err != nil {
+		return err
+	}
+	ci.CaptureLength, ci.Length = len(frame), len(frame)
+	return w.Writer.WritePacket(ci, frame, meta)
+}
+
+func (w *encapWriter) wrap(data []byte) ([]byte, error) {
+	vni := uint32(w.encap.VNI)
+	var (
+		proto layers.IPProtocol
+		shim  []byte
+		port  layers.UDPPort
+	)
+	switch w.encap.Kind {
+	case EncapGRE:
+		// Key present, carrying Transparent Ethernet Bridging.
+		proto = layers.IPProtocolGRE
+		shim = []byte{0x20, 0, 0x65, 0x58}
+		shim = binary.BigEndian.AppendUint32(shim, vni<<8)
+	case EncapVXLAN:
+		proto, port = layers.IPProtocolUDP, 4789
+		shim = binary.BigEndian.AppendUint32([]byte{0x08, 0, 0, 0}, vni<<8)
+	case EncapGeneve:
+		proto, port = layers.IPProtocolUDP, 6081
+		shim = binary.BigEndian.AppendUint32([]byte{0, 0, 0x65, 0x58}, vni<<8)
+	}
+	eth := &layers.Ethernet{SrcMAC: vtepSrcMAC, DstMAC: vtepDstMAC}
+	var ip gopacket.NetworkLayer
+	if w.src.To4() != nil {
+		eth.EthernetType = layers.EthernetTypeIPv4
+		ip = &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Flags: layers.IPv4DontFragment, Protocol: proto, SrcIP: w.src, DstIP: w.dst}
+	} else {
+		eth.EthernetType = layers.EthernetTypeIPv6
+		ip = &layers.IPv6{Version: 6, HopLimit: 64, NextHeader: proto, SrcIP: w.src, DstIP: w.dst}
+	}
+	stack := []gopacket.SerializableLayer{eth, ip.(gopacket.SerializableLayer)}
+	if proto == layers.IPProtocolUDP {
+		udp := &layers.UDP{SrcPort: underlayPort(data), DstPort: port}
+		if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+			return nil, err
+		}
+		stack = append(stack, udp)
+	}
+	stack = append(stack, gopacket.Payload(append(shim, data...)))
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, stack...); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// underlayPort derives the outer UDP source port from the inner frame's
+// addresses and ports, as a VTEP does, so that every inner flow keeps one
+// underlay path while the flows spread over many.
+func underlayPort(frame []byte) layers.UDPPort {
+	h := fnv.New32a()
+	h.Write(frame[:12])
+	if ip := framePacket(frame); ip != nil {
+		var l4 []byte
+		if ip[0]>>4 == 6 {
+			h.Write(ip[8:40])
+			l4 = ip[40:]
+		} else {
+			h.Write(ip[12:20])
+			if ihl := int(ip[0]&0x0f) * 4; len(ip) >= ihl {
+				l4 = ip[ihl:]
+			}
+		}
+		if len(l4) >= 4 {
+			h.Write(l4[:4])
+		}
+	}
+	return layers.UDPPort(49152 + h.Sum32()%16384)
+}
@@ -0,0 +1,98 @@
+package pcapgen
+
+import (
+	"net"
+
+	"github.com/google/gopacket/layers"
+)
+
+// dnsResolver is a public resolver serving DNS over TLS and HTTPS.
+type dnsResolver struct {
+	name    string
+	ip, ip6 net.IP
+}
+
+var dnsResolvers = []dnsResolver{
+	{"cloudflare-dns.com", net.IP{1, 1, 1, 1}, net.ParseIP("2606:4700:4700::1111")},
+	{"dns.google", net.IP{8, 8, 8, 8}, net.ParseIP("2001:4860:4860::8888")},
+	{"dns.quad9.net", net.IP{9, 9, 9, 9}, net.ParseIP("2620:fe::fe")},
+	{"dns.adguard-dns.com", net.IP{94, 140, 14, 14}, net.ParseIP("2a10:50c0::ad1:ff")},
+}
+
+// planEncryptedDNS moves the cfg.EncryptedDNSRatio share of DNS flows, UDP
+// to port 53, to DNS over TLS on TCP 853 or DNS over HTTPS on TCP 443,
+// half each. It draws from its own stream, so the other flows are the
+// same as without EncryptedDNSRatio.
+func planEncryptedDNS(cfg Config, fileSeed int64, flowIdx int, plan *PacketPlan) {
+	if cfg.EncryptedDNSRatio <= 0 || plan.Proto != layers.IPProtocolUDP || plan.DstPort != 53 {
+		return
+	}
+	r := streamL7.rand(fileSeed, int64(flowIdx)<<32|1)
+	if r.Float64() >= cfg.EncryptedDNSRatio {
+		return
+	}
+	plan.Proto, plan.DstPort, plan.encryptedDNS = layers.IPProtocolTCP, 853, appDoT
+	if r.Intn(2) == 0 {
+		plan.DstPort, plan.encryptedDNS = 443, appDoH
+	}
+}
+
+// flowResolver is the resolver an encrypted DNS flow from client goes to:
+// each client is configured with one. It is nil for other flows, and for
+// flows to an internal resolver, which keep their server.
+func flowResolver(plan PacketPlan, internalAsSource bool, client host) *dnsResolver {
+	if plan.encryptedDNS == "" || !internalAsSource {
+		return nil
+	}
+	return &dnsResolvers[pickWord(client.ip, len(dnsResolvers))]
+}
+
+// serve returns h moved to the resolver's addresses. Public resolvers run
+// Linux, whatever persona h had.
+func (r *dnsResolver) serve(h host) host {
+	h.ip, h.ip6 = r.ip, r.ip6
+	if h.persona != "" {
+		h.persona = PersonaLinux
+	}
+	return h
+}
+
+// resolverAt returns the resolver at ip, or nil.
+func resolverAt(ip net.IP) *dnsResolver {
+	for i := range dnsResolvers {
+		if r := &dnsResolvers[i]; r.ip.Equal(ip) || r.ip6.Equal(ip) {
+			return r
+		}
+	}
+	return nil
+}
+
+// openingPacket is the packet a flow's client first sends data in, which
+// carries the TLS ClientHello of an encrypted DNS flow; -1 if there is
+// none.
+func openingPacket(respMask []bool, steps []sessionStep) int {
+	for p, resp := range respMask {
+		if !resp && (steps == nil || steps[p].data && !steps[p].fromServer) {
+			return p
+		}
+	}
+	return -1
+}
+
+// tlsAppData is the header of a TLS 1.2 application data record; the
+// length is set once the payload is sized.
+var tlsAppData = []byte{0x17, 0x03, 0x03, 0x00, 0x00}
+
+// encryptedDNSPayload is the ClientHello that opens a DoT or DoH flow,
+// offering the ALPN protocol of the transport, and an application data
+// record for every other packet: queries and answers are encrypted.
+func (c *flowContext) encryptedDNSPayload(app appKind) []byte {
+	if !c.opening || c.isResponse {
+		return tlsAppData
+	}
+	alpn := "dot"
+	if app == appDoH {
+		alpn = "h2"
+	}
+	return tlsClientHello(c.hostname, c.key, alpn)
+}
@@ -0,0 +1,170 @@
+package pcapgen
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"genflux/internal/pcapio"
+)
+
+// EvasionTechnique is a way of confusing TCP reassembly in an IDS.
+type EvasionTechnique string
+
+const (
+	// EvasionOverlap retransmits part of a data segment with different
+	// bytes, so the reassembled stream depends on overlap policy.
+	EvasionOverlap EvasionTechnique = "overlap"
+	// EvasionUrgent sets URG with the urgent pointer inside the payload,
+	// so stacks disagree on whether that byte belongs to the stream.
+	EvasionUrgent EvasionTechnique = "urgent"
+	// EvasionTTLInsert sends bogus data for the segment's sequence range
+	// ahead of it with a TTL too low to reach the receiver.
+	EvasionTTLInsert EvasionTechnique = "ttl-insert"
+)
+
+const (
+	// evasionPayloadLen is the payload of every added evasion segment;
+	// fixed so the segments can be accounted for when sizing.
+	evasionPayloadLen = 8
+	insertionTTL      = 1
+)
+
+// EvasionConfig selects a fraction of scripted TCP flows and applies the
+// techniques to their first data segment.
+type EvasionConfig struct {
+	Techniques []EvasionTechnique
+	Ratio      float64
+}
+
+// ParseEvasion parses a technique list such as "overlap,urgent,ttl-insert".
+func ParseEvasion(value string) ([]EvasionTechnique, error) {
+	var out []EvasionTechnique
+	for _, part := range strings.Split(value, ",") {
+		t := EvasionTechnique(strings.ToLower(strings.TrimSpace(part)))
+		switch t {
+		case "":
+			continue
+		case EvasionOverlap, EvasionUrgent, EvasionTTLInsert:
+			out = append(out, t)
+		default:
+			return nil, fmt.Errorf("unknown evasion technique %q (want overlap|urgent|ttl-insert)", part)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("empty evasion list")
+	}
+	return out, nil
+}
+
+func (c EvasionConfig) enabled() bool {
+	return len(c.Techniques) > 0
+}
+
+func (c EvasionConfig) has(t EvasionTechnique) bool {
+	for _, x := range c.Techniques {
+		if x == t {
+			return true
+		}
+	}
+	return false
+}
+
+// extraPackets is the number of segments added to a selected flow whose
+// tampered segment carries payloadLen bytes.
+func (c EvasionConfig) extraPackets(payloadLen int) int {
+	n := 0
+	if c.has(EvasionOverlap) && payloadLen > 0 {
+		n++
+	}
+	if c.has(EvasionTTLInsert) {
+		n++
+	}
+	return n
+}
+
+// EvasionLabel is the ground truth for one evasion artifact. Packet is the
+// generation index of the packet carrying it.
+type EvasionLabel struct {
+	Flow      int              `json:"flow"`
+	Packet    int              `json:"packet"`
+	Technique EvasionTechnique `json:"technique"`
+	Seq       uint32           `json:"seq"`
+	Detail    string           `json:"detail"`
+}
+
+// evasionTarget returns the step of the flow whose segment is tampered
+// with, or -1 when the flow is not selected.
+func evasionTarget(cfg Config, fileSeed int64, flowIdx int, plan PacketPlan, steps []sessionStep) int {
+	if !cfg.Evasion.enabled() || !usesSession(cfg, plan) {
+		return -1
+	}
+	if streamAttacks.rand(fileSeed, int64(flowIdx)).Float64() >= cfg.Evasion.Ratio {
+		return -1
+	}
+	for p, step := range steps {
+		if step.data {
+			return p
+		}
+	}
+	return -1
+}
+
+type segmentWriter func(ts time.Time, meta pcapio.PacketMeta, seg *tcpSegment, payloadLen int) error
+
+// emitEvasion writes the data segment seg of a selected flow together with
+// its evasion variants and returns their labels. A segment without payload
+// has no urgent byte to point at nor bytes to overlap, so it only gets
+// ttl-insert.
+func emitEvasion(cfg EvasionConfig, fileSeed int64, flowIdx int, pipe *packetPipeline, ts time.Time, meta pcapio.PacketMeta, seg *tcpSegment, payloadLen int, write segmentWriter) ([]EvasionLabel, error) {
+	r := streamAttacks.rand(fileSeed, int64(flowIdx)<<32|1)
+	var labels []EvasionLabel
+	label := func(t EvasionTechnique, seq uint32, detail string) {
+		labels = append(labels, EvasionLabel{Flow: flowIdx, Packet: pipe.generated, Technique: t, Seq: seq, Detail: detail})
+	}
+	annotate := func(t EvasionTechnique) pcapio.PacketMeta {
+		m := meta
+		if m.Comment != "" {
+			m.Comment += " evasion=" + string(t)
+		}
+		return m
+	}
+
+	if cfg.has(EvasionTTLInsert) {
+		ins := bogusSegment(r, seg, seg.seq)
+		ins.ttl = insertionTTL
+		label(EvasionTTLInsert, ins.seq, fmt.Sprintf("ttl=%d bytes=%d", insertionTTL, evasionPayloadLen))
+		if err := write(ts, annotate(EvasionTTLInsert), ins, evasionPayloadLen); err != nil {
+			return nil, err
+		}
+	}
+	realMeta := meta
+	if cfg.has(EvasionUrgent) && payloadLen > 0 {
+		real := *seg
+		real.urgent = 1
+		seg = &real
+		realMeta = annotate(EvasionUrgent)
+		label(EvasionUrgent, seg.seq, "urgent pointer=1")
+	}
+	if err := write(ts, realMeta, seg, payloadLen); err != nil {
+		return nil, err
+	}
+	if cfg.has(EvasionOverlap) && payloadLen > 0 {
+		back := min(payloadLen, evasionPayloadLen)
+		ov := bogusSegment(r, seg, seg.seq+uint32(payloadLen-back))
+		label(EvasionOverlap, ov.seq, fmt.Sprintf("overlaps %d bytes with different data", back))
+		if err := write(ts.Add(time.Microsecond), annotate(EvasionOverlap), ov, evasionPayloadLen); err != nil {
+			return nil, err
+		}
+	}
+	return labels, nil
+}
+
+// bogusSegment returns a data segment like seg at seq carrying random bytes.
+func bogusSegment(r *rand.Rand, seg *tcpSegment, seq uint32) *tcpSegment {
+	payload := make([]byte, evasionPayloadLen)
+	r.Read(payload)
+	return &tcpSegment{flags: tcpFlags{PSH: true, ACK: true}, seq: seq, ack: seg.ack, window: seg.window, payload: payload}
+}
@@ -0,0 +1,523 @@
+package pcapgen
+
+import (
+	"bufio"
+	"container/list"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+
+	"genflux/internal/pcapio"
+)
+
+// FlowExportFormat is the protocol flow records are exported in.
+type FlowExportFormat string
+
+const (
+	FlowExportNone     FlowExportFormat = ""
+	FlowExportNetFlow9 FlowExportFormat = "netflow9"
+	FlowExportIPFIX    FlowExportFormat = "ipfix"
+)
+
+func ParseFlowExportFormat(value string) (FlowExportFormat, error) {
+	switch f := FlowExportFormat(strings.ToLower(strings.TrimSpace(value))); f {
+	case "", "none":
+		return FlowExportNone, nil
+	case "v9", "netflow":
+		return FlowExportNetFlow9, nil
+	case FlowExportNetFlow9, FlowExportIPFIX:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown flow export format %q (want netflow9|ipfix|none)", value)
+	}
+}
+
+// ext is the extension of the export file written next to a capture:
+// NetFlow v9 export packets, or an IPFIX file as RFC 5655 has it, one
+// message after another either way.
+func (f FlowExportFormat) ext() string {
+	if f == FlowExportIPFIX {
+		return ".ipfix"
+	}
+	return ".nf9"
+}
+
+// FlowExportConfig describes the traffic of every file as flow records
+// too, as a NetFlow v9 or IPFIX exporter where the capture is taken would.
+// Each file is exported as a session of its own, its sequence numbers
+// starting over; uptime counts from Config.StartTime.
+type FlowExportConfig struct {
+	Format FlowExportFormat
+	// Collector is the HOST:PORT the export goes to over UDP, as fast as
+	// it is generated; empty writes it next to each capture instead.
+	Collector string
+	// ActiveTimeout ends a flow record that has lasted that long and
+	// InactiveTimeout one idle that long. A TCP FIN or RST ends it at
+	// once.
+	ActiveTimeout   time.Duration
+	InactiveTimeout time.Duration
+}
+
+func (c FlowExportConfig) enabled() bool {
+	return c.Format != FlowExportNone
+}
+
+func (c FlowExportConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.ActiveTimeout <= 0 || c.InactiveTimeout <= 0 {
+		return errors.New("flow-active-timeout and flow-inactive-timeout must be > 0")
+	}
+	if c.Collector != "" {
+		if _, _, err := net.SplitHostPort(c.Collector); err != nil {
+			return fmt.Errorf("invalid flow-collector %q: want HOST:PORT", c.Collector)
+		}
+	}
+	return nil
+}
+
+const (
+	// flowExportMTU bounds an export message, so that it fits a datagram
+	// on any path.
+	flowExportMTU = 1400
+	// templateRefresh is how many messages go out between the templates,
+	// which collectors listening on UDP need again now and then.
+	templateRefresh = 20
+	// flowExportDelay is the longest an expired record waits for its
+	// message.
+	flowExportDelay = time.Second
+	// flowExportDomain is the v9 source ID and the IPFIX observation
+	// domain.
+	flowExportDomain = 1
+)
+
+// flowField is a field of a template: an information element of IPFIX,
+// which NetFlow v9 numbers alike, and its length.
+type flowField struct {
+	id, len uint16
+}
+
+// Information elements of the templates.
+const (
+	ieOctets         = 1
+	iePackets        = 2
+	ieProtocol       = 4
+	ieTOS            = 5
+	ieTCPFlags       = 6
+	ieSrcPort        = 7
+	ieSrcIPv4        = 8
+	ieDstPort        = 11
+	ieDstIPv4        = 12
+	ieLastSwitched   = 21
+	ieFirstSwitched  = 22
+	ieSrcIPv6        = 27
+	ieDstIPv6        = 28
+	ieDirection      = 61
+	ieFlowStartMilli = 152
+	ieFlowEndMilli   = 153
+)
+
+// templates returns the templates of format, for IPv4 and IPv6 records.
+// v9 counts in 32 bits and times flows by uptime; IPFIX counts in 64
+// bits and times them in milliseconds since the epoch.
+func templates(format FlowExportFormat) [2][]flowField {
+	counter, start, end := uint16(4), flowField{ieFirstSwitched, 4}, flowField{ieLastSwitched, 4}
+	if format == FlowExportIPFIX {
+		counter, start, end = 8, flowField{ieFlowStartMilli, 8}, flowField{ieFlowEndMilli, 8}
+	}
+	rest := []flowField{{ieSrcPort, 2}, {ieDstPort, 2}, {ieProtocol, 1}, {ieTOS, 1}, {ieTCPFlags, 1}, {ieDirection, 1}, {iePackets, counter}, {ieOctets, counter}, start, end}
+	return [2][]flowField{
+		append([]flowField{{ieSrcIPv4, 4}, {ieDstIPv4, 4}}, rest...),
+		append([]flowField{{ieSrcIPv6, 16}, {ieDstIPv6, 16}}, rest...),
+	}
+}
+
+// meterKey is what a flow record is kept by: one direction of a 5-tuple.
+// ICMP has its type and code in dport, as exporters put them.
+type meterKey struct {
+	src, dst     [16]byte
+	sport, dport uint16
+	proto        byte
+	v6           bool
+}
+
+type meterFlow struct {
+	key         meterKey
+	tos, flags  byte
+	egress      bool
+	packets     uint64
+	octets      uint64
+	first, last time.Time
+}
+
+// flowMeter keeps the flow records of the frames written through it and
+// exports them as they expire. Like the labels it sits inside the noise
+// writer and after the loss filter, and counts IP bytes.
+type flowMeter struct {
+	pcapio.Writer
+	cfg       FlowExportConfig
+	templates [2][]flowField
+	boot      time.Time
+	// now is the time of the last frame.
+	now time.Time
+	// cache holds the open records by key; lru orders them by their last
+	// packet, least recent first.
+	cache map[meterKey]*list.Element
+	lru   *list.List
+	frags ipFragments
+	// pending holds the expired records of the next message, per template,
+	// and since when they have waited.
+	pending  [2][]*meterFlow
+	since    time.Time
+	size     int
+	messages int
+	records  uint32
+	sink     io.Writer
+	closer   io.Closer
+}
+
+// newFlowMeter opens the export of the capture at path: a UDP socket to
+// the collector or the export file next to it.
+func newFlowMeter(w pcapio.Writer, path string, cfg Config) (*flowMeter, error) {
+	m := &flowMeter{Writer: w, cfg: cfg.FlowExport, templates: templates(cfg.FlowExport.Format), boot: cfg.StartTime, cache: map[meterKey]*list.Element{}, lru: list.New(), frags: ipFragments{}}
+	if c := cfg.FlowExport.Collector; c != "" {
+		conn, err := net.Dial("udp", c)
+		if err != nil {
+			return nil, fmt.Errorf("flow collector %s: %v", c, err)
+		}
+		m.sink, m.closer = conn, conn
+		return m, nil
+	}
+	f, err := os.Create(flowExportPath(path, cfg))
+	if err != nil {
+		return nil, err
+	}
+	m.sink, m.closer = bufio.NewWriter(f), f
+	return m, nil
+}
+
+// flowExportPath returns the export file of the capture at path.
+func flowExportPath(path string, cfg Config) string {
+	if path == StdoutPath {
+		return filepath.Join(cfg.OutDir, "genflux"+cfg.FlowExport.Format.ext())
+	}
+	return path + cfg.FlowExport.Format.ext()
+}
+
+func (m *flowMeter) WritePacket(ci gopacket.CaptureInfo, data []byte, meta pcapio.PacketMeta) error {
+	if err := m.observe(ci.Timestamp, data, meta.Direction == pcapio.DirectionOutbound); err != nil {
+		return err
+	}
+	return m.Writer.WritePacket(ci, data, meta)
+}
+
+// observe adds a frame to its record, first expiring the records idle
+// for longer than the inactive timeout.
+func (m *flowMeter) observe(ts time.Time, frame []byte, egress bool) error {
+	m.now = ts
+	if err := m.expire(ts); err != nil {
+		return err
+	}
+	ip := framePacket(frame)
+	if ip == nil {
+		return nil
+	}
+	k, tos, length, l4 := meterKeyOf(ip, m.frags)
+	var f *meterFlow
+	if e := m.cache[k]; e != nil {
+		f = e.Value.(*meterFlow)
+		if ts.Sub(f.first) >= m.cfg.ActiveTimeout {
+			m.lru.Remove(e)
+			delete(m.cache, k)
+			if err := m.export(f, ts); err != nil {
+				return err
+			}
+			f = nil
+		} else {
+			m.lru.MoveToBack(e)
+		}
+	}
+	if f == nil {
+		f = &meterFlow{key: k, tos: tos, egress: egress, first: ts}
+		m.cache[k] = m.lru.PushBack(f)
+	}
+	f.packets++
+	f.octets += uint64(length)
+	f.last = ts
+	if k.proto == 6 && len(l4) >= 14 {
+		f.flags |= l4[13]
+		// FIN or RST: the connection is over for this side.
+		if l4[13]&0x05 != 0 {
+			m.lru.Remove(m.cache[k])
+			delete(m.cache, k)
+			return m.export(f, ts)
+		}
+	}
+	return nil
+}
+
+// expire exports the records idle for longer than the inactive timeout
+// at ts, and the message due by then.
+func (m *flowMeter) expire(ts time.Time) error {
+	for e := m.lru.Front(); e != nil; e = m.lru.Front() {
+		f := e.Value.(*meterFlow)
+		if ts.Sub(f.last) < m.cfg.InactiveTimeout {
+			break
+		}
+		m.lru.Remove(e)
+		delete(m.cache, f.key)
+		if err := m.export(f, f.last.Add(m.cfg.InactiveTimeout)); err != nil {
+			return err
+		}
+	}
+	if m.size > 0 && ts.Sub(m.since) >= flowExportDelay {
+		return m.send(m.since.Add(flowExportDelay))
+	}
+	return nil
+}
+
+// export queues the expired record f at ts, sending the queued records
+// first when f does not fit in their message.
+func (m *flowMeter) export(f *meterFlow, ts time.Time) error {
+	t := 0
+	if f.key.v6 {
+		t = 1
+	}
+	n := recordLen(m.templates[t])
+	if m.size > 0 && m.messageLen()+n+4 > flowExportMTU {
+		if err := m.send(ts); err != nil {
+			return err
+		}
+	}
+	if m.size == 0 {
+		m.since = ts
+	}
+	m.pending[t] = append(m.pending[t], f)
+	m.size++
+	return nil
+}
+
+// close exports the records still open after the last frame and closes
+// the export.
+func (m *flowMeter) close() error {
+	end := m.now
+	for e := m.lru.Front(); e != nil; e = e.Next() {
+		if err := m.export(e.Value.(*meterFlow), end); err != nil {
+			return err
+		}
+	}
+	m.lru.Init()
+	m.cache = map[meterKey]*list.Element{}
+	var err error
+	if m.size > 0 {
+		err = m.send(end)
+	}
+	if bw, ok := m.sink.(*bufio.Writer); ok && err == nil {
+		err = bw.Flush()
+	}
+	if cerr := m.closer.Close(); err == nil {
+		err = cerr
+	}
+	m.closer = nil
+	return err
+}
+
+// abandon closes the export of a capture given up on, unless close has.
+func (m *flowMeter) abandon() {
+	if m.closer != nil {
+		m.closer.Close()
+		m.closer = nil
+	}
+}
+
+func recordLen(fields []flowField) int {
+	n := 0
+	for _, f := range fields {
+		n += int(f.len)
+	}
+	return n
+}
+
+// withTemplates reports whether the next message carries the templates.
+func (m *flowMeter) withTemplates() bool {
+	return m.messages%templateRefresh == 0
+}
+
+// messageLen is the length of the message of the queued records.
+func (m *flowMeter) messageLen() int {
+	n := 16 // IPFIX header; v9's is 20
+	if m.cfg.Format == FlowExportNetFlow9 {
+		n = 20
+	}
+	if m.withTemplates() {
+		n += 4
+		for _, t := range m.templates {
+			n += 4 + 4*len(t)
+		}
+	}
+	for t, recs := range m.pending {
+		if len(recs) > 0 {
+			n += 4 + len(recs)*recordLen(m.templates[t])
+			n += (4 - n%4) % 4
+		}
+	}
+	return n
+}
+
+// send writes the queued records in one message exported at ts.
+func (m *flowMeter) send(ts time.Time) error {
+	v9 := m.cfg.Format == FlowExportNetFlow9
+	msg := make([]byte, 0, m.messageLen())
+	count := 0
+	if v9 {
+		msg = binary.BigEndian.AppendUint16(msg, 9)
+		msg = binary.BigEndian.AppendUint16(msg, 0) // count
+		msg = binary.BigEndian.AppendUint32(msg, m.uptime(ts))
+		msg = binary.BigEndian.AppendUint32(msg, uint32(ts.Unix()))
+		msg = binary.BigEndian.AppendUint32(msg, uint32(m.messages))
+	} else {
+		msg = binary.BigEndian.AppendUint16(msg, 10)
+		msg = binary.BigEndian.AppendUint16(msg, 0) // length
+		msg = binary.BigEndian.AppendUint32(msg, uint32(ts.Unix()))
+		msg = binary.BigEndian.AppendUint32(msg, m.records)
+	}
+	msg = binary.BigEndian.AppendUint32(msg, flowExportDomain)
+
+	if m.withTemplates() {
+		// The template set is flowset 0 in v9 and set 2 in IPFIX.
+		set, id := len(msg), uint16(2)
+		if v9 {
+			id = 0
+		}
+		msg = binary.BigEndian.AppendUint16(msg, id)
+		msg = binary.BigEndian.AppendUint16(msg, 0)
+		for t, fields := range m.templates {
+			msg = binary.BigEndian.AppendUint16(msg, uint16(256+t))
+			msg = binary.BigEndian.AppendUint16(msg, uint16(len(fields)))
+			for _, f := range fields {
+				msg = binary.BigEndian.AppendUint16(msg, f.id)
+				msg = binary.BigEndian.AppendUint16(msg, f.len)
+			}
+			count++
+		}
+		binary.BigEndian.PutUint16(msg[set+2:], uint16(len(msg)-set))
+	}
+	for t, recs := range m.pending {
+		if len(recs) == 0 {
+			continue
+		}
+		set := len(msg)
+		msg = binary.BigEndian.AppendUint16(msg, uint16(256+t))
+		msg = binary.BigEndian.AppendUint16(msg, 0)
+		for _, f := range recs {
+			msg = m.appendRecord(msg, m.templates[t], f)
+			count++
+		}
+		for len(msg)%4 != 0 {
+			msg = append(msg, 0)
+		}
+		binary.BigEndian.PutUint16(msg[set+2:], uint16(len(msg)-set))
+		m.records += uint32(len(recs))
+		m.pending[t] = m.pending[t][:0]
+	}
+	if v9 {
+		binary.BigEndian.PutUint16(msg[2:], uint16(count))
+	} else {
+		binary.BigEndian.PutUint16(msg[2:], uint16(len(msg)))
+	}
+	m.size = 0
+	m.messages++
+	_, err := m.sink.Write(msg)
+	return err
+}
+
+// uptime is the v9 sysUptime at ts, in milliseconds.
+func (m *flowMeter) uptime(ts time.Time) uint32 {
+	return uint32(ts.Sub(m.boot).Milliseconds())
+}
+
+func (m *flowMeter) appendRecord(b []byte, fields []flowField, f *meterFlow) []byte {
+	for _, field := range fields {
+		switch field.id {
+		case ieSrcIPv4:
+			b = append(b, f.key.src[:4]...)
+		case ieDstIPv4:
+			b = append(b, f.key.dst[:4]...)
+		case ieSrcIPv6:
+			b = append(b, f.key.src[:]...)
+		case ieDstIPv6:
+			b = append(b, f.key.dst[:]...)
+		case ieSrcPort:
+			b = binary.BigEndian.AppendUint16(b, f.key.sport)
+		case ieDstPort:
+			b = binary.BigEndian.AppendUint16(b, f.key.dport)
+		case ieProtocol:
+			b = append(b, f.key.proto)
+		case ieTOS:
+			b = append(b, f.tos)
+		case ieTCPFlags:
+			b = append(b, f.flags)
+		case ieDirection:
+			// 0 is ingress and 1 egress.
+			if f.egress {
+				b = append(b, 1)
+			} else {
+				b = append(b, 0)
+			}
+		case iePackets, ieOctets:
+			v := f.packets
+			if field.id == ieOctets {
+				v = f.octets
+			}
+			if field.len == 4 {
+				b = binary.BigEndian.AppendUint32(b, uint32(min(v, 1<<32-1)))
+			} else {
+				b = binary.BigEndian.AppendUint64(b, v)
+			}
+		case ieFirstSwitched:
+			b = binary.BigEndian.AppendUint32(b, m.uptime(f.first))
+		case ieLastSwitched:
+			b = binary.BigEndian.AppendUint32(b, m.uptime(f.last))
+		case ieFlowStartMilli:
+			b = binary.BigEndian.AppendUint64(b, uint64(f.first.UnixMilli()))
+		case ieFlowEndMilli:
+			b = binary.BigEndian.AppendUint64(b, uint64(f.last.UnixMilli()))
+		}
+	}
+	return b
+}
+
+// meterKeyOf returns the record key of the IP packet ip, its TOS or
+// traffic class, its length and its transport header; frags gives a
+// fragment the ports of its datagram.
+func meterKeyOf(ip []byte, frags ipFragments) (k meterKey, tos byte, length int, l4 []byte) {
+	if ip[0]>>4 == 6 {
+		k.v6 = true
+		copy(k.src[:], ip[8:24])
+		copy(k.dst[:], ip[24:40])
+		tos = byte(binary.BigEndian.Uint16(ip[0:2]) >> 4)
+		length = 40 + int(binary.BigEndian.Uint16(ip[4:6]))
+	} else {
+		copy(k.src[:], ip[12:16])
+		copy(k.dst[:], ip[16:20])
+		tos = ip[1]
+		length = int(binary.BigEndian.Uint16(ip[2:4]))
+	}
+	k.proto, l4 = frags.transport(ip)
+	switch {
+	case (k.proto == 6 || k.proto == 17) && len(l4) >= 4:
+		k.sport, k.dport = binary.BigEndian.Uint16(l4[0:2]), binary.BigEndian.Uint16(l4[2:4])
+	case (k.proto == 1 || k.proto == 58) && len(l4) >= 2:
+		k.dport = binary.BigEndian.Uint16(l4[0:2])
+	}
+	return k, tos, length, l4
+}
@@ -0,0 +1,154 @@
+package pcapgen
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// PacketsModel is how the packet counts of flow-count flows are spread.
+type PacketsModel string
+
+const (
+	// PacketsFixed gives every flow PacketsPerFlow packets.
+	PacketsFixed PacketsModel = "fixed"
+	// PacketsLognormal draws them from a lognormal distribution, many
+	// short flows and some long ones.
+	PacketsLognormal PacketsModel = "lognormal"
+	// PacketsPareto draws them from a Pareto distribution, whose tail of
+	// elephant flows is heavier still.
+	PacketsPareto PacketsModel = "pareto"
+)
+
+// Default shapes of the models: lognormal's sigma and Pareto's alpha.
+const (
+	defaultLognormalSigma = 1.5
+	defaultParetoAlpha    = 1.2
+)
+
+// PacketsDist is the distribution of packets per flow in flow-count mode.
+// Whatever the model, PacketsPerFlow is the mean: a file holds FlowCount
+// times PacketsPerFlow packets and every flow at least one. The zero
+// value is PacketsFixed.
+type PacketsDist struct {
+	Model PacketsModel
+	// Shape is lognormal's sigma or Pareto's alpha, which must be over 1
+	// for the mean to exist; 0 takes 1.5 and 1.2.
+	Shape float64
+}
+
+// ParsePacketsDist parses "fixed", "lognormal[:SIGMA]" or
+// "pareto[:ALPHA]".
+func ParsePacketsDist(value string) (PacketsDist, error) {
+	name, arg, hasArg := strings.Cut(strings.TrimSpace(value), ":")
+	d := PacketsDist{Model: PacketsModel(strings.ToLower(strings.TrimSpace(name)))}
+	switch d.Model {
+	case "", PacketsFixed:
+		if hasArg {
+			return PacketsDist{}, errors.New("fixed takes no argument; packets-per-flow sets the count")
+		}
+		return PacketsDist{Model: PacketsFixed}, nil
+	case PacketsLognormal, PacketsPareto:
+	default:
+		return PacketsDist{}, fmt.Errorf("unknown packets dist %q (want fixed|lognormal[:SIGMA]|pareto[:ALPHA])", value)
+	}
+	if hasArg {
+		shape, err := strconv.ParseFloat(strings.TrimSpace(arg), 64)
+		if err != nil {
+			return PacketsDist{}, fmt.Errorf("invalid %s shape %q", d.Model, arg)
+		}
+		d.Shape = shape
+	}
+	return d, d.validate()
+}
+
+func (d PacketsDist) fixed() bool {
+	return d.Model == "" || d.Model == PacketsFixed
+}
+
+func (d PacketsDist) validate() error {
+	switch {
+	case d.fixed():
+	case d.Model == PacketsLognormal && (d.Shape < 0 || d.Shape > 4):
+		return errors.New("lognormal sigma must be within (0,4]")
+	case d.Model == PacketsPareto && d.Shape != 0 && d.Shape <= 1:
+		return errors.New("pareto alpha must be > 1")
+	case d.Model != PacketsLognormal && d.Model != PacketsPareto:
+		return fmt.Errorf("unknown packets dist %q", d.Model)
+	}
+	return nil
+}
+
+// String renders the distribution in the syntax accepted by
+// ParsePacketsDist.
+func (d PacketsDist) String() string {
+	if d.fixed() {
+		return string(PacketsFixed)
+	}
+	if d.Shape == 0 {
+		return string(d.Model)
+	}
+	return fmt.Sprintf("%s:%g", d.Model, d.Shape)
+}
+
+// weight draws a flow's share of the packets, relative to a mean of 1.
+func (d PacketsDist) weight(u, n float64) float64 {
+	if d.Model == PacketsPareto {
+		alpha := d.Shape
+		if alpha == 0 {
+			alpha = defaultParetoAlpha
+		}
+		// Inverse transform from the scale giving a mean of 1.
+		return (alpha - 1) / alpha / math.Pow(1-u, 1/alpha)
+	}
+	sigma := d.Shape
+	if sigma == 0 {
+		sigma = defaultLognormalSigma
+	}
+	return math.Exp(sigma*n - sigma*sigma/2)
+}
+
+// flowPackets returns the packet count of every flow of a file. The
+// counts add up to FlowCount times PacketsPerFlow exactly: each flow has
+// one, and the rest go out by the flows' drawn weights, the packets left
+// over by rounding to the largest remainders.
+func flowPackets(cfg Config, fileSeed int64) []int {
+	counts := make([]int, cfg.FlowCount)
+	if cfg.PacketsDist.fixed() {
+		for i := range counts {
+			counts[i] = cfg.PacketsPerFlow
+		}
+		return counts
+	}
+	weights := make([]float64, len(counts))
+	var total float64
+	for i := range weights {
+		r := streamPackets.rand(fileSeed, int64(i))
+		weights[i] = cfg.PacketsDist.weight(r.Float64(), r.NormFloat64())
+		total += weights[i]
+	}
+	extra := cfg.FlowCount * (cfg.PacketsPerFlow - 1)
+	left := extra
+	type rest struct {
+		i    int
+		frac float64
+	}
+	rests := make([]rest, len(counts))
+	for i, w := range weights {
+		exact := float64(extra) * w / total
+		counts[i] = int(exact)
+		left -= counts[i]
+		rests[i] = rest{i, exact - float64(counts[i])}
+	}
+	sort.SliceStable(rests, func(a, b int) bool { return rests[a].frac > rests[b].frac })
+	for k := 0; k < left; k++ {
+		counts[rests[k%len(rests)].i]++
+	}
+	for i := range counts {
+		counts[i]++
+	}
+	return counts
+}
@@ -0,0 +1,109 @@
+package pcapgen
+
+import (
+	"math/rand"
+)
+
+// flowScheduler orders the packets of flow-count flows. Up to concurrency
+// flows are open at once, opened in order of their index, and each slot
+// goes to one of them at random, so that their packets interleave; a flow
+// closes after its last packet and the next one opens. With concurrency 1
+// the flows are written one after another.
+type flowScheduler struct {
+	packets     []int
+	concurrency int
+	r           *rand.Rand
+	// open holds the open flows and sent how many packets each has had.
+	open, sent []int
+	nextFlow   int
+}
+
+func newFlowScheduler(cfg Config, fileSeed int64, packets []int) *flowScheduler {
+	return &flowScheduler{packets: packets, concurrency: max(cfg.Concurrency, 1), r: streamSchedule.rand(fileSeed, 0)}
+}
+
+// next returns the flow the next packet belongs to and its index in the
+// flow; ok is false once every packet has been scheduled.
+func (s *flowScheduler) next() (flow, p int, ok bool) {
+	for len(s.open) < s.concurrency && s.nextFlow < len(s.packets) {
+		s.open = append(s.open, s.nextFlow)
+		s.sent = append(s.sent, 0)
+		s.nextFlow++
+	}
+	if len(s.open) == 0 {
+		return 0, 0, false
+	}
+	i := 0
+	if len(s.open) > 1 {
+		i = s.r.Intn(len(s.open))
+	}
+	flow, p = s.open[i], s.sent[i]
+	s.sent[i]++
+	if s.sent[i] == s.packets[flow] {
+		last := len(s.open) - 1
+		s.open[i], s.sent[i] = s.open[last], s.sent[last]
+		s.open, s.sent = s.open[:last], s.sent[:last]
+	}
+	return flow, p, true
+}
+
+// flowRun is what a flow-count flow needs while its packets are written.
+type flowRun struct {
+	internalIdx, externalIdx int
+	internalAsSource         bool
+	rand                     *rand.Rand
+	plan                     PacketPlan
+	l7                       bool
+	resolver                 *dnsResolver
+	respMask                 []bool
+	steps                    []sessionStep
+	session                  *tcpSession
+	profiles                 [2]*osProfile
+	evasionAt, openAt        int
+}
+
+// openFlow plans the flow flowIdx of packets packets, logging its hosts
+// and starting its timing if those are kept.
+func openFlow(cfg Config, fileSeed int64, flowIdx, packets int, internal, external hostPool, hosts *personaLog, timer *flowTimer) *flowRun {
+	f := &flowRun{openAt: -1}
+	f.internalIdx, f.externalIdx, f.internalAsSource = flowIndexToHosts(flowIdx, internal.count, external.count)
+	f.rand = streamTraffic.rand(fileSeed, int64(flowIdx))
+	f.plan = planFlow(f.rand, cfg)
+	planPersonaFlow(cfg, fileSeed, flowIdx, internal, external, &f.plan)
+	f.l7 = planL7Flow(cfg, fileSeed, flowIdx, &f.plan)
+	planEncryptedDNS(cfg, fileSeed, flowIdx, &f.plan)
+	if f.plan.encryptedDNS != "" {
+		f.resolver = flowResolver(f.plan, f.internalAsSource, internal.at(f.internalIdx))
+	}
+	if hosts != nil {
+		hosts.add(internal.at(f.internalIdx), f.server(external))
+	}
+	if timer != nil {
+		client, server := internal.at(f.internalIdx), f.server(external)
+		if !f.internalAsSource {
+			client, server = server, client
+		}
+		timer.begin(flowIdx, flowTuple(f.plan, client, server))
+	}
+	f.respMask = flowDirections(cfg, fileSeed, flowIdx, f.l7, packets)
+	f.steps = flowSteps(cfg, fileSeed, flowIdx, f.plan, f.respMask)
+	if f.steps != nil {
+		f.profiles = flowProfiles(cfg, internal, external, flowIdx, f.plan)
+		f.session = newTCPSession(streamSession.rand(fileSeed, int64(flowIdx)))
+		f.session.profiles, f.session.mss = f.profiles, tcpMSS(f.plan)
+	}
+	f.evasionAt = evasionTarget(cfg, fileSeed, flowIdx, f.plan, f.steps)
+	if f.plan.encryptedDNS != "" {
+		f.openAt = openingPacket(f.respMask, f.steps)
+	}
+	return f
+}
+
+// server is the flow's external host, or the resolver it is sent to.
+func (f *flowRun) server(external hostPool) host {
+	server := external.at(f.externalIdx)
+	if f.resolver != nil {
+		server = f.resolver.serve(server)
+	}
+	return server
+}
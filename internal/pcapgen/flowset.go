@@ -0,0 +1,148 @@
+package pcapgen
+
+import (
+	"fmt"
+	"hash/fnv"
+	"math"
+	"math/bits"
+	"math/rand"
+
+	"github.com/google/gopacket/layers"
+)
+
+// maxTupleRedraws bounds how often a colliding packet is re-addressed
+// before uniqueness is given up as infeasible for the host counts.
+const maxTupleRedraws = 64
+
+// flowKey is a 5-tuple as it appears on the wire. ICMP has no ports, so
+// all ICMP packets between two hosts share a key.
+type flowKey struct {
+	src, dst         [16]byte
+	srcPort, dstPort uint16
+	proto            layers.IPProtocol
+}
+
+func newFlowKey(src, dst host, plan PacketPlan, isResponse bool) flowKey {
+	k := flowKey{proto: plan.Proto}
+	if plan.IPv6 {
+		copy(k.src[:], src.ip6.To16())
+		copy(k.dst[:], dst.ip6.To16())
+	} else {
+		copy(k.src[:], src.ip.To16())
+		copy(k.dst[:], dst.ip.To16())
+	}
+	if plan.Proto != layers.IPProtocolICMPv4 {
+		k.srcPort, k.dstPort = plan.SrcPort, plan.DstPort
+		if isResponse {
+			k.srcPort, k.dstPort = k.dstPort, k.srcPort
+		}
+	}
+	return k
+}
+
+// hash returns a well mixed 64-bit hash of k.
+func (k flowKey) hash() uint64 {
+	h := fnv.New64a()
+	h.Write(k.src[:])
+	h.Write(k.dst[:])
+	h.Write([]byte{byte(k.srcPort >> 8), byte(k.srcPort), byte(k.dstPort >> 8), byte(k.dstPort), byte(k.proto)})
+	return (&splitMix64{state: h.Sum64()}).Uint64()
+}
+
+// flowSet counts the distinct 5-tuples written in random mode and, when
+// unique is set, re-addresses packets whose 5-tuple was already used.
+// Only unique mode keeps the 5-tuples; otherwise the count is estimated in
+// constant memory, so long captures stream as they do without it.
+type flowSet struct {
+	unique bool
+	seen   map[flowKey]struct{}
+	sketch *hyperLogLog
+	// ephemeral is where redrawn source ports come from.
+	ephemeral PortRange
+}
+
+func newFlowSet(unique bool, ephemeral PortRange) *flowSet {
+	s := &flowSet{unique: unique, ephemeral: ephemeral}
+	if unique {
+		s.seen = map[flowKey]struct{}{}
+	} else {
+		s.sketch = newHyperLogLog()
+	}
+	return s
+}
+
+// count returns the number of distinct 5-tuples, exact in unique mode and
+// to within about 1% otherwise.
+func (s *flowSet) count() int {
+	if s.unique {
+		return len(s.seen)
+	}
+	return s.sketch.estimate()
+}
+
+// assign picks the hosts for a packet and records its 5-tuple. In unique
+// mode colliding packets get new hosts and a new ephemeral port drawn from
+// addrRand; plan is updated in place.
+func (s *flowSet) assign(addrRand *rand.Rand, internal, external hostPool, plan *PacketPlan, isResponse bool) (host, host, error) {
+	src, dst := pickHosts(addrRand, internal, external)
+	key := newFlowKey(src, dst, *plan, isResponse)
+	if s.unique {
+		for redraw := 0; ; redraw++ {
+			if _, ok := s.seen[key]; !ok {
+				break
+			}
+			if redraw == maxTupleRedraws {
+				return host{}, host{}, fmt.Errorf("unique-flows: no unused 5-tuple after %d attempts (%d used); increase internal-hosts/external-hosts", maxTupleRedraws, len(s.seen))
+			}
+			src, dst = pickHosts(addrRand, internal, external)
+			if plan.Proto != layers.IPProtocolICMPv4 {
+				plan.SrcPort = randomEphemeralPort(addrRand, s.ephemeral)
+			}
+			key = newFlowKey(src, dst, *plan, isResponse)
+		}
+		s.seen[key] = struct{}{}
+		return src, dst, nil
+	}
+	s.sketch.add(key.hash())
+	return src, dst, nil
+}
+
+// hllPrecision is the number of hash bits that pick a HyperLogLog
+// register: 2^14 registers estimate to within 0.8% (one standard error).
+const hllPrecision = 14
+
+// hyperLogLog estimates the number of distinct hashes added to it in
+// 2^hllPrecision bytes.
+type hyperLogLog struct {
+	registers []uint8
+}
+
+func newHyperLogLog() *hyperLogLog {
+	return &hyperLogLog{registers: make([]uint8, 1<<hllPrecision)}
+}
+
+func (h *hyperLogLog) add(hash uint64) {
+	idx := hash >> (64 - hllPrecision)
+	rank := uint8(bits.LeadingZeros64(hash<<hllPrecision|1<<(hllPrecision-1)) + 1)
+	if rank > h.registers[idx] {
+		h.registers[idx] = rank
+	}
+}
+
+func (h *hyperLogLog) estimate() int {
+	m := float64(len(h.registers))
+	sum, zeros := 0.0, 0
+	for _, r := range h.registers {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	e := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if e <= 2.5*m && zeros > 0 {
+		// Small counts: linear counting of the empty registers is more
+		// accurate.
+		e = m * math.Log(m/float64(zeros))
+	}
+	return int(math.Round(e))
+}
@@ -0,0 +1,114 @@
+package pcapgen
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+// FlowTiming is the timing ground truth of one flow as written: the
+// inter-packet gaps between its packets that made it into the capture.
+// A burst is a run of at least two packets, each within the burst gap of
+// the one before.
+type FlowTiming struct {
+	Flow      int       `json:"flow"`
+	Tuple     string    `json:"tuple"`
+	Packets   int       `json:"packets"`
+	First     time.Time `json:"first"`
+	Last      time.Time `json:"last"`
+	MinGap    float64   `json:"min_gap_us"`
+	MeanGap   float64   `json:"mean_gap_us"`
+	MaxGap    float64   `json:"max_gap_us"`
+	StddevGap float64   `json:"stddev_gap_us"`
+	Bursts    int       `json:"bursts"`
+	MaxBurst  int       `json:"max_burst"`
+}
+
+// flowTimer accumulates FlowTiming for flows whose packets may
+// interleave. Flows are kept by their index, which counts from 0.
+type flowTimer struct {
+	burstGap time.Duration
+	flows    []FlowTiming
+	gaps     []gapStats
+}
+
+// gapStats is Welford's running mean and sum of squared deviations of a
+// flow's gaps, and its current run of packets within the burst gap.
+type gapStats struct {
+	mean, m2 float64
+	run      int
+}
+
+func newFlowTimer(burstGap time.Duration) *flowTimer {
+	return &flowTimer{burstGap: burstGap, flows: []FlowTiming{}}
+}
+
+func (t *flowTimer) begin(flow int, tuple string) {
+	for len(t.flows) <= flow {
+		t.flows = append(t.flows, FlowTiming{})
+		t.gaps = append(t.gaps, gapStats{})
+	}
+	t.flows[flow] = FlowTiming{Flow: flow, Tuple: tuple}
+}
+
+// observe records a written packet of flow.
+func (t *flowTimer) observe(flow int, ts time.Time) {
+	f, g := &t.flows[flow], &t.gaps[flow]
+	f.Packets++
+	if f.Packets == 1 {
+		f.First, f.Last = ts, ts
+		g.run = 1
+		return
+	}
+	gapDur := ts.Sub(f.Last)
+	gap := float64(gapDur) / float64(time.Microsecond)
+	f.Last = ts
+	n := float64(f.Packets - 1)
+	if n == 1 || gap < f.MinGap {
+		f.MinGap = gap
+	}
+	f.MaxGap = math.Max(f.MaxGap, gap)
+	delta := gap - g.mean
+	g.mean += delta / n
+	g.m2 += delta * (gap - g.mean)
+
+	if gapDur <= t.burstGap {
+		g.run++
+		if g.run == 2 {
+			f.Bursts++
+		}
+		f.MaxBurst = max(f.MaxBurst, g.run)
+	} else {
+		g.run = 1
+	}
+}
+
+// result returns the timing of every flow.
+func (t *flowTimer) result() []FlowTiming {
+	for i := range t.flows {
+		if f, g := &t.flows[i], t.gaps[i]; f.Packets > 1 {
+			f.MeanGap = g.mean
+			f.StddevGap = math.Sqrt(g.m2 / float64(f.Packets-1))
+		}
+	}
+	return t.flows
+}
+
+// flowTuple renders a flow's 5-tuple from its client's point of view.
+func flowTuple(plan PacketPlan, client, server host) string {
+	if plan.Tunnel != "" {
+		client, server = tunnelInner(plan.Tunnel, client, server)
+	}
+	src, dst := client.ip, server.ip
+	if plan.IPv6 {
+		src, dst = client.ip6, server.ip6
+	}
+	if plan.Proto != 6 && plan.Proto != 17 {
+		return fmt.Sprintf("%s %s -> %s", protoName(plan.Proto), src, dst)
+	}
+	return fmt.Sprintf("%s %s -> %s", protoName(plan.Proto),
+		net.JoinHostPort(src.String(), strconv.Itoa(int(plan.SrcPort))),
+		net.JoinHostPort(dst.String(), strconv.Itoa(int(plan.DstPort))))
+}
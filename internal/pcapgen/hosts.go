@@ -0,0 +1,133 @@
+package pcapgen
+
+import "net"
+
+type host struct {
+	side hostSide
+	mac  net.HardwareAddr
+	ip   net.IP
+	ip6  net.IP
+	// vlans holds the tags of frames to or from an internal host.
+	vlans   []uint16
+	persona Persona
+}
+
+type hostSide int
+
+const (
+	sideInternal hostSide = iota
+	sideExternal
+)
+
+// hostPool describes a population of hosts without storing them: each
+// host's MAC and addresses are derived from its index and the seed, so
+// memory stays constant regardless of count.
+type hostPool struct {
+	side  hostSide
+	count int
+	seed  int64
+	// sequential assigns addresses by index (unique per host) instead of
+	// hashing them into the address space.
+	sequential bool
+	ipv6       bool
+	vlans      VLANConfig
+	macs       MACConfig
+	personas   PersonaMix
+}
+
+func (p hostPool) at(idx int) host {
+	r := &splitMix64{state: uint64(streamAddressing.seed(p.seed, int64(idx)<<1|int64(p.side)))}
+	h := host{side: p.side, mac: make(net.HardwareAddr, 6)}
+	v := r.Uint64()
+	for i := range h.mac {
+		h.mac[i] = byte(v >> (8 * i))
+	}
+	// Unicast, as a real NIC address would be.
+	h.mac[0] &^= 0x01
+	p.macs.apply(&h, v>>48)
+
+	v = r.Uint64()
+	switch {
+	case p.sequential && p.side == sideInternal:
+		h.ip = uniqueInternalIPv4(idx)
+	case p.sequential:
+		h.ip = uniqueExternalIPv4(idx)
+	case p.side == sideInternal:
+		h.ip = net.IP{192, 168, byte(v), byte(v >> 8)}
+	default:
+		h.ip = net.IP{byte(v%255 + 1), byte(v >> 8), byte(v >> 16), byte(v >> 24)}
+	}
+
+	if p.ipv6 {
+		switch {
+		case p.sequential && p.side == sideInternal:
+			h.ip6 = uniqueInternalIPv6(idx)
+		case p.sequential:
+			h.ip6 = uniqueExternalIPv6(idx)
+		case p.side == sideInternal:
+			h.ip6 = hashedIPv6(r, internalIPv6Prefix)
+		default:
+			h.ip6 = hashedIPv6(r, externalIPv6Prefix)
+		}
+	}
+	if p.side == sideInternal {
+		h.vlans = p.vlans.tagsFor(h)
+	}
+	h.persona = p.personas.pick(p.seed, h.ip)
+	return h
+}
+
+// hashedIPv6 fills the bytes after prefix from r.
+func hashedIPv6(r *splitMix64, prefix []byte) net.IP {
+	ip := make(net.IP, 16)
+	copy(ip, prefix)
+	for i := len(prefix); i < 16; i += 8 {
+		v := r.Uint64()
+		for j := i; j < 16 && j < i+8; j++ {
+			ip[j] = byte(v >> (8 * (j - i)))
+		}
+	}
+	return ip
+}
+
+func uniqueInternalIPv4(idx int) net.IP {
+	ip := make(net.IP, 4)
+	ip[0] = 192
+	ip[1] = 168
+	ip[2] = byte(idx / 256)
+	ip[3] = byte(idx % 256)
+	return ip
+}
+
+func uniqueExternalIPv4(idx int) net.IP {
+	ip := make(net.IP, 4)
+	ip[0] = 10
+	ip[1] = byte((idx >> 16) & 0xFF)
+	ip[2] = byte((idx >> 8) & 0xFF)
+	ip[3] = byte(idx & 0xFF)
+	return ip
+}
+
+func uniqueInternalIPv6(idx int) net.IP {
+	ip := make(net.IP, 16)
+	copy(ip, internalIPv6Prefix)
+	ip[14] = byte(idx >> 8)
+	ip[15] = byte(idx)
+	return ip
+}
+
+func uniqueExternalIPv6(idx int) net.IP {
+	ip := make(net.IP, 16)
+	copy(ip, externalIPv6Prefix)
+	ip[13] = byte(idx >> 16)
+	ip[14] = byte(idx >> 8)
+	ip[15] = byte(idx)
+	return ip
+}
+
+var (
+	// internalIPv6Prefix is a ULA /48 (fd67:6678::/48); externalIPv6Prefix
+	// is a /16 within global unicast space.
+	internalIPv6Prefix = []byte{0xfd, 0x67, 0x66, 0x78, 0x00, 0x00}
+	externalIPv6Prefix = []byte{0x2a, 0x00}
+)
@@ -0,0 +1,64 @@
+package pcapgen
+
+import "github.com/google/gopacket/layers"
+
+// l7Services are what a flow chosen by L7Ratio becomes: an HTTP GET and
+// its 200, a DNS query and its answer, or a TLS ClientHello with SNI.
+var l7Services = []struct {
+	proto layers.IPProtocol
+	port  uint16
+}{
+	{layers.IPProtocolTCP, 80},
+	{layers.IPProtocolTCP, 443},
+	{layers.IPProtocolUDP, 53},
+}
+
+// planL7Flow decides whether flowIdx is one of the cfg.L7Ratio share of
+// flows that carry application content and, if so, turns plan into one of
+// l7Services. It draws from its own stream, so the other flows are the
+// same as without L7Ratio.
+func planL7Flow(cfg Config, fileSeed int64, flowIdx int, plan *PacketPlan) bool {
+	if cfg.L7Ratio <= 0 {
+		return false
+	}
+	r := streamL7.rand(fileSeed, int64(flowIdx))
+	if r.Float64() >= cfg.L7Ratio {
+		return false
+	}
+	svc := l7Services[r.Intn(len(l7Services))]
+	if plan.Proto != layers.IPProtocolTCP && plan.Proto != layers.IPProtocolUDP {
+		plan.SrcPort = randomEphemeralPort(r, cfg.EphemeralPorts)
+		plan.ICMPType, plan.ICMPCode = 0, 0
+	}
+	plan.Proto, plan.DstPort = svc.proto, svc.port
+	return true
+}
+
+// flowDirections marks which packets of a flow are responses. An
+// application flow alternates request and response, so every request is
+// answered.
+func flowDirections(cfg Config, fileSeed int64, flowIdx int, l7 bool, packets int) []bool {
+	if !l7 {
+		return responseMask(streamDirection.rand(fileSeed, int64(flowIdx)), packets, cfg.ResponseRatio)
+	}
+	mask := make([]bool, packets)
+	for p := range mask {
+		mask[p] = p%2 == 1
+	}
+	return mask
+}
+
+// boundPayloads reports whether the payloads of a flow are bound to it:
+// every flow of an L7Ratio share, or all flows when templates or
+// wordlists are given without one. Encrypted DNS flows always are, as
+// their ClientHello names the resolver, and so are all flows of hosts
+// with personas, whose requests carry their User-Agents.
+func (cfg Config) boundPayloads(l7 bool, plan PacketPlan) bool {
+	if plan.encryptedDNS != "" || cfg.Personas.enabled() {
+		return true
+	}
+	if cfg.L7Ratio > 0 {
+		return l7
+	}
+	return cfg.PayloadTemplates != nil || cfg.Wordlists.enabled()
+}
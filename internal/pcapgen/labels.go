@@ -0,0 +1,261 @@
+package pcapgen
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"genflux/internal/pcapio"
+)
+
+// LabelFormat is the format of the ground-truth labels written next to
+// a capture; LabelsNone writes none.
+type LabelFormat string
+
+const (
+	LabelsNone LabelFormat = ""
+	LabelsJSON LabelFormat = "json"
+	LabelsCSV  LabelFormat = "csv"
+)
+
+func ParseLabelFormat(value string) (LabelFormat, error) {
+	switch f := LabelFormat(strings.ToLower(strings.TrimSpace(value))); f {
+	case "", "none":
+		return LabelsNone, nil
+	case LabelsJSON, LabelsCSV:
+		return f, nil
+	default:
+		return "", fmt.Errorf("unknown labels format %q (want json|csv|none)", value)
+	}
+}
+
+// Labels of FlowLabel besides the Scenario of an attack.
+const (
+	LabelBenign = "benign"
+	LabelNoise  = "noise"
+)
+
+// FlowLabel is the ground truth of one flow of a capture: both directions
+// of a 5-tuple, given from the side that sent first. Bytes are those of
+// the Ethernet frames as generated, before tenant encapsulation or the
+// link layer; tunnelled traffic is keyed by its outer header. Label is
+// LabelBenign, LabelNoise or the Scenario the flow belongs to.
+type FlowLabel struct {
+	Proto   string    `json:"proto"`
+	Src     string    `json:"src"`
+	SrcPort uint16    `json:"sport"`
+	Dst     string    `json:"dst"`
+	DstPort uint16    `json:"dport"`
+	Packets int       `json:"packets"`
+	Bytes   int       `json:"bytes"`
+	First   time.Time `json:"first"`
+	Last    time.Time `json:"last"`
+	Label   string    `json:"label"`
+}
+
+// labelKey is a flow with its endpoints in order, so that both
+// directions share it.
+type labelKey struct {
+	a, b   [16]byte
+	pa, pb uint16
+	proto  byte
+}
+
+// labelWriter tallies every frame written into its flow's FlowLabel. It
+// sits inside the noise writer, so it sees noise and scenario frames,
+// and after the loss filter, so dropped packets are not counted.
+type labelWriter struct {
+	pcapio.Writer
+	flows []FlowLabel
+	index map[labelKey]int
+	frags ipFragments
+}
+
+func newLabelWriter(w pcapio.Writer) *labelWriter {
+	return &labelWriter{Writer: w, flows: []FlowLabel{}, index: map[labelKey]int{}, frags: ipFragments{}}
+}
+
+func (w *labelWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, meta pcapio.PacketMeta) error {
+	w.observe(ci.Timestamp, data, meta.Comment)
+	return w.Writer.WritePacket(ci, data, meta)
+}
+
+func (w *labelWriter) observe(ts time.Time, frame []byte, comment string) {
+	src, dst, sport, dport, proto, ok := frameTuple(frame, w.frags)
+	if !ok {
+		return
+	}
+	k := labelKey{pa: sport, pb: dport, proto: proto}
+	copy(k.a[:], src)
+	copy(k.b[:], dst)
+	if c := bytes.Compare(k.a[:], k.b[:]); c > 0 || c == 0 && k.pa > k.pb {
+		k.a, k.b, k.pa, k.pb = k.b, k.a, k.pb, k.pa
+	}
+	i, seen := w.index[k]
+	if !seen {
+		i = len(w.flows)
+		w.index[k] = i
+		w.flows = append(w.flows, FlowLabel{
+			Proto: protoName(layers.IPProtocol(proto)), Src: src.String(), SrcPort: sport, Dst: dst.String(), DstPort: dport,
+			First: ts, Label: LabelBenign,
+		})
+	}
+	f := &w.flows[i]
+	f.Packets++
+	f.Bytes += len(frame)
+	f.Last = ts
+	// An attack or noise frame marks a flow that began as data too.
+	switch {
+	case strings.HasPrefix(comment, "scenario="):
+		f.Label = strings.TrimPrefix(comment, "scenario=")
+	case strings.HasPrefix(comment, "noise=") && f.Label == LabelBenign:
+		f.Label = LabelNoise
+	}
+}
+
+// frameTuple returns the addresses, ports and protocol of an IP packet in
+// an Ethernet frame, VLAN tagged or not; frags gives a fragment the ports
+// of its datagram.
+func frameTuple(frame []byte, frags ipFragments) (src, dst net.IP, sport, dport uint16, proto byte, ok bool) {
+	ip := framePacket(frame)
+	if ip == nil {
+		return nil, nil, 0, 0, 0, false
+	}
+	if ip[0]>>4 == 6 {
+		src, dst = net.IP(ip[8:24]), net.IP(ip[24:40])
+	} else {
+		src, dst = net.IP(ip[12:16]), net.IP(ip[16:20])
+	}
+	proto, l4 := frags.transport(ip)
+	if (proto == 6 || proto == 17) && len(l4) >= 4 {
+		sport, dport = binary.BigEndian.Uint16(l4[0:2]), binary.BigEndian.Uint16(l4[2:4])
+	}
+	return src, dst, sport, dport, proto, true
+}
+
+// framePacket returns the IP packet in an Ethernet frame, VLAN tagged or
+// not, with at least its fixed header; nil if there is none.
+func framePacket(frame []byte) []byte {
+	if len(frame) < 14 {
+		return nil
+	}
+	off := 12
+	etherType := binary.BigEndian.Uint16(frame[off:])
+	for (etherType == 0x8100 || etherType == 0x88a8) && len(frame) >= off+6 {
+		off += 4
+		etherType = binary.BigEndian.Uint16(frame[off:])
+	}
+	off += 2
+	switch {
+	case etherType == 0x0800 && len(frame) >= off+20 && frame[off]>>4 == 4:
+		return frame[off:]
+	case etherType == 0x86dd && len(frame) >= off+40 && frame[off]>>4 == 6:
+		return frame[off:]
+	}
+	return nil
+}
+
+// fragKey identifies an IP datagram by its addresses, protocol and
+// fragment identification.
+type fragKey struct {
+	src, dst [16]byte
+	proto    byte
+	id       uint32
+}
+
+// ipFragments holds the start of the transport header of the datagrams
+// whose first fragment has been seen and last has not, for the fragments
+// in between, which carry none.
+type ipFragments map[fragKey][]byte
+
+// transport returns the protocol and transport header of the IP packet
+// ip. For a fragment after the first it is the first's, cut to the ports,
+// or nil if that was not seen.
+func (fs ipFragments) transport(ip []byte) (proto byte, l4 []byte) {
+	var (
+		k                fragKey
+		offset           int
+		more, fragmented bool
+	)
+	if ip[0]>>4 == 6 {
+		copy(k.src[:], ip[8:24])
+		copy(k.dst[:], ip[24:40])
+		proto, l4 = ip[6], ip[40:]
+		if proto == 44 && len(ip) >= 48 {
+			frag := binary.BigEndian.Uint16(ip[42:44])
+			proto, l4 = ip[40], ip[48:]
+			offset, more, fragmented = int(frag>>3), frag&1 != 0, true
+			k.id = binary.BigEndian.Uint32(ip[44:48])
+		}
+	} else {
+		copy(k.src[:], ip[12:16])
+		copy(k.dst[:], ip[16:20])
+		proto = ip[9]
+		if ihl := int(ip[0]&0x0f) * 4; len(ip) >= ihl {
+			l4 = ip[ihl:]
+		}
+		frag := binary.BigEndian.Uint16(ip[6:8])
+		offset, more = int(frag&0x1fff), frag&0x2000 != 0
+		fragmented = offset > 0 || more
+		k.id = uint32(binary.BigEndian.Uint16(ip[4:6]))
+	}
+	if !fragmented || offset == 0 && !more {
+		return proto, l4
+	}
+	k.proto = proto
+	if offset == 0 {
+		fs[k] = append([]byte(nil), l4[:min(len(l4), 4)]...)
+		return proto, l4
+	}
+	l4 = fs[k]
+	if !more {
+		delete(fs, k)
+	}
+	return proto, l4
+}
+
+// labelsPath returns the labels path for the capture at path.
+func labelsPath(path string, cfg Config) string {
+	if path == StdoutPath {
+		return filepath.Join(cfg.OutDir, "genflux.labels."+string(cfg.Labels))
+	}
+	return path + ".labels." + string(cfg.Labels)
+}
+
+// write writes the flows to the labels file of the capture at path, in
+// the order their first packets were written.
+func (w *labelWriter) write(path string, cfg Config) error {
+	f, err := os.Create(labelsPath(path, cfg))
+	if err != nil {
+		return err
+	}
+	bw := bufio.NewWriter(f)
+	if cfg.Labels == LabelsJSON {
+		enc := json.NewEncoder(bw)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(w.flows)
+	} else {
+		fmt.Fprintln(bw, "proto,src,sport,dst,dport,packets,bytes,first,last,label")
+		for _, fl := range w.flows {
+			fmt.Fprintf(bw, "%s,%s,%d,%s,%d,%d,%d,%s,%s,%s\n", fl.Proto, fl.Src, fl.SrcPort, fl.Dst, fl.DstPort, fl.Packets, fl.Bytes,
+				fl.First.UTC().Format(time.RFC3339Nano), fl.Last.UTC().Format(time.RFC3339Nano), fl.Label)
+		}
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
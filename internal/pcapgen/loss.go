@@ -0,0 +1,134 @@
+package pcapgen
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// LossConfig simulates a lossy sensor: packets are generated as usual and
+// then omitted from the output. DropRate drops single packets at random;
+// Gaps blackout windows of GapLength drop everything inside them.
+type LossConfig struct {
+	DropRate  float64
+	Gaps      int
+	GapLength time.Duration
+}
+
+func (c LossConfig) enabled() bool {
+	return c.DropRate > 0 || c.Gaps > 0
+}
+
+func (c LossConfig) validate() error {
+	if c.DropRate < 0 || c.DropRate >= 1 {
+		return errors.New("drop-rate must be within [0,1)")
+	}
+	if c.Gaps < 0 {
+		return errors.New("gaps must be >= 0")
+	}
+	if c.Gaps > 0 && c.GapLength <= 0 {
+		return errors.New("gap-length must be > 0 when gaps are set")
+	}
+	return nil
+}
+
+// DropRun is a run of consecutive randomly dropped packets. Packet
+// indexes count every generated packet, written or not.
+type DropRun struct {
+	FirstPacket int       `json:"first_packet"`
+	Count       int       `json:"count"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+}
+
+// Gap is a blackout window and the packets lost in it.
+type Gap struct {
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	FirstPacket int       `json:"first_packet"`
+	Packets     int       `json:"packets"`
+}
+
+// LossReport lists what a lossFilter omitted.
+type LossReport struct {
+	DropRate float64   `json:"drop_rate"`
+	Dropped  int       `json:"dropped"`
+	Drops    []DropRun `json:"drops"`
+	Gaps     []Gap     `json:"gaps"`
+}
+
+// lossFilter decides, in generation order, which packets to omit.
+type lossFilter struct {
+	rate   float64
+	rng    *rand.Rand
+	gaps   []Gap
+	next   int
+	report LossReport
+}
+
+func newLossFilter(cfg LossConfig, fileSeed int64, start time.Time, duration time.Duration) *lossFilter {
+	f := &lossFilter{
+		rate:   cfg.DropRate,
+		rng:    streamLoss.rand(fileSeed, 0),
+		report: LossReport{DropRate: cfg.DropRate, Drops: []DropRun{}, Gaps: []Gap{}},
+	}
+	if cfg.Gaps == 0 {
+		return f
+	}
+	r := streamLoss.rand(fileSeed, -1)
+	span := duration - cfg.GapLength
+	if span < 0 {
+		span = 0
+	}
+	starts := make([]time.Duration, cfg.Gaps)
+	for i := range starts {
+		starts[i] = time.Duration(r.Int63n(int64(span) + 1))
+	}
+	sort.Slice(starts, func(i, j int) bool { return starts[i] < starts[j] })
+	for _, off := range starts {
+		g := Gap{Start: start.Add(off), End: start.Add(off + cfg.GapLength), FirstPacket: -1}
+		if n := len(f.gaps); n > 0 && !g.Start.After(f.gaps[n-1].End) {
+			// Overlapping windows merge into one longer gap.
+			f.gaps[n-1].End = g.End
+			continue
+		}
+		f.gaps = append(f.gaps, g)
+	}
+	return f
+}
+
+// drop reports whether the next generated packet, stamped ts, is omitted.
+func (f *lossFilter) drop(ts time.Time) bool {
+	idx := f.next
+	f.next++
+	for i := range f.gaps {
+		g := &f.gaps[i]
+		if !ts.Before(g.Start) && ts.Before(g.End) {
+			if g.FirstPacket < 0 {
+				g.FirstPacket = idx
+			}
+			g.Packets++
+			f.report.Dropped++
+			return true
+		}
+	}
+	if f.rate <= 0 || f.rng.Float64() >= f.rate {
+		return false
+	}
+	f.report.Dropped++
+	if n := len(f.report.Drops); n > 0 && f.report.Drops[n-1].FirstPacket+f.report.Drops[n-1].Count == idx {
+		f.report.Drops[n-1].Count++
+		f.report.Drops[n-1].End = ts
+		return true
+	}
+	f.report.Drops = append(f.report.Drops, DropRun{FirstPacket: idx, Count: 1, Start: ts, End: ts})
+	return true
+}
+
+// result returns the loss report; gaps that no packet fell into keep a
+// FirstPacket of -1.
+func (f *lossFilter) result() *LossReport {
+	f.report.Gaps = append(f.report.Gaps, f.gaps...)
+	return &f.report
+}
@@ -0,0 +1,76 @@
+package pcapgen
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// MACConfig makes the Ethernet addresses look like a capture at a network
+// edge. OUIs, when set, give every internal host a MAC from one of these
+// vendor prefixes; GatewayMAC, when set, stands in for every external
+// host, since their frames reach the edge through the router.
+type MACConfig struct {
+	OUIs       [][3]byte
+	GatewayMAC net.HardwareAddr
+}
+
+// VendorOUIs are prefixes of common workstation, server and phone NICs.
+var VendorOUIs = [][3]byte{
+	{0x00, 0x1b, 0x21}, // Intel
+	{0x3c, 0xfd, 0xfe}, // Intel
+	{0xf8, 0xbc, 0x12}, // Dell
+	{0x18, 0x66, 0xda}, // Dell
+	{0x3c, 0xd9, 0x2b}, // HP
+	{0x94, 0x57, 0xa5}, // HP
+	{0x54, 0xee, 0x75}, // Lenovo
+	{0x8c, 0x16, 0x45}, // Lenovo
+	{0xa4, 0x83, 0xe7}, // Apple
+	{0xf0, 0x18, 0x98}, // Apple
+	{0x00, 0x50, 0x56}, // VMware
+	{0x00, 0x15, 0x5d}, // Microsoft Hyper-V
+	{0x8c, 0x79, 0xf5}, // Samsung
+	{0x00, 0x1e, 0x67}, // Intel (server boards)
+	{0x70, 0x10, 0x6f}, // HPE
+	{0xb8, 0x27, 0xeb}, // Raspberry Pi
+}
+
+// ParseOUIs parses "vendor" for VendorOUIs, or a list of prefixes such as
+// "00:1b:21,f8:bc:12".
+func ParseOUIs(value string) ([][3]byte, error) {
+	value = strings.TrimSpace(strings.ToLower(value))
+	if value == "vendor" {
+		return VendorOUIs, nil
+	}
+	var ouis [][3]byte
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		mac, err := net.ParseMAC(part + ":00:00:00")
+		if err != nil || len(mac) != 6 {
+			return nil, fmt.Errorf("invalid OUI %q", part)
+		}
+		if mac[0]&0x01 != 0 {
+			return nil, fmt.Errorf("OUI %q is multicast", part)
+		}
+		ouis = append(ouis, [3]byte{mac[0], mac[1], mac[2]})
+	}
+	if len(ouis) == 0 {
+		return nil, fmt.Errorf("empty OUI list")
+	}
+	return ouis, nil
+}
+
+// apply overrides the random MAC of h. v supplies the bits that pick the
+// OUI; the NIC-specific half of the address stays random.
+func (c MACConfig) apply(h *host, v uint64) {
+	switch {
+	case h.side == sideExternal && c.GatewayMAC != nil:
+		h.mac = c.GatewayMAC
+	case h.side == sideInternal && len(c.OUIs) > 0:
+		oui := c.OUIs[v%uint64(len(c.OUIs))]
+		copy(h.mac[:3], oui[:])
+	}
+}
@@ -0,0 +1,107 @@
+package pcapgen
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	"genflux/internal/pcapio"
+)
+
+// Manifest is the sidecar JSON written next to a generated capture. It
+// records what cannot be recovered from the packets alone, such as the
+// packets that were deliberately left out.
+type Manifest struct {
+	File      string          `json:"file"`
+	Seed      int64           `json:"seed"`
+	Start     time.Time       `json:"start"`
+	Duration  string          `json:"duration"`
+	Generated int             `json:"generated_packets"`
+	Written   int             `json:"written_packets"`
+	Loss      *LossReport     `json:"loss,omitempty"`
+	Evasion   []EvasionLabel  `json:"evasion,omitempty"`
+	Flows     []FlowTiming    `json:"flows,omitempty"`
+	Hosts     []HostPersona   `json:"hosts,omitempty"`
+	Sample    *SampleReport   `json:"sample,omitempty"`
+	Scenarios []ScenarioLabel `json:"scenarios,omitempty"`
+}
+
+func (cfg Config) wantsManifest() bool {
+	return cfg.Loss.enabled() || cfg.Evasion.enabled() || cfg.FlowTiming || cfg.Personas.enabled() || cfg.Sample.enabled() || cfg.Scenarios.enabled()
+}
+
+// manifestPath returns the sidecar path for the capture at path.
+func manifestPath(path string, cfg Config) string {
+	if path == StdoutPath {
+		return filepath.Join(cfg.OutDir, "genflux.manifest.json")
+	}
+	return path + ".manifest.json"
+}
+
+// newFilePipeline sets up the pipeline for the output file at path,
+// including the loss filter and sampler when they are on. Its checkpoints
+// stop it once ctx ends and report progress against budget.
+func newFilePipeline(ctx context.Context, writer pcapio.Writer, cfg Config, path string, fileSeed int64, start time.Time, duration time.Duration, frames *frameCounter, budget sizeBudget) *packetPipeline {
+	var loss *lossFilter
+	if cfg.Loss.enabled() {
+		loss = newLossFilter(cfg.Loss, fileSeed, start, duration)
+	}
+	pipe := newPacketPipeline(writer, cfg.Workers, loss)
+	if cfg.Sample.enabled() {
+		frames.sample = newSampler(cfg.Sample, fileSeed, start)
+		pipe.sample = frames.sample
+	}
+	pipe.checkpoint = func() error {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if cfg.Progress != nil {
+			return cfg.Progress(Progress{File: path, Packets: pipe.written, Bytes: frames.written(), Target: budget.target, Files: cfg.FileCount})
+		}
+		return nil
+	}
+	return pipe
+}
+
+// finishFile drains pipe and writes the manifest for the capture at path.
+func finishFile(pipe *packetPipeline, path string, cfg Config, start time.Time, duration time.Duration, evasion []EvasionLabel, flows []FlowTiming, hosts []HostPersona, scenarios []ScenarioLabel) error {
+	if err := pipe.close(); err != nil {
+		return err
+	}
+	if !cfg.wantsManifest() {
+		return nil
+	}
+	m := Manifest{
+		File:      path,
+		Seed:      cfg.Seed,
+		Start:     start,
+		Duration:  duration.String(),
+		Generated: pipe.generated,
+		Written:   pipe.written,
+		Evasion:   evasion,
+		Flows:     flows,
+		Hosts:     hosts,
+		Scenarios: scenarios,
+	}
+	if pipe.loss != nil {
+		m.Loss = pipe.loss.result()
+		log.Printf("Loss %s dropped=%d of %d (random runs=%d, gaps=%d)", path, m.Loss.Dropped, m.Generated, len(m.Loss.Drops), len(m.Loss.Gaps))
+	}
+	if pipe.sample != nil {
+		// The writer may still hold noise and link-layer frames, which
+		// the totals must count.
+		if err := pipe.writer.Flush(); err != nil {
+			return err
+		}
+		m.Sample = pipe.sample.result()
+		log.Printf("Sample %s sampled=%d of %d frames (1 in %d, %s)", path, m.Sample.Sampled, m.Sample.Frames, m.Sample.Rate, m.Sample.Format)
+	}
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(manifestPath(path, cfg), append(data, '\n'), 0o644)
+}
@@ -0,0 +1,84 @@
+package pcapgen
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket"
+
+	"genflux/internal/pcapio"
+)
+
+// maxMPLSLabels bounds the label stack; provider networks rarely push
+// more than three or four.
+const maxMPLSLabels = 8
+
+// ParseMPLSLabels parses a label stack such as "100" or "16001,24005",
+// top of the stack first.
+func ParseMPLSLabels(value string) ([]uint32, error) {
+	var labels []uint32
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		label, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("invalid mpls label %q", part)
+		}
+		labels = append(labels, uint32(label))
+	}
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("empty mpls label stack")
+	}
+	return labels, validateMPLS(labels)
+}
+
+func validateMPLS(labels []uint32) error {
+	if len(labels) > maxMPLSLabels {
+		return fmt.Errorf("mpls stack of %d labels, at most %d", len(labels), maxMPLSLabels)
+	}
+	for _, label := range labels {
+		if label > 1<<20-1 {
+			return fmt.Errorf("mpls label out of range [0,%d]: %d", 1<<20-1, label)
+		}
+	}
+	return nil
+}
+
+// mplsWriter pushes a label stack onto every IP frame, between its
+// Ethernet header and VLAN tags and the IP packet, as a provider edge
+// router does. Other frames pass unchanged.
+type mplsWriter struct {
+	pcapio.Writer
+	stack []byte
+}
+
+func newMPLSWriter(w pcapio.Writer, labels []uint32) *mplsWriter {
+	stack := make([]byte, 0, 4*len(labels))
+	for i, label := range labels {
+		entry := label<<12 | 64
+		if i == len(labels)-1 {
+			entry |= 1 << 8
+		}
+		stack = binary.BigEndian.AppendUint32(stack, entry)
+	}
+	return &mplsWriter{Writer: w, stack: stack}
+}
+
+func (w *mplsWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, meta pcapio.PacketMeta) error {
+	ip := framePacket(data)
+	if ip == nil {
+		return w.Writer.WritePacket(ci, data, meta)
+	}
+	off := len(data) - len(ip)
+	frame := make([]byte, 0, len(data)+len(w.stack))
+	frame = append(frame, data[:off-2]...)
+	frame = binary.BigEndian.AppendUint16(frame, 0x8847)
+	frame = append(frame, w.stack...)
+	frame = append(frame, ip...)
+	ci.CaptureLength, ci.Length = len(frame), len(frame)
+	return w.Writer.WritePacket(ci, frame, meta)
+}
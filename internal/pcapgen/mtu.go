@@ -0,0 +1,81 @@
+package pcapgen
+
+import (
+	"errors"
+
+	"genflux/internal/ipfrag"
+)
+
+// defaultMTU is the MTU packets are planned for when Config.MTU is 0; it
+// only sets the MSS of TCP sessions, as packets may then reach 64 KiB.
+const defaultMTU = 1500
+
+func (cfg Config) validateMTU() error {
+	switch {
+	case cfg.MTU == 0:
+		if cfg.Fragment {
+			return errors.New("fragment requires mtu")
+		}
+		return nil
+	case cfg.MTU < 576 || cfg.MTU > 65535:
+		return errors.New("mtu must be within [576,65535]")
+	case cfg.MTU < 1280 && (cfg.IPv6Ratio > 0 || cfg.Tunnels.enabled()):
+		return errors.New("IPv6 needs an mtu of at least 1280")
+	case cfg.Profile != ProfileNone:
+		return errors.New("mtu does not apply to profile")
+	}
+	return nil
+}
+
+// outerIPLen is the length of the outermost IP header of a packet of plan,
+// IPv4 for tunnelled IPv6, and of the header each of its fragments
+// carries, with an IPv6 Fragment header.
+func outerIPLen(plan PacketPlan) (ip, frag int) {
+	if plan.IPv6 && plan.Tunnel == "" {
+		return 40, 48
+	}
+	return 20, 20
+}
+
+// maxFrameLen is the longest frame of plan as written: one whose IP
+// packet is its MTU long, when packets are kept to it.
+func maxFrameLen(cfg Config, plan PacketPlan) int {
+	const maxCaptureLen = 65535
+	if cfg.MTU == 0 || cfg.Fragment {
+		return maxCaptureLen
+	}
+	return min(plan.EncapLen+4*plan.VLANTags+14+cfg.MTU, maxCaptureLen)
+}
+
+// fragments returns how many IP fragments a packet of plan with payloadLen
+// bytes of payload is written as, and the payload it carries then: less,
+// by what the headers of the further fragments take, so that the
+// fragments come to the frame length planned. It is 1 and payloadLen for a
+// packet that fits the MTU or when packets are not fragmented.
+func (cfg Config) fragments(plan PacketPlan, payloadLen int) (n, payload int) {
+	if !cfg.Fragment {
+		return 1, payloadLen
+	}
+	link := 14 + 4*plan.VLANTags
+	frame := basePacketLen(plan) - plan.EncapLen + payloadLen
+	if frame-link <= cfg.MTU {
+		return 1, payloadLen
+	}
+	ip, frag := outerIPLen(plan)
+	per := (cfg.MTU - frag) &^ 7
+	// The fewest fragments whose headers and data add up to frame.
+	n = (frame + link + frag + per - 1) / (link + frag + per)
+	data := frame - n*(link+frag)
+	return n, payloadLen - (frame - link - ip - data)
+}
+
+// splitFragments returns the split of a packet into n fragments, id
+// naming the datagram; nil when n is 1.
+func (cfg Config) splitFragments(n int, id uint32) func([]byte) ([][]byte, error) {
+	if n <= 1 {
+		return nil
+	}
+	return func(frame []byte) ([][]byte, error) {
+		return ipfrag.Split(frame, n, cfg.MTU, id)
+	}
+}
@@ -0,0 +1,434 @@
+package pcapgen
+
+import (
+	"container/heap"
+	"fmt"
+	"math"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"genflux/internal/pcapio"
+)
+
+// NoiseConfig adds background internet noise: the unsolicited packets any
+// network with a public edge receives. A capture without them is itself
+// an anomaly to a detector trained on real traffic.
+type NoiseConfig struct {
+	// Rate is in packets per second of capture time; zero disables it.
+	Rate float64
+}
+
+func (c NoiseConfig) validate() error {
+	if c.Rate < 0 {
+		return fmt.Errorf("noise-rate must be >= 0")
+	}
+	return nil
+}
+
+// noiseKind is one source of background noise.
+type noiseKind int
+
+const (
+	// noiseScan is a probe from a scanner sweeping the internet: a bare
+	// SYN, or a UDP request to a service prone to amplification.
+	noiseScan noiseKind = iota
+	// noiseBackscatter is misdirected traffic: replies to packets someone
+	// else sent with our addresses as source.
+	noiseBackscatter
+	// noiseSpoofed is junk from a source that cannot be routed back, with
+	// flag combinations no stack sends.
+	noiseSpoofed
+)
+
+func (k noiseKind) String() string {
+	switch k {
+	case noiseScan:
+		return "scan"
+	case noiseBackscatter:
+		return "backscatter"
+	default:
+		return "spoofed"
+	}
+}
+
+var (
+	noiseTCPPorts = []uint16{22, 23, 80, 443, 445, 1433, 2323, 3306, 3389, 5900, 6379, 8080, 8443, 9200}
+	noiseUDPPorts = []uint16{53, 123, 161, 1900, 5060, 11211}
+)
+
+type noiseFrame struct {
+	ts   time.Time
+	data []byte
+	meta pcapio.PacketMeta
+	// seq orders frames of the same time by when they were made.
+	seq int
+}
+
+// noiseFrames is a heap of frames by time: a unit's answers may come
+// after the units that start after it.
+type noiseFrames []noiseFrame
+
+func (h noiseFrames) Len() int { return len(h) }
+func (h noiseFrames) Less(i, j int) bool {
+	if !h[i].ts.Equal(h[j].ts) {
+		return h[i].ts.Before(h[j].ts)
+	}
+	return h[i].seq < h[j].seq
+}
+func (h noiseFrames) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *noiseFrames) Push(x any)   { *h = append(*h, x.(noiseFrame)) }
+func (h *noiseFrames) Pop() any {
+	old := *h
+	f := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return f
+}
+
+// noiseSource lays out frames mixed into the traffic a unit at a time: a
+// noise packet, a probe and its answers, a login, an exchange of chatter.
+// Units start in time order and none of their frames comes before the
+// unit starts, so the frames can be made as they are written.
+type noiseSource interface {
+	// next returns when the next unit starts; ok is false when there are
+	// no more.
+	next() (at time.Time, ok bool)
+	// step appends the frames of the next unit to frames.
+	step(frames []noiseFrame) ([]noiseFrame, error)
+}
+
+// noisePlan is the noise of one capture. Its sources are laid out once up
+// front, so that its size can be taken out of the budget before the data
+// traffic is planned, and again as it is written; no frame is kept.
+type noisePlan struct {
+	// sources returns the sources of the frames, each time from the start.
+	sources []func() []noiseSource
+	// bytes is the frame bytes of the noise per tenant, with the framing
+	// the writers add.
+	bytes int
+}
+
+// injectedLen is the length frame comes to as written, with what the
+// writers add around it. MPLS labels go on IP frames only.
+func (cfg Config) injectedLen(frame []byte) int {
+	n := len(frame) + cfg.wrapLen()
+	if framePacket(frame) == nil {
+		n -= 4 * len(cfg.MPLS)
+	}
+	return n
+}
+
+// drain lays out every frame of src to add up their bytes, and drops
+// them; last is the time of the latest frame.
+func drain(cfg Config, src noiseSource) (bytes int, last time.Time, err error) {
+	var frames []noiseFrame
+	for _, ok := src.next(); ok; _, ok = src.next() {
+		if frames, err = src.step(frames[:0]); err != nil {
+			return 0, last, err
+		}
+		for _, f := range frames {
+			bytes += cfg.injectedLen(f.data)
+			if f.ts.After(last) {
+				last = f.ts
+			}
+		}
+	}
+	return bytes, last, nil
+}
+
+// planNoise spreads cfg.Noise.Rate packets a second at random over the
+// capture. Every file draws its own mix of kinds, so scenarios differ in
+// what their edge attracts as well as how much.
+func planNoise(cfg Config, fileSeed int64, start time.Time, duration time.Duration, internal, external hostPool) (noisePlan, error) {
+	var plan noisePlan
+	n := int(cfg.Noise.Rate * duration.Seconds())
+	if n <= 0 {
+		return plan, nil
+	}
+	open := func() []noiseSource {
+		s := &noiseRun{cfg: &cfg, fileSeed: fileSeed, start: start, duration: duration, internal: internal, external: external, n: n}
+		s.r = streamNoise.rand(fileSeed, -1)
+		// Scans dominate everywhere; how much backscatter and spoofed junk
+		// turn up varies more between networks.
+		s.scan, s.backscatter = 1+4*s.r.Float64(), s.r.Float64()
+		s.total = s.scan + s.backscatter + s.r.Float64()
+		s.advance()
+		return []noiseSource{s}
+	}
+	var err error
+	if plan.bytes, _, err = drain(cfg, open()[0]); err != nil {
+		return plan, err
+	}
+	plan.sources = []func() []noiseSource{open}
+	return plan, nil
+}
+
+// noiseRun lays out the n noise packets of a capture, one per unit.
+type noiseRun struct {
+	cfg                      *Config
+	fileSeed                 int64
+	start                    time.Time
+	duration                 time.Duration
+	internal, external       hostPool
+	scan, backscatter, total float64
+	r                        *rand.Rand
+	n, i                     int
+	// u is the time of packet i as a share of duration, and at the time.
+	u  float64
+	at time.Time
+}
+
+// advance draws the time of the next packet. The times are the n draws
+// of a uniform variable in ascending order, made one after another: each
+// is the minimum of those left above the one before.
+func (s *noiseRun) advance() {
+	left := s.n - s.i
+	if left <= 0 {
+		return
+	}
+	s.u = 1 - (1-s.u)*math.Pow(1-s.r.Float64(), 1/float64(left))
+	s.at = s.start.Add(time.Duration(s.u * float64(s.duration)).Truncate(time.Microsecond))
+}
+
+func (s *noiseRun) next() (time.Time, bool) { return s.at, s.i < s.n }
+
+func (s *noiseRun) step(frames []noiseFrame) ([]noiseFrame, error) {
+	fr := streamNoise.rand(s.fileSeed, int64(s.i))
+	kind := noiseSpoofed
+	switch x := fr.Float64() * s.total; {
+	case x < s.scan:
+		kind = noiseScan
+	case x < s.scan+s.backscatter:
+		kind = noiseBackscatter
+	}
+	dst := s.internal.at(fr.Intn(s.internal.count))
+	src := host{side: sideExternal, mac: s.external.at(fr.Intn(s.external.count)).mac, ip: publicIPv4(fr)}
+	data, err := buildNoise(fr, kind, src, dst, *s.cfg)
+	if err != nil {
+		return frames, err
+	}
+	meta := pcapio.PacketMeta{Comment: "noise=" + kind.String(), Direction: pcapio.DirectionInbound}
+	frames = append(frames, noiseFrame{ts: s.at, data: data, meta: meta})
+	s.i++
+	s.advance()
+	return frames, nil
+}
+
+// buildNoise builds one noise packet from src to dst. Every kind comes out
+// at least minFrameLen long, so no padding is left for the link to add.
+func buildNoise(r *rand.Rand, kind noiseKind, src, dst host, cfg Config) ([]byte, error) {
+	plan := PacketPlan{Proto: layers.IPProtocolTCP, SrcPort: uint16(1024 + r.Intn(64512)), VLANTags: cfg.VLAN.tagCount()}
+	seg := &tcpSegment{seq: r.Uint32(), ttl: uint8(32 + r.Intn(32))}
+	switch kind {
+	case noiseScan:
+		if r.Intn(4) == 0 {
+			plan.Proto = layers.IPProtocolUDP
+			plan.DstPort = noiseUDPPorts[r.Intn(len(noiseUDPPorts))]
+			seg.payload = randomBytes(r, 18+r.Intn(32))
+			break
+		}
+		// Stateless scanners send a fixed small window.
+		plan.DstPort = noiseTCPPorts[r.Intn(len(noiseTCPPorts))]
+		seg.flags, seg.window = tcpFlags{SYN: true}, 1024
+	case noiseBackscatter:
+		// The victim's service port is the source; ours is the port the
+		// spoofer picked.
+		plan.SrcPort, plan.DstPort = noiseTCPPorts[r.Intn(len(noiseTCPPorts))], uint16(1024+r.Intn(64512))
+		seg.ack = r.Uint32()
+		if r.Intn(2) == 0 {
+			seg.flags, seg.window = tcpFlags{SYN: true, ACK: true}, 65535
+		} else {
+			seg.flags = tcpFlags{RST: true, ACK: true}
+		}
+	case noiseSpoofed:
+		src.ip = bogonIPv4(r)
+		plan.DstPort = uint16(r.Intn(65536))
+		if r.Intn(2) == 0 {
+			plan.Proto = layers.IPProtocolUDP
+			seg.payload = randomBytes(r, 18+r.Intn(64))
+			break
+		}
+		// Null or Xmas scan flags.
+		if r.Intn(2) == 0 {
+			seg.flags = tcpFlags{FIN: true, PSH: true}
+			seg.urgent = uint16(r.Intn(65535)) + 1
+		}
+	}
+	return buildPacket(r, src, dst, plan, false, len(seg.payload), seg, nil)
+}
+
+// publicIPv4 draws a unicast address outside the private, shared, loopback
+// and link-local ranges.
+func publicIPv4(r *rand.Rand) net.IP {
+	for {
+		v := r.Uint32()
+		ip := net.IP{byte(v>>24%223) + 1, byte(v >> 16), byte(v >> 8), byte(v)}
+		if !ip.IsPrivate() && !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !(ip[0] == 100 && ip[1]&0xc0 == 64) {
+			return ip
+		}
+	}
+}
+
+// bogonIPv4 draws a source that cannot be routed back: this network,
+// loopback, link-local, multicast, reserved, or our own internal prefix
+// arriving from outside.
+func bogonIPv4(r *rand.Rand) net.IP {
+	ip := net.IP{0, byte(r.Intn(256)), byte(r.Intn(256)), byte(r.Intn(256))}
+	switch r.Intn(6) {
+	case 1:
+		ip[0] = 127
+	case 2:
+		ip[0], ip[1] = 169, 254
+	case 3:
+		ip[0] = byte(224 + r.Intn(16))
+	case 4:
+		ip[0] = byte(240 + r.Intn(15))
+	case 5:
+		ip[0], ip[1] = 192, 168
+	}
+	return ip
+}
+
+func randomBytes(r *rand.Rand, n int) []byte {
+	b := make([]byte, n)
+	r.Read(b)
+	return b
+}
+
+// merge adds the frames of o, which come after those of p at the same
+// time.
+func (p noisePlan) merge(o noisePlan) noisePlan {
+	return noisePlan{sources: append(append([]func() []noiseSource(nil), p.sources...), o.sources...), bytes: p.bytes + o.bytes}
+}
+
+// reserveNoise takes the noise frames' share out of a size budget of the
+// data traffic. A zero budget means unlimited and is kept.
+func reserveNoise(budget int, noise noisePlan) (int, error) {
+	if budget <= 0 || noise.bytes == 0 {
+		return budget, nil
+	}
+	if budget <= noise.bytes {
+		return 0, fmt.Errorf("size %d leaves no room for data after %d bytes of background noise, scenarios and chatter; lower noise-rate or scenario-rate, or drop background", budget, noise.bytes)
+	}
+	return budget - noise.bytes, nil
+}
+
+// noiseStream merges the frames of the sources of a plan by time, making
+// them as they come due.
+type noiseStream struct {
+	sources queuedSources
+	pending noiseFrames
+	buf     []noiseFrame
+	seq     int
+}
+
+// queuedSource is a source and when its next unit starts; order, its
+// place in the plan, breaks ties.
+type queuedSource struct {
+	src   noiseSource
+	at    time.Time
+	order int
+}
+
+// queuedSources is a heap of sources by when their next unit starts.
+type queuedSources []queuedSource
+
+func (h queuedSources) Len() int { return len(h) }
+func (h queuedSources) Less(i, j int) bool {
+	if !h[i].at.Equal(h[j].at) {
+		return h[i].at.Before(h[j].at)
+	}
+	return h[i].order < h[j].order
+}
+func (h queuedSources) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *queuedSources) Push(x any)   { *h = append(*h, x.(queuedSource)) }
+func (h *queuedSources) Pop() any {
+	old := *h
+	q := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return q
+}
+
+func (p noisePlan) stream() *noiseStream {
+	s := &noiseStream{}
+	for _, open := range p.sources {
+		for _, src := range open() {
+			if at, ok := src.next(); ok {
+				s.sources = append(s.sources, queuedSource{src: src, at: at, order: len(s.sources)})
+			}
+		}
+	}
+	heap.Init(&s.sources)
+	return s
+}
+
+// next returns the next frame if it is due by until, or whatever its time
+// for the zero time; ok is false if there is none.
+func (s *noiseStream) next(until time.Time) (f noiseFrame, ok bool, err error) {
+	for len(s.sources) > 0 {
+		q := &s.sources[0]
+		// The earliest frame made is due before any still to be made, or
+		// none to be made is due yet.
+		if len(s.pending) > 0 && !s.pending[0].ts.After(q.at) || !until.IsZero() && q.at.After(until) {
+			break
+		}
+		if s.buf, err = q.src.step(s.buf[:0]); err != nil {
+			return f, false, err
+		}
+		for _, f := range s.buf {
+			f.seq = s.seq
+			s.seq++
+			heap.Push(&s.pending, f)
+		}
+		if q.at, ok = q.src.next(); ok {
+			heap.Fix(&s.sources, 0)
+		} else {
+			heap.Pop(&s.sources)
+		}
+	}
+	if len(s.pending) == 0 || !until.IsZero() && s.pending[0].ts.After(until) {
+		return f, false, nil
+	}
+	return heap.Pop(&s.pending).(noiseFrame), true, nil
+}
+
+// noiseWriter interleaves the noise frames, and those of the scenarios
+// and the chatter, with the traffic by timestamp.
+// It sits outside the tenant and link writers, so noise is framed like
+// any other packet. Flush writes the frames left after the last packet.
+type noiseWriter struct {
+	pcapio.Writer
+	stream *noiseStream
+}
+
+func (w *noiseWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, meta pcapio.PacketMeta) error {
+	if err := w.writeNoise(ci.Timestamp); err != nil {
+		return err
+	}
+	return w.Writer.WritePacket(ci, data, meta)
+}
+
+func (w *noiseWriter) Flush() error {
+	if err := w.writeNoise(time.Time{}); err != nil {
+		return err
+	}
+	return w.Writer.Flush()
+}
+
+// writeNoise writes the frames due up to until, or all of them for the
+// zero time.
+func (w *noiseWriter) writeNoise(until time.Time) error {
+	for {
+		f, ok, err := w.stream.next(until)
+		if err != nil || !ok {
+			return err
+		}
+		ci := gopacket.CaptureInfo{Timestamp: f.ts, CaptureLength: len(f.data), Length: len(f.data)}
+		if err := w.Writer.WritePacket(ci, f.data, f.meta); err != nil {
+			return err
+		}
+	}
+}
@@ -9,11 +9,24 @@ import (
 )
 
 type PacketPlan struct {
+	IPv6     bool
 	Proto    layers.IPProtocol
 	SrcPort  uint16
 	DstPort  uint16
 	ICMPType uint8
 	ICMPCode uint8
+	// VLANTags is the number of 802.1Q tags on the frame.
+	VLANTags int
+	// EncapLen is what the writer adds to the frame: tenant encapsulation
+	// or 802.11 framing.
+	EncapLen int
+	// encryptedDNS is appDoT or appDoH for a DNS flow moved to an
+	// encrypted transport; see planEncryptedDNS.
+	encryptedDNS appKind
+	// Tunnel, when set, carries the IPv6 packet over IPv4.
+	Tunnel Tunnel
+	// MTU is that of the link, which TCP takes its MSS from; 0 is 1500.
+	MTU int
 }
 
 type tcpFlags struct {
@@ -29,63 +42,91 @@ func planFlow(r *rand.Rand, cfg Config) PacketPlan {
 }
 
 func planPacket(r *rand.Rand, cfg Config) PacketPlan {
+	plan := PacketPlan{VLANTags: cfg.VLAN.tagCount(), EncapLen: cfg.wrapLen(), MTU: cfg.MTU}
+	if cfg.IPv6Ratio > 0 {
+		plan.IPv6 = r.Float64() < cfg.IPv6Ratio
+	}
+	if t := cfg.Tunnels; t.enabled() && r.Float64() < t.Ratio {
+		plan.IPv6, plan.Tunnel = true, t.Kinds[r.Intn(len(t.Kinds))]
+	}
 	proto := cfg.ProtoDist.Pick(r)
-	plan := PacketPlan{Proto: proto}
+	plan.Proto = proto
 	switch proto {
 	case layers.IPProtocolTCP:
 		plan.DstPort = cfg.TCPPortDist.Pick(r)
-		plan.SrcPort = randomEphemeralPort(r)
+		plan.SrcPort = randomEphemeralPort(r, cfg.EphemeralPorts)
 	case layers.IPProtocolUDP:
 		plan.DstPort = cfg.UDPPortDist.Pick(r)
-		plan.SrcPort = randomEphemeralPort(r)
+		plan.SrcPort = randomEphemeralPort(r, cfg.EphemeralPorts)
 	case layers.IPProtocolICMPv4:
 		plan.ICMPType = layers.ICMPv4TypeEchoRequest
 		plan.ICMPCode = 0
 	default:
 		plan.Proto = layers.IPProtocolTCP
 		plan.DstPort = cfg.TCPPortDist.Pick(r)
-		plan.SrcPort = randomEphemeralPort(r)
+		plan.SrcPort = randomEphemeralPort(r, cfg.EphemeralPorts)
 	}
 	return plan
 }
 
-func planPayloadLen(r *rand.Rand, cfg Config, proto layers.IPProtocol) (payloadLen int, maxAdd int, basePayload int) {
+func planPayloadLen(r *rand.Rand, cfg Config, plan PacketPlan) (payloadLen int, maxAdd int, basePayload int) {
 	target := cfg.PktSizeDist.Pick(r)
-	base := basePacketLen(proto)
-	if target < base {
-		target = base
+	base, floor := basePacketLen(plan), minPacketLen(plan)
+	if target < floor {
+		target = floor
 	}
+	target = min(target, maxFrameLen(cfg, plan))
 	payloadLen = target - base
-	maxPayload := maxPayloadLen(proto)
+	maxPayload := maxFrameLen(cfg, plan) - base
 	maxAdd = maxPayload - payloadLen
 	if maxAdd < 0 {
 		maxAdd = 0
 	}
-	basePayload = payloadLen
+	// Payload that only stands in for padding cannot be removed: the frame
+	// would be padded back to the same length.
+	basePayload = payloadLen - (floor - base)
 	return payloadLen, maxAdd, basePayload
 }
 
-func basePacketLen(proto layers.IPProtocol) int {
-	switch proto {
+func basePacketLen(plan PacketPlan) int {
+	return plan.EncapLen + 4*plan.VLANTags + untaggedPacketLen(plan)
+}
+
+// minFrameLen is the shortest Ethernet frame, without FCS. Shorter frames
+// are padded to it, so packets are planned at least this long and the
+// padding is payload instead.
+const minFrameLen = 60
+
+// minPacketLen is the shortest packet of plan as written.
+func minPacketLen(plan PacketPlan) int {
+	return max(basePacketLen(plan), plan.EncapLen+minFrameLen)
+}
+
+func untaggedPacketLen(plan PacketPlan) int {
+	ipLen := 20
+	if plan.IPv6 {
+		ipLen = 40 + plan.Tunnel.overhead()
+	}
+	switch plan.Proto {
 	case layers.IPProtocolUDP:
-		return 14 + 20 + 8
+		return 14 + ipLen + 8
 	case layers.IPProtocolICMPv4:
-		return 14 + 20 + 8
+		return 14 + ipLen + 8
 	case layers.IPProtocolTCP:
 		fallthrough
 	default:
-		return 14 + 20 + 28
+		return 14 + ipLen + 28
 	}
 }
 
-func maxPayloadLen(proto layers.IPProtocol) int {
-	base := basePacketLen(proto)
-	const maxCaptureLen = 65535
-	return maxCaptureLen - base
-}
+// defaultEphemeralPorts is the range Linux picks client ports from.
+var defaultEphemeralPorts = PortRange{Min: 32768, Max: 60999}
 
-func randomEphemeralPort(r *rand.Rand) uint16 {
-	return uint16(49152 + r.Intn(65535-49152+1))
+func randomEphemeralPort(r *rand.Rand, ports PortRange) uint16 {
+	if ports.Min == 0 {
+		ports = defaultEphemeralPorts
+	}
+	return uint16(int(ports.Min) + r.Intn(int(ports.Max)-int(ports.Min)+1))
 }
 
 func pickTCPFlags(r *rand.Rand, isResponse bool, payloadLen int) tcpFlags {
@@ -143,21 +184,36 @@ func responseMask(r *rand.Rand, packetsPerFlow int, responseRatio float64) []boo
 	return mask
 }
 
-func planFlowSizing(cfg Config, totalPackets int, fileSeed int64) (baseSize int, totalPayload int, totalCapacity int, minSize int, err error) {
-	if totalPackets <= 0 {
+func planFlowSizing(cfg Config, packets []int, fileSeed int64, internal, external hostPool) (baseSize int, totalPayload int, totalCapacity int, minSize int, err error) {
+	if len(packets) == 0 {
 		return 0, 0, 0, 0, fmt.Errorf("totalPackets must be > 0")
 	}
 	for flowIdx := 0; flowIdx < cfg.FlowCount; flowIdx++ {
-		flowRand := rand.New(rand.NewSource(mixSeed(fileSeed, int64(flowIdx))))
+		flowRand := streamTraffic.rand(fileSeed, int64(flowIdx))
 		flowPlan := planFlow(flowRand, cfg)
-		for p := 0; p < cfg.PacketsPerFlow; p++ {
-			payloadLen, maxAdd, basePayload := planPayloadLen(flowRand, cfg, flowPlan.Proto)
-			baseLen := basePacketLen(flowPlan.Proto)
-			minSize += baseLen
+		planPersonaFlow(cfg, fileSeed, flowIdx, internal, external, &flowPlan)
+		l7 := planL7Flow(cfg, fileSeed, flowIdx, &flowPlan)
+		planEncryptedDNS(cfg, fileSeed, flowIdx, &flowPlan)
+		profiles := flowProfiles(cfg, internal, external, flowIdx, flowPlan)
+		respMask := flowDirections(cfg, fileSeed, flowIdx, l7, packets[flowIdx])
+		steps := flowSteps(cfg, fileSeed, flowIdx, flowPlan, respMask)
+		evasionAt, evasionPayload := evasionTarget(cfg, fileSeed, flowIdx, flowPlan, steps), 0
+		for p := 0; p < packets[flowIdx]; p++ {
+			payloadLen, maxAdd, basePayload := flowPayloadLen(flowRand, cfg, flowPlan, steps, p, p == evasionAt)
+			if p == evasionAt {
+				evasionPayload = payloadLen
+			}
+			baseLen := sessionPacketLen(flowPlan, steps, profiles, p)
+			minSize += max(baseLen, flowPlan.EncapLen+minFrameLen)
 			baseSize += baseLen + payloadLen
 			totalPayload += basePayload
 			totalCapacity += maxAdd
 		}
+		if evasionAt >= 0 {
+			extra := cfg.Evasion.extraPackets(evasionPayload) * (basePacketLen(flowPlan) + evasionPayloadLen)
+			minSize += extra
+			baseSize += extra
+		}
 	}
 	return baseSize, totalPayload, totalCapacity, minSize, nil
 }
@@ -167,11 +223,11 @@ func planPacketSizing(cfg Config, totalPackets int, fileSeed int64) (baseSize in
 		return 0, 0, 0, 0, fmt.Errorf("totalPackets must be > 0")
 	}
 	for i := 0; i < totalPackets; i++ {
-		planRand := rand.New(rand.NewSource(mixSeed(fileSeed, int64(i))))
+		planRand := streamTraffic.rand(fileSeed, int64(i))
 		packetPlan := planPacket(planRand, cfg)
-		payloadLen, maxAdd, basePayload := planPayloadLen(planRand, cfg, packetPlan.Proto)
-		baseLen := basePacketLen(packetPlan.Proto)
-		minSize += baseLen
+		payloadLen, maxAdd, basePayload := planPayloadLen(planRand, cfg, packetPlan)
+		baseLen := basePacketLen(packetPlan)
+		minSize += minPacketLen(packetPlan)
 		baseSize += baseLen + payloadLen
 		totalPayload += basePayload
 		totalCapacity += maxAdd
@@ -223,7 +279,3 @@ func mixSeed(seed int64, idx int64) int64 {
 	x ^= x >> 31
 	return int64(x)
 }
-
-func mixSeedWithSalt(seed int64, idx int64, salt uint64) int64 {
-	return mixSeed(seed, idx) ^ int64(salt&0x7fffffffffffffff)
-}
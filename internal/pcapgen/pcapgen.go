@@ -1,18 +1,24 @@
 package pcapgen
 
 import (
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"math/rand"
-	"net"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
-	"github.com/google/gopacket/pcapgo"
+
+	"genflux/internal/microburst"
+	"genflux/internal/pcapio"
 )
 
 type Config struct {
@@ -32,8 +38,114 @@ type Config struct {
 	ProtoDist      ProtoDist
 	TCPPortDist    PortDist
 	UDPPortDist    PortDist
+	// EphemeralPorts is where client source ports are drawn from; the
+	// zero value is the Linux range 32768-60999.
+	EphemeralPorts PortRange
 	PktSizeDist    SizeDist
 	ResponseRatio  float64
+	IPv6Ratio      float64
+	SessionModel   SessionModel
+	UniqueFlows    bool
+	VLAN           VLANConfig
+	Tenants        TenantConfig
+	Workers        int
+	Loss           LossConfig
+	Evasion        EvasionConfig
+	ZeroWindowRate float64
+	FlowTiming     bool
+	BurstGap       time.Duration
+	Link           Link
+	Format         pcapio.Format
+	// PayloadTemplates, when non-nil, binds application payloads to
+	// their flow; see PayloadTemplates.
+	PayloadTemplates PayloadTemplates
+	Wordlists        Wordlists
+	MACs             MACConfig
+	// L7Ratio is the share of flows turned into HTTP, TLS or DNS
+	// exchanges with bound payloads; see planL7Flow.
+	L7Ratio float64
+	// TrafficModel shapes the packet rate over the day; see TrafficModel.
+	TrafficModel TrafficModel
+	// Progress, when set, is called every few thousand packets and once
+	// each file is complete. An error from it stops the generation.
+	Progress func(Progress) error
+	// SizeSplit is how ExactBytes is shared out over several files; the
+	// zero value splits it evenly.
+	SizeSplit SizeSplit
+	// Noise mixes background internet noise into every file; see
+	// NoiseConfig.
+	Noise NoiseConfig
+	// EncryptedDNSRatio is the share of DNS flows carried over DoT or DoH
+	// instead; see planEncryptedDNS.
+	EncryptedDNSRatio float64
+	// Rotate writes files of MaxSizeBytes one after another, as tcpdump -C
+	// cuts a capture, until ExactBytes in total or TotalDuration of capture
+	// time is reached; FileCount is ignored. See planRotation.
+	Rotate        bool
+	TotalDuration time.Duration
+	// Tunnels carries a share of the traffic over IPv6 transition
+	// mechanisms; see TunnelConfig.
+	Tunnels TunnelConfig
+	// Microbursts squeezes the traffic into line-rate bursts now and then;
+	// see microburst.Shaper.
+	Microbursts microburst.Config
+	// Personas gives every host an operating system to pass for; see
+	// Persona.
+	Personas PersonaMix
+	// Sample writes only a sample of the traffic, as a sampling monitor
+	// would see it; see SampleConfig.
+	Sample SampleConfig
+	// Profile, when set, replaces the traffic mix with that of one
+	// application; DNS configures ProfileDNS.
+	Profile Profile
+	DNS     DNSConfig
+	// Scenarios mixes attacks with known ground truth into every file;
+	// see ScenarioConfig.
+	Scenarios ScenarioConfig
+	// Labels, when set, writes every flow of a file with its ground truth
+	// next to it; see FlowLabel.
+	Labels LabelFormat
+	// FlowExport, when set, exports the flows of every file as NetFlow v9
+	// or IPFIX records; see FlowExportConfig.
+	FlowExport FlowExportConfig
+	// PacketsDist spreads the packets of flow-count flows unevenly around
+	// PacketsPerFlow; see PacketsDist.
+	PacketsDist PacketsDist
+	// Concurrency is how many flow-count flows are open at once, their
+	// packets interleaved; 0 or 1 writes the flows one after another.
+	Concurrency int
+	// MTU, when set, is the largest IP packet written and sets the MSS of
+	// TCP sessions: packets are planned to fit it, or with Fragment, larger
+	// ones are written as IP fragments of it.
+	MTU      int
+	Fragment bool
+	// Snaplen, when set, is the snap length of the captures: frames are
+	// stored cut to it with their original length, as tcpdump -s stores
+	// them; 0 is 65535. Sizes still count the whole frames.
+	Snaplen int
+	// Encap, when set, carries every frame in a GRE, VXLAN or Geneve
+	// tunnel; see EncapConfig.
+	Encap EncapConfig
+	// MPLS, when set, is the label stack pushed onto every frame, top
+	// first, below its VLAN tags.
+	MPLS []uint32
+	// Background, when set, mixes the ARP, DHCP or NDP chatter of the
+	// internal hosts with their gateways into every file; see Background.
+	Background []Background
+}
+
+// Progress is how far the generation of one file has got.
+type Progress struct {
+	File string
+	// Packets is the number of packets written to File so far.
+	Packets int
+	// Bytes is the frame bytes written to File so far and Target the size
+	// it is generated to: exact-size, or max-size as an upper bound.
+	Bytes  int
+	Target int
+	Done   bool
+	// Files is the number of files the generation writes.
+	Files int
 }
 
 func DefaultConfig() Config {
@@ -57,15 +169,18 @@ func DefaultConfig() Config {
 		UDPPortDist:    DefaultUDPPortDist(),
 		PktSizeDist:    DefaultPktSizeDist(),
 		ResponseRatio:  0.35,
+		BurstGap:       time.Millisecond,
+		Workers:        runtime.NumCPU(),
+		Format:         pcapio.FormatPcap,
+		DNS:            DNSConfig{QPS: 100, Zipf: 1.2, NXDomainRatio: 0.05, TCPRatio: 0.01},
+		FlowExport:     FlowExportConfig{ActiveTimeout: 60 * time.Second, InactiveTimeout: 15 * time.Second},
 	}
 }
 
-type host struct {
-	mac net.HardwareAddr
-	ip  net.IP
-}
-
-func Generate(cfg Config) error {
+// Generate writes the captures cfg describes. Once ctx ends it stops with
+// ctx.Err(); on that or any other error it removes the file it was
+// writing, and files already finished are kept.
+func Generate(ctx context.Context, cfg Config) error {
 	if cfg.InternalHosts <= 0 || cfg.ExternalHosts <= 0 {
 		return errors.New("internal-hosts and external-hosts must be > 0")
 	}
@@ -75,14 +190,36 @@ func Generate(cfg Config) error {
 	if cfg.OutFile != "" && cfg.FileCount != 1 {
 		return errors.New("out-file requires file-count=1")
 	}
-	if cfg.ExactBytes > 0 && cfg.FileCount != 1 {
-		return errors.New("exact-size requires file-count=1")
+	if cfg.TotalDuration < 0 {
+		return errors.New("total-duration must be >= 0")
+	}
+	if cfg.Rotate {
+		if cfg.MaxSizeBytes <= 0 {
+			return errors.New("rotate requires max-size")
+		}
+		if cfg.ExactBytes <= 0 && cfg.TotalDuration == 0 {
+			return errors.New("rotate requires exact-size or total-duration")
+		}
+		if cfg.OutFile != "" {
+			return errors.New("rotate writes numbered files to out-dir; out-file is not supported")
+		}
+	} else if cfg.TotalDuration > 0 {
+		return errors.New("total-duration requires rotate")
+	}
+	if _, err := ParseSizeSplit(string(cfg.SizeSplit)); err != nil {
+		return err
 	}
 	if cfg.MinDuration <= 0 || cfg.MaxDuration <= 0 || cfg.MaxDuration < cfg.MinDuration {
 		return errors.New("invalid duration range")
 	}
-	if cfg.ExactBytes <= 0 {
-		return errors.New("exact-size must be > 0")
+	if cfg.ExactBytes < 0 || cfg.MaxSizeBytes < 0 {
+		return errors.New("exact-size and max-size must be >= 0")
+	}
+	if cfg.ExactBytes == 0 && cfg.MaxSizeBytes == 0 {
+		return errors.New("exact-size or max-size must be > 0")
+	}
+	if cfg.Workers < 0 {
+		return errors.New("workers must be >= 0")
 	}
 	if cfg.FlowCount < 0 {
 		return errors.New("flow-count must be >= 0")
@@ -90,96 +227,316 @@ func Generate(cfg Config) error {
 	if cfg.FlowCount > 0 && cfg.PacketsPerFlow <= 0 {
 		return errors.New("packets-per-flow must be > 0 when flow-count is set")
 	}
+	if err := cfg.PacketsDist.validate(); err != nil {
+		return err
+	}
+	if !cfg.PacketsDist.fixed() && cfg.FlowCount == 0 {
+		return errors.New("packets-dist requires flow-count")
+	}
+	if cfg.Concurrency < 0 {
+		return errors.New("concurrency must be >= 0")
+	}
+	if cfg.Concurrency > 1 && cfg.FlowCount == 0 {
+		return errors.New("concurrency requires flow-count")
+	}
+	if err := cfg.validateMTU(); err != nil {
+		return err
+	}
+	if cfg.Snaplen < 0 || cfg.Snaplen > 65535 {
+		return errors.New("snaplen must be within [0,65535]")
+	}
+	if err := cfg.Encap.validate(); err != nil {
+		return err
+	}
+	if cfg.Link == LinkWiFi && cfg.Encap.enabled() {
+		return errors.New("link wifi cannot be carried in encap")
+	}
+	if err := validateMPLS(cfg.MPLS); err != nil {
+		return err
+	}
+	if err := validateBackground(cfg.Background); err != nil {
+		return err
+	}
 	if cfg.ResponseRatio < 0 || cfg.ResponseRatio > 1 {
 		return errors.New("resp-ratio must be within [0,1]")
 	}
+	if cfg.IPv6Ratio < 0 || cfg.IPv6Ratio > 1 {
+		return errors.New("ipv6-ratio must be within [0,1]")
+	}
+	if cfg.UniqueFlows && cfg.FlowCount > 0 {
+		return errors.New("unique-flows applies to random mode; flow-count already generates distinct 5-tuples")
+	}
+	if err := cfg.Loss.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Noise.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Scenarios.validate(); err != nil {
+		return err
+	}
+	if err := cfg.FlowExport.validate(); err != nil {
+		return err
+	}
+	if err := cfg.Sample.validate(cfg.Link); err != nil {
+		return err
+	}
+	if err := cfg.Microbursts.Validate(); err != nil {
+		return err
+	}
+	if err := cfg.validateProfile(); err != nil {
+		return err
+	}
+	if cfg.Evasion.enabled() {
+		if cfg.FlowCount == 0 || cfg.SessionModel == SessionNone {
+			return errors.New("evasion requires flow-count and session-model")
+		}
+		if cfg.Evasion.Ratio <= 0 || cfg.Evasion.Ratio > 1 {
+			return errors.New("evasion-ratio must be within (0,1]")
+		}
+	}
+	if cfg.Tunnels.enabled() && (cfg.Tunnels.Ratio <= 0 || cfg.Tunnels.Ratio > 1) {
+		return errors.New("tunnel-ratio must be within (0,1]")
+	}
+	if cfg.ZeroWindowRate < 0 || cfg.ZeroWindowRate >= 1 {
+		return errors.New("zero-window-rate must be within [0,1)")
+	}
+	if cfg.ZeroWindowRate > 0 && (cfg.FlowCount == 0 || cfg.SessionModel == SessionNone) {
+		return errors.New("zero-window-rate requires flow-count and session-model")
+	}
+	if r := cfg.EphemeralPorts; r.Min > r.Max {
+		return errors.New("invalid ephemeral-ports range")
+	}
+	if cfg.L7Ratio < 0 || cfg.L7Ratio > 1 {
+		return errors.New("l7-ratio must be within [0,1]")
+	}
+	if cfg.L7Ratio > 0 && cfg.FlowCount == 0 {
+		return errors.New("l7-ratio requires flow-count")
+	}
+	if cfg.EncryptedDNSRatio < 0 || cfg.EncryptedDNSRatio > 1 {
+		return errors.New("encrypted-dns-ratio must be within [0,1]")
+	}
+	if cfg.EncryptedDNSRatio > 0 && cfg.FlowCount == 0 {
+		return errors.New("encrypted-dns-ratio requires flow-count")
+	}
+	if cfg.FlowTiming && cfg.FlowCount == 0 {
+		return errors.New("flow-timing requires flow-count")
+	}
+	if cfg.BurstGap < 0 {
+		return errors.New("burst-gap must be >= 0")
+	}
+	if cfg.Link == LinkWiFi && (cfg.VLAN.tagCount() > 0 || len(cfg.MPLS) > 0 || cfg.Tenants.Count > 0) {
+		return errors.New("link wifi cannot carry VLAN tags, MPLS labels or tenant encapsulation")
+	}
+	if err := cfg.Tenants.validate(); err != nil {
+		return err
+	}
+	exactBytes, maxSize := cfg.ExactBytes, cfg.MaxSizeBytes
+	if n := cfg.Tenants.Count; n > 0 {
+		// Each logical packet is written once per tenant, so plan the
+		// logical traffic against a per-tenant share of the size.
+		if exactBytes%n != 0 {
+			return fmt.Errorf("exact-size %d is not a multiple of tenants=%d (try %d)", exactBytes, n, exactBytes/n*n)
+		}
+		exactBytes /= n
+		maxSize /= n
+	}
+	if cfg.SessionModel != SessionNone && cfg.FlowCount == 0 {
+		return errors.New("session-model requires flow-count")
+	}
+	if n := sessionMinPackets(cfg.SessionModel); cfg.SessionModel != SessionNone && cfg.PacketsPerFlow < n {
+		return fmt.Errorf("session-model %s needs packets-per-flow >= %d, got %d", cfg.SessionModel, n, cfg.PacketsPerFlow)
+	}
+	if cfg.SessionModel != SessionNone && !cfg.PacketsDist.fixed() {
+		log.Printf("Sessions of flows that packets-dist %s draws shorter than %d packets are cut short", cfg.PacketsDist, sessionMinPackets(cfg.SessionModel))
+	}
 
-	randSrc := rand.New(rand.NewSource(cfg.Seed))
-
-	internal := make([]host, cfg.InternalHosts)
-	external := make([]host, cfg.ExternalHosts)
-	if cfg.FlowCount > 0 {
+	sequential := cfg.FlowCount > 0
+	if sequential {
 		if cfg.InternalHosts > 65536 {
 			return errors.New("internal-hosts exceeds 192.168.0.0/16 capacity (65536)")
 		}
 		if cfg.ExternalHosts > 16777216 {
 			return errors.New("external-hosts exceeds 10.0.0.0/8 capacity (16777216)")
 		}
-		for i := 0; i < cfg.InternalHosts; i++ {
-			internal[i] = host{mac: randomMAC(randSrc), ip: uniqueInternalIPv4(i)}
-		}
-		for i := 0; i < cfg.ExternalHosts; i++ {
-			external[i] = host{mac: randomMAC(randSrc), ip: uniqueExternalIPv4(i)}
-		}
-	} else {
-		for i := 0; i < cfg.InternalHosts; i++ {
-			internal[i] = host{mac: randomMAC(randSrc), ip: randomIPv4(randSrc, 192, 168)}
-		}
-		for i := 0; i < cfg.ExternalHosts; i++ {
-			external[i] = host{mac: randomMAC(randSrc), ip: randomIPv4(randSrc)}
-		}
 	}
+	ipv6 := cfg.IPv6Ratio > 0 || cfg.Tunnels.enabled()
+	internal := hostPool{side: sideInternal, count: cfg.InternalHosts, seed: cfg.Seed, sequential: sequential, ipv6: ipv6, vlans: cfg.VLAN, macs: cfg.MACs, personas: cfg.Personas}
+	external := hostPool{side: sideExternal, count: cfg.ExternalHosts, seed: cfg.Seed, sequential: sequential, ipv6: ipv6, macs: cfg.MACs, personas: cfg.Personas}
 
-	startTime := cfg.StartTime
-	for i := 0; i < cfg.FileCount; i++ {
+	var spans []fileSpan
+	var fileBytes []int
+	if cfg.Rotate {
+		spans, fileBytes = planRotation(cfg, exactBytes, maxSize)
+		cfg.FileCount = len(spans)
+	} else {
+		spans = planFiles(cfg)
+		fileBytes = splitExact(cfg, exactBytes, spans)
+	}
+	for i, span := range spans {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		path := cfg.OutFile
 		if path == "" {
-			name := "generated_0000.pcap"
+			name := "generated_0000" + cfg.Format.Ext()
 			if cfg.FileCount > 1 {
-				name = fmt.Sprintf("generated_%06d.pcap", i)
+				name = fmt.Sprintf("generated_%06d%s", i, cfg.Format.Ext())
 			}
 			path = filepath.Join(cfg.OutDir, name)
 		}
 
 		fileSeed := mixSeed(cfg.Seed, int64(i))
-		randSrc := rand.New(rand.NewSource(fileSeed))
-		dur := randomDuration(randSrc, cfg.MinDuration, cfg.MaxDuration)
-		if cfg.FileCount > 1 {
-			next := startTime
-			isWeekend := next.Weekday() == time.Saturday || next.Weekday() == time.Sunday
-			decimalHour := float64(next.Hour()) + float64(next.Minute())/60 + float64(next.Second())/3600
-			scale := durationScalar(decimalHour, isWeekend)
-			dur = time.Duration(float64(480)*scale) * time.Second
-			log.Printf("%s - duration=%s (scale=%.3f)", next.Format(time.RFC3339), dur.String(), scale)
-		}
-
-		if cfg.FlowCount > 0 {
-			if err := createPcapFileFlows(path, startTime, dur, cfg, cfg.ExactBytes, fileSeed, internal, external); err != nil {
-				return err
-			}
+		if span.scale > 0 {
+			log.Printf("%s - duration=%s (scale=%.3f)", span.start.Format(time.RFC3339), span.dur.String(), span.scale)
+		}
+
+		var err error
+		if cfg.Profile == ProfileDNS {
+			err = createDNSFile(ctx, path, span.start, span.dur, cfg, maxSize, fileSeed, internal, external)
+		} else if cfg.FlowCount > 0 {
+			err = createPcapFileFlows(ctx, path, span.start, span.dur, cfg, maxSize, fileBytes[i], fileSeed, internal, external)
 		} else {
-			if err := createPcapFile(path, startTime, dur, cfg, cfg.MaxSizeBytes, cfg.ExactBytes, fileSeed, internal, external); err != nil {
-				return err
-			}
+			err = createPcapFile(ctx, path, span.start, span.dur, cfg, maxSize, fileBytes[i], fileSeed, internal, external)
+		}
+		if err != nil {
+			removePartial(path, cfg)
+			return err
 		}
-		startTime = startTime.Add(dur)
 	}
 	return nil
 }
 
-func createPcapFileFlows(path string, start time.Time, duration time.Duration, cfg Config, exactBytes int, fileSeed int64, internal, external []host) error {
-	log.Printf("Creating %s flows=%d packetsPerFlow=%d duration=%s", path, cfg.FlowCount, cfg.PacketsPerFlow, duration)
+// fileSpan is the stretch of capture time one file covers. scale is the
+// share of the longest duration given to it when the traffic model sets
+// the durations, and 0 otherwise.
+type fileSpan struct {
+	start time.Time
+	dur   time.Duration
+	scale float64
+}
+
+// planFiles lays the files end to end from cfg.StartTime. In multi-file
+// mode the traffic model sets their durations, busier files being
+// shorter, unless it shares out the exact size instead.
+func planFiles(cfg Config) []fileSpan {
+	spans := make([]fileSpan, cfg.FileCount)
+	start := cfg.StartTime
+	for i := range spans {
+		fileSeed := mixSeed(cfg.Seed, int64(i))
+		span := fileSpan{start: start, dur: randomDuration(streamTiming.rand(fileSeed, -1), cfg.MinDuration, cfg.MaxDuration)}
+		if cfg.FileCount > 1 && cfg.TrafficModel.Kind != TrafficFlat && !(cfg.ExactBytes > 0 && cfg.SizeSplit == SplitTraffic) {
+			span.scale = cfg.TrafficModel.durationScale(start)
+			span.dur = time.Duration(float64(480)*span.scale) * time.Second
+		}
+		spans[i] = span
+		start = start.Add(span.dur)
+	}
+	return spans
+}
+
+// planRotation lays out the files of rotation mode the way tcpdump -C
+// cuts a continuous capture: each file is filled to exactly maxSize over a
+// duration drawn from min/max-duration, and files follow one another
+// until totalBytes or cfg.TotalDuration is reached, whichever comes first.
+// The last file takes what is left of both at the same packet rate.
+func planRotation(cfg Config, totalBytes, maxSize int) ([]fileSpan, []int) {
+	var spans []fileSpan
+	var sizes []int
+	start, used, elapsed := cfg.StartTime, 0, time.Duration(0)
+	for i := 0; ; i++ {
+		fileSeed := mixSeed(cfg.Seed, int64(i))
+		dur := randomDuration(streamTiming.rand(fileSeed, -1), cfg.MinDuration, cfg.MaxDuration)
+		size := maxSize
+		if totalBytes > 0 && totalBytes-used < size {
+			dur = time.Duration(float64(dur) * float64(totalBytes-used) / float64(size))
+			size = totalBytes - used
+		}
+		if rest := cfg.TotalDuration - elapsed; cfg.TotalDuration > 0 && dur > rest {
+			size = int(float64(size) * float64(rest) / float64(dur))
+			dur = rest
+		}
+		if size <= 0 || dur <= 0 {
+			break
+		}
+		spans = append(spans, fileSpan{start: start, dur: dur})
+		sizes = append(sizes, size)
+		start, used, elapsed = start.Add(dur), used+size, elapsed+dur
+		if (totalBytes > 0 && used >= totalBytes) || (cfg.TotalDuration > 0 && elapsed >= cfg.TotalDuration) {
+			break
+		}
+	}
+	return spans, sizes
+}
+
+// splitExact shares exactBytes out over the files of spans: evenly, or
+// by the traffic each file's span carries under the traffic model. Shares
+// are whole bytes summing to exactBytes. Without exact-size every file
+// gets 0.
+func splitExact(cfg Config, exactBytes int, spans []fileSpan) []int {
+	shares := make([]int, len(spans))
+	if exactBytes <= 0 {
+		return shares
+	}
+	weights := make([]float64, len(spans))
+	var total float64
+	for i, span := range spans {
+		weights[i] = 1
+		if cfg.SizeSplit == SplitTraffic {
+			weights[i] = cfg.TrafficModel.volume(span.start, span.dur)
+		}
+		total += weights[i]
+	}
+	// Floor every share, then hand the bytes left over to the files with
+	// the largest remainders, so the shares add up exactly.
+	type rest struct {
+		i    int
+		frac float64
+	}
+	rests := make([]rest, len(spans))
+	left := exactBytes
+	for i, w := range weights {
+		exact := float64(exactBytes) * w / total
+		shares[i] = int(exact)
+		left -= shares[i]
+		rests[i] = rest{i, exact - float64(shares[i])}
+	}
+	sort.SliceStable(rests, func(a, b int) bool { return rests[a].frac > rests[b].frac })
+	for k := 0; k < left; k++ {
+		shares[rests[k%len(rests)].i]++
+	}
+	return shares
+}
 
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+func createPcapFileFlows(ctx context.Context, path string, start time.Time, duration time.Duration, cfg Config, maxSize int, exactBytes int, fileSeed int64, internal, external hostPool) error {
+	log.Printf("Creating %s flows=%d packetsPerFlow=%d (%s) duration=%s", path, cfg.FlowCount, cfg.PacketsPerFlow, cfg.PacketsDist, duration)
+
+	noise, scenarios, err := planInjected(cfg, fileSeed, start, duration, internal, external)
+	if err != nil {
 		return err
 	}
-	f, err := os.Create(path)
+	f, writer, frames, err := openOutput(path, cfg, start, duration, internal, noise)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-
-	writer := pcapgo.NewWriter(f)
-	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+	budget := fileBudget(cfg, exactBytes, maxSize)
+	pipe := newFilePipeline(ctx, writer, cfg, path, fileSeed, start, duration, frames, budget)
+	defer pipe.close()
+	if exactBytes, err = reserveMgmt(cfg, exactBytes, duration, internal); err != nil {
+		return err
+	}
+	if exactBytes, err = reserveNoise(exactBytes, noise); err != nil {
 		return err
 	}
 
-	totalCapacity := 2 * len(internal) * len(external)
+	totalCapacity := 2 * internal.count * external.count
 	if cfg.FlowCount > totalCapacity {
 		return fmt.Errorf("flow-count exceeds capacity: flow-count=%d max=%d (2*internal*external)", cfg.FlowCount, totalCapacity)
 	}
+	packets := flowPackets(cfg, fileSeed)
 	totalPackets := cfg.FlowCount * cfg.PacketsPerFlow
-	baseSize, totalPayload, totalCapacityBytes, minSize, err := planFlowSizing(cfg, totalPackets, fileSeed)
+	baseSize, totalPayload, totalCapacityBytes, minSize, err := planFlowSizing(cfg, packets, fileSeed, internal, external)
 	if err != nil {
 		return err
 	}
@@ -197,8 +554,12 @@ func createPcapFileFlows(path string, start time.Time, duration time.Duration, c
 			return fmt.Errorf("exact-size requires payloadExtra=%d but max supported is %d; increase packets-per-flow or flow-count", payloadExtra, totalCapacityBytes)
 		}
 		_ = payloadExtra
-	} else if cfg.MaxSizeBytes > 0 && baseSize > cfg.MaxSizeBytes {
-		return fmt.Errorf("estimated size %d > max-size %d; increase max-size or reduce flow-count/packets-per-flow", baseSize, cfg.MaxSizeBytes)
+	} else if maxSize, err = reserveMgmt(cfg, maxSize, duration, internal); err != nil {
+		return err
+	} else if maxSize, err = reserveNoise(maxSize, noise); err != nil {
+		return err
+	} else if baseSize > maxSize {
+		return fmt.Errorf("estimated size %d > max-size %d; increase max-size or reduce flow-count/packets-per-flow", baseSize, maxSize)
 	}
 
 	if duration <= 0 {
@@ -213,6 +574,8 @@ func createPcapFileFlows(path string, start time.Time, duration time.Duration, c
 		usecStep = 1
 	}
 
+	warp := cfg.TrafficModel.warp(start, duration)
+	bursts := microburst.New(cfg.Microbursts, streamMicroburst.rand(fileSeed, -1), start)
 	packetIdx := 0
 	remainingPackets := totalPackets
 	remainingDelta := 0
@@ -227,90 +590,147 @@ func createPcapFileFlows(path string, start time.Time, duration time.Duration, c
 	}
 	remainingCapacity := totalCapacityBytes
 	remainingPayload := totalPayload
-	for flowIdx := 0; flowIdx < cfg.FlowCount; flowIdx++ {
-		internalIdx, externalIdx, internalAsSource := flowIndexToHosts(flowIdx, len(internal), len(external))
-		flowRand := rand.New(rand.NewSource(mixSeed(fileSeed, int64(flowIdx))))
-		flowPlan := planFlow(flowRand, cfg)
-		respRand := rand.New(rand.NewSource(mixSeedWithSalt(fileSeed, int64(flowIdx), 0x5bd1e995)))
-		respMask := responseMask(respRand, cfg.PacketsPerFlow, cfg.ResponseRatio)
-		for p := 0; p < cfg.PacketsPerFlow; p++ {
-			offsetUsec := packetIdx * usecStep
-			packetIdx++
-			packetTime := start.Add(time.Duration(offsetUsec) * time.Microsecond)
-			payloadLen, maxAdd, basePayload := planPayloadLen(flowRand, cfg, flowPlan.Proto)
-			adjustedPayload := payloadLen
-			if remainingDelta > 0 {
-				add := allocateDelta(remainingDelta, remainingCapacity, maxAdd, remainingPackets)
-				adjustedPayload += add
-				remainingDelta -= add
-				remainingCapacity -= maxAdd
-			} else if remainingRemove > 0 {
-				remove := allocateRemove(remainingRemove, remainingPayload, basePayload, remainingPackets)
-				adjustedPayload -= remove
-				remainingRemove -= remove
-				remainingPayload -= basePayload
+	var evasion []EvasionLabel
+	hosts := newPersonaLog(cfg)
+	var timer *flowTimer
+	if cfg.FlowTiming {
+		timer = newFlowTimer(cfg.BurstGap)
+	}
+	sched := newFlowScheduler(cfg, fileSeed, packets)
+	runs := map[int]*flowRun{}
+	for {
+		flowIdx, p, ok := sched.next()
+		if !ok {
+			break
+		}
+		flow := runs[flowIdx]
+		if p == 0 {
+			flow = openFlow(cfg, fileSeed, flowIdx, packets[flowIdx], internal, external, hosts, timer)
+			runs[flowIdx] = flow
+			if flowIdx%100000 == 0 && flowIdx > 0 && cfg.Progress == nil {
+				log.Printf("Creating flow %d", flowIdx)
 			}
-			remainingPackets--
-			payloadRand := rand.New(rand.NewSource(mixSeed(fileSeed, int64(flowIdx)<<32|int64(p))))
-			isResponse := respMask[p]
-			effectiveInternalAsSource := internalAsSource
-			if isResponse {
-				effectiveInternalAsSource = !internalAsSource
+		}
+		if p == packets[flowIdx]-1 {
+			delete(runs, flowIdx)
+		}
+		flowPlan, steps, profiles := flow.plan, flow.steps, flow.profiles
+		offsetUsec := packetIdx * usecStep
+		packetIdx++
+		packetTime := warp.at(start.Add(time.Duration(offsetUsec) * time.Microsecond))
+		payloadLen, maxAdd, basePayload := flowPayloadLen(flow.rand, cfg, flowPlan, steps, p, p == flow.evasionAt)
+		adjustedPayload := payloadLen
+		if remainingDelta > 0 {
+			add := allocateDelta(remainingDelta, remainingCapacity, maxAdd, remainingPackets)
+			adjustedPayload += add
+			remainingDelta -= add
+			remainingCapacity -= maxAdd
+		} else if remainingRemove > 0 {
+			remove := allocateRemove(remainingRemove, remainingPayload, basePayload, remainingPackets)
+			adjustedPayload -= remove
+			remainingRemove -= remove
+			remainingPayload -= basePayload
+		}
+		remainingPackets--
+		packetTime = bursts.At(packetTime, sessionPacketLen(flowPlan, steps, profiles, p)+adjustedPayload)
+		payloadSeed := int64(flowIdx)<<32 | int64(p)
+		isResponse := flow.respMask[p]
+		var seg *tcpSegment
+		if flow.session != nil {
+			isResponse = steps[p].fromServer
+			seg = flow.session.next(steps[p], adjustedPayload)
+		}
+		effectiveInternalAsSource := flow.internalAsSource
+		if isResponse {
+			effectiveInternalAsSource = !flow.internalAsSource
+		}
+		meta := pcapio.PacketMeta{Direction: tapDirection(effectiveInternalAsSource)}
+		if cfg.Format == pcapio.FormatPcapNG {
+			meta.Comment = packetComment(flowIdx, p, flowPlan, isResponse)
+		}
+		write := func(ts time.Time, meta pcapio.PacketMeta, seg *tcpSegment, payloadLen int) error {
+			written := pipe.written
+			env := cfg.payloadEnv(flow.l7, flowPlan, flowIdx, ts, external)
+			if env != nil {
+				env.opening = p == flow.openAt
 			}
-			packetData, err := createPacketForHosts(payloadRand, internal[internalIdx], external[externalIdx], effectiveInternalAsSource, flowPlan, isResponse, adjustedPayload)
-			if err != nil {
-				return err
+			// Session segments keep to the MSS; only the rest fragment.
+			n := 1
+			if seg == nil {
+				n, payloadLen = cfg.fragments(flowPlan, payloadLen)
 			}
-			ci := gopacket.CaptureInfo{
-				Timestamp:     packetTime,
-				CaptureLength: len(packetData),
-				Length:        len(packetData),
+			split := cfg.splitFragments(n, uint32(streamPayload.seed(fileSeed, payloadSeed)))
+			err := pipe.writeSplit(gopacket.CaptureInfo{Timestamp: ts}, meta, func() ([]byte, error) {
+				payloadRand := streamPayload.rand(fileSeed, payloadSeed)
+				return createPacketForHosts(payloadRand, internal.at(flow.internalIdx), flow.server(external), effectiveInternalAsSource, flowPlan, isResponse, payloadLen, seg, env)
+			}, split)
+			if timer != nil && pipe.written > written {
+				timer.observe(flowIdx, ts)
 			}
-			if err := writer.WritePacket(ci, packetData); err != nil {
+			return err
+		}
+		if p == flow.evasionAt {
+			labels, err := emitEvasion(cfg.Evasion, fileSeed, flowIdx, pipe, packetTime, meta, seg, adjustedPayload, write)
+			if err != nil {
 				return err
 			}
-		}
-		if flowIdx%100000 == 0 && flowIdx > 0 {
-			log.Printf("Creating flow %d", flowIdx)
+			evasion = append(evasion, labels...)
+		} else if err := write(packetTime, meta, seg, adjustedPayload); err != nil {
+			return err
 		}
 	}
 	if remainingDelta != 0 || remainingRemove != 0 {
 		return fmt.Errorf("payload distribution bug: remainingDelta=%d remainingRemove=%d", remainingDelta, remainingRemove)
 	}
-	log.Printf("Done %s packets=%d exactBytes=%d", path, totalPackets, exactBytes)
-
-	return nil
+	var flows []FlowTiming
+	if timer != nil {
+		flows = timer.result()
+	}
+	if err := finishFile(pipe, path, cfg, start, duration, evasion, flows, hosts.result(), scenarios); err != nil {
+		return err
+	}
+	return flushFile(pipe, path, cfg, budget, frames, "")
 }
 
-func createPcapFile(path string, start time.Time, duration time.Duration, cfg Config, maxSize int, exactBytes int, fileSeed int64, internal, external []host) error {
+func createPcapFile(ctx context.Context, path string, start time.Time, duration time.Duration, cfg Config, maxSize int, exactBytes int, fileSeed int64, internal, external hostPool) error {
 	log.Printf("Creating %s duration=%s", path, duration)
 
-	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+	noise, scenarios, err := planInjected(cfg, fileSeed, start, duration, internal, external)
+	if err != nil {
 		return err
 	}
-	f, err := os.Create(path)
+	f, writer, frames, err := openOutput(path, cfg, start, duration, internal, noise)
 	if err != nil {
 		return err
 	}
 	defer f.Close()
-
-	writer := pcapgo.NewWriter(f)
-	if err := writer.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+	budget := fileBudget(cfg, exactBytes, maxSize)
+	pipe := newFilePipeline(ctx, writer, cfg, path, fileSeed, start, duration, frames, budget)
+	defer pipe.close()
+	if exactBytes, err = reserveMgmt(cfg, exactBytes, duration, internal); err != nil {
+		return err
+	}
+	if exactBytes, err = reserveNoise(exactBytes, noise); err != nil {
+		return err
+	}
+	if maxSize, err = reserveMgmt(cfg, maxSize, duration, internal); err != nil {
+		return err
+	}
+	if maxSize, err = reserveNoise(maxSize, noise); err != nil {
 		return err
 	}
 
+	flows := newFlowSet(cfg.UniqueFlows, cfg.EphemeralPorts)
+	hosts := newPersonaLog(cfg)
 	if exactBytes > 0 {
-		const (
-			sizeFileHeader       = 24
-			sizePacketPlusHeader = 78
-		)
-		if exactBytes < sizeFileHeader+sizePacketPlusHeader {
-			return errors.New("exact-size too small for packet generation")
-		}
-		totalPackets := (exactBytes - sizeFileHeader) / sizePacketPlusHeader
-		if totalPackets <= 0 {
+		if exactBytes < minFrameLen+framingLen(cfg) {
 			return errors.New("exact-size too small for packet generation")
 		}
+		// As many packets as fit at the lengths the size distribution
+		// gives them, framing included; the bytes left over are spread
+		// over their payloads.
+		totalPackets, _ := fitPackets(cfg, exactBytes, fileSeed)
+		totalPackets = max(totalPackets, 1)
 		baseSize, totalPayload, totalCapacityBytes, minSize, err := planPacketSizing(cfg, totalPackets, fileSeed)
 		if err != nil {
 			return err
@@ -326,6 +746,9 @@ func createPcapFile(path string, start time.Time, duration time.Duration, cfg Co
 		startSec := start.Unix()
 		endSec := startSec + int64(duration.Seconds()) - 1
 		offsetUsec := 0
+		timingRand := streamTiming.rand(fileSeed, 0)
+		warp := cfg.TrafficModel.warp(start, duration)
+		bursts := microburst.New(cfg.Microbursts, streamMicroburst.rand(fileSeed, -1), start)
 
 		remainingPackets := totalPackets
 		remainingDelta := 0
@@ -339,16 +762,18 @@ func createPcapFile(path string, start time.Time, duration time.Duration, cfg Co
 		remainingPayload := totalPayload
 
 		for i := 0; i < totalPackets; i++ {
-			if i%100000 == 0 {
+			if i%100000 == 0 && cfg.Progress == nil {
 				log.Printf("Creating packet %d", i)
 			}
 
 			packetTime := time.Unix(startSec, int64(offsetUsec)*1000)
-			planRand := rand.New(rand.NewSource(mixSeed(fileSeed, int64(i))))
+			if warp != nil {
+				packetTime = warp.nth(i, totalPackets, timingRand.Float64())
+			}
+			planRand := streamTraffic.rand(fileSeed, int64(i))
 			packetPlan := planPacket(planRand, cfg)
-			respRand := rand.New(rand.NewSource(mixSeedWithSalt(fileSeed, int64(i), 0x5bd1e995)))
-			isResponse := respRand.Float64() < cfg.ResponseRatio
-			payloadLen, maxAdd, basePayload := planPayloadLen(planRand, cfg, packetPlan.Proto)
+			isResponse := streamDirection.rand(fileSeed, int64(i)).Float64() < cfg.ResponseRatio
+			payloadLen, maxAdd, basePayload := planPayloadLen(planRand, cfg, packetPlan)
 			adjustedPayload := payloadLen
 			if remainingDelta > 0 {
 				add := allocateDelta(remainingDelta, remainingCapacity, maxAdd, remainingPackets)
@@ -362,17 +787,8 @@ func createPcapFile(path string, start time.Time, duration time.Duration, cfg Co
 				remainingPayload -= basePayload
 			}
 			remainingPackets--
-			payloadRand := rand.New(rand.NewSource(mixSeedWithSalt(fileSeed, int64(i), 0x9e3779b97f4a7c15)))
-			packetData, err := createPacket(payloadRand, internal, external, packetPlan, isResponse, adjustedPayload)
-			if err != nil {
-				return err
-			}
-			ci := gopacket.CaptureInfo{
-				Timestamp:     packetTime,
-				CaptureLength: len(packetData),
-				Length:        len(packetData),
-			}
-			if err := writer.WritePacket(ci, packetData); err != nil {
+			packetTime = bursts.At(packetTime, basePacketLen(packetPlan)+adjustedPayload)
+			if err := writeRandomPacket(pipe, fileSeed, i, packetTime, cfg, internal, external, flows, hosts, packetPlan, isResponse, adjustedPayload); err != nil {
 				return err
 			}
 
@@ -384,7 +800,7 @@ func createPcapFile(path string, start time.Time, duration time.Duration, cfg Co
 			if interPacket < 1 {
 				interPacket = 1
 			}
-			offsetUsec += planRand.Intn(interPacket + 1)
+			offsetUsec += timingRand.Intn(interPacket + 1)
 			if offsetUsec >= 1_000_000 {
 				startSec++
 				offsetUsec -= 1_000_000
@@ -394,43 +810,40 @@ func createPcapFile(path string, start time.Time, duration time.Duration, cfg Co
 		if remainingDelta != 0 || remainingRemove != 0 {
 			return fmt.Errorf("payload distribution bug: remainingDelta=%d remainingRemove=%d", remainingDelta, remainingRemove)
 		}
-
-		return nil
+		if err := finishFile(pipe, path, cfg, start, duration, nil, nil, hosts.result(), scenarios); err != nil {
+			return err
+		}
+		return flushFile(pipe, path, cfg, budget, frames, fmt.Sprintf("uniqueFlows=%d", flows.count()))
 	}
 
-	sizeFileHeader := 24
-	sizePacketPlusHeader := 78
-	numPackets := (maxSize - sizeFileHeader) / sizePacketPlusHeader
-	if numPackets <= 0 {
+	numPackets, next := fitPackets(cfg, maxSize, fileSeed)
+	if numPackets == 0 {
 		return errors.New("max-size too small for packet generation")
 	}
+	budget.tolerance = next * max(cfg.Tenants.Count, 1)
 
 	startSec := start.Unix()
 	endSec := startSec + int64(duration.Seconds()) - 1
 	offsetUsec := 0
+	timingRand := streamTiming.rand(fileSeed, 0)
+	warp := cfg.TrafficModel.warp(start, duration)
+	bursts := microburst.New(cfg.Microbursts, streamMicroburst.rand(fileSeed, -1), start)
 
-	for i := 0; i < numPackets-1; i++ {
-		if i%100000 == 0 {
+	for i := 0; i < numPackets; i++ {
+		if i%100000 == 0 && cfg.Progress == nil {
 			log.Printf("Creating packet %d", i)
 		}
 
 		packetTime := time.Unix(startSec, int64(offsetUsec)*1000)
-		planRand := rand.New(rand.NewSource(mixSeed(fileSeed, int64(i))))
-		packetPlan := planPacket(planRand, cfg)
-		respRand := rand.New(rand.NewSource(mixSeedWithSalt(fileSeed, int64(i), 0x5bd1e995)))
-		isResponse := respRand.Float64() < cfg.ResponseRatio
-		payloadRand := rand.New(rand.NewSource(mixSeedWithSalt(fileSeed, int64(i), 0x9e3779b97f4a7c15)))
-		payloadLen, _, _ := planPayloadLen(planRand, cfg, packetPlan.Proto)
-		packetData, err := createPacket(payloadRand, internal, external, packetPlan, isResponse, payloadLen)
-		if err != nil {
-			return err
+		if warp != nil {
+			packetTime = warp.nth(i, numPackets, timingRand.Float64())
 		}
-		ci := gopacket.CaptureInfo{
-			Timestamp:     packetTime,
-			CaptureLength: len(packetData),
-			Length:        len(packetData),
-		}
-		if err := writer.WritePacket(ci, packetData); err != nil {
+		planRand := streamTraffic.rand(fileSeed, int64(i))
+		packetPlan := planPacket(planRand, cfg)
+		isResponse := streamDirection.rand(fileSeed, int64(i)).Float64() < cfg.ResponseRatio
+		payloadLen, _, _ := planPayloadLen(planRand, cfg, packetPlan)
+		packetTime = bursts.At(packetTime, basePacketLen(packetPlan)+payloadLen)
+		if err := writeRandomPacket(pipe, fileSeed, i, packetTime, cfg, internal, external, flows, hosts, packetPlan, isResponse, payloadLen); err != nil {
 			return err
 		}
 
@@ -442,27 +855,228 @@ func createPcapFile(path string, start time.Time, duration time.Duration, cfg Co
 		if interPacket < 1 {
 			interPacket = 1
 		}
-		offsetUsec += planRand.Intn(interPacket + 1)
+		offsetUsec += timingRand.Intn(interPacket + 1)
 		if offsetUsec >= 1_000_000 {
 			startSec++
 			offsetUsec -= 1_000_000
 		}
 	}
+	if err := finishFile(pipe, path, cfg, start, duration, nil, nil, hosts.result(), scenarios); err != nil {
+		return err
+	}
+	return flushFile(pipe, path, cfg, budget, frames, fmt.Sprintf("uniqueFlows=%d", flows.count()))
+}
 
+// flushFile flushes the capture at path after finishFile, since the
+// writer may still hold link-layer frames, logs the frames written with
+// the generator's own figures in detail, writes its labels, ends its flow
+// export and reports its size against budget.
+func flushFile(pipe *packetPipeline, path string, cfg Config, budget sizeBudget, frames *frameCounter, detail string) error {
+	if err := pipe.writer.Flush(); err != nil {
+		return err
+	}
+	written := frames.count.Snapshot()
+	done := fmt.Sprintf("Done %s packets=%d bytes=%d", path, written.Packets, written.Bytes)
+	if detail != "" {
+		done += " " + detail
+		if cfg.Tenants.Count > 0 {
+			// The generator's figures count each tenant's copy once.
+			done += " per tenant"
+		}
+	}
+	log.Print(done)
+	if frames.labels != nil {
+		if err := frames.labels.write(path, cfg); err != nil {
+			return err
+		}
+	}
+	if frames.export != nil {
+		if err := frames.export.close(); err != nil {
+			return err
+		}
+	}
+	budget.report(path, frames.written(), cfg.Loss.enabled())
+	if cfg.Progress != nil {
+		return cfg.Progress(Progress{File: path, Packets: pipe.written, Bytes: frames.written(), Target: budget.target, Done: true, Files: cfg.FileCount})
+	}
 	return nil
 }
 
-func createPacket(randSrc *rand.Rand, internal, external []host, plan PacketPlan, isResponse bool, payloadLen int) ([]byte, error) {
-	internalAsSource := randSrc.Intn(2) == 1
-	var src, dst host
+// framingLen is what VLAN tags, MPLS labels, tenant encapsulation, the
+// tunnel and the link layer add to each frame.
+func framingLen(cfg Config) int {
+	return 4*cfg.VLAN.tagCount() + cfg.wrapLen()
+}
+
+// wrapLen is what the writers add around each generated frame: MPLS
+// labels, tenant encapsulation, the tunnel and the link layer.
+func (cfg Config) wrapLen() int {
+	return 4*len(cfg.MPLS) + cfg.Tenants.encapLen() + cfg.Encap.overhead() + cfg.Link.overhead()
+}
+
+// StdoutPath is the OutFile value that streams the capture to stdout.
+const StdoutPath = "-"
+
+// openOutput creates the capture at path, or streams to stdout when path
+// is StdoutPath. Stdout is left open when the returned closer is called.
+// The link layer's own frames are scheduled over start and duration, and
+// the noise is mixed in. The counter sees every frame as written; the
+// labels and flow export, when on, every frame before the link layer.
+func openOutput(path string, cfg Config, start time.Time, duration time.Duration, internal hostPool, noise noisePlan) (io.Closer, pcapio.Writer, *frameCounter, error) {
+	var f io.WriteCloser = nopCloser{os.Stdout}
+	if path != StdoutPath {
+		if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+			return nil, nil, nil, err
+		}
+		file, err := os.Create(path)
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		f = file
+	}
+	writer, err := pcapio.NewWriter(f, cfg.Format, pcapio.WriterOptions{
+		Snaplen:       uint32(cfg.Snaplen),
+		LinkType:      cfg.Link.linkType(),
+		IfName:        "genflux0",
+		IfDescription: "genflux synthetic traffic",
+	})
+	if err != nil {
+		f.Close()
+		return nil, nil, nil, err
+	}
+	if cfg.Snaplen > 0 {
+		writer = snapWriter{Writer: writer, snaplen: cfg.Snaplen}
+	}
+	frames := &frameCounter{Writer: writer}
+	writer = frames
+	if cfg.Encap.enabled() {
+		writer = newEncapWriter(writer, cfg.Encap)
+	}
+	if cfg.Tenants.Count > 0 {
+		writer = &tenantWriter{Writer: writer, tenants: cfg.Tenants}
+	}
+	if cfg.Link == LinkWiFi {
+		writer = newWifiWriter(writer, wifiPlan{start: start, duration: duration, stations: internal})
+	}
+	if len(cfg.MPLS) > 0 {
+		writer = newMPLSWriter(writer, cfg.MPLS)
+	}
+	if cfg.Labels != LabelsNone {
+		frames.labels = newLabelWriter(writer)
+		writer = frames.labels
+	}
+	if cfg.FlowExport.enabled() {
+		if frames.export, err = newFlowMeter(writer, path, cfg); err != nil {
+			f.Close()
+			return nil, nil, nil, err
+		}
+		writer = frames.export
+		f = exportCloser{f, frames.export}
+	}
+	if len(noise.sources) > 0 {
+		writer = &noiseWriter{Writer: writer, stream: noise.stream()}
+	}
+	return f, writer, frames, nil
+}
+
+// removePartial deletes the capture at path, abandoned half written, and
+// its flow export file. Its manifest and labels are written last and so
+// do not exist yet.
+func removePartial(path string, cfg Config) {
+	if cfg.FlowExport.enabled() && cfg.FlowExport.Collector == "" {
+		os.Remove(flowExportPath(path, cfg))
+	}
+	if path == StdoutPath {
+		return
+	}
+	if err := os.Remove(path); err == nil {
+		log.Printf("Removed partial %s", path)
+	}
+}
+
+type nopCloser struct{ io.Writer }
+
+// exportCloser closes the flow export along with the capture, for when
+// the capture is given up on before flushFile.
+type exportCloser struct {
+	io.WriteCloser
+	export *flowMeter
+}
+
+func (c exportCloser) Close() error {
+	c.export.abandon()
+	return c.WriteCloser.Close()
+}
+
+func (nopCloser) Close() error { return nil }
+
+// snapWriter stores frames cut to the snap length, keeping their original
+// length, like a capture taken with a short snaplen.
+type snapWriter struct {
+	pcapio.Writer
+	snaplen int
+}
+
+func (w snapWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, meta pcapio.PacketMeta) error {
+	if len(data) > w.snaplen {
+		data = data[:w.snaplen]
+		ci.CaptureLength = w.snaplen
+	}
+	return w.Writer.WritePacket(ci, data, meta)
+}
+
+// tapDirection places the simulated tap at the edge of the internal
+// network: traffic leaving internal hosts is outbound.
+func tapDirection(internalAsSource bool) pcapio.Direction {
 	if internalAsSource {
-		src = internal[randSrc.Intn(len(internal))]
-		dst = external[randSrc.Intn(len(external))]
-	} else {
-		src = external[randSrc.Intn(len(external))]
-		dst = internal[randSrc.Intn(len(internal))]
+		return pcapio.DirectionOutbound
+	}
+	return pcapio.DirectionInbound
+}
+
+// packetComment describes a generated packet for pcapng comments. flowIdx
+// is -1 outside flow-count mode.
+func packetComment(flowIdx, packetIdx int, plan PacketPlan, isResponse bool) string {
+	dir := "request"
+	if isResponse {
+		dir = "response"
+	}
+	comment := fmt.Sprintf("flow=%d pkt=%d app=%s dir=%s", flowIdx, packetIdx, identifyApp(plan), dir)
+	if flowIdx < 0 {
+		comment = fmt.Sprintf("pkt=%d app=%s dir=%s", packetIdx, identifyApp(plan), dir)
+	}
+	if plan.Tunnel != "" {
+		comment += " tunnel=" + string(plan.Tunnel)
+	}
+	return comment
+}
+
+// writeRandomPacket addresses packet i of a random-mode file and queues it
+// on pipe. Addressing stays on the caller's goroutine because flows is
+// shared state; building the bytes is left to the pipeline.
+func writeRandomPacket(pipe *packetPipeline, fileSeed int64, i int, ts time.Time, cfg Config, internal, external hostPool, flows *flowSet, hosts *personaLog, plan PacketPlan, isResponse bool, payloadLen int) error {
+	src, dst, err := flows.assign(streamAddressing.rand(fileSeed, int64(i)), internal, external, &plan, isResponse)
+	if err != nil {
+		return err
+	}
+	hosts.add(src, dst)
+	meta := pcapio.PacketMeta{Direction: tapDirection(src.side == sideInternal)}
+	if cfg.Format == pcapio.FormatPcapNG {
+		meta.Comment = packetComment(-1, i, plan, isResponse)
 	}
-	return buildPacket(randSrc, src, dst, plan, isResponse, payloadLen)
+	env := cfg.payloadEnv(false, plan, -1, ts, external)
+	n, payloadLen := cfg.fragments(plan, payloadLen)
+	split := cfg.splitFragments(n, uint32(streamPayload.seed(fileSeed, int64(i))))
+	return pipe.writeSplit(gopacket.CaptureInfo{Timestamp: ts}, meta, func() ([]byte, error) {
+		return buildPacket(streamPayload.rand(fileSeed, int64(i)), src, dst, plan, isResponse, payloadLen, nil, env)
+	}, split)
+}
+
+func pickHosts(addrRand *rand.Rand, internal, external hostPool) (host, host) {
+	if addrRand.Intn(2) == 1 {
+		return internal.at(addrRand.Intn(internal.count)), external.at(addrRand.Intn(external.count))
+	}
+	return external.at(addrRand.Intn(external.count)), internal.at(addrRand.Intn(internal.count))
 }
 
 func flowIndexToHosts(idx, internalCount, externalCount int) (int, int, bool) {
@@ -474,7 +1088,7 @@ func flowIndexToHosts(idx, internalCount, externalCount int) (int, int, bool) {
 	return idx / externalCount, idx % externalCount, false
 }
 
-func createPacketForHosts(randSrc *rand.Rand, internalHost, externalHost host, internalAsSource bool, plan PacketPlan, isResponse bool, payloadLen int) ([]byte, error) {
+func createPacketForHosts(randSrc *rand.Rand, internalHost, externalHost host, internalAsSource bool, plan PacketPlan, isResponse bool, payloadLen int, seg *tcpSegment, env *payloadEnv) ([]byte, error) {
 	var src, dst host
 	if internalAsSource {
 		src = internalHost
@@ -483,30 +1097,70 @@ func createPacketForHosts(randSrc *rand.Rand, internalHost, externalHost host, i
 		src = externalHost
 		dst = internalHost
 	}
-	return buildPacket(randSrc, src, dst, plan, isResponse, payloadLen)
+	return buildPacket(randSrc, src, dst, plan, isResponse, payloadLen, seg, env)
 }
 
-func buildPacket(randSrc *rand.Rand, src host, dst host, plan PacketPlan, isResponse bool, payloadLen int) ([]byte, error) {
+func buildPacket(randSrc *rand.Rand, src host, dst host, plan PacketPlan, isResponse bool, payloadLen int, seg *tcpSegment, env *payloadEnv) ([]byte, error) {
 	eth := layers.Ethernet{
-		SrcMAC:       src.mac,
-		DstMAC:       dst.mac,
-		EthernetType: layers.EthernetTypeIPv4,
+		SrcMAC: src.mac,
+		DstMAC: dst.mac,
+	}
+	tags := dst.vlans
+	if src.side == sideInternal {
+		tags = src.vlans
+	}
+	etherType := layers.EthernetTypeIPv4
+	if plan.Tunnel != "" {
+		src, dst = tunnelInner(plan.Tunnel, src, dst)
+	}
+	ttl, window := uint8(128), uint16(8760)
+	if p := src.profile(); p != nil {
+		ttl, window = p.ttl, p.window
 	}
 
-	ip := layers.IPv4{
-		Version:  4,
-		IHL:      5,
-		TTL:      128,
-		Protocol: plan.Proto,
-		SrcIP:    src.ip,
-		DstIP:    dst.ip,
+	var network gopacket.NetworkLayer
+	var netLayer gopacket.SerializableLayer
+	if plan.IPv6 {
+		etherType = layers.EthernetTypeIPv6
+		nextHeader := plan.Proto
+		if plan.Proto == layers.IPProtocolICMPv4 {
+			nextHeader = layers.IPProtocolICMPv6
+		}
+		ip6 := &layers.IPv6{
+			Version:    6,
+			HopLimit:   ttl,
+			NextHeader: nextHeader,
+			SrcIP:      src.ip6,
+			DstIP:      dst.ip6,
+		}
+		network, netLayer = ip6, ip6
+	} else {
+		ip := &layers.IPv4{
+			Version:  4,
+			IHL:      5,
+			TTL:      ttl,
+			Protocol: plan.Proto,
+			SrcIP:    src.ip,
+			DstIP:    dst.ip,
+		}
+		network, netLayer = ip, ip
+	}
+	if seg != nil && seg.ttl != 0 {
+		switch l := network.(type) {
+		case *layers.IPv4:
+			l.TTL = seg.ttl
+		case *layers.IPv6:
+			l.HopLimit = seg.ttl
+		}
 	}
 
 	buf := gopacket.NewSerializeBuffer()
 	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
 	payload := []byte(nil)
-	if payloadLen > 0 {
-		payload = buildAppPayload(randSrc, plan, isResponse, payloadLen)
+	if seg != nil && seg.payload != nil {
+		payload = seg.payload
+	} else if payloadLen > 0 {
+		payload = buildAppPayload(randSrc, plan, isResponse, payloadLen, env.bind(src, dst, plan, isResponse))
 		if len(payload) == 0 {
 			payload = make([]byte, payloadLen)
 			if _, err := randSrc.Read(payload); err != nil {
@@ -515,28 +1169,35 @@ func buildPacket(randSrc *rand.Rand, src host, dst host, plan PacketPlan, isResp
 		}
 	}
 
+	var outer []gopacket.SerializableLayer
+	if plan.Tunnel != "" {
+		var err error
+		if outer, err = tunnelOuter(plan.Tunnel, src, dst); err != nil {
+			return nil, err
+		}
+		etherType = layers.EthernetTypeIPv4
+	}
+
+	ls := []gopacket.SerializableLayer{&eth}
+	for _, tag := range vlanLayers(&eth, tags, etherType) {
+		ls = append(ls, tag)
+	}
+	ls = append(ls, outer...)
+	ls = append(ls, netLayer)
 	switch plan.Proto {
 	case layers.IPProtocolUDP:
 		srcPort, dstPort := plan.SrcPort, plan.DstPort
 		if isResponse {
 			srcPort, dstPort = dstPort, srcPort
 		}
-		udp := layers.UDP{
+		udp := &layers.UDP{
 			SrcPort: layers.UDPPort(srcPort),
 			DstPort: layers.UDPPort(dstPort),
 		}
-		if err := udp.SetNetworkLayerForChecksum(&ip); err != nil {
+		if err := udp.SetNetworkLayerForChecksum(network); err != nil {
 			return nil, err
 		}
-		if payloadLen > 0 {
-			if err := gopacket.SerializeLayers(buf, opts, &eth, &ip, &udp, gopacket.Payload(payload)); err != nil {
-				return nil, err
-			}
-		} else {
-			if err := gopacket.SerializeLayers(buf, opts, &eth, &ip, &udp); err != nil {
-				return nil, err
-			}
-		}
+		ls = append(ls, udp)
 	case layers.IPProtocolICMPv4:
 		icmpType := plan.ICMPType
 		icmpCode := plan.ICMPCode
@@ -544,19 +1205,24 @@ func buildPacket(randSrc *rand.Rand, src host, dst host, plan PacketPlan, isResp
 			icmpType = layers.ICMPv4TypeEchoReply
 			icmpCode = 0
 		}
-		icmp := layers.ICMPv4{
-			TypeCode: layers.CreateICMPv4TypeCode(icmpType, icmpCode),
-			Id:       uint16(randSrc.Intn(65535)),
-			Seq:      uint16(randSrc.Intn(65535)),
-		}
-		if payloadLen > 0 {
-			if err := gopacket.SerializeLayers(buf, opts, &eth, &ip, &icmp, gopacket.Payload(payload)); err != nil {
-				return nil, err
+		id := uint16(randSrc.Intn(65535))
+		seq := uint16(randSrc.Intn(65535))
+		if plan.IPv6 {
+			icmp6Type := uint8(layers.ICMPv6TypeEchoRequest)
+			if icmpType == layers.ICMPv4TypeEchoReply {
+				icmp6Type = layers.ICMPv6TypeEchoReply
 			}
-		} else {
-			if err := gopacket.SerializeLayers(buf, opts, &eth, &ip, &icmp); err != nil {
+			icmp6 := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(icmp6Type, 0)}
+			if err := icmp6.SetNetworkLayerForChecksum(network); err != nil {
 				return nil, err
 			}
+			ls = append(ls, icmp6, &layers.ICMPv6Echo{Identifier: id, SeqNumber: seq})
+		} else {
+			ls = append(ls, &layers.ICMPv4{
+				TypeCode: layers.CreateICMPv4TypeCode(icmpType, icmpCode),
+				Id:       id,
+				Seq:      seq,
+			})
 		}
 	case layers.IPProtocolTCP:
 		fallthrough
@@ -565,90 +1231,55 @@ func buildPacket(randSrc *rand.Rand, src host, dst host, plan PacketPlan, isResp
 		if isResponse {
 			srcPort, dstPort = dstPort, srcPort
 		}
-		flags := pickTCPFlags(randSrc, isResponse, payloadLen)
-		tcp := layers.TCP{
+		var flags tcpFlags
+		var seq, ack uint32
+		var urgent uint16
+		options := []layers.TCPOption{
+			{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: binary.BigEndian.AppendUint16(nil, uint16(tcpMSS(plan)))},
+			{OptionType: layers.TCPOptionKindNop},
+			{OptionType: layers.TCPOptionKindNop},
+			{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
+		}
+		if seg != nil {
+			flags, seq, ack, urgent, window = seg.flags, seg.seq, seg.ack, seg.urgent, seg.window
+			if seg.options != nil {
+				options = seg.options
+			}
+		} else {
+			flags = pickTCPFlags(randSrc, isResponse, payloadLen)
+			seq = randSrc.Uint32()
+		}
+		tcp := &layers.TCP{
 			SrcPort:    layers.TCPPort(srcPort),
 			DstPort:    layers.TCPPort(dstPort),
-			Seq:        randSrc.Uint32(),
-			Ack:        0,
-			Window:     8760,
+			Seq:        seq,
+			Ack:        ack,
+			Window:     window,
 			FIN:        flags.FIN,
 			SYN:        flags.SYN,
 			RST:        flags.RST,
 			PSH:        flags.PSH,
 			ACK:        flags.ACK,
-			URG:        false,
+			URG:        urgent != 0,
+			Urgent:     urgent,
 			ECE:        false,
 			CWR:        false,
 			NS:         false,
-			DataOffset: 7,
-			Options: []layers.TCPOption{
-				{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xB4}},
-				{OptionType: layers.TCPOptionKindNop},
-				{OptionType: layers.TCPOptionKindNop},
-				{OptionType: layers.TCPOptionKindSACKPermitted, OptionLength: 2},
-			},
-		}
-		if err := tcp.SetNetworkLayerForChecksum(&ip); err != nil {
-			return nil, err
+			DataOffset: uint8(5 + tcpOptionsSize(options)/4),
+			Options:    options,
 		}
-		if payloadLen > 0 {
-			if err := gopacket.SerializeLayers(buf, opts, &eth, &ip, &tcp, gopacket.Payload(payload)); err != nil {
-				return nil, err
-			}
-		} else {
-			if err := gopacket.SerializeLayers(buf, opts, &eth, &ip, &tcp); err != nil {
-				return nil, err
-			}
+		if err := tcp.SetNetworkLayerForChecksum(network); err != nil {
+			return nil, err
 		}
+		ls = append(ls, tcp)
 	}
-	return buf.Bytes(), nil
-}
-
-func randomMAC(randSrc *rand.Rand) net.HardwareAddr {
-	return net.HardwareAddr{
-		byte(randSrc.Intn(256)),
-		byte(randSrc.Intn(256)),
-		byte(randSrc.Intn(256)),
-		byte(randSrc.Intn(256)),
-		byte(randSrc.Intn(256)),
-		byte(randSrc.Intn(256)),
-	}
-}
-
-func randomIPv4(randSrc *rand.Rand, prefix ...int) net.IP {
-	ip := make(net.IP, 4)
-	if len(prefix) >= 1 {
-		ip[0] = byte(prefix[0])
-	} else {
-		ip[0] = byte(randSrc.Intn(255) + 1)
+	if payloadLen > 0 {
+		ls = append(ls, gopacket.Payload(payload))
 	}
-	if len(prefix) >= 2 {
-		ip[1] = byte(prefix[1])
-	} else {
-		ip[1] = byte(randSrc.Intn(256))
+	if err := gopacket.SerializeLayers(buf, opts, ls...); err != nil {
+		return nil, err
 	}
-	ip[2] = byte(randSrc.Intn(256))
-	ip[3] = byte(randSrc.Intn(256))
-	return ip
-}
-
-func uniqueInternalIPv4(idx int) net.IP {
-	ip := make(net.IP, 4)
-	ip[0] = 192
-	ip[1] = 168
-	ip[2] = byte(idx / 256)
-	ip[3] = byte(idx % 256)
-	return ip
-}
-
-func uniqueExternalIPv4(idx int) net.IP {
-	ip := make(net.IP, 4)
-	ip[0] = 10
-	ip[1] = byte((idx >> 16) & 0xFF)
-	ip[2] = byte((idx >> 8) & 0xFF)
-	ip[3] = byte(idx & 0xFF)
-	return ip
+	return buf.Bytes(), nil
 }
 
 func randomDuration(randSrc *rand.Rand, min, max time.Duration) time.Duration {
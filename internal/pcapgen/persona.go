@@ -0,0 +1,351 @@
+package pcapgen
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// Persona is the operating system a generated host passes for. It sets the
+// host's TTL, TCP window and SYN options, the User-Agent of its HTTP
+// requests and, in flow mode, part of the services it uses as a client, so
+// passive fingerprinting tools classify every host the same way.
+type Persona string
+
+const (
+	PersonaWindows Persona = "windows"
+	PersonaLinux   Persona = "linux"
+	PersonaMacOS   Persona = "macos"
+	// PersonaIoT is an embedded device on a minimal stack such as lwIP.
+	PersonaIoT Persona = "iot"
+)
+
+// PersonaMix assigns personas to hosts with the given weights. Hosts get
+// theirs from the seed and their IPv4 address, so a host keeps its persona
+// across flows and files; the zero value assigns none.
+type PersonaMix struct {
+	Items []WeightedPersona
+	Total int
+}
+
+type WeightedPersona struct {
+	Persona Persona
+	Weight  int
+}
+
+// DefaultPersonaMix resembles an office network: mostly Windows desktops,
+// some Linux and Mac machines, and a few devices.
+func DefaultPersonaMix() PersonaMix {
+	return PersonaMix{Items: []WeightedPersona{
+		{PersonaWindows, 55},
+		{PersonaLinux, 20},
+		{PersonaMacOS, 15},
+		{PersonaIoT, 10},
+	}, Total: 100}
+}
+
+// ParsePersonaMix parses "default" or a list of personas with optional
+// weights such as "windows=60,linux=30,iot=10"; a bare name weighs 1.
+func ParsePersonaMix(value string) (PersonaMix, error) {
+	value = strings.TrimSpace(strings.ToLower(value))
+	if value == "default" {
+		return DefaultPersonaMix(), nil
+	}
+	var mix PersonaMix
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, weightText, hasWeight := strings.Cut(part, "=")
+		p := Persona(strings.TrimSpace(name))
+		if _, ok := personaProfiles[p]; !ok {
+			return PersonaMix{}, fmt.Errorf("unknown persona %q (want windows|linux|macos|iot)", name)
+		}
+		weight := 1
+		if hasWeight {
+			var err error
+			if weight, err = parseWeight(weightText); err != nil {
+				return PersonaMix{}, err
+			}
+		}
+		mix.Items = append(mix.Items, WeightedPersona{Persona: p, Weight: weight})
+		mix.Total += weight
+	}
+	if len(mix.Items) == 0 {
+		return PersonaMix{}, errors.New("empty persona mix")
+	}
+	return mix, nil
+}
+
+func (m PersonaMix) enabled() bool {
+	return m.Total > 0
+}
+
+// pick returns the persona of the host at ip.
+func (m PersonaMix) pick(seed int64, ip net.IP) Persona {
+	if !m.enabled() {
+		return ""
+	}
+	h := fnv.New64a()
+	h.Write(ip.To4())
+	n := int(uint64(mixSeed(seed, int64(h.Sum64()))) % uint64(m.Total))
+	for _, item := range m.Items {
+		if n < item.Weight {
+			return item.Persona
+		}
+		n -= item.Weight
+	}
+	return m.Items[len(m.Items)-1].Persona
+}
+
+// osProfile is what a persona looks like on the wire.
+type osProfile struct {
+	ttl uint8
+	// window is the receive window of its SYNs, and of all its segments
+	// outside scripted sessions.
+	window uint16
+	// synOptions is the order of the options of its SYNs; wscale is the
+	// shift it offers when they include window scaling.
+	synOptions []layers.TCPOptionKind
+	wscale     uint8
+	userAgents []string
+	// services are what its flows as a client turn to; see planPersonaFlow.
+	services []personaService
+}
+
+type personaService struct {
+	proto layers.IPProtocol
+	port  uint16
+}
+
+var personaProfiles = map[Persona]*osProfile{
+	PersonaWindows: {
+		ttl:    128,
+		window: 64240,
+		synOptions: []layers.TCPOptionKind{
+			layers.TCPOptionKindMSS, layers.TCPOptionKindNop, layers.TCPOptionKindWindowScale,
+			layers.TCPOptionKindNop, layers.TCPOptionKindNop, layers.TCPOptionKindSACKPermitted,
+		},
+		wscale: 8,
+		userAgents: []string{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36 Edg/124.0.0.0",
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:125.0) Gecko/20100101 Firefox/125.0",
+			"Microsoft-CryptoAPI/10.0",
+		},
+		services: []personaService{
+			{layers.IPProtocolTCP, 445},
+			{layers.IPProtocolTCP, 135},
+			{layers.IPProtocolTCP, 3389},
+			{layers.IPProtocolTCP, 88},
+			{layers.IPProtocolUDP, 137},
+		},
+	},
+	PersonaLinux: {
+		ttl:    64,
+		window: 64240,
+		synOptions: []layers.TCPOptionKind{
+			layers.TCPOptionKindMSS, layers.TCPOptionKindSACKPermitted, layers.TCPOptionKindTimestamps,
+			layers.TCPOptionKindNop, layers.TCPOptionKindWindowScale,
+		},
+		wscale: 7,
+		userAgents: []string{
+			"Mozilla/5.0 (X11; Linux x86_64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			"Mozilla/5.0 (X11; Ubuntu; Linux x86_64; rv:125.0) Gecko/20100101 Firefox/125.0",
+			"curl/8.5.0",
+			"Debian APT-HTTP/1.3 (2.6.1)",
+		},
+		services: []personaService{
+			{layers.IPProtocolTCP, 22},
+			{layers.IPProtocolUDP, 123},
+			{layers.IPProtocolTCP, 80},
+			{layers.IPProtocolTCP, 5432},
+		},
+	},
+	PersonaMacOS: {
+		ttl:    64,
+		window: 65535,
+		synOptions: []layers.TCPOptionKind{
+			layers.TCPOptionKindMSS, layers.TCPOptionKindNop, layers.TCPOptionKindWindowScale,
+			layers.TCPOptionKindNop, layers.TCPOptionKindNop, layers.TCPOptionKindTimestamps,
+			layers.TCPOptionKindSACKPermitted, layers.TCPOptionKindEndList, layers.TCPOptionKindEndList,
+		},
+		wscale: 6,
+		userAgents: []string{
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.4 Safari/605.1.15",
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/124.0.0.0 Safari/537.36",
+			"com.apple.trustd/3.0",
+		},
+		services: []personaService{
+			{layers.IPProtocolUDP, 5353},
+			{layers.IPProtocolTCP, 5223},
+			{layers.IPProtocolUDP, 123},
+		},
+	},
+	PersonaIoT: {
+		ttl:        255,
+		window:     5840,
+		synOptions: []layers.TCPOptionKind{layers.TCPOptionKindMSS},
+		userAgents: []string{
+			"ESP32HTTPClient",
+			"Roku/DVP-12.5 (12.5.0.4178-88)",
+		},
+		services: []personaService{
+			{layers.IPProtocolTCP, 1883},
+			{layers.IPProtocolTCP, 8883},
+			{layers.IPProtocolUDP, 5683},
+			{layers.IPProtocolUDP, 123},
+		},
+	},
+}
+
+func (h host) profile() *osProfile {
+	return personaProfiles[h.persona]
+}
+
+// personaServiceShare is the share of a client's flows that turn to one of
+// its persona's services.
+const personaServiceShare = 0.3
+
+// planPersonaFlow turns a share of the flows of clients with a persona
+// into one of its persona's services. It draws from its own stream, so the
+// other flows are the same as without personas.
+func planPersonaFlow(cfg Config, fileSeed int64, flowIdx int, internal, external hostPool, plan *PacketPlan) {
+	if !cfg.Personas.enabled() {
+		return
+	}
+	internalIdx, externalIdx, internalAsSource := flowIndexToHosts(flowIdx, internal.count, external.count)
+	client := external.at(externalIdx)
+	if internalAsSource {
+		client = internal.at(internalIdx)
+	}
+	r := streamPersona.rand(fileSeed, int64(flowIdx))
+	if r.Float64() >= personaServiceShare {
+		return
+	}
+	services := client.profile().services
+	svc := services[r.Intn(len(services))]
+	if plan.Proto != layers.IPProtocolTCP && plan.Proto != layers.IPProtocolUDP {
+		plan.SrcPort = randomEphemeralPort(r, cfg.EphemeralPorts)
+		plan.ICMPType, plan.ICMPCode = 0, 0
+	}
+	plan.Proto, plan.DstPort = svc.proto, svc.port
+}
+
+// flowProfiles returns the profiles of the client and server of flowIdx,
+// planned as plan; both are nil without personas.
+func flowProfiles(cfg Config, internal, external hostPool, flowIdx int, plan PacketPlan) [2]*osProfile {
+	if !cfg.Personas.enabled() {
+		return [2]*osProfile{}
+	}
+	internalIdx, externalIdx, internalAsSource := flowIndexToHosts(flowIdx, internal.count, external.count)
+	client, server := internal.at(internalIdx), external.at(externalIdx)
+	if r := flowResolver(plan, internalAsSource, client); r != nil {
+		server = r.serve(server)
+	}
+	if !internalAsSource {
+		client, server = server, client
+	}
+	return [2]*osProfile{client.profile(), server.profile()}
+}
+
+// layout lays out the options of a SYN from p. A SYN-ACK, which
+// answers peer's SYN, leaves out what peer did not offer along with the
+// NOPs aligning it, as a stack does when it declines an extension.
+// Timestamps echo tsecr.
+func (p *osProfile) layout(peer *osProfile, mss int, tsval, tsecr uint32) []layers.TCPOption {
+	opts := make([]layers.TCPOption, 0, len(p.synOptions))
+	for _, kind := range p.synOptions {
+		if peer != nil && kind != layers.TCPOptionKindMSS && kind > layers.TCPOptionKindNop && !peer.offers(kind) {
+			for len(opts) > 0 && opts[len(opts)-1].OptionType == layers.TCPOptionKindNop {
+				opts = opts[:len(opts)-1]
+			}
+			continue
+		}
+		opt := layers.TCPOption{OptionType: kind}
+		switch kind {
+		case layers.TCPOptionKindMSS:
+			opt.OptionData = binary.BigEndian.AppendUint16(nil, uint16(mss))
+		case layers.TCPOptionKindWindowScale:
+			opt.OptionData = []byte{p.wscale}
+		case layers.TCPOptionKindTimestamps:
+			opt.OptionData = binary.BigEndian.AppendUint32(binary.BigEndian.AppendUint32(nil, tsval), tsecr)
+		}
+		if kind > layers.TCPOptionKindNop {
+			opt.OptionLength = uint8(2 + len(opt.OptionData))
+		}
+		opts = append(opts, opt)
+	}
+	return opts
+}
+
+func (p *osProfile) offers(kind layers.TCPOptionKind) bool {
+	for _, k := range p.synOptions {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// tcpOptionsSize is the space opts take in a TCP header, padded to a
+// multiple of four bytes as on the wire.
+func tcpOptionsSize(opts []layers.TCPOption) int {
+	n := 0
+	for _, o := range opts {
+		n += max(1, int(o.OptionLength))
+	}
+	return (n + 3) &^ 3
+}
+
+// HostPersona is a host of a capture and the persona it was given.
+type HostPersona struct {
+	IP      string  `json:"ip"`
+	IPv6    string  `json:"ipv6,omitempty"`
+	Persona Persona `json:"persona"`
+}
+
+// personaLog lists the hosts of a capture with their personas, each once,
+// in order of first appearance. A nil log records nothing.
+type personaLog struct {
+	seen  map[string]struct{}
+	hosts []HostPersona
+}
+
+func newPersonaLog(cfg Config) *personaLog {
+	if !cfg.Personas.enabled() {
+		return nil
+	}
+	return &personaLog{seen: map[string]struct{}{}}
+}
+
+func (l *personaLog) add(hosts ...host) {
+	if l == nil {
+		return
+	}
+	for _, h := range hosts {
+		key := string(h.ip.To4())
+		if _, ok := l.seen[key]; ok || h.persona == "" {
+			continue
+		}
+		l.seen[key] = struct{}{}
+		entry := HostPersona{IP: h.ip.String(), Persona: h.persona}
+		if h.ip6 != nil {
+			entry.IPv6 = h.ip6.String()
+		}
+		l.hosts = append(l.hosts, entry)
+	}
+}
+
+func (l *personaLog) result() []HostPersona {
+	if l == nil {
+		return nil
+	}
+	return l.hosts
+}
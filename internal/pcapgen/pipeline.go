@@ -0,0 +1,193 @@
+package pcapgen
+
+import (
+	"sync"
+
+	"github.com/google/gopacket"
+
+	"genflux/internal/pcapio"
+)
+
+// pipelineBatch is the number of packets handed to the workers at once.
+const pipelineBatch = 256
+
+// checkpointEvery is how many packets pass between checkpoints.
+const checkpointEvery = 1 << 14
+
+// packetJob is a packet whose headers and timing are decided but whose
+// bytes are still to be built. build must only touch state owned by the
+// job, since jobs of a batch run concurrently. split, when set, turns the
+// packet into the frames written for it, such as IP fragments.
+type packetJob struct {
+	ci    gopacket.CaptureInfo
+	meta  pcapio.PacketMeta
+	build func() ([]byte, error)
+	split func([]byte) ([][]byte, error)
+	data  []byte
+	parts [][]byte
+	err   error
+}
+
+func (j *packetJob) run() {
+	j.data, j.err = j.build()
+	if j.err == nil && j.split != nil {
+		j.parts, j.err = j.split(j.data)
+	}
+}
+
+type jobBatch struct {
+	jobs []packetJob
+	done sync.WaitGroup
+}
+
+// packetPipeline builds packets on several workers and writes them in
+// submission order. Every packet draws from its own seed-derived random
+// streams, so the output does not depend on the number of workers.
+type packetPipeline struct {
+	writer  pcapio.Writer
+	workers int
+	// loss, when set, omits packets before they are built. generated
+	// counts every packet offered, written those that were kept.
+	loss *lossFilter
+	// sample, when set, is the sampler below writer.
+	sample    *sampler
+	generated int
+	written   int
+	cur       *jobBatch
+	work      chan *jobBatch
+	ordered   chan *jobBatch
+	wg        sync.WaitGroup
+	werr      chan error
+	failed    chan struct{}
+	closed    bool
+	err       error
+
+	// checkpoint, when set, runs every checkpointEvery packets; an error
+	// from it stops the file.
+	checkpoint func() error
+}
+
+func newPacketPipeline(writer pcapio.Writer, workers int, loss *lossFilter) *packetPipeline {
+	p := &packetPipeline{writer: writer, workers: workers, loss: loss}
+	if workers <= 1 {
+		return p
+	}
+	p.work = make(chan *jobBatch, workers)
+	p.ordered = make(chan *jobBatch, 2*workers)
+	p.werr = make(chan error, 1)
+	p.failed = make(chan struct{})
+	for w := 0; w < workers; w++ {
+		p.wg.Add(1)
+		go func() {
+			defer p.wg.Done()
+			for b := range p.work {
+				for i := range b.jobs {
+					b.jobs[i].run()
+				}
+				b.done.Done()
+			}
+		}()
+	}
+	go func() {
+		var err error
+		for b := range p.ordered {
+			b.done.Wait()
+			if err != nil {
+				continue
+			}
+			for i := range b.jobs {
+				if err = p.writeJob(&b.jobs[i]); err != nil {
+					close(p.failed)
+					break
+				}
+			}
+		}
+		p.werr <- err
+	}()
+	return p
+}
+
+func (p *packetPipeline) write(ci gopacket.CaptureInfo, meta pcapio.PacketMeta, build func() ([]byte, error)) error {
+	return p.submit(packetJob{ci: ci, meta: meta, build: build})
+}
+
+// writeSplit writes the packet build returns as the frames split makes of
+// it, all at its timestamp; a nil split writes it whole. It counts as one
+// packet.
+func (p *packetPipeline) writeSplit(ci gopacket.CaptureInfo, meta pcapio.PacketMeta, build func() ([]byte, error), split func([]byte) ([][]byte, error)) error {
+	return p.submit(packetJob{ci: ci, meta: meta, build: build, split: split})
+}
+
+func (p *packetPipeline) submit(j packetJob) error {
+	p.generated++
+	if p.checkpoint != nil && p.generated%checkpointEvery == 0 {
+		if err := p.checkpoint(); err != nil {
+			return err
+		}
+	}
+	if p.loss != nil && p.loss.drop(j.ci.Timestamp) {
+		return nil
+	}
+	p.written++
+	if p.workers <= 1 {
+		j.run()
+		return p.writeJob(&j)
+	}
+	select {
+	case <-p.failed:
+		return p.close()
+	default:
+	}
+	if p.cur == nil {
+		p.cur = &jobBatch{jobs: make([]packetJob, 0, pipelineBatch)}
+	}
+	p.cur.jobs = append(p.cur.jobs, j)
+	if len(p.cur.jobs) == pipelineBatch {
+		p.dispatch()
+	}
+	return nil
+}
+
+func (p *packetPipeline) dispatch() {
+	b := p.cur
+	p.cur = nil
+	b.done.Add(1)
+	p.ordered <- b
+	p.work <- b
+}
+
+func (p *packetPipeline) writeJob(j *packetJob) error {
+	if j.err != nil {
+		return j.err
+	}
+	for _, part := range j.parts {
+		j.ci.CaptureLength = len(part)
+		j.ci.Length = len(part)
+		if err := p.writer.WritePacket(j.ci, part, j.meta); err != nil {
+			return err
+		}
+	}
+	if j.parts != nil {
+		return nil
+	}
+	j.ci.CaptureLength = len(j.data)
+	j.ci.Length = len(j.data)
+	return p.writer.WritePacket(j.ci, j.data, j.meta)
+}
+
+// close writes the remaining packets and stops the workers. It returns the
+// first build or write error and may be called more than once.
+func (p *packetPipeline) close() error {
+	if p.workers <= 1 || p.closed {
+		return p.err
+	}
+	p.closed = true
+	if p.cur != nil && len(p.cur.jobs) > 0 {
+		p.dispatch()
+	}
+	close(p.work)
+	close(p.ordered)
+	p.wg.Wait()
+	p.err = <-p.werr
+	return p.err
+}
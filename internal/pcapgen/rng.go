@@ -0,0 +1,59 @@
+package pcapgen
+
+import "math/rand"
+
+// rngStream identifies an independent random stream derived from the seed.
+// Each generator module draws from its own stream, so changing one knob
+// (e.g. payload content) does not shift the random choices of the others.
+type rngStream uint64
+
+const (
+	streamAddressing rngStream = iota + 1
+	streamTiming
+	streamTraffic
+	streamDirection
+	streamPayload
+	streamAttacks
+	streamSession
+	streamLoss
+	streamL7
+	streamNoise
+	streamMicroburst
+	streamPersona
+	streamSample
+	streamDNS
+	streamScenario
+	streamPackets
+	streamSchedule
+	streamBackground
+)
+
+func (s rngStream) seed(seed int64, idx int64) int64 {
+	return mixSeed(mixSeed(seed, int64(s)), idx)
+}
+
+func (s rngStream) rand(seed int64, idx int64) *rand.Rand {
+	return rand.New(&splitMix64{state: uint64(s.seed(seed, idx))})
+}
+
+// splitMix64 is a small rand.Source64 that is cheap to create, so a fresh
+// stream can be derived per packet without the cost of rand.NewSource.
+type splitMix64 struct {
+	state uint64
+}
+
+func (s *splitMix64) Uint64() uint64 {
+	s.state += 0x9e3779b97f4a7c15
+	z := s.state
+	z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+	z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+	return z ^ (z >> 31)
+}
+
+func (s *splitMix64) Int63() int64 {
+	return int64(s.Uint64() & (1<<63 - 1))
+}
+
+func (s *splitMix64) Seed(seed int64) {
+	s.state = uint64(seed)
+}
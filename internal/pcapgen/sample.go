@@ -0,0 +1,246 @@
+package pcapgen
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"genflux/internal/pcapio"
+)
+
+// SampleFormat is what a sampled capture holds.
+type SampleFormat string
+
+const (
+	// SamplePcap keeps the sampled frames themselves.
+	SamplePcap SampleFormat = "pcap"
+	// SampleSFlow exports them as an sFlow v5 agent would: UDP datagrams
+	// to a collector, each carrying flow samples with the frames' first
+	// sflowHeaderLen bytes.
+	SampleSFlow SampleFormat = "sflow"
+)
+
+func ParseSampleFormat(value string) (SampleFormat, error) {
+	switch SampleFormat(strings.ToLower(strings.TrimSpace(value))) {
+	case "", SamplePcap:
+		return SamplePcap, nil
+	case SampleSFlow:
+		return SampleSFlow, nil
+	default:
+		return "", fmt.Errorf("unknown sample format %q (want pcap|sflow)", value)
+	}
+}
+
+// SampleConfig simulates a sampling monitor: the traffic is generated in
+// full, sizes and manifest included, but only a sample of its frames is
+// written. The gap between samples is random with a mean of Rate frames,
+// as sFlow agents draw it.
+type SampleConfig struct {
+	// Rate samples one frame in Rate; 0 writes every frame.
+	Rate   int
+	Format SampleFormat
+}
+
+func (c SampleConfig) enabled() bool {
+	return c.Rate > 0
+}
+
+func (c SampleConfig) validate(link Link) error {
+	if c.Rate < 0 {
+		return errors.New("sample rate must be >= 0")
+	}
+	if c.enabled() && c.Format == SampleSFlow && link != LinkEthernet {
+		return errors.New("sflow samples need link ethernet")
+	}
+	return nil
+}
+
+// SampleReport gives the known totals sampling estimators are judged by.
+// Frames and Bytes count everything generated, noise and link-layer
+// frames included, whether sampled or not.
+type SampleReport struct {
+	Rate         int          `json:"rate"`
+	Format       SampleFormat `json:"format"`
+	Frames       int64        `json:"frames"`
+	Bytes        int64        `json:"bytes"`
+	Sampled      int64        `json:"sampled_frames"`
+	SampledBytes int64        `json:"sampled_bytes"`
+	Datagrams    int          `json:"sflow_datagrams,omitempty"`
+}
+
+const (
+	// sflowHeaderLen is how much of a sampled frame a flow sample keeps,
+	// the usual agent default.
+	sflowHeaderLen = 128
+	// sflowMaxDatagram bounds the sFlow payload of one datagram, so that
+	// it fits an Ethernet MTU.
+	sflowMaxDatagram = 1400
+	// sflowMaxDelay is the longest a sample waits for its datagram.
+	sflowMaxDelay = time.Second
+)
+
+var (
+	sflowAgentMAC     = net.HardwareAddr{0x02, 0x00, 0x5e, 0x00, 0x5f, 0x01}
+	sflowCollectorMAC = net.HardwareAddr{0x02, 0x00, 0x5e, 0x00, 0x5f, 0x02}
+	sflowAgentIP      = net.IP{192, 0, 2, 1}
+	sflowCollectorIP  = net.IP{192, 0, 2, 2}
+)
+
+// sampler picks the frames to write. It sits below the frame counter, so
+// sizes count the full traffic.
+type sampler struct {
+	cfg    SampleConfig
+	rng    *rand.Rand
+	skip   int
+	report SampleReport
+
+	// The sFlow agent booted at boot; samples wait in records, the first
+	// of them since first, for their datagram.
+	boot      time.Time
+	first     time.Time
+	last      time.Time
+	records   []byte
+	count     uint32
+	datagrams uint32
+}
+
+func newSampler(cfg SampleConfig, fileSeed int64, start time.Time) *sampler {
+	if cfg.Format == "" {
+		cfg.Format = SamplePcap
+	}
+	s := &sampler{
+		cfg:    cfg,
+		rng:    streamSample.rand(fileSeed, 0),
+		report: SampleReport{Rate: cfg.Rate, Format: cfg.Format},
+		boot:   start,
+	}
+	s.skip = s.gap()
+	return s
+}
+
+// gap draws the number of frames up to and including the next sample.
+func (s *sampler) gap() int {
+	return 1 + s.rng.Intn(2*s.cfg.Rate-1)
+}
+
+func (s *sampler) write(w pcapio.Writer, ci gopacket.CaptureInfo, data []byte, meta pcapio.PacketMeta) error {
+	s.report.Frames++
+	s.report.Bytes += int64(len(data))
+	if s.skip--; s.skip > 0 {
+		return nil
+	}
+	s.skip = s.gap()
+	s.report.Sampled++
+	s.report.SampledBytes += int64(len(data))
+	if s.cfg.Format != SampleSFlow {
+		return w.WritePacket(ci, data, meta)
+	}
+
+	if len(s.records) > 0 && ci.Timestamp.Sub(s.first) >= sflowMaxDelay {
+		if err := s.flush(w); err != nil {
+			return err
+		}
+	}
+	header := data
+	if len(header) > sflowHeaderLen {
+		header = header[:sflowHeaderLen]
+	}
+	padded := (len(header) + 3) &^ 3
+	if len(s.records) > 0 && 28+len(s.records)+64+padded > sflowMaxDatagram {
+		if err := s.flush(w); err != nil {
+			return err
+		}
+	}
+	if len(s.records) == 0 {
+		s.first = ci.Timestamp
+	}
+	s.last = ci.Timestamp
+	// Interface 1 faces the internal network, 2 the outside.
+	in, out := uint32(2), uint32(1)
+	if meta.Direction == pcapio.DirectionOutbound {
+		in, out = 1, 2
+	}
+	s.count++
+	rec := make([]byte, 0, 64+padded)
+	rec = binary.BigEndian.AppendUint32(rec, 1) // flow_sample
+	rec = binary.BigEndian.AppendUint32(rec, uint32(56+padded))
+	rec = binary.BigEndian.AppendUint32(rec, s.count)
+	rec = binary.BigEndian.AppendUint32(rec, in) // source_id: ifIndex
+	rec = binary.BigEndian.AppendUint32(rec, uint32(s.cfg.Rate))
+	rec = binary.BigEndian.AppendUint32(rec, uint32(s.report.Frames)) // sample_pool
+	rec = binary.BigEndian.AppendUint32(rec, 0)                       // drops
+	rec = binary.BigEndian.AppendUint32(rec, in)
+	rec = binary.BigEndian.AppendUint32(rec, out)
+	rec = binary.BigEndian.AppendUint32(rec, 1) // one flow record
+	rec = binary.BigEndian.AppendUint32(rec, 1) // raw packet header
+	rec = binary.BigEndian.AppendUint32(rec, uint32(16+padded))
+	rec = binary.BigEndian.AppendUint32(rec, 1) // Ethernet
+	rec = binary.BigEndian.AppendUint32(rec, uint32(len(data)))
+	rec = binary.BigEndian.AppendUint32(rec, 0) // stripped
+	rec = binary.BigEndian.AppendUint32(rec, uint32(len(header)))
+	rec = append(rec, header...)
+	rec = append(rec, make([]byte, padded-len(header))...)
+	s.records = append(s.records, rec...)
+	return nil
+}
+
+// flush sends the waiting samples in one datagram, stamped with the last
+// of them.
+func (s *sampler) flush(w pcapio.Writer) error {
+	if len(s.records) == 0 {
+		return nil
+	}
+	samples := uint32(0)
+	for off := 0; off < len(s.records); samples++ {
+		off += 8 + int(binary.BigEndian.Uint32(s.records[off+4:]))
+	}
+	s.datagrams++
+	s.report.Datagrams++
+	payload := make([]byte, 0, 28+len(s.records))
+	payload = binary.BigEndian.AppendUint32(payload, 5) // version
+	payload = binary.BigEndian.AppendUint32(payload, 1) // IPv4 agent
+	payload = append(payload, sflowAgentIP...)
+	payload = binary.BigEndian.AppendUint32(payload, 0) // sub-agent
+	payload = binary.BigEndian.AppendUint32(payload, s.datagrams)
+	payload = binary.BigEndian.AppendUint32(payload, uint32(s.last.Sub(s.boot).Milliseconds()))
+	payload = binary.BigEndian.AppendUint32(payload, samples)
+	payload = append(payload, s.records...)
+	s.records = s.records[:0]
+
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    sflowAgentIP,
+		DstIP:    sflowCollectorIP,
+	}
+	udp := &layers.UDP{SrcPort: 6343, DstPort: 6343}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return err
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{SrcMAC: sflowAgentMAC, DstMAC: sflowCollectorMAC, EthernetType: layers.EthernetTypeIPv4},
+		ip, udp, gopacket.Payload(payload),
+	)
+	if err != nil {
+		return err
+	}
+	frame := buf.Bytes()
+	ci := gopacket.CaptureInfo{Timestamp: s.last, CaptureLength: len(frame), Length: len(frame)}
+	return w.WritePacket(ci, frame, pcapio.PacketMeta{Comment: "sflow", Direction: pcapio.DirectionOutbound})
+}
+
+func (s *sampler) result() *SampleReport {
+	r := s.report
+	return &r
+}
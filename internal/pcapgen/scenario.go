@@ -0,0 +1,633 @@
+package pcapgen
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"math/rand"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"genflux/internal/pcapio"
+)
+
+// Scenario is an attack mixed into the traffic with its ground truth in
+// the manifest, for validating IDS rules.
+type Scenario string
+
+const (
+	// ScenarioPortScan is a SYN scan of every port on one target after
+	// another, as nmap -sS runs it.
+	ScenarioPortScan Scenario = "portscan"
+	// ScenarioSweep probes one port across all targets before the next.
+	ScenarioSweep Scenario = "sweep"
+	// ScenarioBruteForce tries passwords against a login service of the
+	// first target, one connection per attempt, in bursts.
+	ScenarioBruteForce Scenario = "bruteforce"
+)
+
+const (
+	// maxScenarioTargets caps what ParseTargets expands CIDRs to.
+	maxScenarioTargets = 65536
+	// defaultScenarioTargets is how many internal hosts are attacked when
+	// no targets are given.
+	defaultScenarioTargets = 16
+)
+
+// ScenarioConfig mixes attacks from one host outside into every file; see
+// Scenario.
+type ScenarioConfig struct {
+	Kinds []Scenario
+	// Scanner is the attacker's address; nil draws a public one per file.
+	Scanner net.IP
+	// Targets are the addresses attacked; empty means the first internal
+	// hosts, up to defaultScenarioTargets.
+	Targets []net.IP
+	// Ports replace the ports of every kind; see Scenario.ports.
+	Ports []uint16
+	// Rate is the probes, or login attempts, a second; zero takes each
+	// kind's default.
+	Rate float64
+}
+
+// ParseScenarios parses a scenario list such as "portscan,bruteforce".
+func ParseScenarios(value string) ([]Scenario, error) {
+	var out []Scenario
+	for _, part := range strings.Split(value, ",") {
+		s := Scenario(strings.ToLower(strings.TrimSpace(part)))
+		switch s {
+		case "":
+			continue
+		case ScenarioPortScan, ScenarioSweep, ScenarioBruteForce:
+			out = append(out, s)
+		default:
+			return nil, fmt.Errorf("unknown scenario %q (want portscan|sweep|bruteforce)", part)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("empty scenario list")
+	}
+	return out, nil
+}
+
+// ParseTargets parses addresses and CIDR prefixes such as
+// "192.168.0.0/28,192.168.1.5". A prefix stands for its hosts, without
+// the network and broadcast addresses when it has them.
+func ParseTargets(value string) ([]net.IP, error) {
+	var out []net.IP
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		if !strings.Contains(part, "/") {
+			ip := net.ParseIP(part).To4()
+			if ip == nil {
+				return nil, fmt.Errorf("invalid target %q (want an IPv4 address or prefix)", part)
+			}
+			out = append(out, ip)
+			continue
+		}
+		_, ipn, err := net.ParseCIDR(part)
+		if err != nil || ipn.IP.To4() == nil {
+			return nil, fmt.Errorf("invalid target %q (want an IPv4 address or prefix)", part)
+		}
+		ones, _ := ipn.Mask.Size()
+		first := binary.BigEndian.Uint32(ipn.IP.To4())
+		last := first | (1<<(32-ones) - 1)
+		if ones < 31 {
+			first, last = first+1, last-1
+		}
+		if len(out)+int(last-first) >= maxScenarioTargets {
+			return nil, fmt.Errorf("targets expand to more than %d addresses", maxScenarioTargets)
+		}
+		for v := first; ; v++ {
+			out = append(out, binary.BigEndian.AppendUint32(nil, v))
+			if v == last {
+				break
+			}
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("empty target list")
+	}
+	return out, nil
+}
+
+// ParsePortList parses ports and ranges such as "22,80,8000-8100". Order
+// is kept.
+func ParsePortList(value string) ([]uint16, error) {
+	var ports []uint16
+	for _, part := range strings.Split(value, ",") {
+		if strings.TrimSpace(part) == "" {
+			continue
+		}
+		r, err := ParsePortRange(part)
+		if err != nil {
+			return nil, err
+		}
+		for p := int(r.Min); p <= int(r.Max); p++ {
+			ports = append(ports, uint16(p))
+		}
+	}
+	if len(ports) == 0 {
+		return nil, errors.New("empty port list")
+	}
+	return ports, nil
+}
+
+func (c ScenarioConfig) enabled() bool {
+	return len(c.Kinds) > 0
+}
+
+func (c ScenarioConfig) validate() error {
+	if !c.enabled() {
+		return nil
+	}
+	if c.Scanner != nil && c.Scanner.To4() == nil {
+		return errors.New("scanner-ip must be an IPv4 address")
+	}
+	for _, ip := range c.Targets {
+		if ip.To4() == nil {
+			return fmt.Errorf("target %s is not an IPv4 address", ip)
+		}
+	}
+	if c.Rate < 0 {
+		return errors.New("scenario-rate must be >= 0")
+	}
+	return nil
+}
+
+// ports returns the ports the scenario attacks: c.Ports, or 1-1024 for a
+// port scan, 445 for a sweep and 22 for a brute force. A brute force
+// takes only the first.
+func (s Scenario) ports(c ScenarioConfig) []uint16 {
+	ports := c.Ports
+	if len(ports) == 0 {
+		switch s {
+		case ScenarioPortScan:
+			for p := 1; p <= 1024; p++ {
+				ports = append(ports, uint16(p))
+			}
+		case ScenarioSweep:
+			ports = []uint16{445}
+		default:
+			ports = []uint16{22}
+		}
+	}
+	if s == ScenarioBruteForce {
+		return ports[:1]
+	}
+	return ports
+}
+
+// rate returns the probes, or login attempts, a second of the scenario.
+func (s Scenario) rate(c ScenarioConfig) float64 {
+	switch {
+	case c.Rate > 0:
+		return c.Rate
+	case s == ScenarioBruteForce:
+		return 4
+	default:
+		return 500
+	}
+}
+
+// ScenarioLabel is the ground truth of one scenario in a file. Probes is
+// the SYNs of a scan or the login attempts of a brute force; Packets
+// counts theirs and the replies, which Loss never drops. Open lists the
+// ADDR:PORT a scan found open.
+type ScenarioLabel struct {
+	Scenario Scenario  `json:"scenario"`
+	Attacker string    `json:"attacker"`
+	Targets  []string  `json:"targets"`
+	Ports    string    `json:"ports"`
+	Start    time.Time `json:"start"`
+	End      time.Time `json:"end"`
+	Probes   int       `json:"probes"`
+	Packets  int       `json:"packets"`
+	Open     []string  `json:"open,omitempty"`
+}
+
+// planInjected plans the frames mixed into the traffic of a file from
+// outside it: the noise, the attacks of the scenarios, with the attacks'
+// labels, and the hosts' background chatter.
+func planInjected(cfg Config, fileSeed int64, start time.Time, duration time.Duration, internal, external hostPool) (noisePlan, []ScenarioLabel, error) {
+	noise, err := planNoise(cfg, fileSeed, start, duration, internal, external)
+	if err != nil {
+		return noise, nil, err
+	}
+	attacks, labels, err := planScenarios(cfg, fileSeed, start, duration, internal, external)
+	if err != nil {
+		return noise, nil, err
+	}
+	background, err := planBackground(cfg, fileSeed, start, duration, internal)
+	if err != nil {
+		return noise, nil, err
+	}
+	return noise.merge(attacks).merge(background), labels, nil
+}
+
+// scenarioRun lays out the frames of one scenario, a probe or a login at
+// a time.
+type scenarioRun struct {
+	cfg      *Config
+	r        *rand.Rand
+	attacker host
+	// ttl is what is left of the attacker's TTL at the edge; netRTT is the
+	// round trip from the edge to the attacker.
+	ttl    uint8
+	netRTT time.Duration
+	begin  time.Time
+	end    time.Time
+	label  ScenarioLabel
+	// at is when the next probe or login starts, and unit lays it out;
+	// unit is nil once the scenario is done.
+	at     time.Time
+	unit   func() error
+	frames []noiseFrame
+}
+
+func (s *scenarioRun) next() (time.Time, bool) {
+	return s.at.Truncate(time.Microsecond), s.unit != nil
+}
+
+func (s *scenarioRun) step(frames []noiseFrame) ([]noiseFrame, error) {
+	s.frames = frames
+	err := s.unit()
+	return s.frames, err
+}
+
+// planScenarios lays out cfg.Scenarios over the capture, each kind from a
+// random time in its first half until it is done or the capture ends.
+func planScenarios(cfg Config, fileSeed int64, start time.Time, duration time.Duration, internal, external hostPool) (noisePlan, []ScenarioLabel, error) {
+	var plan noisePlan
+	c := cfg.Scenarios
+	if !c.enabled() {
+		return plan, nil, nil
+	}
+	r := streamScenario.rand(fileSeed, -1)
+	attacker := host{side: sideExternal, mac: external.at(r.Intn(external.count)).mac, ip: c.Scanner.To4()}
+	if attacker.ip == nil {
+		attacker.ip = publicIPv4(r)
+	}
+	targets := scenarioTargets(c, internal)
+	var labels []ScenarioLabel
+	for k, kind := range c.Kinds {
+		k, kind := k, kind
+		open := func() []noiseSource {
+			return []noiseSource{newScenarioRun(&cfg, fileSeed, k, kind, attacker, targets, start, duration)}
+		}
+		s := open()[0].(*scenarioRun)
+		bytes, last, err := drain(cfg, s)
+		if err != nil {
+			return plan, nil, err
+		}
+		if s.label.Packets == 0 {
+			continue
+		}
+		s.label.End = last
+		labels = append(labels, s.label)
+		plan = plan.merge(noisePlan{sources: []func() []noiseSource{open}, bytes: bytes})
+	}
+	return plan, labels, nil
+}
+
+// newScenarioRun starts the scenario of kind, the k-th of the capture.
+func newScenarioRun(cfg *Config, fileSeed int64, k int, kind Scenario, attacker host, targets []host, start time.Time, duration time.Duration) *scenarioRun {
+	c := cfg.Scenarios
+	s := &scenarioRun{cfg: cfg, r: streamScenario.rand(fileSeed, int64(k)), attacker: attacker, end: start.Add(duration)}
+	s.ttl = uint8(40 + s.r.Intn(24))
+	s.netRTT = time.Duration(20+s.r.Intn(130)) * time.Millisecond
+	s.begin = start.Add(time.Duration(s.r.Int63n(int64(duration)/2 + 1))).Truncate(time.Microsecond)
+	ports := kind.ports(c)
+	s.label = ScenarioLabel{Scenario: kind, Attacker: attacker.ip.String(), Ports: formatPorts(ports), Start: s.begin}
+	switch kind {
+	case ScenarioPortScan:
+		s.scan(targets, ports, false, kind.rate(c))
+	case ScenarioSweep:
+		s.scan(targets, ports, true, kind.rate(c))
+	case ScenarioBruteForce:
+		s.bruteForce(bruteForceTarget(targets, ports[0]), ports[0], kind.rate(c))
+	}
+	return s
+}
+
+// scenarioTargets returns the hosts of c.Targets, or the first internal
+// hosts. A target given by address takes the MAC and VLANs of the
+// internal host its address picks.
+func scenarioTargets(c ScenarioConfig, internal hostPool) []host {
+	if len(c.Targets) == 0 {
+		hosts := make([]host, min(internal.count, defaultScenarioTargets))
+		for i := range hosts {
+			hosts[i] = internal.at(i)
+		}
+		return hosts
+	}
+	hosts := make([]host, len(c.Targets))
+	for i, ip := range c.Targets {
+		h := internal.at(pickWord(ip, internal.count))
+		h.ip, h.ip6 = ip.To4(), nil
+		h.vlans = internal.vlans.tagsFor(h)
+		h.persona = internal.personas.pick(internal.seed, h.ip)
+		hosts[i] = h
+	}
+	return hosts
+}
+
+// scenarioOpenPorts are the services a target may run. Whether it does
+// follows from its address, so every scan of it agrees.
+var scenarioOpenPorts = []uint16{21, 22, 23, 25, 53, 80, 110, 135, 139, 143, 443, 445, 993, 995, 1433, 3306, 3389, 5432, 5900, 8080}
+
+// portOpen reports whether the target at ip listens on port.
+func portOpen(ip net.IP, port uint16) bool {
+	for _, p := range scenarioOpenPorts {
+		if p == port {
+			h := fnv.New64a()
+			h.Write(ip)
+			h.Write([]byte{byte(port >> 8), byte(port)})
+			return h.Sum64()%2 == 0
+		}
+	}
+	return false
+}
+
+// firewalled reports whether the target at ip drops probes of closed
+// ports instead of answering them with a reset.
+func firewalled(ip net.IP) bool {
+	return pickWord(ip, 4) == 0
+}
+
+// bruteForceTarget returns the first target with port open, or the first
+// target when none has.
+func bruteForceTarget(targets []host, port uint16) host {
+	for _, t := range targets {
+		if portOpen(t.ip, port) {
+			return t
+		}
+	}
+	return targets[0]
+}
+
+// scan sends a SYN to every port of every target, rate a second: all the
+// ports of a target before the next, or with sweep each port across all
+// targets before the next. An open port answers with a SYN-ACK that the
+// scanner resets; a closed one resets unless its host is firewalled.
+func (s *scenarioRun) scan(targets []host, ports []uint16, sweep bool, rate float64) {
+	r := s.r
+	// Scanners randomize the order within a pass, and send from one port.
+	targets = append([]host(nil), targets...)
+	ports = append([]uint16(nil), ports...)
+	r.Shuffle(len(targets), func(a, b int) { targets[a], targets[b] = targets[b], targets[a] })
+	r.Shuffle(len(ports), func(a, b int) { ports[a], ports[b] = ports[b], ports[a] })
+	plan := PacketPlan{Proto: layers.IPProtocolTCP, SrcPort: uint16(1024 + r.Intn(64512)), VLANTags: s.cfg.VLAN.tagCount()}
+	mss := []layers.TCPOption{{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: []byte{0x05, 0xb4}}}
+	outer, inner := len(targets), len(ports)
+	if sweep {
+		outer, inner = inner, outer
+	}
+	seen := map[string]bool{}
+	i := 0
+	probe := func() error {
+		t, p := i/inner, i%inner
+		if sweep {
+			t, p = p, t
+		}
+		target, port := targets[t], ports[p]
+		ts := s.at
+		if !seen[target.ip.String()] {
+			seen[target.ip.String()] = true
+			s.label.Targets = append(s.label.Targets, target.ip.String())
+		}
+		plan.DstPort = port
+		seq := r.Uint32()
+		if err := s.add(ts, target, plan, false, &tcpSegment{flags: tcpFlags{SYN: true}, seq: seq, window: 1024, ttl: s.ttl, options: mss}); err != nil {
+			return err
+		}
+		s.label.Probes++
+		at := ts.Add(time.Duration(100+r.Intn(900)) * time.Microsecond)
+		switch {
+		case portOpen(target.ip, port):
+			s.label.Open = append(s.label.Open, net.JoinHostPort(target.ip.String(), strconv.Itoa(int(port))))
+			if err := s.add(at, target, plan, true, &tcpSegment{flags: tcpFlags{SYN: true, ACK: true}, seq: r.Uint32(), ack: seq + 1, window: 65535}); err != nil {
+				return err
+			}
+			if err := s.add(at.Add(s.netRTT), target, plan, false, &tcpSegment{flags: tcpFlags{RST: true}, seq: seq + 1, ttl: s.ttl, options: []layers.TCPOption{}}); err != nil {
+				return err
+			}
+		case !firewalled(target.ip):
+			if err := s.add(at, target, plan, true, &tcpSegment{flags: tcpFlags{RST: true, ACK: true}, ack: seq + 1, options: []layers.TCPOption{}}); err != nil {
+				return err
+			}
+		}
+		i++
+		s.schedule(i, outer*inner, rate)
+		return nil
+	}
+	s.unit = probe
+	s.schedule(0, outer*inner, rate)
+}
+
+// schedule sets probe i of n, rate a second, to go next, or ends the scan
+// when there are no more before the end of the capture.
+func (s *scenarioRun) schedule(i, n int, rate float64) {
+	s.at = s.begin.Add(time.Duration(float64(i) / rate * float64(time.Second)))
+	if i == n || !s.at.Before(s.end) {
+		s.unit = nil
+	}
+}
+
+// bruteForce tries the built-in credentials against port of target, one
+// connection per attempt, rate a second in bursts of 8 to 16 attempts
+// with a pause of 20 to 60 seconds after each, as tools pace themselves
+// to stay under lockout thresholds.
+func (s *scenarioRun) bruteForce(target host, port uint16, rate float64) {
+	r := s.r
+	s.label.Targets = []string{target.ip.String()}
+	left := 8 + r.Intn(9)
+	n := len(bruteForceUsers) * len(bruteForcePasswords)
+	i := 0
+	s.at = s.begin
+	s.unit = func() error {
+		user, pass := bruteForceUsers[i/len(bruteForcePasswords)], bruteForcePasswords[i%len(bruteForcePasswords)]
+		if err := s.login(s.at, target, port, user, pass); err != nil {
+			return err
+		}
+		s.label.Probes++
+		s.at = s.at.Add(time.Duration(float64(time.Second) / rate * (0.8 + 0.4*r.Float64()))).Truncate(time.Microsecond)
+		if left--; left == 0 {
+			s.at = s.at.Add(time.Duration(20+r.Intn(41)) * time.Second)
+			left = 8 + r.Intn(9)
+		}
+		if i++; i == n || !s.at.Before(s.end) {
+			s.unit = nil
+		}
+		return nil
+	}
+	if !s.at.Before(s.end) {
+		s.unit = nil
+	}
+}
+
+var (
+	bruteForceUsers     = []string{"root", "admin", "user", "test", "ubuntu", "oracle", "postgres", "guest"}
+	bruteForcePasswords = []string{"123456", "password", "admin", "root", "12345678", "qwerty", "letmein", "welcome", "changeme", "P@ssw0rd", "admin123", "toor"}
+)
+
+// loginMessage is a message of a login dialog; wait is how long the
+// server takes over it.
+type loginMessage struct {
+	server  bool
+	wait    time.Duration
+	payload []byte
+}
+
+// login lays out one failed login attempt on a connection of its own,
+// closed by the attacker once the server has refused it.
+func (s *scenarioRun) login(ts time.Time, target host, port uint16, user, pass string) error {
+	r := s.r
+	plan := PacketPlan{Proto: layers.IPProtocolTCP, SrcPort: uint16(32768 + r.Intn(28232)), DstPort: port, VLANTags: s.cfg.VLAN.tagCount()}
+	lan := time.Duration(100+r.Intn(400)) * time.Microsecond
+	steps := []tcpStep{
+		{0, false, tcpFlags{SYN: true}, nil},
+		{lan, true, tcpFlags{SYN: true, ACK: true}, nil},
+		{lan + s.netRTT, false, tcpFlags{ACK: true}, nil},
+	}
+	at, server := lan+s.netRTT, false
+	mss := tcpMSS(plan)
+	for _, m := range loginDialog(r, port, target.ip, user, pass) {
+		switch {
+		case m.server:
+			at += lan + m.wait
+		case server:
+			at += s.netRTT
+		default:
+			at += 50 * time.Microsecond
+		}
+		server = m.server
+		for off := 0; off < len(m.payload); off += mss {
+			end := min(off+mss, len(m.payload))
+			steps = append(steps, tcpStep{at, m.server, tcpFlags{PSH: end == len(m.payload), ACK: true}, m.payload[off:end]})
+			at += 10 * time.Microsecond
+		}
+	}
+	at += s.netRTT
+	steps = append(steps,
+		tcpStep{at, false, tcpFlags{FIN: true, ACK: true}, nil},
+		tcpStep{at + lan, true, tcpFlags{FIN: true, ACK: true}, nil},
+		tcpStep{at + lan + s.netRTT, false, tcpFlags{ACK: true}, nil},
+	)
+	for i, seg := range scriptSegments(steps, r.Uint32(), r.Uint32()) {
+		if !steps[i].server {
+			seg.ttl = s.ttl
+		}
+		if err := s.add(ts.Add(steps[i].at), target, plan, steps[i].server, seg); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loginDialog is what a failed login looks like on port: SSH up to the
+// encrypted authentication, FTP, Telnet and HTTP form posts in the clear,
+// and for anything else a few opaque exchanges.
+func loginDialog(r *rand.Rand, port uint16, ip net.IP, user, pass string) []loginMessage {
+	refuse := time.Duration(200+r.Intn(800)) * time.Millisecond
+	switch port {
+	case 22:
+		return []loginMessage{
+			{true, time.Millisecond, []byte("SSH-2.0-OpenSSH_8.9p1 Ubuntu-3ubuntu0.6\r\n")},
+			{false, 0, []byte("SSH-2.0-libssh_0.9.6\r\n")},
+			{false, 0, randomBytes(r, 1200+r.Intn(300))},
+			{true, time.Millisecond, randomBytes(r, 1000+r.Intn(100))},
+			{false, 0, randomBytes(r, 48)},
+			{true, 2 * time.Millisecond, randomBytes(r, 500+r.Intn(600))},
+			{false, 0, randomBytes(r, 64+16*r.Intn(4))},
+			{true, refuse, randomBytes(r, 36+16*r.Intn(2))},
+		}
+	case 21:
+		return []loginMessage{
+			{true, time.Millisecond, []byte("220 (vsFTPd 3.0.5)\r\n")},
+			{false, 0, []byte("USER " + user + "\r\n")},
+			{true, 0, []byte("331 Please specify the password.\r\n")},
+			{false, 0, []byte("PASS " + pass + "\r\n")},
+			{true, refuse, []byte("530 Login incorrect.\r\n")},
+			{false, 0, []byte("QUIT\r\n")},
+			{true, 0, []byte("221 Goodbye.\r\n")},
+		}
+	case 23:
+		return []loginMessage{
+			{true, time.Millisecond, []byte("\xff\xfd\x18\xff\xfd\x20\xff\xfd\x23\xff\xfd\x27")},
+			{false, 0, []byte("\xff\xfc\x18\xff\xfc\x20\xff\xfc\x23\xff\xfc\x27")},
+			{true, 0, []byte("\r\nlogin: ")},
+			{false, 0, []byte(user + "\r\n")},
+			{true, 0, []byte("Password: ")},
+			{false, 0, []byte(pass + "\r\n")},
+			{true, refuse, []byte("\r\nLogin incorrect\r\n")},
+		}
+	case 80, 8000, 8080:
+		form := "username=" + user + "&password=" + pass
+		host := ip.String()
+		if port != 80 {
+			host = net.JoinHostPort(host, strconv.Itoa(int(port)))
+		}
+		return []loginMessage{
+			{false, 0, []byte("POST /login HTTP/1.1\r\nHost: " + host + "\r\nUser-Agent: Mozilla/5.0 (Hydra)\r\nContent-Type: application/x-www-form-urlencoded\r\nContent-Length: " + strconv.Itoa(len(form)) + "\r\nConnection: close\r\n\r\n" + form)},
+			{true, refuse, []byte("HTTP/1.1 401 Unauthorized\r\nContent-Type: text/html\r\nContent-Length: 26\r\nConnection: close\r\n\r\n<h1>Invalid password</h1>\n")},
+		}
+	default:
+		return []loginMessage{
+			{false, 0, randomBytes(r, 100+r.Intn(200))},
+			{true, time.Millisecond, randomBytes(r, 50+r.Intn(150))},
+			{false, 0, randomBytes(r, 100+r.Intn(200))},
+			{true, refuse, randomBytes(r, 30+r.Intn(50))},
+		}
+	}
+}
+
+// add builds a frame of the scenario between the attacker and target,
+// from the target when fromTarget. Frames past the capture are left out.
+func (s *scenarioRun) add(ts time.Time, target host, plan PacketPlan, fromTarget bool, seg *tcpSegment) error {
+	if !ts.Before(s.end) {
+		return nil
+	}
+	src, dst := s.attacker, target
+	if fromTarget {
+		src, dst = dst, src
+	}
+	data, err := buildPacket(s.r, src, dst, plan, fromTarget, len(seg.payload), seg, nil)
+	if err != nil {
+		return err
+	}
+	meta := pcapio.PacketMeta{Comment: "scenario=" + string(s.label.Scenario), Direction: tapDirection(fromTarget)}
+	s.frames = append(s.frames, noiseFrame{ts: ts.Truncate(time.Microsecond), data: data, meta: meta})
+	s.label.Packets++
+	return nil
+}
+
+// formatPorts writes ports as a list with runs collapsed, such as
+// "1-1024" or "22,80,443".
+func formatPorts(ports []uint16) string {
+	sorted := append([]uint16(nil), ports...)
+	sort.Slice(sorted, func(a, b int) bool { return sorted[a] < sorted[b] })
+	var parts []string
+	for i := 0; i < len(sorted); {
+		j := i
+		for j+1 < len(sorted) && sorted[j+1] <= sorted[j]+1 {
+			j++
+		}
+		if sorted[j] == sorted[i] {
+			parts = append(parts, strconv.Itoa(int(sorted[i])))
+		} else {
+			parts = append(parts, fmt.Sprintf("%d-%d", sorted[i], sorted[j]))
+		}
+		i = j + 1
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,358 @@
+package pcapgen
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/layers"
+)
+
+// SessionModel selects how TCP flows are rendered in flow-count mode.
+type SessionModel string
+
+const (
+	SessionNone      SessionModel = ""
+	SessionHandshake SessionModel = "handshake"
+	SessionFull      SessionModel = "full"
+)
+
+func ParseSessionModel(value string) (SessionModel, error) {
+	switch SessionModel(strings.ToLower(strings.TrimSpace(value))) {
+	case SessionNone, "none":
+		return SessionNone, nil
+	case SessionHandshake:
+		return SessionHandshake, nil
+	case SessionFull:
+		return SessionFull, nil
+	default:
+		return SessionNone, fmt.Errorf("unknown session model %q (want handshake|full)", value)
+	}
+}
+
+// sessionStep describes one packet of a scripted TCP session.
+type sessionStep struct {
+	flags      tcpFlags
+	fromServer bool
+	data       bool
+	// limit is the most payload a data step may carry; see shapeSession.
+	limit int
+	// probe marks a step that would have carried data but found the peer's
+	// window closed, and is sent as a zero-window probe instead.
+	probe bool
+	// zeroWindow makes the step advertise a zero receive window.
+	zeroWindow bool
+}
+
+// sessionSteps lays out a flow of the given length as a three-way
+// handshake, data segments and (for SessionFull) a FIN teardown. Data
+// direction follows respMask; a nil mask sends all data from the client.
+func sessionSteps(model SessionModel, packets int, respMask []bool) []sessionStep {
+	handshake := []sessionStep{
+		{flags: tcpFlags{SYN: true}},
+		{flags: tcpFlags{SYN: true, ACK: true}, fromServer: true},
+		{flags: tcpFlags{ACK: true}},
+	}
+	teardown := []sessionStep{
+		{flags: tcpFlags{FIN: true, ACK: true}},
+		{flags: tcpFlags{ACK: true}, fromServer: true},
+		{flags: tcpFlags{FIN: true, ACK: true}, fromServer: true},
+		{flags: tcpFlags{ACK: true}},
+	}
+	if len(handshake) > packets {
+		handshake = handshake[:packets]
+	}
+	if model != SessionFull {
+		teardown = nil
+	}
+	if n := packets - len(handshake); len(teardown) > n {
+		teardown = teardown[len(teardown)-n:]
+	}
+
+	steps := make([]sessionStep, 0, packets)
+	steps = append(steps, handshake...)
+	for p := len(handshake); p < packets-len(teardown); p++ {
+		step := sessionStep{flags: tcpFlags{PSH: true, ACK: true}, data: true}
+		if respMask != nil {
+			step.fromServer = respMask[p]
+		}
+		steps = append(steps, step)
+	}
+	return append(steps, teardown...)
+}
+
+// sessionMinPackets is the shortest flow that holds the whole handshake
+// and, for SessionFull, the whole teardown; sessionSteps cuts shorter
+// flows down to their first and last packets.
+func sessionMinPackets(model SessionModel) int {
+	if model == SessionFull {
+		return 7
+	}
+	return 3
+}
+
+const (
+	// sessionWindow is the receive window both sides of a scripted session
+	// advertise; no window scaling is negotiated.
+	sessionWindow = 65535
+	// tcpOptionsLen is the option space on every generated TCP header, which
+	// counts against the MSS.
+	tcpOptionsLen = 8
+)
+
+// tcpMSS is the MSS announced for a plan: its MTU less the IP and base
+// TCP headers, and less the tunnel headers of a tunnelled flow.
+func tcpMSS(plan PacketPlan) int {
+	mtu := plan.MTU
+	if mtu == 0 {
+		mtu = defaultMTU
+	}
+	if plan.IPv6 {
+		return mtu - 60 - plan.Tunnel.overhead()
+	}
+	return mtu - 40
+}
+
+// flowSteps lays out the scripted session of a flow, or returns nil when
+// the flow is not rendered as a session.
+func flowSteps(cfg Config, fileSeed int64, flowIdx int, plan PacketPlan, respMask []bool) []sessionStep {
+	if !usesSession(cfg, plan) {
+		return nil
+	}
+	steps := sessionSteps(cfg.SessionModel, len(respMask), respMask)
+	r := streamSession.rand(fileSeed, int64(flowIdx)<<32|1)
+	shapeSession(steps, tcpMSS(plan)-tcpOptionsLen, r, cfg.ZeroWindowRate)
+	return steps
+}
+
+// shapeSession segments the data steps the way a TCP stack would: each
+// carries at most segLimit bytes, and a side never has more than the
+// peer's receive window in flight. Any packet from the peer acknowledges
+// everything before it, so in-flight bytes are counted over the run of
+// segments sent since the peer last spoke, assuming each is full-sized.
+// That keeps the limits independent of how payloads are later resized.
+//
+// A sender whose window is used up, or whose peer has closed its window,
+// sends zero-window probes instead of data until the peer speaks again.
+// stallRate is the chance that, before a data segment, the receiver's last
+// packet advertised a zero window.
+func shapeSession(steps []sessionStep, segLimit int, r *rand.Rand, stallRate float64) {
+	var (
+		last     = [2]int{-1, -1}
+		inflight [2]int
+		closed   [2]bool
+	)
+	side := func(fromServer bool) int {
+		if fromServer {
+			return 1
+		}
+		return 0
+	}
+	for p := range steps {
+		step := &steps[p]
+		own := side(step.fromServer)
+		peer := 1 - own
+		// This packet acknowledges the peer's data and reopens our window.
+		inflight[peer], closed[own] = 0, false
+		last[own] = p
+		if !step.data {
+			continue
+		}
+		if stallRate > 0 && !closed[peer] && r.Float64() < stallRate {
+			// The peer's window must have been advertised after the handshake.
+			if q := last[peer]; q >= 0 && !steps[q].flags.SYN {
+				steps[q].zeroWindow = true
+				closed[peer] = true
+			}
+		}
+		room := sessionWindow - inflight[own]
+		if closed[peer] || room <= 0 {
+			step.data, step.probe = false, true
+			step.flags = tcpFlags{ACK: true}
+			continue
+		}
+		step.limit = min(segLimit, room)
+		inflight[own] += step.limit
+	}
+}
+
+// tcpSegment overrides the random flags and sequence numbers buildPacket
+// would otherwise pick.
+type tcpSegment struct {
+	flags tcpFlags
+	seq   uint32
+	ack   uint32
+	// window is the advertised receive window.
+	window uint16
+	// urgent sets URG with this urgent pointer when non-zero.
+	urgent uint16
+	// ttl overrides the IP TTL or hop limit when non-zero.
+	ttl uint8
+	// payload replaces the generated payload when non-nil.
+	payload []byte
+	// options replace the usual TCP options when non-nil.
+	options []layers.TCPOption
+}
+
+// tcpStep is a segment of a scripted connection, at offset from its
+// first.
+type tcpStep struct {
+	at      time.Duration
+	server  bool
+	flags   tcpFlags
+	payload []byte
+}
+
+// scriptSegments numbers the steps of a scripted connection from the
+// initial sequence numbers of the client and the server. Only the SYNs
+// carry options.
+func scriptSegments(steps []tcpStep, cseq, sseq uint32) []*tcpSegment {
+	segs := make([]*tcpSegment, len(steps))
+	// sent counts the sequence space each side has used past its SYN.
+	var sent [2]uint32
+	for i, s := range steps {
+		side := 0
+		if s.server {
+			side = 1
+		}
+		seg := &tcpSegment{flags: s.flags, window: 65535, payload: s.payload}
+		seg.seq, seg.ack = cseq+1+sent[0], sseq+1+sent[1]
+		if s.server {
+			seg.seq, seg.ack = seg.ack, seg.seq
+		}
+		if s.flags.SYN {
+			seg.seq--
+		} else {
+			seg.options = []layers.TCPOption{}
+		}
+		if !s.flags.ACK {
+			seg.ack = 0
+		}
+		sent[side] += uint32(len(s.payload))
+		if s.flags.FIN {
+			sent[side]++
+		}
+		segs[i] = seg
+	}
+	return segs
+}
+
+// tcpSession tracks both sides' sequence numbers across a scripted flow.
+type tcpSession struct {
+	clientSeq uint32
+	serverSeq uint32
+	// profiles are the personas of the client and server, if any; their
+	// SYNs carry the persona's window and options, announcing mss.
+	profiles [2]*osProfile
+	mss      int
+}
+
+func newTCPSession(r *rand.Rand) *tcpSession {
+	return &tcpSession{clientSeq: r.Uint32(), serverSeq: r.Uint32()}
+}
+
+func (s *tcpSession) next(step sessionStep, payloadLen int) *tcpSegment {
+	seg := &tcpSegment{flags: step.flags, window: sessionWindow}
+	if step.data && payloadLen == 0 {
+		seg.flags = tcpFlags{ACK: true}
+	}
+	if step.zeroWindow {
+		seg.window = 0
+	}
+	own, peer := &s.clientSeq, &s.serverSeq
+	if step.fromServer {
+		own, peer = peer, own
+	}
+	seg.seq = *own
+	if step.probe {
+		// Probes repeat the last acknowledged byte so the receiver has to
+		// answer with its current window.
+		seg.seq--
+	}
+	if seg.flags.ACK {
+		seg.ack = *peer
+	}
+	if seg.flags.SYN {
+		s.personaSYN(seg, step.fromServer)
+	}
+	advance := uint32(payloadLen)
+	if seg.flags.SYN || seg.flags.FIN {
+		advance++
+	}
+	*own += advance
+	return seg
+}
+
+// personaSYN gives a SYN from the client, or the server's SYN-ACK, the
+// sender's persona. Timestamps are derived from the initial sequence
+// numbers, so the SYN-ACK can echo the SYN's without further state.
+func (s *tcpSession) personaSYN(seg *tcpSegment, fromServer bool) {
+	own, peer := s.profiles[0], s.profiles[1]
+	if fromServer {
+		own, peer = peer, own
+	}
+	if own == nil {
+		return
+	}
+	tsval, tsecr := seg.seq^tsMask, (seg.ack-1)^tsMask
+	if !seg.flags.ACK {
+		peer, tsecr = nil, 0
+	}
+	seg.window = own.window
+	seg.options = own.layout(peer, s.mss, tsval, tsecr)
+}
+
+// tsMask keeps a SYN's timestamp from giving away its sequence number.
+const tsMask = 0x5bd1e995
+
+// sessionPacketLen is the length of packet p of a flow without payload.
+// The SYNs of hosts with a persona carry its options instead of the usual
+// tcpOptionsLen bytes.
+func sessionPacketLen(plan PacketPlan, steps []sessionStep, profiles [2]*osProfile, p int) int {
+	base := basePacketLen(plan)
+	if steps == nil || !steps[p].flags.SYN {
+		return base
+	}
+	own, peer := profiles[0], profiles[1]
+	if steps[p].fromServer {
+		own, peer = peer, own
+	}
+	if own == nil {
+		return base
+	}
+	if !steps[p].flags.ACK {
+		peer = nil
+	}
+	size := tcpOptionsSize(own.layout(peer, 0, 0, 0))
+	return max(base-tcpOptionsLen+size, plan.EncapLen+minFrameLen)
+}
+
+// flowPayloadLen plans the payload of packet p in a flow. Control
+// segments of a scripted session carry no payload and cannot grow, but the
+// size draw is still made so the traffic stream stays aligned. Data
+// segments are held to the limit set by shapeSession. The segment evasion
+// tampers with neither gains nor loses all its payload in sizing, so that
+// the evasions that need payload are made or not as planned.
+func flowPayloadLen(r *rand.Rand, cfg Config, plan PacketPlan, steps []sessionStep, p int, evasion bool) (payloadLen int, maxAdd int, basePayload int) {
+	payloadLen, maxAdd, basePayload = planPayloadLen(r, cfg, plan)
+	if steps == nil {
+		return payloadLen, maxAdd, basePayload
+	}
+	step := steps[p]
+	if !step.data {
+		return 0, 0, 0
+	}
+	payloadLen = min(payloadLen, step.limit)
+	if evasion {
+		if payloadLen == 0 {
+			return 0, 0, 0
+		}
+		return payloadLen, step.limit - payloadLen, payloadLen - 1
+	}
+	return payloadLen, step.limit - payloadLen, payloadLen
+}
+
+func usesSession(cfg Config, plan PacketPlan) bool {
+	return cfg.SessionModel != SessionNone && plan.Proto == layers.IPProtocolTCP
+}
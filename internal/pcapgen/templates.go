@@ -0,0 +1,343 @@
+package pcapgen
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// PayloadTemplates binds application payloads to the flow carrying them.
+// Keys are app names, with a "-response" suffix for the reply direction;
+// apps without an entry keep the built-in payload, except that HTTP, DNS
+// and TLS ones name the server by its flow-derived hostname. A non-nil
+// empty map enables just that.
+type PayloadTemplates map[string][]byte
+
+// templateApps are the keys a PayloadTemplates may use, without the
+// "-response" suffix.
+var templateApps = []appKind{appHTTP, appHTTPS, appDNS, appQUIC, appNTP, appSTUN, appIPSEC, appSSDP, appMDNS, appSSH, appRDP, appSMB, appDB, appBACnet, appS7comm, appOther}
+
+// templateDomain is the suffix of every flow-derived hostname.
+const templateDomain = "example.com"
+
+// LoadPayloadTemplates parses "builtin" or a list of APP=FILE, such as
+// "http=req.txt,http-response=resp.txt".
+func LoadPayloadTemplates(value string) (PayloadTemplates, error) {
+	t := PayloadTemplates{}
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" || part == "builtin" {
+			continue
+		}
+		name, path, ok := strings.Cut(part, "=")
+		if !ok {
+			return nil, fmt.Errorf("expected APP=FILE or builtin, got %q", part)
+		}
+		name = strings.ToLower(strings.TrimSpace(name))
+		if !knownTemplateApp(strings.TrimSuffix(name, "-response")) {
+			return nil, fmt.Errorf("unknown app %q", name)
+		}
+		data, err := os.ReadFile(strings.TrimSpace(path))
+		if err != nil {
+			return nil, err
+		}
+		t[name] = data
+	}
+	return t, nil
+}
+
+func knownTemplateApp(name string) bool {
+	for _, app := range templateApps {
+		if string(app) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// Wordlists are what HTTP, DNS and TLS payloads draw names from, so the
+// traffic resembles a given environment's. Each list is one entry per
+// line; empty lists keep the built-in names.
+type Wordlists struct {
+	Domains    []string
+	Paths      []string
+	UserAgents []string
+}
+
+func (w Wordlists) enabled() bool {
+	return len(w.Domains) > 0 || len(w.Paths) > 0 || len(w.UserAgents) > 0
+}
+
+// LoadWordlist reads a list file: one entry per line, blank lines and
+// lines starting with # skipped.
+func LoadWordlist(path string) ([]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var words []string
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		words = append(words, line)
+	}
+	if len(words) == 0 {
+		return nil, fmt.Errorf("%s has no entries", path)
+	}
+	return words, nil
+}
+
+// payloadEnv is what a packet's payload may refer to beyond its own
+// headers. flow is the flow index, or -1 in random mode where the flow is
+// identified by its 5-tuple.
+type payloadEnv struct {
+	templates PayloadTemplates
+	words     Wordlists
+	flow      int
+	ts        time.Time
+	// external is the pool DNS answers are drawn from, so the names they
+	// resolve are those later flows connect to.
+	external hostPool
+	// opening is set for the packet that opens the flow's exchange; see
+	// openingPacket.
+	opening bool
+}
+
+// payloadEnv returns the environment of the payloads of flow at ts, or nil
+// when they are not bound to it.
+func (cfg Config) payloadEnv(l7 bool, plan PacketPlan, flow int, ts time.Time, external hostPool) *payloadEnv {
+	if !cfg.boundPayloads(l7, plan) {
+		return nil
+	}
+	return &payloadEnv{templates: cfg.PayloadTemplates, words: cfg.Wordlists, flow: flow, ts: ts, external: external}
+}
+
+// flowContext is a payloadEnv bound to one packet's endpoints.
+type flowContext struct {
+	*payloadEnv
+	client, server net.IP
+	src, dst       net.IP
+	sport, dport   uint16
+	flowID         string
+	hostname       string
+	path           string
+	userAgent      string
+	answerIP       net.IP
+	isResponse     bool
+	key            uint64
+}
+
+// bind returns the context of a packet from src to dst, or nil when
+// payloads are not bound to flows.
+func (e *payloadEnv) bind(src, dst host, plan PacketPlan, isResponse bool) *flowContext {
+	if e == nil {
+		return nil
+	}
+	c := &flowContext{payloadEnv: e, isResponse: isResponse}
+	c.src, c.dst = src.ip, dst.ip
+	if plan.IPv6 {
+		c.src, c.dst = src.ip6, dst.ip6
+	}
+	c.sport, c.dport = plan.SrcPort, plan.DstPort
+	c.client, c.server = c.src, c.dst
+	if isResponse {
+		c.sport, c.dport = c.dport, c.sport
+		c.client, c.server = c.dst, c.src
+	}
+	if e.flow >= 0 {
+		c.key = uint64(e.flow)
+		c.flowID = strconv.Itoa(e.flow)
+	} else {
+		h := fnv.New64a()
+		h.Write(c.client)
+		h.Write(c.server)
+		binary.Write(h, binary.BigEndian, [3]uint16{plan.SrcPort, plan.DstPort, uint16(plan.Proto)})
+		c.key = h.Sum64()
+		c.flowID = fmt.Sprintf("%016x", c.key)
+	}
+	c.hostname = e.hostname(c.server)
+	if r := resolverAt(c.server); r != nil && plan.encryptedDNS != "" {
+		c.hostname = r.name
+	}
+	if identifyApp(plan) == appDNS {
+		// A DNS flow resolves the name of some external host instead.
+		answer := e.external.at(int(uint64(mixSeed(int64(c.key), 0)) % uint64(e.external.count)))
+		c.answerIP = answer.ip
+		c.hostname = e.hostname(answer.ip)
+	}
+	c.path, c.userAgent = "/index.html", "genflux"
+	if p := e.words.Paths; len(p) > 0 {
+		c.path = p[uint64(mixSeed(int64(c.key), 1))%uint64(len(p))]
+	}
+	ua := e.words.UserAgents
+	if len(ua) == 0 {
+		// Without a list, a client with a persona uses its browsers.
+		client := src
+		if isResponse {
+			client = dst
+		}
+		if p := client.profile(); p != nil {
+			ua = p.userAgents
+		}
+	}
+	if len(ua) > 0 {
+		// A client keeps its browser across flows.
+		c.userAgent = ua[pickWord(c.client, len(ua))]
+	}
+	return c
+}
+
+// pickWord picks one of n words by an address.
+func pickWord(ip net.IP, n int) int {
+	h := fnv.New64a()
+	h.Write(ip)
+	return int(h.Sum64() % uint64(n))
+}
+
+// hostname names the server at ip: an entry of the domain list picked by
+// the address, or a name made from the address such as
+// ip-10-0-0-5.example.com. Either way every flow to the same server
+// agrees on its name.
+func (e *payloadEnv) hostname(ip net.IP) string {
+	if d := e.words.Domains; len(d) > 0 {
+		return d[pickWord(ip, len(d))]
+	}
+	s := ip.String()
+	if ip.To4() != nil {
+		s = strings.ReplaceAll(s, ".", "-")
+	} else {
+		s = strings.ReplaceAll(s, ":", "-")
+	}
+	return "ip-" + s + "." + templateDomain
+}
+
+// payload returns the template for app with its variables expanded.
+func (c *flowContext) payload(app appKind) []byte {
+	name := string(app)
+	if c.isResponse {
+		name += "-response"
+	}
+	if t, ok := c.templates[name]; ok {
+		return c.expand(t)
+	}
+	switch app {
+	case appHTTP:
+		if c.isResponse {
+			return c.expand([]byte("HTTP/1.1 200 OK\r\nServer: genflux\r\nDate: {{http_date}}\r\nContent-Type: text/html\r\nContent-Length: 13\r\n\r\nHello, world!"))
+		}
+		return c.expand([]byte("GET {{path}} HTTP/1.1\r\nHost: {{hostname}}\r\nUser-Agent: {{user_agent}}\r\nAccept: */*\r\n\r\n"))
+	case appHTTPS:
+		if !c.isResponse {
+			return tlsClientHello(c.hostname, c.key, "")
+		}
+	case appDoT, appDoH:
+		return c.encryptedDNSPayload(app)
+	case appDNS:
+		return dnsMessage(c.hostname, c.answerIP, uint16(c.key), c.isResponse)
+	}
+	return appTemplate(app, c.isResponse)
+}
+
+// expand replaces the {{variables}} of a template.
+func (c *flowContext) expand(t []byte) []byte {
+	if !bytes.Contains(t, []byte("{{")) {
+		return t
+	}
+	answer := ""
+	if c.answerIP != nil {
+		answer = c.answerIP.String()
+	}
+	vars := []string{
+		"{{src_ip}}", c.src.String(),
+		"{{dst_ip}}", c.dst.String(),
+		"{{src_port}}", strconv.Itoa(int(c.sport)),
+		"{{dst_port}}", strconv.Itoa(int(c.dport)),
+		"{{client_ip}}", c.client.String(),
+		"{{server_ip}}", c.server.String(),
+		"{{hostname}}", c.hostname,
+		"{{path}}", c.path,
+		"{{user_agent}}", c.userAgent,
+		"{{qname}}", string(dnsName(c.hostname)),
+		"{{answer_ip}}", answer,
+		"{{flow_id}}", c.flowID,
+		"{{timestamp}}", strconv.FormatInt(c.ts.Unix(), 10),
+		"{{http_date}}", c.ts.UTC().Format(httpDateFormat),
+	}
+	return []byte(strings.NewReplacer(vars...).Replace(string(t)))
+}
+
+const httpDateFormat = "Mon, 02 Jan 2006 15:04:05 GMT"
+
+// dnsName encodes name in DNS wire format.
+func dnsName(name string) []byte {
+	var b []byte
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		b = append(b, byte(len(label)))
+		b = append(b, label...)
+	}
+	return append(b, 0)
+}
+
+// dnsMessage is an A query for name, or its answer with addr.
+func dnsMessage(name string, addr net.IP, id uint16, isResponse bool) []byte {
+	b := binary.BigEndian.AppendUint16(nil, id)
+	if isResponse {
+		b = append(b, 0x81, 0x80, 0x00, 0x01, 0x00, 0x01)
+	} else {
+		b = append(b, 0x01, 0x00, 0x00, 0x01, 0x00, 0x00)
+	}
+	b = append(b, 0x00, 0x00, 0x00, 0x00)
+	b = append(b, dnsName(name)...)
+	b = append(b, 0x00, 0x01, 0x00, 0x01)
+	if isResponse {
+		// Name by pointer to the question, A, IN, TTL 300.
+		b = append(b, 0xc0, 0x0c, 0x00, 0x01, 0x00, 0x01, 0x00, 0x00, 0x01, 0x2c, 0x00, 0x04)
+		b = append(b, addr.To4()...)
+	}
+	return b
+}
+
+// tlsClientHello is a TLS 1.2 ClientHello offering two suites, naming
+// the server in its SNI extension and, when alpn is set, offering that
+// application protocol.
+func tlsClientHello(name string, key uint64, alpn string) []byte {
+	sni := binary.BigEndian.AppendUint16(nil, uint16(len(name)+3))
+	sni = append(sni, 0x00)
+	sni = binary.BigEndian.AppendUint16(sni, uint16(len(name)))
+	sni = append(sni, name...)
+	ext := []byte{0x00, 0x00}
+	ext = binary.BigEndian.AppendUint16(ext, uint16(len(sni)))
+	ext = append(ext, sni...)
+	if alpn != "" {
+		ext = append(ext, 0x00, 0x10)
+		ext = binary.BigEndian.AppendUint16(ext, uint16(len(alpn)+3))
+		ext = binary.BigEndian.AppendUint16(ext, uint16(len(alpn)+1))
+		ext = append(ext, byte(len(alpn)))
+		ext = append(ext, alpn...)
+	}
+
+	body := []byte{0x03, 0x03}
+	r := &splitMix64{state: key}
+	for i := 0; i < 4; i++ {
+		body = binary.BigEndian.AppendUint64(body, r.Uint64())
+	}
+	body = append(body, 0x00)                               // session ID
+	body = append(body, 0x00, 0x04, 0xc0, 0x2f, 0x13, 0x01) // cipher suites
+	body = append(body, 0x01, 0x00)                         // compression
+	body = binary.BigEndian.AppendUint16(body, uint16(len(ext)))
+	body = append(body, ext...)
+
+	hs := []byte{0x01, byte(len(body) >> 16), byte(len(body) >> 8), byte(len(body))}
+	hs = append(hs, body...)
+	rec := []byte{0x16, 0x03, 0x01}
+	rec = binary.BigEndian.AppendUint16(rec, uint16(len(hs)))
+	return append(rec, hs...)
+}
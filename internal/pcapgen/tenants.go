@@ -0,0 +1,159 @@
+package pcapgen
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"genflux/internal/pcapio"
+)
+
+// TenantEncap selects how tenants are kept apart on the wire.
+type TenantEncap string
+
+const (
+	TenantVLAN  TenantEncap = "vlan"
+	TenantVXLAN TenantEncap = "vxlan"
+)
+
+func ParseTenantEncap(value string) (TenantEncap, error) {
+	switch TenantEncap(strings.ToLower(strings.TrimSpace(value))) {
+	case TenantVLAN:
+		return TenantVLAN, nil
+	case TenantVXLAN:
+		return TenantVXLAN, nil
+	default:
+		return "", fmt.Errorf("unknown tenant encapsulation %q (want vlan|vxlan)", value)
+	}
+}
+
+// TenantConfig renders the same logical traffic once per tenant. Tenants
+// share the generated addressing, so their RFC1918 spaces overlap and only
+// the tenant's VLAN ID or VNI (BaseID+tenant) tells them apart.
+type TenantConfig struct {
+	Count  int
+	Encap  TenantEncap
+	BaseID int
+}
+
+const vxlanOverhead = 14 + 20 + 8 + 8
+
+func (t TenantConfig) validate() error {
+	if t.Count < 0 {
+		return fmt.Errorf("tenants must be >= 0")
+	}
+	if t.Count == 0 {
+		return nil
+	}
+	maxID := 1<<24 - 1
+	if t.Encap == TenantVLAN {
+		maxID = 4094
+	}
+	if t.BaseID < 1 || t.BaseID+t.Count-1 > maxID {
+		return fmt.Errorf("tenant ids %d-%d out of range [1,%d] for %s", t.BaseID, t.BaseID+t.Count-1, maxID, t.Encap)
+	}
+	return nil
+}
+
+// encapLen is the number of bytes each tenant copy adds to a frame.
+func (t TenantConfig) encapLen() int {
+	switch {
+	case t.Count == 0:
+		return 0
+	case t.Encap == TenantVLAN:
+		return 4
+	default:
+		return vxlanOverhead
+	}
+}
+
+var (
+	vtepSrcMAC = net.HardwareAddr{0x02, 0x00, 0x5e, 0x00, 0x00, 0x01}
+	vtepDstMAC = net.HardwareAddr{0x02, 0x00, 0x5e, 0x00, 0x00, 0x02}
+	vtepSrcIP  = net.IP{172, 16, 0, 1}
+	vtepDstIP  = net.IP{172, 16, 0, 2}
+)
+
+// tenantWriter writes every packet once per tenant, encapsulated with
+// that tenant's VLAN tag or VXLAN header.
+type tenantWriter struct {
+	pcapio.Writer
+	tenants TenantConfig
+}
+
+func (w *tenantWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, meta pcapio.PacketMeta) error {
+	comment := meta.Comment
+	for t := 0; t < w.tenants.Count; t++ {
+		id := w.tenants.BaseID + t
+		var frame []byte
+		var err error
+		if w.tenants.Encap == TenantVLAN {
+			frame = insertVLANTag(data, uint16(id))
+		} else if frame, err = vxlanEncap(data, uint32(id)); err != nil {
+			return err
+		}
+		ci.CaptureLength, ci.Length = len(frame), len(frame)
+		if comment != "" {
+			meta.Comment = fmt.Sprintf("%s tenant=%d", comment, id)
+		}
+		if err := w.Writer.WritePacket(ci, frame, meta); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertVLANTag adds an outermost tag. A frame that is already tagged gets
+// a service (802.1ad) tag on top of its existing stack.
+func insertVLANTag(data []byte, id uint16) []byte {
+	tpid := layers.EthernetTypeDot1Q
+	if et := layers.EthernetType(binary.BigEndian.Uint16(data[12:14])); et == layers.EthernetTypeDot1Q || et == layers.EthernetTypeQinQ {
+		tpid = layers.EthernetTypeQinQ
+	}
+	frame := make([]byte, len(data)+4)
+	copy(frame, data[:12])
+	binary.BigEndian.PutUint16(frame[12:], uint16(tpid))
+	binary.BigEndian.PutUint16(frame[14:], id)
+	copy(frame[16:], data[12:])
+	return frame
+}
+
+func vxlanEncap(data []byte, vni uint32) ([]byte, error) {
+	// Like a VTEP, derive the outer source port from the inner addresses
+	// so each inner host pair keeps one underlay path.
+	h := fnv.New32a()
+	h.Write(data[:12])
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		Flags:    layers.IPv4DontFragment,
+		Protocol: layers.IPProtocolUDP,
+		SrcIP:    vtepSrcIP,
+		DstIP:    vtepDstIP,
+	}
+	udp := &layers.UDP{
+		SrcPort: layers.UDPPort(49152 + h.Sum32()%16384),
+		DstPort: 4789,
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, err
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	err := gopacket.SerializeLayers(buf, opts,
+		&layers.Ethernet{SrcMAC: vtepSrcMAC, DstMAC: vtepDstMAC, EthernetType: layers.EthernetTypeIPv4},
+		ip, udp,
+		&layers.VXLAN{ValidIDFlag: true, VNI: vni},
+		gopacket.Payload(data),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -1,6 +1,211 @@
 package pcapgen
 
-import "math"
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TrafficModel is how busy the network is over the day and the week. The
+// zero value is the original behaviour: in multi-file mode the file
+// durations follow the diurnal curve, and traffic is even within each
+// file.
+type TrafficModel struct {
+	Kind TrafficModelKind
+	// Weekday and Weekend are the activity of each hour of the day, from
+	// 0 (idle) to 1 (busiest), for TrafficCustom.
+	Weekday, Weekend [24]float64
+}
+
+type TrafficModelKind string
+
+const (
+	// TrafficFlat spreads traffic evenly, within and across files.
+	TrafficFlat TrafficModelKind = "flat"
+	// TrafficDiurnal follows the built-in weekday and weekend curves.
+	TrafficDiurnal TrafficModelKind = "diurnal"
+	// TrafficCustom follows hourly curves read from a CSV file.
+	TrafficCustom TrafficModelKind = "custom"
+)
+
+// minActivity keeps idle hours from stretching the gaps between packets
+// without bound.
+const minActivity = 0.05
+
+// ParseTrafficModel parses flat, diurnal or the path of a CSV file of
+// hourly activity; see LoadTrafficCurve.
+func ParseTrafficModel(value string) (TrafficModel, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "":
+		return TrafficModel{}, nil
+	case string(TrafficFlat):
+		return TrafficModel{Kind: TrafficFlat}, nil
+	case string(TrafficDiurnal):
+		return TrafficModel{Kind: TrafficDiurnal}, nil
+	}
+	return LoadTrafficCurve(value)
+}
+
+// LoadTrafficCurve reads hourly activity from a CSV file with a line
+// HOUR,LEVEL or HOUR,WEEKDAY,WEEKEND for each hour 0-23, levels between 0
+// and 1; between hours the level moves linearly. A header line, blank
+// lines and lines starting with # are skipped.
+func LoadTrafficCurve(path string) (TrafficModel, error) {
+	m := TrafficModel{Kind: TrafficCustom}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return m, err
+	}
+	var seen [24]bool
+	for i, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, ",")
+		hour, err := strconv.Atoi(strings.TrimSpace(fields[0]))
+		if err != nil {
+			if i == 0 {
+				continue
+			}
+			return m, fmt.Errorf("line %d: invalid hour %q", i+1, fields[0])
+		}
+		if hour < 0 || hour > 23 {
+			return m, fmt.Errorf("line %d: hour %d outside 0-23", i+1, hour)
+		}
+		if seen[hour] {
+			return m, fmt.Errorf("line %d: hour %d given twice", i+1, hour)
+		}
+		if len(fields) != 2 && len(fields) != 3 {
+			return m, fmt.Errorf("line %d: expected HOUR,LEVEL or HOUR,WEEKDAY,WEEKEND", i+1)
+		}
+		var levels []float64
+		for _, f := range fields[1:] {
+			v, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+			if err != nil || v < 0 || v > 1 {
+				return m, fmt.Errorf("line %d: level %q not within [0,1]", i+1, f)
+			}
+			levels = append(levels, v)
+		}
+		seen[hour] = true
+		m.Weekday[hour] = levels[0]
+		m.Weekend[hour] = levels[len(levels)-1]
+	}
+	for hour, ok := range seen {
+		if !ok {
+			return m, fmt.Errorf("hour %d missing", hour)
+		}
+	}
+	return m, nil
+}
+
+// durationScale is the share of the longest multi-file duration given to
+// a file starting at t: the busier the hour, the sooner a file fills.
+func (m TrafficModel) durationScale(t time.Time) float64 {
+	if m.Kind == TrafficCustom {
+		return 1 - m.activity(t)
+	}
+	return durationScalar(decimalHour(t), isWeekend(t))
+}
+
+// activity is how busy the network is at t, from 0 to 1.
+func (m TrafficModel) activity(t time.Time) float64 {
+	switch m.Kind {
+	case TrafficCustom:
+		levels := m.Weekday
+		if isWeekend(t) {
+			levels = m.Weekend
+		}
+		return clamp01(hourlyLevel(levels, decimalHour(t)))
+	case TrafficFlat:
+		return 1
+	}
+	return 1 - durationScalar(decimalHour(t), isWeekend(t))
+}
+
+func decimalHour(t time.Time) float64 {
+	return float64(t.Hour()) + float64(t.Minute())/60 + float64(t.Second())/3600
+}
+
+func isWeekend(t time.Time) bool {
+	return t.Weekday() == time.Saturday || t.Weekday() == time.Sunday
+}
+
+func clamp01(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
+
+// hourlyLevel interpolates levels linearly at hour, wrapping at
+// midnight. A spline would overshoot at the steps such curves often have.
+func hourlyLevel(levels [24]float64, hour float64) float64 {
+	h := int(hour) % 24
+	frac := hour - math.Floor(hour)
+	return levels[h] + (levels[(h+1)%24]-levels[h])*frac
+}
+
+// warpSegments is the number of pieces a file is cut into to follow the
+// activity curve.
+const warpSegments = 256
+
+// timeWarp moves timestamps spread evenly over a file so that their
+// density follows the activity of the traffic model. Order is kept.
+type timeWarp struct {
+	start time.Time
+	dur   time.Duration
+	// cum[i] is the share of the file's traffic due before segment i.
+	cum []float64
+}
+
+// warp returns the time warp of a file, or nil for the zero model, which
+// keeps the original timing.
+func (m TrafficModel) warp(start time.Time, dur time.Duration) *timeWarp {
+	if m.Kind == "" || dur <= 0 {
+		return nil
+	}
+	w := &timeWarp{start: start, dur: dur, cum: make([]float64, warpSegments+1)}
+	step := dur / warpSegments
+	for i := 0; i < warpSegments; i++ {
+		a := math.Max(m.activity(start.Add(step*time.Duration(i)+step/2)), minActivity)
+		w.cum[i+1] = w.cum[i] + a
+	}
+	total := w.cum[warpSegments]
+	for i := range w.cum {
+		w.cum[i] /= total
+	}
+	return w
+}
+
+// volume is the traffic of the window of dur from start, in hours at full
+// activity.
+func (m TrafficModel) volume(start time.Time, dur time.Duration) float64 {
+	step := dur / warpSegments
+	var v float64
+	for i := 0; i < warpSegments; i++ {
+		v += math.Max(m.activity(start.Add(step*time.Duration(i)+step/2)), minActivity)
+	}
+	return v * dur.Hours() / warpSegments
+}
+
+// at returns where t, evenly spread, lands once warped.
+func (w *timeWarp) at(t time.Time) time.Time {
+	if w == nil {
+		return t
+	}
+	u := clamp01(float64(t.Sub(w.start)) / float64(w.dur))
+	i := sort.SearchFloat64s(w.cum, u)
+	if i == 0 {
+		return w.start
+	}
+	if i > warpSegments {
+		i = warpSegments
+	}
+	frac := (u - w.cum[i-1]) / (w.cum[i] - w.cum[i-1])
+	return w.start.Add(time.Duration((float64(i-1) + frac) / warpSegments * float64(w.dur)))
+}
 
 func durationScalar(hour float64, weekend bool) float64 {
 	if hour < 0 || hour >= 24 {
@@ -95,3 +300,10 @@ func (s *cubicSpline) eval(x float64) float64 {
 	dx := x - s.x[idx]
 	return s.a[idx] + s.b[idx]*dx + s.c[idx]*dx*dx + s.d[idx]*dx*dx*dx
 }
+
+// nth places packet i of n: spread evenly over the file with jitter in
+// [0,1) of a slot, so that the warp alone shapes the rate, and warped.
+func (w *timeWarp) nth(i, n int, jitter float64) time.Time {
+	even := (float64(i) + jitter) / float64(n)
+	return w.at(w.start.Add(time.Duration(even * float64(w.dur))))
+}
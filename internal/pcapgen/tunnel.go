@@ -0,0 +1,149 @@
+package pcapgen
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Tunnel is an IPv6 transition mechanism carrying IPv6 over IPv4.
+type Tunnel string
+
+const (
+	// Tunnel6in4 is a configured tunnel (IP protocol 41) between the
+	// internal host and the external end, as to a tunnel broker.
+	Tunnel6in4 Tunnel = "6in4"
+	// TunnelTeredo carries IPv6 in UDP to a relay's port 3544; the
+	// internal host's IPv6 address embeds the Teredo server and its own
+	// obfuscated IPv4 address and port.
+	TunnelTeredo Tunnel = "teredo"
+	// TunnelISATAP is protocol 41 between the internal host and the site's
+	// ISATAP router; the internal host's interface ID embeds its IPv4
+	// address.
+	TunnelISATAP Tunnel = "isatap"
+)
+
+var (
+	teredoServer = net.IP{65, 55, 158, 118}
+	isatapRouter = net.IP{192, 168, 255, 254}
+)
+
+const teredoPort = 3544
+
+// TunnelConfig tunnels a fraction of the IPv6 traffic over IPv4 with the
+// listed mechanisms. Tunnelled flows and packets are always IPv6 inside,
+// whatever IPv6Ratio says.
+type TunnelConfig struct {
+	Kinds []Tunnel
+	Ratio float64
+}
+
+// ParseTunnels parses a mechanism list such as "6in4,teredo,isatap".
+func ParseTunnels(value string) ([]Tunnel, error) {
+	var out []Tunnel
+	for _, part := range strings.Split(value, ",") {
+		t := Tunnel(strings.ToLower(strings.TrimSpace(part)))
+		switch t {
+		case "":
+			continue
+		case Tunnel6in4, TunnelTeredo, TunnelISATAP:
+			out = append(out, t)
+		default:
+			return nil, fmt.Errorf("unknown tunnel %q (want 6in4|teredo|isatap)", part)
+		}
+	}
+	if len(out) == 0 {
+		return nil, errors.New("empty tunnel list")
+	}
+	return out, nil
+}
+
+func (c TunnelConfig) enabled() bool {
+	return len(c.Kinds) > 0
+}
+
+// overhead is what the tunnel adds to an IPv6 packet.
+func (t Tunnel) overhead() int {
+	switch t {
+	case "":
+		return 0
+	case TunnelTeredo:
+		return 20 + 8
+	default:
+		return 20
+	}
+}
+
+// tunnelInner returns the hosts as the IPv6 packet inside the tunnel sees
+// them: Teredo and ISATAP derive the internal host's address from its IPv4
+// one.
+func tunnelInner(t Tunnel, src, dst host) (host, host) {
+	in := &src
+	if dst.side == sideInternal {
+		in = &dst
+	}
+	switch t {
+	case TunnelTeredo:
+		in.ip6 = teredoAddr(in.ip.To4(), teredoClientPort(in.ip))
+	case TunnelISATAP:
+		ip6 := make(net.IP, net.IPv6len)
+		copy(ip6, in.ip6[:8])
+		copy(ip6[10:], []byte{0x5e, 0xfe})
+		copy(ip6[12:], in.ip.To4())
+		in.ip6 = ip6
+	}
+	return src, dst
+}
+
+// tunnelOuter returns the IPv4 (and for Teredo, UDP) headers carrying an
+// IPv6 packet from src to dst.
+func tunnelOuter(t Tunnel, src, dst host) ([]gopacket.SerializableLayer, error) {
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolIPv6, SrcIP: src.ip, DstIP: dst.ip}
+	if t == TunnelISATAP {
+		// The external end is reached through the ISATAP router.
+		if src.side == sideInternal {
+			ip.DstIP = isatapRouter
+		} else {
+			ip.SrcIP = isatapRouter
+		}
+	}
+	if t != TunnelTeredo {
+		return []gopacket.SerializableLayer{ip}, nil
+	}
+	ip.Protocol = layers.IPProtocolUDP
+	udp := &layers.UDP{SrcPort: teredoPort, DstPort: teredoPort}
+	if src.side == sideInternal {
+		udp.SrcPort = layers.UDPPort(teredoClientPort(src.ip))
+	} else {
+		udp.DstPort = layers.UDPPort(teredoClientPort(dst.ip))
+	}
+	if err := udp.SetNetworkLayerForChecksum(ip); err != nil {
+		return nil, err
+	}
+	return []gopacket.SerializableLayer{ip, udp}, nil
+}
+
+// teredoClientPort is the UDP port a Teredo client at ip uses, fixed per
+// client.
+func teredoClientPort(ip net.IP) uint16 {
+	return uint16(1024 + pickWord(ip, 65535-1024))
+}
+
+// teredoAddr is the Teredo address of a cone-NAT client mapped to ip and
+// port: 2001:0::/32, the server, flags, then port and address inverted.
+func teredoAddr(ip net.IP, port uint16) net.IP {
+	addr := make(net.IP, 0, net.IPv6len)
+	addr = append(addr, 0x20, 0x01, 0x00, 0x00)
+	addr = append(addr, teredoServer...)
+	addr = append(addr, 0x80, 0x00)
+	addr = binary.BigEndian.AppendUint16(addr, ^port)
+	for _, b := range ip {
+		addr = append(addr, ^b)
+	}
+	return addr
+}
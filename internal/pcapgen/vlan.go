@@ -0,0 +1,116 @@
+package pcapgen
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/gopacket/layers"
+)
+
+// VLANConfig describes the 802.1Q tags put on generated frames. Stack
+// holds fixed tags, outermost first. Pool, when set, adds an innermost
+// tag chosen by the internal host's /24 subnet, so every internal subnet
+// lives in its own VLAN. With more than one tag the outer ones use the
+// 802.1ad (QinQ) TPID.
+type VLANConfig struct {
+	Stack []uint16
+	Pool  []uint16
+}
+
+// ParseVLANList parses VLAN IDs such as "100", "100,200" or "100-163".
+// Order is kept.
+func ParseVLANList(value string) ([]uint16, error) {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil, fmt.Errorf("empty vlan list")
+	}
+	var ids []uint16
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		lo, hi, isRange := strings.Cut(part, "-")
+		first, err := parseVLANID(lo)
+		if err != nil {
+			return nil, err
+		}
+		last := first
+		if isRange {
+			if last, err = parseVLANID(hi); err != nil {
+				return nil, err
+			}
+			if last < first {
+				return nil, fmt.Errorf("invalid vlan range %q", part)
+			}
+		}
+		for id := first; id <= last; id++ {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 {
+		return nil, fmt.Errorf("empty vlan list")
+	}
+	return ids, nil
+}
+
+func parseVLANID(value string) (uint16, error) {
+	id, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid vlan id %q", value)
+	}
+	if id < 1 || id > 4094 {
+		return 0, fmt.Errorf("vlan id out of range [1,4094]: %d", id)
+	}
+	return uint16(id), nil
+}
+
+func (v VLANConfig) tagCount() int {
+	n := len(v.Stack)
+	if len(v.Pool) > 0 {
+		n++
+	}
+	return n
+}
+
+// tagsFor returns the tags for frames to or from the internal host h.
+func (v VLANConfig) tagsFor(h host) []uint16 {
+	if len(v.Pool) == 0 {
+		return v.Stack
+	}
+	tags := make([]uint16, 0, len(v.Stack)+1)
+	tags = append(tags, v.Stack...)
+	return append(tags, v.Pool[int(h.ip[2])%len(v.Pool)])
+}
+
+// vlanLayers returns the Dot1Q headers for tags and sets the frame's
+// EtherType chain from eth through to inner.
+func vlanLayers(eth *layers.Ethernet, tags []uint16, inner layers.EthernetType) []*layers.Dot1Q {
+	if len(tags) == 0 {
+		eth.EthernetType = inner
+		return nil
+	}
+	dot1q := make([]*layers.Dot1Q, len(tags))
+	for i, id := range tags {
+		dot1q[i] = &layers.Dot1Q{VLANIdentifier: id}
+	}
+	eth.EthernetType = tagTPID(0, len(tags))
+	for i := range dot1q {
+		if i+1 < len(dot1q) {
+			dot1q[i].Type = tagTPID(i+1, len(tags))
+		} else {
+			dot1q[i].Type = inner
+		}
+	}
+	return dot1q
+}
+
+// tagTPID returns the TPID announcing tag i of n: the innermost tag is a
+// customer tag (802.1Q), outer ones are service tags (802.1ad).
+func tagTPID(i, n int) layers.EthernetType {
+	if i == n-1 {
+		return layers.EthernetTypeDot1Q
+	}
+	return layers.EthernetTypeQinQ
+}
@@ -0,0 +1,282 @@
+package pcapgen
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"genflux/internal/pcapio"
+)
+
+// Link selects the link layer of generated captures.
+type Link string
+
+const (
+	LinkEthernet Link = "ethernet"
+	// LinkWiFi writes radiotap + 802.11 frames as seen by a monitor-mode
+	// sniffer next to one access point. Internal hosts are its stations;
+	// external hosts sit behind the distribution system.
+	LinkWiFi Link = "wifi"
+)
+
+func ParseLink(value string) (Link, error) {
+	switch Link(strings.ToLower(strings.TrimSpace(value))) {
+	case "", LinkEthernet:
+		return LinkEthernet, nil
+	case LinkWiFi, "802.11":
+		return LinkWiFi, nil
+	default:
+		return "", fmt.Errorf("unknown link %q (want ethernet|wifi)", value)
+	}
+}
+
+func (l Link) linkType() layers.LinkType {
+	if l == LinkWiFi {
+		return layers.LinkTypeIEEE80211Radio
+	}
+	return layers.LinkTypeEthernet
+}
+
+const (
+	radiotapLen = 16
+	dot11HdrLen = 24
+	llcSNAPLen  = 8
+	// wifiOverhead is what converting an Ethernet frame to 802.11 adds.
+	wifiOverhead = radiotapLen + dot11HdrLen + llcSNAPLen - 14
+
+	wifiSSID         = "genflux"
+	wifiChannel      = 6
+	wifiFreqMHz      = 2437
+	beaconInterval   = 100 // TUs of 1024us
+	beaconBodyLen    = 12 + 2 + len(wifiSSID) + 2 + 8 + 2 + 1 + 2 + 4
+	probeReqBodyLen  = 2 + 2 + 8
+	beaconFrameLen   = radiotapLen + dot11HdrLen + beaconBodyLen
+	probeReqFrameLen = radiotapLen + dot11HdrLen + probeReqBodyLen
+)
+
+var (
+	wifiBSSID      = net.HardwareAddr{0x02, 0x00, 0x5e, 0x00, 0x01, 0x00}
+	wifiBroadcast  = net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+	wifiRates      = []byte{0x82, 0x84, 0x8b, 0x96, 0x0c, 0x12, 0x18, 0x24}
+	beaconPeriod   = beaconInterval * 1024 * time.Microsecond
+	apSignalDBm    = int8(-35)
+	dataRate500kHz = byte(108)
+)
+
+// overhead is what the link adds to each generated Ethernet frame.
+func (l Link) overhead() int {
+	if l == LinkWiFi {
+		return wifiOverhead
+	}
+	return 0
+}
+
+// wifiPlan lists the management frames of one capture: a beacon every
+// beacon interval and one probe request per station, spread evenly.
+type wifiPlan struct {
+	start    time.Time
+	duration time.Duration
+	stations hostPool
+}
+
+func (p wifiPlan) beacons() int {
+	return int((p.duration + beaconPeriod - 1) / beaconPeriod)
+}
+
+// mgmtBytes is the frame bytes of all management frames, which the data
+// traffic has to leave room for under exact-size.
+func (p wifiPlan) mgmtBytes() int {
+	return p.beacons()*beaconFrameLen + p.stations.count*probeReqFrameLen
+}
+
+// reserveMgmt takes the management frames' share out of a size budget
+// of the data traffic. A zero budget means unlimited and is kept.
+func reserveMgmt(cfg Config, budget int, duration time.Duration, stations hostPool) (int, error) {
+	if cfg.Link != LinkWiFi || budget <= 0 {
+		return budget, nil
+	}
+	mgmt := wifiPlan{duration: duration, stations: stations}.mgmtBytes()
+	if budget <= mgmt {
+		return 0, fmt.Errorf("size %d leaves no room for data after %d bytes of 802.11 management frames", budget, mgmt)
+	}
+	return budget - mgmt, nil
+}
+
+// wifiWriter converts Ethernet frames to 802.11 data frames and
+// interleaves the management frames by timestamp. Flush writes the ones
+// left after the last data frame.
+type wifiWriter struct {
+	pcapio.Writer
+	plan   wifiPlan
+	beacon int
+	probe  int
+	seq    map[string]uint16
+}
+
+func newWifiWriter(w pcapio.Writer, plan wifiPlan) *wifiWriter {
+	return &wifiWriter{Writer: w, plan: plan, seq: map[string]uint16{}}
+}
+
+func (w *wifiWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, meta pcapio.PacketMeta) error {
+	if err := w.writeMgmt(ci.Timestamp); err != nil {
+		return err
+	}
+	frame := w.dataFrame(data, meta.Direction)
+	ci.CaptureLength, ci.Length = len(frame), len(frame)
+	return w.Writer.WritePacket(ci, frame, meta)
+}
+
+func (w *wifiWriter) Flush() error {
+	if err := w.writeMgmt(w.plan.start.Add(w.plan.duration)); err != nil {
+		return err
+	}
+	return w.Writer.Flush()
+}
+
+// writeMgmt writes the management frames due up to until.
+func (w *wifiWriter) writeMgmt(until time.Time) error {
+	for {
+		beaconAt, probeAt := w.nextBeacon(), w.nextProbe()
+		switch {
+		case beaconAt.IsZero() && probeAt.IsZero():
+			return nil
+		case !beaconAt.IsZero() && (probeAt.IsZero() || !probeAt.Before(beaconAt)):
+			if beaconAt.After(until) {
+				return nil
+			}
+			if err := w.writeFrame(beaconAt, w.beaconFrame(beaconAt), "beacon"); err != nil {
+				return err
+			}
+			w.beacon++
+		default:
+			if probeAt.After(until) {
+				return nil
+			}
+			if err := w.writeFrame(probeAt, w.probeFrame(w.plan.stations.at(w.probe)), "probe-request"); err != nil {
+				return err
+			}
+			w.probe++
+		}
+	}
+}
+
+func (w *wifiWriter) nextBeacon() time.Time {
+	if w.beacon >= w.plan.beacons() {
+		return time.Time{}
+	}
+	return w.plan.start.Add(time.Duration(w.beacon) * beaconPeriod)
+}
+
+// nextProbe spreads the stations' probe requests over the capture, half a
+// slot in so they do not coincide with beacons.
+func (w *wifiWriter) nextProbe() time.Time {
+	n := w.plan.stations.count
+	if w.probe >= n {
+		return time.Time{}
+	}
+	slot := w.plan.duration / time.Duration(n)
+	return w.plan.start.Add(time.Duration(w.probe)*slot + slot/2).Truncate(time.Microsecond)
+}
+
+func (w *wifiWriter) writeFrame(ts time.Time, frame []byte, kind string) error {
+	ci := gopacket.CaptureInfo{Timestamp: ts, CaptureLength: len(frame), Length: len(frame)}
+	return w.Writer.WritePacket(ci, frame, pcapio.PacketMeta{Comment: "wifi=" + kind})
+}
+
+// nextSeq returns the 802.11 sequence control field for the next frame
+// sent by addr.
+func (w *wifiWriter) nextSeq(addr net.HardwareAddr) uint16 {
+	n := w.seq[string(addr)]
+	w.seq[string(addr)] = (n + 1) & 0x0fff
+	return n << 4
+}
+
+// dataFrame rewrites an Ethernet frame as an 802.11 data frame. Outbound
+// frames travel from a station to the AP (ToDS), the rest from the AP to
+// a station (FromDS).
+func (w *wifiWriter) dataFrame(eth []byte, dir pcapio.Direction) []byte {
+	dst, src := net.HardwareAddr(eth[0:6]), net.HardwareAddr(eth[6:12])
+	frame := make([]byte, 0, len(eth)+wifiOverhead)
+	var flags byte
+	var a1, a2, a3 net.HardwareAddr
+	var signal int8
+	if dir == pcapio.DirectionInbound {
+		flags, a1, a2, a3 = 0x02, dst, wifiBSSID, src
+		signal = apSignalDBm
+	} else {
+		flags, a1, a2, a3 = 0x01, wifiBSSID, src, dst
+		signal = stationSignal(src)
+	}
+	frame = appendRadiotap(frame, dataRate500kHz, signal)
+	frame = append(frame, 0x08, flags, 44, 0)
+	frame = append(frame, a1...)
+	frame = append(frame, a2...)
+	frame = append(frame, a3...)
+	frame = binary.LittleEndian.AppendUint16(frame, w.nextSeq(a2))
+	frame = append(frame, 0xaa, 0xaa, 0x03, 0, 0, 0)
+	return append(frame, eth[12:]...)
+}
+
+func (w *wifiWriter) beaconFrame(ts time.Time) []byte {
+	frame := appendRadiotap(make([]byte, 0, beaconFrameLen), 2, apSignalDBm)
+	frame = appendMgmtHeader(frame, 0x80, wifiBSSID, wifiBSSID, w.nextSeq(wifiBSSID))
+	frame = binary.LittleEndian.AppendUint64(frame, uint64(ts.Sub(w.plan.start)/time.Microsecond))
+	frame = binary.LittleEndian.AppendUint16(frame, beaconInterval)
+	frame = binary.LittleEndian.AppendUint16(frame, 0x0401) // ESS, short slot time
+	frame = append(frame, 0, byte(len(wifiSSID)))
+	frame = append(frame, wifiSSID...)
+	frame = append(frame, 1, byte(len(wifiRates)))
+	frame = append(frame, wifiRates...)
+	frame = append(frame, 3, 1, wifiChannel)
+	// TIM: DTIM every beacon, no buffered traffic.
+	return append(frame, 5, 4, 0, 1, 0, 0)
+}
+
+// probeFrame is a wildcard-SSID probe request from station h.
+func (w *wifiWriter) probeFrame(h host) []byte {
+	frame := appendRadiotap(make([]byte, 0, probeReqFrameLen), 2, stationSignal(h.mac))
+	frame = appendMgmtHeader(frame, 0x40, h.mac, wifiBroadcast, w.nextSeq(h.mac))
+	frame = append(frame, 0, 0)
+	frame = append(frame, 1, byte(len(wifiRates)))
+	return append(frame, wifiRates...)
+}
+
+func appendMgmtHeader(frame []byte, subtype byte, src, bssid net.HardwareAddr, seq uint16) []byte {
+	frame = append(frame, subtype, 0, 0, 0)
+	frame = append(frame, wifiBroadcast...)
+	frame = append(frame, src...)
+	frame = append(frame, bssid...)
+	return binary.LittleEndian.AppendUint16(frame, seq)
+}
+
+// appendRadiotap adds a radiotap header with flags, rate, channel, antenna
+// signal and antenna fields.
+func appendRadiotap(frame []byte, rate byte, signal int8) []byte {
+	const present = 1<<1 | 1<<2 | 1<<3 | 1<<5 | 1<<11
+	frame = append(frame, 0, 0)
+	frame = binary.LittleEndian.AppendUint16(frame, radiotapLen)
+	frame = binary.LittleEndian.AppendUint32(frame, present)
+	frame = append(frame, 0, rate)
+	// 2 GHz channel, CCK for the 802.11b rates and OFDM otherwise.
+	chFlags := uint16(0x00c0)
+	if rate < 12 {
+		chFlags = 0x00a0
+	}
+	frame = binary.LittleEndian.AppendUint16(frame, wifiFreqMHz)
+	frame = binary.LittleEndian.AppendUint16(frame, chFlags)
+	return append(frame, byte(signal), 0)
+}
+
+// stationSignal gives each station a fixed signal level between -45 and
+// -84 dBm, as if it sat at its own distance from the sniffer.
+func stationSignal(mac net.HardwareAddr) int8 {
+	h := fnv.New32a()
+	h.Write(mac)
+	return int8(-45 - int(h.Sum32()%40))
+}
@@ -0,0 +1,133 @@
+package pcapio
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+
+	"github.com/google/gopacket"
+)
+
+// pcapng block and option codes (draft-ietf-opsawg-pcapng).
+const (
+	ngBlockSectionHeader   = 0x0A0D0D0A
+	ngBlockInterface       = 0x00000001
+	ngBlockEnhancedPacket  = 0x00000006
+	ngByteOrderMagic       = 0x1A2B3C4D
+	ngOptEnd               = 0
+	ngOptComment           = 1
+	ngOptShbUserAppl       = 4
+	ngOptIfName            = 2
+	ngOptEpbFlags          = 2
+	ngOptIfDescription     = 3
+	ngOptIfTsresol         = 9
+	ngTsresolNanoseconds   = 9
+	ngMaxOptionValueLength = 0xffff
+)
+
+// ngWriter writes a single-section, single-interface pcapng stream with
+// nanosecond timestamps. gopacket's NgWriter cannot attach per-packet
+// options, which we need for comments.
+type ngWriter struct {
+	w   *bufio.Writer
+	buf []byte
+}
+
+type ngOption struct {
+	code  uint16
+	value []byte
+}
+
+func newNgWriter(w *bufio.Writer, opts WriterOptions) (*ngWriter, error) {
+	n := &ngWriter{w: w}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:4], ngByteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:6], 1)
+	binary.LittleEndian.PutUint16(shb[6:8], 0)
+	binary.LittleEndian.PutUint64(shb[8:16], 0xffffffffffffffff)
+	if err := n.writeBlock(ngBlockSectionHeader, shb, []ngOption{{ngOptShbUserAppl, []byte("genflux")}}); err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:2], uint16(opts.LinkType))
+	binary.LittleEndian.PutUint32(idb[4:8], opts.Snaplen)
+	idbOpts := []ngOption{{ngOptIfTsresol, []byte{ngTsresolNanoseconds}}}
+	if opts.IfName != "" {
+		idbOpts = append(idbOpts, ngOption{ngOptIfName, []byte(opts.IfName)})
+	}
+	if opts.IfDescription != "" {
+		idbOpts = append(idbOpts, ngOption{ngOptIfDescription, []byte(opts.IfDescription)})
+	}
+	if err := n.writeBlock(ngBlockInterface, idb, idbOpts); err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+func (n *ngWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, meta PacketMeta) error {
+	if ci.CaptureLength != len(data) {
+		return errors.New("capture length does not match data length")
+	}
+	ts := uint64(ci.Timestamp.UnixNano())
+	hdr := make([]byte, 20, 20+len(data)+3)
+	binary.LittleEndian.PutUint32(hdr[0:4], 0)
+	binary.LittleEndian.PutUint32(hdr[4:8], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(ts))
+	binary.LittleEndian.PutUint32(hdr[12:16], uint32(ci.CaptureLength))
+	binary.LittleEndian.PutUint32(hdr[16:20], uint32(ci.Length))
+	body := append(hdr, data...)
+	body = append(body, make([]byte, pad4(len(data)))...)
+
+	var opts []ngOption
+	if meta.Comment != "" {
+		opts = append(opts, ngOption{ngOptComment, []byte(meta.Comment)})
+	}
+	if meta.Direction != DirectionUnknown {
+		flags := binary.LittleEndian.AppendUint32(nil, uint32(meta.Direction))
+		opts = append(opts, ngOption{ngOptEpbFlags, flags})
+	}
+	return n.writeBlock(ngBlockEnhancedPacket, body, opts)
+}
+
+func (n *ngWriter) Flush() error {
+	return n.w.Flush()
+}
+
+// writeBlock writes a block whose fixed part is body (already padded to 32
+// bits) followed by options.
+func (n *ngWriter) writeBlock(blockType uint32, body []byte, opts []ngOption) error {
+	optLen := 0
+	for i := range opts {
+		if len(opts[i].value) > ngMaxOptionValueLength {
+			opts[i].value = opts[i].value[:ngMaxOptionValueLength]
+		}
+		optLen += 4 + len(opts[i].value) + pad4(len(opts[i].value))
+	}
+	if len(opts) > 0 {
+		optLen += 4
+	}
+	total := 12 + len(body) + optLen
+
+	n.buf = n.buf[:0]
+	n.buf = binary.LittleEndian.AppendUint32(n.buf, blockType)
+	n.buf = binary.LittleEndian.AppendUint32(n.buf, uint32(total))
+	n.buf = append(n.buf, body...)
+	for _, o := range opts {
+		n.buf = binary.LittleEndian.AppendUint16(n.buf, o.code)
+		n.buf = binary.LittleEndian.AppendUint16(n.buf, uint16(len(o.value)))
+		n.buf = append(n.buf, o.value...)
+		n.buf = append(n.buf, make([]byte, pad4(len(o.value)))...)
+	}
+	if len(opts) > 0 {
+		n.buf = binary.LittleEndian.AppendUint32(n.buf, ngOptEnd)
+	}
+	n.buf = binary.LittleEndian.AppendUint32(n.buf, uint32(total))
+	_, err := n.w.Write(n.buf)
+	return err
+}
+
+func pad4(n int) int {
+	return (4 - n%4) % 4
+}
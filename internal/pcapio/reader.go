@@ -0,0 +1,307 @@
+package pcapio
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+type Reader interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	LinkType() layers.LinkType
+}
+
+// ReaderOptions controls how damaged captures are read.
+type ReaderOptions struct {
+	// SkipCorrupt steps over corrupt records and ends the capture at a
+	// truncated one instead of failing. In pcap files reading resumes at
+	// the next plausible record; in pcapng files the rest of the file is
+	// skipped.
+	SkipCorrupt bool
+	// OnCorrupt, when set, is told of every record skipped.
+	OnCorrupt func(*CorruptError)
+}
+
+// CorruptError is a record that could not be read.
+type CorruptError struct {
+	// Offset is where the record starts in the (uncompressed) file, or -1
+	// when the format does not tell.
+	Offset int64
+	// Packet is the number of packets read before it.
+	Packet int64
+	Reason string
+}
+
+func (e *CorruptError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("corrupt record after packet %d: %s", e.Packet, e.Reason)
+	}
+	return fmt.Sprintf("corrupt record at offset %d (after packet %d): %s", e.Offset, e.Packet, e.Reason)
+}
+
+// NewReader detects whether r holds a pcap or pcapng stream from its magic
+// number and returns the matching reader.
+func NewReader(r io.Reader) (Reader, error) {
+	return NewReaderOptions(r, ReaderOptions{})
+}
+
+// NewReaderOptions is NewReader with control over damaged records.
+func NewReaderOptions(r io.Reader, opts ReaderOptions) (Reader, error) {
+	br := bufio.NewReaderSize(r, 1<<20)
+	magic, err := br.Peek(4)
+	if err != nil {
+		return nil, err
+	}
+	if binary.LittleEndian.Uint32(magic) == ngBlockSectionHeader {
+		ng, err := pcapgo.NewNgReader(br, pcapgo.DefaultNgReaderOptions)
+		if err != nil {
+			return nil, err
+		}
+		return &ngReader{NgReader: ng, opts: opts}, nil
+	}
+	if magic[0] == 0x1f && magic[1] == 0x8b {
+		gz, err := gzip.NewReader(br)
+		if err != nil {
+			return nil, err
+		}
+		br = bufio.NewReaderSize(gz, 1<<20)
+	}
+	return newPcapReader(br, opts)
+}
+
+const (
+	pcapMagicMicros = 0xa1b2c3d4
+	pcapMagicNanos  = 0xa1b23c4d
+	pcapRecordLen   = 16
+	// maxRecordLen bounds the records a resync accepts, whatever the
+	// snap length claims.
+	maxRecordLen = 262144
+	// resyncWindow is how far from the last good packet the timestamp of
+	// a resync candidate may be.
+	resyncWindow = 24 * time.Hour
+)
+
+// PcapReader reads classic pcap files, keeping track of offsets so that
+// damaged records can be reported and stepped over.
+type PcapReader struct {
+	r       *bufio.Reader
+	order   binary.ByteOrder
+	nanos   bool
+	snaplen uint32
+	link    layers.LinkType
+	opts    ReaderOptions
+
+	offset  int64
+	packets int64
+	last    time.Time
+}
+
+func newPcapReader(r *bufio.Reader, opts ReaderOptions) (*PcapReader, error) {
+	var hdr [24]byte
+	if _, err := io.ReadFull(r, hdr[:]); err != nil {
+		return nil, err
+	}
+	p := &PcapReader{r: r, opts: opts, offset: 24}
+	switch magic := binary.LittleEndian.Uint32(hdr[0:4]); {
+	case magic == pcapMagicMicros || magic == pcapMagicNanos:
+		p.order = binary.LittleEndian
+	case binary.BigEndian.Uint32(hdr[0:4]) == pcapMagicMicros || binary.BigEndian.Uint32(hdr[0:4]) == pcapMagicNanos:
+		p.order = binary.BigEndian
+	default:
+		return nil, fmt.Errorf("unknown magic %x", magic)
+	}
+	p.nanos = p.order.Uint32(hdr[0:4]) == pcapMagicNanos
+	if major := p.order.Uint16(hdr[4:6]); major != 2 {
+		return nil, fmt.Errorf("unknown major version %d", major)
+	}
+	p.snaplen = p.order.Uint32(hdr[16:20])
+	p.link = layers.LinkType(p.order.Uint32(hdr[20:24]))
+	return p, nil
+}
+
+func (p *PcapReader) LinkType() layers.LinkType { return p.link }
+
+func (p *PcapReader) Snaplen() uint32 { return p.snaplen }
+
+// ReadPacketData returns the next packet. The data is not reused.
+func (p *PcapReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := p.readRecord()
+		if err == nil || err == io.EOF {
+			return data, ci, err
+		}
+		cerr, ok := err.(*CorruptError)
+		if !ok {
+			return nil, ci, err
+		}
+		if !p.opts.SkipCorrupt {
+			return nil, ci, cerr
+		}
+		if p.opts.OnCorrupt != nil {
+			p.opts.OnCorrupt(cerr)
+		}
+		if !p.resync() {
+			return nil, ci, io.EOF
+		}
+	}
+}
+
+// readRecord reads the record at the current offset. A bad header leaves
+// the offset at its start, so that resync can search from there.
+func (p *PcapReader) readRecord() ([]byte, gopacket.CaptureInfo, error) {
+	var ci gopacket.CaptureInfo
+	hdr, err := p.r.Peek(pcapRecordLen)
+	if err == io.EOF && len(hdr) == 0 {
+		return nil, ci, io.EOF
+	}
+	if err != nil {
+		if errors.Is(err, io.EOF) {
+			return nil, ci, p.corrupt(fmt.Sprintf("truncated record header: %d of %d bytes", len(hdr), pcapRecordLen))
+		}
+		return nil, ci, err
+	}
+	ci, reason := p.parseHeader(hdr)
+	if reason != "" {
+		return nil, ci, p.corrupt(reason)
+	}
+	data := make([]byte, ci.CaptureLength)
+	p.r.Discard(pcapRecordLen)
+	n, err := io.ReadFull(p.r, data)
+	if err != nil {
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			cerr := p.corrupt(fmt.Sprintf("truncated record: %d of %d bytes", n, ci.CaptureLength))
+			p.offset += int64(pcapRecordLen + n)
+			return nil, ci, cerr
+		}
+		return nil, ci, err
+	}
+	p.offset += int64(pcapRecordLen + n)
+	p.packets++
+	p.last = ci.Timestamp
+	return data, ci, nil
+}
+
+func (p *PcapReader) parseHeader(hdr []byte) (gopacket.CaptureInfo, string) {
+	var ci gopacket.CaptureInfo
+	sec, frac := p.order.Uint32(hdr[0:4]), p.order.Uint32(hdr[4:8])
+	ci.CaptureLength = int(p.order.Uint32(hdr[8:12]))
+	ci.Length = int(p.order.Uint32(hdr[12:16]))
+	if p.nanos {
+		ci.Timestamp = time.Unix(int64(sec), int64(frac)).UTC()
+	} else {
+		ci.Timestamp = time.Unix(int64(sec), int64(frac)*1000).UTC()
+	}
+	switch {
+	case ci.CaptureLength > int(p.snaplen):
+		return ci, fmt.Sprintf("capture length %d exceeds snap length %d", ci.CaptureLength, p.snaplen)
+	case ci.CaptureLength > ci.Length:
+		return ci, fmt.Sprintf("capture length %d exceeds original length %d", ci.CaptureLength, ci.Length)
+	}
+	return ci, ""
+}
+
+func (p *PcapReader) corrupt(reason string) *CorruptError {
+	return &CorruptError{Offset: p.offset, Packet: p.packets, Reason: reason}
+}
+
+// resync moves past a bad record to the next offset that holds a
+// plausible record followed by another one or by the end of the file. It
+// reports false when none is left.
+func (p *PcapReader) resync() bool {
+	for {
+		if _, err := p.r.Discard(1); err != nil {
+			return false
+		}
+		p.offset++
+		hdr, err := p.r.Peek(pcapRecordLen)
+		if err != nil {
+			return false
+		}
+		ci, ok := p.plausible(hdr)
+		if !ok {
+			continue
+		}
+		end := pcapRecordLen + ci.CaptureLength
+		next, err := p.r.Peek(end + pcapRecordLen)
+		if len(next) == end && errors.Is(err, io.EOF) {
+			return true
+		}
+		if err != nil {
+			continue
+		}
+		if _, ok := p.plausible(next[end:]); ok {
+			return true
+		}
+	}
+}
+
+// plausible reports whether hdr looks like a record header of this
+// capture, strictly enough to find one in arbitrary bytes.
+func (p *PcapReader) plausible(hdr []byte) (gopacket.CaptureInfo, bool) {
+	ci, reason := p.parseHeader(hdr)
+	if reason != "" || ci.CaptureLength > maxRecordLen || ci.Length > maxRecordLen {
+		return ci, false
+	}
+	frac, limit := p.order.Uint32(hdr[4:8]), uint32(1e6)
+	if p.nanos {
+		limit = 1e9
+	}
+	if frac >= limit {
+		return ci, false
+	}
+	if !p.last.IsZero() && (ci.Timestamp.Before(p.last.Add(-resyncWindow)) || ci.Timestamp.After(p.last.Add(resyncWindow))) {
+		return ci, false
+	}
+	return ci, true
+}
+
+// ngReader turns the errors of a damaged pcapng file into CorruptErrors.
+// pcapng does not expose offsets, and the rest of the file is skipped.
+type ngReader struct {
+	*pcapgo.NgReader
+	opts    ReaderOptions
+	packets int64
+	done    bool
+}
+
+func (r *ngReader) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if r.done {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	data, ci, err := r.NgReader.ReadPacketData()
+	if err == nil {
+		r.packets++
+		return data, ci, nil
+	}
+	if err == io.EOF {
+		return nil, ci, err
+	}
+	cerr := &CorruptError{Offset: -1, Packet: r.packets, Reason: err.Error()}
+	if errors.Is(err, io.ErrUnexpectedEOF) {
+		cerr.Reason = "truncated block"
+	}
+	if !r.opts.SkipCorrupt {
+		return nil, ci, cerr
+	}
+	if r.opts.OnCorrupt != nil {
+		r.opts.OnCorrupt(cerr)
+	}
+	r.done = true
+	return nil, ci, io.EOF
+}
+
+// FormatOf returns the format of the capture r reads.
+func FormatOf(r Reader) Format {
+	if _, ok := r.(*ngReader); ok {
+		return FormatPcapNG
+	}
+	return FormatPcap
+}
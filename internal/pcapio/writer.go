@@ -0,0 +1,103 @@
+package pcapio
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+)
+
+type Format string
+
+const (
+	FormatPcap   Format = "pcap"
+	FormatPcapNG Format = "pcapng"
+)
+
+func ParseFormat(value string) (Format, error) {
+	switch Format(strings.ToLower(strings.TrimSpace(value))) {
+	case "", FormatPcap:
+		return FormatPcap, nil
+	case FormatPcapNG, "ng":
+		return FormatPcapNG, nil
+	default:
+		return "", fmt.Errorf("unknown format %q (want pcap|pcapng)", value)
+	}
+}
+
+// Ext returns the conventional file extension for the format.
+func (f Format) Ext() string {
+	if f == FormatPcapNG {
+		return ".pcapng"
+	}
+	return ".pcap"
+}
+
+// Direction is a packet's direction relative to the capture point. The
+// values match the direction bits of the pcapng epb_flags option.
+type Direction uint8
+
+const (
+	DirectionUnknown  Direction = 0
+	DirectionInbound  Direction = 1
+	DirectionOutbound Direction = 2
+)
+
+// PacketMeta carries per-packet annotations. Formats that cannot store
+// them (classic pcap) ignore them.
+type PacketMeta struct {
+	Comment   string
+	Direction Direction
+}
+
+type Writer interface {
+	WritePacket(ci gopacket.CaptureInfo, data []byte, meta PacketMeta) error
+	// Flush writes buffered data to the underlying writer.
+	Flush() error
+}
+
+type WriterOptions struct {
+	Snaplen  uint32
+	LinkType layers.LinkType
+	// Interface name and description recorded in pcapng IDBs.
+	IfName        string
+	IfDescription string
+}
+
+// NewWriter writes the file header for format to w and returns a buffered
+// packet writer.
+func NewWriter(w io.Writer, format Format, opts WriterOptions) (Writer, error) {
+	if opts.Snaplen == 0 {
+		opts.Snaplen = 65535
+	}
+	bw := bufio.NewWriterSize(w, 1<<20)
+	switch format {
+	case FormatPcapNG:
+		return newNgWriter(bw, opts)
+	case FormatPcap, "":
+		pw := pcapgo.NewWriter(bw)
+		if err := pw.WriteFileHeader(opts.Snaplen, opts.LinkType); err != nil {
+			return nil, err
+		}
+		return &pcapWriter{w: pw, buf: bw}, nil
+	default:
+		return nil, fmt.Errorf("unknown format %q", format)
+	}
+}
+
+type pcapWriter struct {
+	w   *pcapgo.Writer
+	buf *bufio.Writer
+}
+
+func (p *pcapWriter) WritePacket(ci gopacket.CaptureInfo, data []byte, _ PacketMeta) error {
+	return p.w.WritePacket(ci, data)
+}
+
+func (p *pcapWriter) Flush() error {
+	return p.buf.Flush()
+}
@@ -0,0 +1,240 @@
+package pcaptool
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"genflux/internal/pcapio"
+)
+
+// InfoConfig describes a capture summary.
+type InfoConfig struct {
+	InPath string
+	// Top is how many talkers to list; zero lists none.
+	Top int
+	// Read controls how damaged records are handled.
+	Read pcapio.ReaderOptions
+}
+
+// Info summarises a capture: its size, timing, flows, the protocols it
+// carries and the hosts that carry most of it.
+type Info struct {
+	Path     string `json:"path"`
+	Format   string `json:"format"`
+	LinkType string `json:"link_type"`
+	// FileBytes is the size of the file on disk, headers and compression
+	// included; Bytes counts frame bytes as the packets had them on the
+	// wire, Captured as far as the capture kept them.
+	FileBytes int64 `json:"file_bytes"`
+	Packets   int64 `json:"packets"`
+	Bytes     int64 `json:"bytes"`
+	Captured  int64 `json:"captured_bytes"`
+	// First and Last are the earliest and latest timestamps, whatever the
+	// packet order.
+	First    time.Time     `json:"first"`
+	Last     time.Time     `json:"last"`
+	Duration time.Duration `json:"duration_ns"`
+	PPS      float64       `json:"pps"`
+	Mbps     float64       `json:"mbps"`
+	// Flows counts 5-tuples with both directions together. Frames that
+	// are not IP count per MAC address pair.
+	Flows     int             `json:"flows"`
+	Protocols []ProtocolCount `json:"protocols"`
+	Talkers   []TalkerCount   `json:"top_talkers"`
+}
+
+// ProtocolCount is the traffic of one protocol: the transport protocol of
+// IP packets, the IP protocol of those without one, or the first layer
+// above the link of other frames.
+type ProtocolCount struct {
+	Protocol string `json:"protocol"`
+	Packets  int64  `json:"packets"`
+	Bytes    int64  `json:"bytes"`
+}
+
+// TalkerCount is the traffic a host sent and received, by IP address or
+// for frames that are not IP by MAC address.
+type TalkerCount struct {
+	Address string `json:"address"`
+	Packets int64  `json:"packets"`
+	Bytes   int64  `json:"bytes"`
+}
+
+type infoFlow struct {
+	net, transport gopacket.Flow
+}
+
+// linkLayers are stepped over when naming the protocol of a frame that is
+// not IP.
+var linkLayers = map[gopacket.LayerType]bool{
+	layers.LayerTypeEthernet:        true,
+	layers.LayerTypeDot1Q:           true,
+	layers.LayerTypeRadioTap:        true,
+	layers.LayerTypeDot11:           true,
+	layers.LayerTypeLLC:             true,
+	layers.LayerTypeSNAP:            true,
+	layers.LayerTypeLinuxSLL:        true,
+	layers.LayerTypeLoopback:        true,
+	gopacket.LayerTypePayload:       true,
+	gopacket.LayerTypeDecodeFailure: true,
+}
+
+// Summarize reads the capture at cfg.InPath once and summarises it.
+func Summarize(cfg InfoConfig) (Info, error) {
+	info := Info{Path: cfg.InPath}
+	if cfg.InPath == "" {
+		return info, errors.New("capture path required")
+	}
+	if cfg.Top < 0 {
+		return info, errors.New("top must be >= 0")
+	}
+	in, err := os.Open(cfg.InPath)
+	if err != nil {
+		return info, err
+	}
+	defer in.Close()
+	if st, err := in.Stat(); err == nil {
+		info.FileBytes = st.Size()
+	}
+	reader, err := pcapio.NewReaderOptions(in, cfg.Read)
+	if err != nil {
+		return info, fmt.Errorf("read %s: %v", cfg.InPath, err)
+	}
+	info.Format, info.LinkType = string(pcapio.FormatOf(reader)), reader.LinkType().String()
+
+	decoder := reader.LinkType()
+	flows := map[infoFlow]bool{}
+	protocols := map[string]*ProtocolCount{}
+	talkers := map[gopacket.Endpoint]*TalkerCount{}
+	for {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return info, fmt.Errorf("read %s: %w", cfg.InPath, err)
+		}
+		info.Packets++
+		info.Bytes += int64(ci.Length)
+		info.Captured += int64(ci.CaptureLength)
+		if info.First.IsZero() || ci.Timestamp.Before(info.First) {
+			info.First = ci.Timestamp
+		}
+		if ci.Timestamp.After(info.Last) {
+			info.Last = ci.Timestamp
+		}
+
+		p := gopacket.NewPacket(data, decoder, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		flow, name := packetFlow(p)
+		if name == "" {
+			continue
+		}
+		flows[flow] = true
+		pc := protocols[name]
+		if pc == nil {
+			pc = &ProtocolCount{Protocol: name}
+			protocols[name] = pc
+		}
+		pc.Packets++
+		pc.Bytes += int64(ci.Length)
+		src, dst := flow.net.Endpoints()
+		for _, ep := range []gopacket.Endpoint{src, dst} {
+			tc := talkers[ep]
+			if tc == nil {
+				tc = &TalkerCount{Address: ep.String()}
+				talkers[ep] = tc
+			}
+			tc.Packets++
+			tc.Bytes += int64(ci.Length)
+		}
+	}
+
+	info.Duration = info.Last.Sub(info.First)
+	if secs := info.Duration.Seconds(); secs > 0 {
+		info.PPS = float64(info.Packets) / secs
+		info.Mbps = float64(info.Bytes) * 8 / secs / 1e6
+	}
+	info.Flows = len(flows)
+	for _, pc := range protocols {
+		info.Protocols = append(info.Protocols, *pc)
+	}
+	sort.Slice(info.Protocols, func(i, j int) bool {
+		a, b := info.Protocols[i], info.Protocols[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Protocol < b.Protocol
+	})
+	for _, tc := range talkers {
+		info.Talkers = append(info.Talkers, *tc)
+	}
+	sort.Slice(info.Talkers, func(i, j int) bool {
+		a, b := info.Talkers[i], info.Talkers[j]
+		if a.Bytes != b.Bytes {
+			return a.Bytes > b.Bytes
+		}
+		return a.Address < b.Address
+	})
+	info.Talkers = info.Talkers[:min(cfg.Top, len(info.Talkers))]
+	return info, nil
+}
+
+// packetFlow returns the flow of p, both directions alike, and the name of
+// its protocol; the name is empty for a frame too damaged to tell. Tunnels
+// count by the innermost IP header decoded.
+func packetFlow(p gopacket.Packet) (infoFlow, string) {
+	var flow infoFlow
+	var ipProto layers.IPProtocol
+	var ip gopacket.NetworkLayer
+	var dot11 *layers.Dot11
+	name := ""
+	for _, l := range p.Layers() {
+		switch l := l.(type) {
+		case *layers.IPv4:
+			ip, ipProto = l, l.Protocol
+		case *layers.IPv6:
+			ip, ipProto = l, l.NextHeader
+		case *layers.IPv6HopByHop:
+			ipProto = l.NextHeader
+		case *layers.Dot11:
+			dot11 = l
+		}
+		if name == "" && !linkLayers[l.LayerType()] {
+			name = l.LayerType().String()
+		}
+	}
+	switch {
+	case ip != nil:
+		flow.net = ip.NetworkFlow()
+		name = ipProto.String()
+		if t := p.TransportLayer(); t != nil {
+			flow.transport = t.TransportFlow()
+			name = t.LayerType().String()
+		}
+	case p.LinkLayer() != nil || dot11 != nil:
+		if dot11 != nil {
+			// 802.11 frames are not a gopacket link layer; transmitter to
+			// receiver stands in for source to destination.
+			flow.net = gopacket.NewFlow(layers.EndpointMAC, dot11.Address2, dot11.Address1)
+		} else {
+			flow.net = p.LinkLayer().LinkFlow()
+		}
+		if name == "" {
+			name = "other"
+		}
+	default:
+		return flow, ""
+	}
+	src, dst := flow.net.Endpoints()
+	if dst.LessThan(src) || src == dst && flow.transport.Dst().LessThan(flow.transport.Src()) {
+		flow.net, flow.transport = flow.net.Reverse(), flow.transport.Reverse()
+	}
+	return flow, name
+}
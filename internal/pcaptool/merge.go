@@ -0,0 +1,183 @@
+package pcaptool
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/google/gopacket"
+
+	"genflux/internal/pcapio"
+)
+
+// MergeConfig describes a merge of several captures into one.
+type MergeConfig struct {
+	InPaths []string
+	OutPath string
+	// Offsets shift every packet of the input at the same index; inputs
+	// past the end of the list are not shifted.
+	Offsets []time.Duration
+	// Format is the output format; empty takes that of the first input.
+	Format pcapio.Format
+	// Read controls how damaged records are handled.
+	Read pcapio.ReaderOptions
+}
+
+// MergeStats summarises a merge.
+type MergeStats struct {
+	Packets int64
+	// PerInput is the number of packets taken from each input.
+	PerInput []int64
+	First    time.Time
+	Last     time.Time
+}
+
+// mergeInput is an input with its next packet read ahead.
+type mergeInput struct {
+	index  int
+	path   string
+	reader pcapio.Reader
+	offset time.Duration
+	data   []byte
+	ci     gopacket.CaptureInfo
+}
+
+// next reads the input's next packet, reporting false at its end.
+func (in *mergeInput) next() (bool, error) {
+	data, ci, err := in.reader.ReadPacketData()
+	if err == io.EOF {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("read %s: %w", in.path, err)
+	}
+	ci.Timestamp = ci.Timestamp.Add(in.offset)
+	in.data, in.ci = data, ci
+	return true, nil
+}
+
+// mergeQueue orders inputs by their next packet's timestamp, earlier
+// inputs first on a tie.
+type mergeQueue []*mergeInput
+
+func (q mergeQueue) Len() int { return len(q) }
+func (q mergeQueue) Less(i, j int) bool {
+	if a, b := q[i].ci.Timestamp, q[j].ci.Timestamp; !a.Equal(b) {
+		return a.Before(b)
+	}
+	return q[i].index < q[j].index
+}
+func (q mergeQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+func (q *mergeQueue) Push(x any)   { *q = append(*q, x.(*mergeInput)) }
+func (q *mergeQueue) Pop() any {
+	old := *q
+	in := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return in
+}
+
+// Merge interleaves the packets of cfg.InPaths into cfg.OutPath in
+// timestamp order, after shifting each input by its offset. Every input
+// is read once, front to back: the order within an input is kept, so an
+// input whose timestamps go backwards merges as if it were sorted up to
+// that point. All inputs must share a link type.
+func Merge(cfg MergeConfig) (MergeStats, error) {
+	stats := MergeStats{PerInput: make([]int64, len(cfg.InPaths))}
+	if len(cfg.InPaths) == 0 || cfg.OutPath == "" {
+		return stats, errors.New("inputs and out required")
+	}
+	if len(cfg.Offsets) > len(cfg.InPaths) {
+		return stats, fmt.Errorf("%d offsets for %d inputs", len(cfg.Offsets), len(cfg.InPaths))
+	}
+
+	inputs := make([]*mergeInput, len(cfg.InPaths))
+	snaplen := uint32(0)
+	for i, path := range cfg.InPaths {
+		if cfg.OutPath != StdoutPath && sameFile(path, cfg.OutPath) {
+			return stats, fmt.Errorf("out must differ from input %s", path)
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return stats, err
+		}
+		defer f.Close()
+		reader, err := pcapio.NewReaderOptions(f, cfg.Read)
+		if err != nil {
+			return stats, fmt.Errorf("read %s: %v", path, err)
+		}
+		if i > 0 && reader.LinkType() != inputs[0].reader.LinkType() {
+			return stats, fmt.Errorf("link types differ: %s is %s, %s is %s",
+				cfg.InPaths[0], inputs[0].reader.LinkType(), path, reader.LinkType())
+		}
+		if r, ok := reader.(*pcapio.PcapReader); ok {
+			snaplen = max(snaplen, r.Snaplen())
+		}
+		inputs[i] = &mergeInput{index: i, path: path, reader: reader}
+		if i < len(cfg.Offsets) {
+			inputs[i].offset = cfg.Offsets[i]
+		}
+	}
+	format := cfg.Format
+	if format == "" {
+		format = pcapio.FormatOf(inputs[0].reader)
+	}
+
+	var out io.Writer = os.Stdout
+	if cfg.OutPath != StdoutPath {
+		f, err := os.Create(cfg.OutPath)
+		if err != nil {
+			return stats, err
+		}
+		defer f.Close()
+		out = f
+	}
+	writer, err := pcapio.NewWriter(out, format, pcapio.WriterOptions{Snaplen: max(snaplen, 65535), LinkType: inputs[0].reader.LinkType()})
+	if err != nil {
+		return stats, err
+	}
+
+	q := make(mergeQueue, 0, len(inputs))
+	for _, in := range inputs {
+		ok, err := in.next()
+		if err != nil {
+			return stats, err
+		}
+		if ok {
+			q = append(q, in)
+		}
+	}
+	heap.Init(&q)
+	for len(q) > 0 {
+		in := q[0]
+		if stats.Packets == 0 || in.ci.Timestamp.Before(stats.First) {
+			stats.First = in.ci.Timestamp
+		}
+		if in.ci.Timestamp.After(stats.Last) {
+			stats.Last = in.ci.Timestamp
+		}
+		if err := writer.WritePacket(in.ci, in.data, pcapio.PacketMeta{}); err != nil {
+			return stats, err
+		}
+		stats.Packets++
+		stats.PerInput[in.index]++
+		ok, err := in.next()
+		if err != nil {
+			return stats, err
+		}
+		if ok {
+			heap.Fix(&q, 0)
+		} else {
+			heap.Pop(&q)
+		}
+	}
+	if err := writer.Flush(); err != nil {
+		return stats, err
+	}
+	if f, ok := out.(*os.File); ok && f != os.Stdout {
+		return stats, f.Close()
+	}
+	return stats, nil
+}
@@ -0,0 +1,137 @@
+// Package pcaptool rewrites and inspects existing captures.
+package pcaptool
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"genflux/internal/pcapio"
+)
+
+// StdoutPath is the output path that streams the capture to stdout.
+const StdoutPath = "-"
+
+// RetimeConfig describes a timestamp rewrite.
+type RetimeConfig struct {
+	InPath  string
+	OutPath string
+	// Scale multiplies every packet's offset from the first packet: 0.1
+	// compresses the capture to a tenth of its duration, 2 doubles it.
+	Scale float64
+	// StartTime, when set, moves the first packet to it; otherwise it
+	// keeps its timestamp.
+	StartTime time.Time
+	// StartDay, when set instead, moves the capture to that day in
+	// StartDay's location, the first packet keeping its time of day there,
+	// so time-of-day patterns survive the move.
+	StartDay time.Time
+	// Read controls how damaged records are handled.
+	Read pcapio.ReaderOptions
+}
+
+// RetimeStats summarises a rewrite.
+type RetimeStats struct {
+	Packets     int64
+	OldDuration time.Duration
+	NewDuration time.Duration
+	NewStart    time.Time
+}
+
+// Retime copies the capture at cfg.InPath to cfg.OutPath in the same
+// format and link type, with its timestamps scaled and shifted. Packet
+// order is kept even where timestamps go backwards.
+func Retime(cfg RetimeConfig) (RetimeStats, error) {
+	var stats RetimeStats
+	if cfg.InPath == "" || cfg.OutPath == "" {
+		return stats, errors.New("in and out required")
+	}
+	if cfg.Scale <= 0 {
+		return stats, errors.New("scale must be > 0")
+	}
+	if !cfg.StartTime.IsZero() && !cfg.StartDay.IsZero() {
+		return stats, errors.New("set at most one of start time and start day")
+	}
+	if cfg.OutPath != StdoutPath && sameFile(cfg.InPath, cfg.OutPath) {
+		return stats, errors.New("out must differ from in")
+	}
+
+	in, err := os.Open(cfg.InPath)
+	if err != nil {
+		return stats, err
+	}
+	defer in.Close()
+	reader, err := pcapio.NewReaderOptions(in, cfg.Read)
+	if err != nil {
+		return stats, fmt.Errorf("read %s: %v", cfg.InPath, err)
+	}
+	format, snaplen := pcapio.FormatOf(reader), uint32(65535)
+	if r, ok := reader.(*pcapio.PcapReader); ok {
+		snaplen = r.Snaplen()
+	}
+
+	var out io.Writer = os.Stdout
+	if cfg.OutPath != StdoutPath {
+		f, err := os.Create(cfg.OutPath)
+		if err != nil {
+			return stats, err
+		}
+		defer f.Close()
+		out = f
+	}
+	writer, err := pcapio.NewWriter(out, format, pcapio.WriterOptions{Snaplen: snaplen, LinkType: reader.LinkType()})
+	if err != nil {
+		return stats, err
+	}
+
+	var first time.Time
+	for {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return stats, fmt.Errorf("read %s: %w", cfg.InPath, err)
+		}
+		if stats.Packets == 0 {
+			first = ci.Timestamp
+			stats.NewStart = first
+			switch {
+			case !cfg.StartTime.IsZero():
+				stats.NewStart = cfg.StartTime
+			case !cfg.StartDay.IsZero():
+				y, m, d := cfg.StartDay.Date()
+				at := first.In(cfg.StartDay.Location())
+				stats.NewStart = time.Date(y, m, d, at.Hour(), at.Minute(), at.Second(), at.Nanosecond(), at.Location())
+			}
+		}
+		offset := ci.Timestamp.Sub(first)
+		stats.OldDuration = max(stats.OldDuration, offset)
+		ci.Timestamp = stats.NewStart.Add(time.Duration(float64(offset) * cfg.Scale))
+		stats.NewDuration = max(stats.NewDuration, ci.Timestamp.Sub(stats.NewStart))
+		if err := writer.WritePacket(ci, data, pcapio.PacketMeta{}); err != nil {
+			return stats, err
+		}
+		stats.Packets++
+	}
+	if err := writer.Flush(); err != nil {
+		return stats, err
+	}
+	if f, ok := out.(*os.File); ok && f != os.Stdout {
+		return stats, f.Close()
+	}
+	return stats, nil
+}
+
+// sameFile reports whether a and b name the same existing file.
+func sameFile(a, b string) bool {
+	ia, err := os.Stat(a)
+	if err != nil {
+		return filepath.Clean(a) == filepath.Clean(b)
+	}
+	ib, err := os.Stat(b)
+	return err == nil && os.SameFile(ia, ib)
+}
@@ -0,0 +1,272 @@
+package pcaptool
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+
+	"genflux/internal/pcapio"
+)
+
+// SelfTestConfig describes what the captures of one generator run should
+// hold, as its configuration says. Zero fields are not checked.
+type SelfTestConfig struct {
+	// Paths are the captures, in the order they were written; Files is
+	// how many the run wrote, so that totals are only checked over all of
+	// them.
+	Paths []string
+	Files int
+	// ExactBytes is the frame bytes of all the files together, MaxBytes
+	// the most any one file may hold. SizeTolerance is the fraction of
+	// ExactBytes the total may be off by.
+	ExactBytes    int64
+	MaxBytes      int64
+	SizeTolerance float64
+	// Flows is the number of IP flows in every file, both directions of
+	// a 5-tuple counting once.
+	Flows int
+	// Mix is the expected share of every IP protocol (tcp, udp, icmp),
+	// among the flows when MixByFlows, else among the IP packets.
+	// MixTolerance is how far a share may stray; 0 allows three standard
+	// errors of a share drawn from that many, and at least one point, so
+	// about one protocol check in 400 fails on a sound capture.
+	Mix          map[string]float64
+	MixByFlows   bool
+	MixTolerance float64
+	// Packets, when set, is the number of packets each path should hold,
+	// by path.
+	Packets map[string]int64
+	// Skip gives, by check, why it does not apply to this run.
+	Skip map[string]string
+	// Read controls how damaged records are handled.
+	Read pcapio.ReaderOptions
+}
+
+// SelfTestCheck is the outcome of one check: pass, fail or skip, with
+// what was expected and found, or why it was skipped.
+type SelfTestCheck struct {
+	Name   string `json:"name"`
+	File   string `json:"file,omitempty"`
+	Status string `json:"status"`
+	Detail string `json:"detail"`
+}
+
+// SelfTestReport lists the checks a self-test made, in order.
+type SelfTestReport struct {
+	Checks []SelfTestCheck `json:"checks"`
+}
+
+// Failed returns the number of checks that failed.
+func (r SelfTestReport) Failed() int {
+	n := 0
+	for _, c := range r.Checks {
+		if c.Status == "fail" {
+			n++
+		}
+	}
+	return n
+}
+
+func (r *SelfTestReport) add(name, file string, pass bool, format string, args ...any) {
+	status := "pass"
+	if !pass {
+		status = "fail"
+	}
+	r.Checks = append(r.Checks, SelfTestCheck{Name: name, File: file, Status: status, Detail: fmt.Sprintf(format, args...)})
+}
+
+// selfTestFile is what a self-test reads from one capture.
+type selfTestFile struct {
+	packets, bytes int64
+	// flows holds the protocol of every IP flow.
+	flows map[infoFlow]string
+	// disorder counts packets stamped earlier than the one before, the
+	// first of them at packet firstDisorder (counting from 1).
+	disorder      int64
+	firstDisorder int64
+	earlier       time.Duration
+}
+
+// SelfTest reads every capture of cfg.Paths once and checks it against
+// the model: the size, the number of flows, the protocol mix, that
+// timestamps never go back, and the packet counts. A check that fails is
+// reported, not returned as an error; errors are for captures that
+// cannot be read.
+func SelfTest(cfg SelfTestConfig) (SelfTestReport, error) {
+	var report SelfTestReport
+	if len(cfg.Paths) == 0 {
+		return report, errors.New("capture path required")
+	}
+	protoPackets := map[string]int64{}
+	var ipPackets int64
+	files := make([]selfTestFile, len(cfg.Paths))
+	for i, path := range cfg.Paths {
+		f, err := selfTestRead(path, cfg.Read, protoPackets, &ipPackets)
+		if err != nil {
+			return report, err
+		}
+		files[i] = f
+	}
+
+	skip := func(name string) bool {
+		if reason, ok := cfg.Skip[name]; ok {
+			report.Checks = append(report.Checks, SelfTestCheck{Name: name, Status: "skip", Detail: reason})
+			return true
+		}
+		return false
+	}
+
+	if !skip("size") {
+		var total int64
+		for i, f := range files {
+			total += f.bytes
+			if cfg.MaxBytes > 0 {
+				report.add("size", cfg.Paths[i], f.bytes <= cfg.MaxBytes, "%d frame bytes, at most %d", f.bytes, cfg.MaxBytes)
+			}
+		}
+		switch {
+		case cfg.ExactBytes <= 0:
+		case len(cfg.Paths) < cfg.Files:
+			report.Checks = append(report.Checks, SelfTestCheck{Name: "size", Status: "skip",
+				Detail: fmt.Sprintf("total of %d files given out of %d", len(cfg.Paths), cfg.Files)})
+		default:
+			slack := int64(math.Round(float64(cfg.ExactBytes) * cfg.SizeTolerance))
+			off := total - cfg.ExactBytes
+			report.add("size", "", max(off, -off) <= slack, "%d frame bytes, want %d ± %d", total, cfg.ExactBytes, slack)
+		}
+	}
+
+	for i, f := range files {
+		if f.disorder == 0 {
+			report.add("order", cfg.Paths[i], true, "timestamps of %d packets never go back", f.packets)
+		} else {
+			report.add("order", cfg.Paths[i], false, "%d packets stamped before the one ahead of them, first packet %d by %s",
+				f.disorder, f.firstDisorder, f.earlier)
+		}
+	}
+
+	if cfg.Packets != nil && !skip("packets") {
+		for i, f := range files {
+			if want, ok := cfg.Packets[cfg.Paths[i]]; ok {
+				report.add("packets", cfg.Paths[i], f.packets == want, "%d packets, want %d", f.packets, want)
+			}
+		}
+	}
+
+	if cfg.Flows > 0 && !skip("flows") {
+		for i, f := range files {
+			report.add("flows", cfg.Paths[i], len(f.flows) == cfg.Flows, "%d IP flows, want %d", len(f.flows), cfg.Flows)
+		}
+	}
+
+	if len(cfg.Mix) > 0 && !skip("mix") {
+		counts, n := protoPackets, ipPackets
+		if cfg.MixByFlows {
+			counts, n = map[string]int64{}, 0
+			for _, f := range files {
+				for _, proto := range f.flows {
+					counts[proto]++
+				}
+				n += int64(len(f.flows))
+			}
+		}
+		names := make([]string, 0, len(cfg.Mix))
+		for name := range cfg.Mix {
+			names = append(names, name)
+		}
+		for name := range counts {
+			if _, ok := cfg.Mix[name]; !ok {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		unit := "packets"
+		if cfg.MixByFlows {
+			unit = "flows"
+		}
+		for _, name := range names {
+			want := cfg.Mix[name]
+			got := 0.0
+			if n > 0 {
+				got = float64(counts[name]) / float64(n)
+			}
+			tol := cfg.MixTolerance
+			if tol <= 0 {
+				tol = 0.01
+				if n > 0 {
+					tol = max(tol, 3*math.Sqrt(want*(1-want)/float64(n)))
+				}
+			}
+			report.add("mix", "", math.Abs(got-want) <= tol, "%s %.2f%% of %d %s, want %.2f%% ± %.2f",
+				name, 100*got, n, unit, 100*want, 100*tol)
+		}
+	}
+	return report, nil
+}
+
+// selfTestRead reads the capture at path, adding its IP packets, by
+// protocol, to protoPackets and ipPackets.
+func selfTestRead(path string, opts pcapio.ReaderOptions, protoPackets map[string]int64, ipPackets *int64) (selfTestFile, error) {
+	f := selfTestFile{flows: map[infoFlow]string{}}
+	in, err := os.Open(path)
+	if err != nil {
+		return f, err
+	}
+	defer in.Close()
+	reader, err := pcapio.NewReaderOptions(in, opts)
+	if err != nil {
+		return f, fmt.Errorf("read %s: %v", path, err)
+	}
+	decoder := reader.LinkType()
+	var last time.Time
+	for {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return f, fmt.Errorf("read %s: %w", path, err)
+		}
+		f.packets++
+		f.bytes += int64(ci.Length)
+		if ci.Timestamp.Before(last) {
+			if f.disorder == 0 {
+				f.firstDisorder, f.earlier = f.packets, last.Sub(ci.Timestamp)
+			}
+			f.disorder++
+		} else {
+			last = ci.Timestamp
+		}
+
+		p := gopacket.NewPacket(data, decoder, gopacket.DecodeOptions{Lazy: true, NoCopy: true})
+		if p.NetworkLayer() == nil {
+			continue
+		}
+		flow, name := packetFlow(p)
+		if name == "" {
+			continue
+		}
+		name = mixName(name)
+		f.flows[flow] = name
+		protoPackets[name]++
+		*ipPackets++
+	}
+	return f, nil
+}
+
+// mixName names a protocol as the generator's distributions do, ICMP of
+// either IP version alike.
+func mixName(name string) string {
+	name = strings.ToLower(name)
+	if strings.HasPrefix(name, "icmp") {
+		return "icmp"
+	}
+	return name
+}
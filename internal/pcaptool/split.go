@@ -0,0 +1,184 @@
+package pcaptool
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"genflux/internal/pcapio"
+)
+
+// SplitConfig describes cutting a capture into numbered chunks. Exactly
+// one of Packets, Bytes and Window sets where the chunks end.
+type SplitConfig struct {
+	InPath string
+	// OutDir receives the chunks, named <Prefix>_000000.<ext> onwards in
+	// the input's format. An empty OutDir is the input's directory and an
+	// empty Prefix the input's name without extension.
+	OutDir string
+	Prefix string
+	// Packets is the number of packets per chunk.
+	Packets int64
+	// Bytes is the most frame bytes per chunk, as sizes count them in
+	// generation: record and file headers come on top. A packet larger
+	// than Bytes gets a chunk of its own.
+	Bytes int64
+	// Window is the span of capture time per chunk. Windows are laid from
+	// the first packet on, and those without packets get no chunk; a
+	// packet earlier than its predecessor stays in the current chunk.
+	Window time.Duration
+	// Read controls how damaged records are handled.
+	Read pcapio.ReaderOptions
+}
+
+// SplitStats summarises a split.
+type SplitStats struct {
+	Packets int64
+	// Files are the chunks written, in order.
+	Files []string
+}
+
+// Split cuts the capture at cfg.InPath into chunks. The chunks depend only
+// on the input and cfg, so the same split can be repeated anywhere.
+func Split(cfg SplitConfig) (SplitStats, error) {
+	var stats SplitStats
+	if cfg.InPath == "" {
+		return stats, errors.New("in required")
+	}
+	set := 0
+	for _, on := range []bool{cfg.Packets != 0, cfg.Bytes != 0, cfg.Window != 0} {
+		if on {
+			set++
+		}
+	}
+	if set != 1 {
+		return stats, errors.New("set exactly one of packets, bytes and window")
+	}
+	if cfg.Packets < 0 || cfg.Bytes < 0 || cfg.Window < 0 {
+		return stats, errors.New("packets, bytes and window must be > 0")
+	}
+	if cfg.OutDir == "" {
+		cfg.OutDir = filepath.Dir(cfg.InPath)
+	}
+	if cfg.Prefix == "" {
+		cfg.Prefix = captureStem(cfg.InPath)
+	}
+
+	in, err := os.Open(cfg.InPath)
+	if err != nil {
+		return stats, err
+	}
+	defer in.Close()
+	reader, err := pcapio.NewReaderOptions(in, cfg.Read)
+	if err != nil {
+		return stats, fmt.Errorf("read %s: %v", cfg.InPath, err)
+	}
+	format, snaplen := pcapio.FormatOf(reader), uint32(65535)
+	if r, ok := reader.(*pcapio.PcapReader); ok {
+		snaplen = r.Snaplen()
+	}
+	if err := os.MkdirAll(cfg.OutDir, 0o755); err != nil {
+		return stats, err
+	}
+
+	var (
+		chunk          *splitChunk
+		packets, bytes int64
+		windowEnd      time.Time
+	)
+	for {
+		data, ci, err := reader.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if chunk != nil {
+				chunk.close()
+			}
+			return stats, fmt.Errorf("read %s: %w", cfg.InPath, err)
+		}
+		next := chunk == nil
+		switch {
+		case cfg.Packets > 0:
+			next = next || packets == cfg.Packets
+		case cfg.Bytes > 0:
+			next = next || bytes+int64(len(data)) > cfg.Bytes && packets > 0
+		default:
+			if windowEnd.IsZero() {
+				windowEnd = ci.Timestamp.Add(cfg.Window)
+			} else if !ci.Timestamp.Before(windowEnd) {
+				windowEnd = windowEnd.Add(ci.Timestamp.Sub(windowEnd)/cfg.Window*cfg.Window + cfg.Window)
+				next = true
+			}
+		}
+		if next {
+			if chunk != nil {
+				if err := chunk.close(); err != nil {
+					return stats, err
+				}
+			}
+			path := filepath.Join(cfg.OutDir, fmt.Sprintf("%s_%06d%s", cfg.Prefix, len(stats.Files), format.Ext()))
+			if sameFile(cfg.InPath, path) {
+				return stats, fmt.Errorf("chunk %s would overwrite the input", path)
+			}
+			if chunk, err = newSplitChunk(path, format, pcapio.WriterOptions{Snaplen: snaplen, LinkType: reader.LinkType()}); err != nil {
+				return stats, err
+			}
+			stats.Files = append(stats.Files, path)
+			packets, bytes = 0, 0
+		}
+		if err := chunk.writer.WritePacket(ci, data, pcapio.PacketMeta{}); err != nil {
+			chunk.close()
+			return stats, err
+		}
+		packets++
+		bytes += int64(len(data))
+		stats.Packets++
+	}
+	if chunk != nil {
+		return stats, chunk.close()
+	}
+	return stats, nil
+}
+
+type splitChunk struct {
+	file   *os.File
+	writer pcapio.Writer
+}
+
+func newSplitChunk(path string, format pcapio.Format, opts pcapio.WriterOptions) (*splitChunk, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := pcapio.NewWriter(f, format, opts)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &splitChunk{file: f, writer: w}, nil
+}
+
+func (c *splitChunk) close() error {
+	err := c.writer.Flush()
+	if cerr := c.file.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// captureStem is the file name of path without its capture extensions.
+func captureStem(path string) string {
+	name := filepath.Base(path)
+	name = strings.TrimSuffix(name, ".gz")
+	for _, ext := range []string{".pcapng", ".pcap", ".cap"} {
+		if strings.HasSuffix(strings.ToLower(name), ext) {
+			return name[:len(name)-len(ext)]
+		}
+	}
+	return name
+}
@@ -0,0 +1,41 @@
+package replay
+
+import (
+	"fmt"
+	"strings"
+)
+
+// TxBackend selects how frames are handed to the kernel.
+type TxBackend string
+
+const (
+	// BackendSocket hands frames to the kernel with sendmmsg, in batches
+	// of those already due (see Config.SendBatch), or one sendto each.
+	BackendSocket TxBackend = "socket"
+	// BackendRing queues frames in a PACKET_MMAP TX ring and sends them
+	// in batches.
+	BackendRing TxBackend = "ring"
+	// BackendXDP sends through an AF_XDP socket and its UMEM, zero-copy
+	// where the driver supports it.
+	BackendXDP TxBackend = "xdp"
+	// BackendPcap injects frames with libpcap, or Npcap on Windows: the
+	// backend of macOS and Windows, where there is no AF_PACKET.
+	BackendPcap TxBackend = "pcap"
+)
+
+func ParseTxBackend(value string) (TxBackend, error) {
+	switch TxBackend(strings.ToLower(strings.TrimSpace(value))) {
+	case "":
+		return DefaultBackend, nil
+	case BackendSocket:
+		return BackendSocket, nil
+	case BackendRing, "mmap":
+		return BackendRing, nil
+	case BackendXDP, "af_xdp":
+		return BackendXDP, nil
+	case BackendPcap, "npcap":
+		return BackendPcap, nil
+	default:
+		return "", fmt.Errorf("unknown tx backend %q (want socket|ring|xdp|pcap)", value)
+	}
+}
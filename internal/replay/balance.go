@@ -0,0 +1,104 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/fnv"
+	"strings"
+)
+
+// Balance decides which interface sends each packet when replaying on
+// several.
+type Balance string
+
+const (
+	// BalanceFlowHash keeps both directions of a flow on one interface,
+	// the way RSS spreads flows across queues.
+	BalanceFlowHash   Balance = "flow-hash"
+	BalanceRoundRobin Balance = "round-robin"
+	// BalanceTee sends every packet on every interface, to feed several
+	// sensors the same stream.
+	BalanceTee Balance = "tee"
+)
+
+func ParseBalance(value string) (Balance, error) {
+	switch Balance(strings.ToLower(strings.TrimSpace(value))) {
+	case "", BalanceFlowHash, "hash":
+		return BalanceFlowHash, nil
+	case BalanceRoundRobin, "rr":
+		return BalanceRoundRobin, nil
+	case BalanceTee, "replicate":
+		return BalanceTee, nil
+	default:
+		return "", fmt.Errorf("unknown balance policy %q (want flow-hash|round-robin|tee)", value)
+	}
+}
+
+// splitIfaces parses an --iface list.
+func splitIfaces(value string) []string {
+	var out []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			out = append(out, name)
+		}
+	}
+	return out
+}
+
+// frameFlow locates the addresses, ports and IP protocol of an Ethernet
+// frame. Frames that are not IP yield their MAC addresses and protocol 0;
+// ports are nil unless the frame is TCP or UDP. An IPv4 fragment yields
+// no ports either, since only the first one carries them: that way every
+// fragment of a datagram goes with the same flow.
+func frameFlow(frame []byte) (src, dst, sport, dport []byte, proto byte) {
+	src, dst = frame[6:12], frame[0:6]
+	off := 12
+	etherType := binary.BigEndian.Uint16(frame[off:])
+	for (etherType == 0x8100 || etherType == 0x88a8) && len(frame) >= off+6 {
+		off += 4
+		etherType = binary.BigEndian.Uint16(frame[off:])
+	}
+	off += 2
+	var l4 []byte
+	switch {
+	case etherType == 0x0800 && len(frame) >= off+20:
+		ihl := int(frame[off]&0x0f) * 4
+		src, dst, proto = frame[off+12:off+16], frame[off+16:off+20], frame[off+9]
+		// More fragments, or a fragment offset.
+		if binary.BigEndian.Uint16(frame[off+6:])&0x3fff != 0 {
+			break
+		}
+		if len(frame) >= off+ihl {
+			l4 = frame[off+ihl:]
+		}
+	case etherType == 0x86dd && len(frame) >= off+40:
+		src, dst, proto = frame[off+8:off+24], frame[off+24:off+40], frame[off+6]
+		l4 = frame[off+40:]
+	}
+	if (proto == 6 || proto == 17) && len(l4) >= 4 {
+		sport, dport = l4[0:2], l4[2:4]
+	}
+	return src, dst, sport, dport, proto
+}
+
+// flowHash hashes the addresses and ports of an Ethernet frame so that
+// both directions of a flow hash alike. Frames that are not IP hash by
+// their MAC addresses.
+func flowHash(frame []byte) uint32 {
+	if len(frame) < 14 {
+		return 0
+	}
+	a, b, pa, pb, proto := frameFlow(frame)
+	// Order the endpoints so that replies hash like requests.
+	if c := bytes.Compare(a, b); c > 0 || c == 0 && bytes.Compare(pa, pb) > 0 {
+		a, b, pa, pb = b, a, pb, pa
+	}
+	h := fnv.New32a()
+	h.Write(a)
+	h.Write(pa)
+	h.Write(b)
+	h.Write(pb)
+	h.Write([]byte{proto})
+	return h.Sum32()
+}
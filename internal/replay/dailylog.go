@@ -0,0 +1,56 @@
+package replay
+
+import (
+	"os"
+	"sync"
+	"time"
+)
+
+// dailyLog is an io.Writer that appends to path and, when the local date
+// changes, renames the current file to path.YYYY-MM-DD and starts a new one.
+type dailyLog struct {
+	mu   sync.Mutex
+	path string
+	day  string
+	f    *os.File
+}
+
+func newDailyLog(path string) (*dailyLog, error) {
+	l := &dailyLog{path: path}
+	if err := l.open(time.Now()); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+func (l *dailyLog) open(now time.Time) error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	l.f = f
+	l.day = now.Format("2006-01-02")
+	return nil
+}
+
+func (l *dailyLog) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if day := now.Format("2006-01-02"); day != l.day {
+		l.f.Close()
+		if err := os.Rename(l.path, l.path+"."+l.day); err != nil && !os.IsNotExist(err) {
+			return 0, err
+		}
+		if err := l.open(now); err != nil {
+			return 0, err
+		}
+	}
+	return l.f.Write(p)
+}
+
+func (l *dailyLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.f.Close()
+}
@@ -0,0 +1,153 @@
+package replay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+)
+
+// Direction picks the side of every session a replay sends.
+type Direction string
+
+const (
+	DirectionBoth Direction = "both"
+	// DirectionClient sends what the client of each session sent, for a
+	// device under test whose servers are real or another replay.
+	DirectionClient Direction = "client"
+	// DirectionServer sends what the server of each session sent.
+	DirectionServer Direction = "server"
+)
+
+func ParseDirection(value string) (Direction, error) {
+	switch Direction(strings.ToLower(strings.TrimSpace(value))) {
+	case "", DirectionBoth:
+		return DirectionBoth, nil
+	case DirectionClient:
+		return DirectionClient, nil
+	case DirectionServer:
+		return DirectionServer, nil
+	default:
+		return "", fmt.Errorf("unknown direction %q (want client|server|both)", value)
+	}
+}
+
+// ParseNets parses a comma-separated list of CIDRs or addresses.
+func ParseNets(value string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, item := range strings.Split(value, ",") {
+		if strings.TrimSpace(item) == "" {
+			continue
+		}
+		n, err := parseIPNet(item)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, n)
+	}
+	if len(nets) == 0 {
+		return nil, fmt.Errorf("no networks in %q", value)
+	}
+	return nets, nil
+}
+
+// sessionSides tells the client of every session from its server. A
+// packet from clientNets to elsewhere is the client's; otherwise the
+// first packet of a session decides: a SYN comes from the client and a
+// SYN-ACK from the server, a well-known port marks the server of a
+// session seen mid-way, and failing all that the first sender is taken
+// for the client. The sides are kept across passes, so every loop sends
+// the same half.
+type sessionSides struct {
+	want       Direction
+	clientNets []*net.IPNet
+	// clientIsSrc holds, by session, whether the client is the source of
+	// the session's key.
+	clientIsSrc map[flowKey]bool
+}
+
+func newSessionSides(want Direction, clientNets []*net.IPNet) *sessionSides {
+	return &sessionSides{want: want, clientNets: clientNets, clientIsSrc: map[flowKey]bool{}}
+}
+
+// allow reports whether frame was sent by the wanted side.
+func (s *sessionSides) allow(frame []byte) bool {
+	if len(frame) < 14 {
+		return false
+	}
+	return s.fromClient(frame) == (s.want == DirectionClient)
+}
+
+func (s *sessionSides) fromClient(frame []byte) bool {
+	src, dst, sport, dport, proto := frameFlow(frame)
+	if proto != 0 && len(s.clientNets) > 0 {
+		if in, out := s.inClientNets(src), s.inClientNets(dst); in != out {
+			return in
+		}
+	}
+	k := frameKey(frame)
+	session := k.session()
+	// Both directions of a flow from a host to itself look alike.
+	isSrc := k == session
+	if clientIsSrc, ok := s.clientIsSrc[session]; ok {
+		return clientIsSrc == isSrc
+	}
+	client := true
+	flags, hasFlags := byte(0), false
+	if proto == 6 && sport != nil {
+		flags, hasFlags = tcpFlags(frame, sport)
+	}
+	switch {
+	case hasFlags && flags&0x12 == 0x02: // SYN
+	case hasFlags && flags&0x12 == 0x12: // SYN-ACK
+		client = false
+	case sport != nil:
+		sp, dp := binary.BigEndian.Uint16(sport), binary.BigEndian.Uint16(dport)
+		if sp < 1024 && dp >= 1024 {
+			client = false
+		}
+	}
+	s.clientIsSrc[session] = client == isSrc
+	return client
+}
+
+func (s *sessionSides) inClientNets(ip []byte) bool {
+	for _, n := range s.clientNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// tcpFlags returns the flags of a TCP frame whose header frameFlow found
+// starting at sport, if the frame holds them.
+func tcpFlags(frame, sport []byte) (byte, bool) {
+	off := cap(frame) - cap(sport)
+	if len(frame) < off+14 {
+		return 0, false
+	}
+	return frame[off+13], true
+}
+
+// directionSource passes on only the packets of src sent by the wanted
+// side of their session.
+type directionSource struct {
+	src   packetSource
+	sides *sessionSides
+}
+
+func (s *directionSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := s.src.ReadPacketData()
+		if err != nil || s.sides.allow(data) {
+			return data, ci, err
+		}
+	}
+}
+
+func (s *directionSource) Close() error {
+	return s.src.Close()
+}
@@ -0,0 +1,85 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"time"
+)
+
+// dryRun stands in for the senders under --dry-run. It never sleeps, so
+// the scheduled send times run ahead of the clock; it lays the passes end
+// to end on a virtual timeline and tallies the traffic per second of it.
+type dryRun struct {
+	base      time.Duration // virtual time at which the current pass started
+	passStart time.Time
+	last      time.Time // when the last packet was due
+	end       time.Duration
+	passes    int
+	packets   int64
+	bytes     int64
+	// seconds holds the bytes and packets sent in each virtual second.
+	seconds []dryRunSecond
+}
+
+type dryRunSecond struct {
+	bytes   int64
+	packets int64
+}
+
+func (d *dryRun) send(data []byte, at time.Time) error {
+	if d.passStart.IsZero() {
+		// The first packet of a pass is scheduled at the pass start,
+		// which may leave a pause after the previous pass.
+		d.passStart = at
+		if !d.last.IsZero() {
+			d.base += max(at.Sub(d.last), 0)
+		}
+	}
+	d.last = at
+	t := d.base + max(at.Sub(d.passStart), 0)
+	d.end = max(d.end, t)
+	sec := int(t / time.Second)
+	for len(d.seconds) <= sec {
+		d.seconds = append(d.seconds, dryRunSecond{})
+	}
+	d.seconds[sec].bytes += int64(len(data))
+	d.seconds[sec].packets++
+	d.packets++
+	d.bytes += int64(len(data))
+	return nil
+}
+
+// flush ends a pass; the next one starts where it stopped.
+func (d *dryRun) flush() error {
+	if !d.passStart.IsZero() {
+		d.passes++
+		d.base = d.end
+		d.passStart = time.Time{}
+	}
+	return nil
+}
+
+func (d *dryRun) Close() error {
+	return nil
+}
+
+func (d *dryRun) report(out io.Writer) {
+	d.flush()
+	fmt.Fprintf(out, "Dry run: %d packets, %d bytes in %d passes\n", d.packets, d.bytes, d.passes)
+	fmt.Fprintf(out, "Projected duration: %s\n", d.end.Round(time.Microsecond))
+	secs := d.end.Seconds()
+	if secs > 0 {
+		fmt.Fprintf(out, "Average rate: %.2f Mbps %.2f pps\n", float64(d.bytes)*8/secs/1e6, float64(d.packets)/secs)
+	}
+	if d.end > 0 && d.end < time.Second {
+		// No window fills up: the run is its own window.
+		fmt.Fprintf(out, "Peak rate (%s window): %.2f Mbps %.2f pps\n", d.end.Round(time.Microsecond), float64(d.bytes)*8/secs/1e6, float64(d.packets)/secs)
+		return
+	}
+	var peak dryRunSecond
+	for _, s := range d.seconds {
+		peak.bytes = max(peak.bytes, s.bytes)
+		peak.packets = max(peak.packets, s.packets)
+	}
+	fmt.Fprintf(out, "Peak rate (1s windows): %.2f Mbps %d pps\n", float64(peak.bytes)*8/1e6, peak.packets)
+}
@@ -0,0 +1,82 @@
+package replay
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// errorBudget counts the failed sends of a replay, of which it tolerates
+// up to max, after retrying those that may pass on a second try. The
+// fanout's workers share it with the replay.
+type errorBudget struct {
+	max     int
+	retries int
+	backoff time.Duration
+	retried atomic.Int64
+
+	mu    sync.Mutex
+	count int
+	first error
+}
+
+// tolerate counts err and reports whether the replay may go on.
+func (b *errorBudget) tolerate(err error) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.count++
+	if b.first == nil {
+		b.first = err
+	}
+	return b.count <= b.max
+}
+
+// tolerated returns how many failed sends were stepped over and the first
+// of them.
+func (b *errorBudget) tolerated() (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return min(b.count, b.max), b.first
+}
+
+// failures returns how many sends have failed.
+func (b *errorBudget) failures() int {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.count
+}
+
+// send sends data through t. A send that fails for want of buffer space
+// is retried up to retries times, waiting backoff and then twice as long
+// each time.
+func (b *errorBudget) send(t transmitter, data []byte, at time.Time) error {
+	err := t.send(data, at)
+	wait := b.backoff
+	for i := 0; i < b.retries && transient(err); i++ {
+		b.retried.Add(1)
+		time.Sleep(wait)
+		wait *= 2
+		err = t.send(data, at)
+	}
+	return err
+}
+
+// transient reports whether a send failed only because the socket or
+// the device queue was full at the time.
+func transient(err error) bool {
+	return errors.Is(err, syscall.ENOBUFS) || errors.Is(err, syscall.EAGAIN)
+}
+
+// refusedError is the error of a queued frame the kernel refused for
+// good. The frame is dropped; the rest of the batch goes on. Frames too
+// long for the interface, the usual reason, are sent on their own
+// instead, so that their errors are their own.
+type refusedError struct {
+	err error
+}
+
+func (e *refusedError) Error() string { return e.err.Error() }
+
+func (e *refusedError) Unwrap() error { return e.err }
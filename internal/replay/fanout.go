@@ -0,0 +1,201 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"genflux/internal/stats"
+)
+
+// transmitter sends a frame at a scheduled time. flush waits until every
+// frame handed to send has gone out.
+type transmitter interface {
+	send(data []byte, at time.Time) error
+	flush() error
+	Close() error
+}
+
+// describer is a transmitter with a line to print about how it sends.
+type describer interface {
+	describe() string
+}
+
+// newSender opens the configured backend on interface name.
+func newSender(cfg Config, name string) (transmitter, error) {
+	t, err := openBackend(cfg, name)
+	if err != nil || !cfg.MTUCheck && !cfg.Fragment {
+		return t, err
+	}
+	m, err := newMTUChecker(t, name, cfg.Fragment)
+	if err != nil {
+		t.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// Sender gives other packages the configured TX backend on one
+// interface.
+type Sender struct {
+	t transmitter
+}
+
+func NewSender(cfg Config, iface string) (*Sender, error) {
+	t, err := newSender(cfg, iface)
+	if err != nil {
+		return nil, err
+	}
+	return &Sender{t: t}, nil
+}
+
+// Send transmits data once at has come.
+func (s *Sender) Send(data []byte, at time.Time) error { return s.t.send(data, at) }
+
+// Flush waits until every frame handed to Send has gone out.
+func (s *Sender) Flush() error { return s.t.flush() }
+
+func (s *Sender) Close() error { return s.t.Close() }
+
+// fanout spreads frames over several interfaces, each served by its own
+// goroutine so that the senders wait and transmit in parallel. Errors
+// surface on a later send or on close, once they exceed the budget.
+type fanout struct {
+	names   []string
+	senders []transmitter
+	queues  []chan fanoutFrame
+	balance Balance
+	next    int
+	// sent counts the frames and bytes each interface has sent.
+	sent    *stats.Sharded
+	budget  *errorBudget
+	wg      sync.WaitGroup
+	pending sync.WaitGroup
+
+	mu  sync.Mutex
+	err error
+}
+
+type fanoutFrame struct {
+	data []byte
+	at   time.Time
+}
+
+func newFanout(cfg Config, names []string, budget *errorBudget) (*fanout, error) {
+	f := &fanout{names: names, balance: cfg.Balance, sent: stats.NewSharded(len(names)), budget: budget}
+	for _, name := range names {
+		s, err := newSender(cfg, name)
+		if err != nil {
+			f.closeSenders()
+			return nil, fmt.Errorf("%s: %v", name, err)
+		}
+		f.senders = append(f.senders, s)
+	}
+	for i := range f.senders {
+		q := make(chan fanoutFrame, 1024)
+		f.queues = append(f.queues, q)
+		f.wg.Add(1)
+		go f.run(i, q)
+	}
+	return f, nil
+}
+
+func (f *fanout) run(i int, q chan fanoutFrame) {
+	defer f.wg.Done()
+	for fr := range q {
+		if !f.failed() {
+			if err := f.budget.send(f.senders[i], fr.data, fr.at); err == nil {
+				f.sent.Shard(i).Add(len(fr.data))
+			} else if err = fmt.Errorf("%s: %v", f.names[i], err); !f.budget.tolerate(err) {
+				f.mu.Lock()
+				if f.err == nil {
+					f.err = err
+				}
+				f.mu.Unlock()
+			}
+		}
+		f.pending.Done()
+	}
+}
+
+func (f *fanout) failed() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err != nil
+}
+
+func (f *fanout) send(data []byte, at time.Time) error {
+	f.mu.Lock()
+	err := f.err
+	f.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	// The source may reuse data once send returns; the copy is only read,
+	// so a tee can share it between interfaces.
+	fr := fanoutFrame{data: append([]byte(nil), data...), at: at}
+	if f.balance == BalanceTee {
+		f.pending.Add(len(f.queues))
+		for _, q := range f.queues {
+			q <- fr
+		}
+		return nil
+	}
+	i := f.next
+	if f.balance == BalanceRoundRobin {
+		f.next = (f.next + 1) % len(f.queues)
+	} else {
+		i = int(flowHash(data) % uint32(len(f.queues)))
+	}
+	f.pending.Add(1)
+	f.queues[i] <- fr
+	return nil
+}
+
+// flush waits for the queues to drain and then for each sender. The
+// workers are idle by then, so the senders can be used from here.
+func (f *fanout) flush() error {
+	f.pending.Wait()
+	if err := f.pendingErr(); err != nil {
+		return err
+	}
+	for i, s := range f.senders {
+		if err := s.flush(); err != nil {
+			return fmt.Errorf("%s: %w", f.names[i], err)
+		}
+	}
+	return nil
+}
+
+func (f *fanout) pendingErr() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.err
+}
+
+// Close waits for the queued frames to go out and closes the sockets.
+func (f *fanout) Close() error {
+	for _, q := range f.queues {
+		close(q)
+	}
+	f.wg.Wait()
+	f.closeSenders()
+	return f.err
+}
+
+func (f *fanout) closeSenders() {
+	for _, s := range f.senders {
+		s.Close()
+	}
+}
+
+// report writes how many frames and bytes each interface sent.
+func (f *fanout) report(out io.Writer) {
+	fmt.Fprint(out, "Interfaces:")
+	for i, name := range f.names {
+		sent := f.sent.Shard(i).Snapshot()
+		fmt.Fprintf(out, " %s=%d (%d bytes)", name, sent.Packets, sent.Bytes)
+	}
+	fmt.Fprintln(out)
+}
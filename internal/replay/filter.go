@@ -0,0 +1,27 @@
+package replay
+
+import (
+	"github.com/google/gopacket"
+
+	"genflux/internal/filter"
+)
+
+// filterSource passes on only the packets of src that match a capture
+// filter; the rest are skipped as if the capture never had them.
+type filterSource struct {
+	src    packetSource
+	filter *filter.Filter
+}
+
+func (s *filterSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := s.src.ReadPacketData()
+		if err != nil || s.filter.Match(data) {
+			return data, ci, err
+		}
+	}
+}
+
+func (s *filterSource) Close() error {
+	return s.src.Close()
+}
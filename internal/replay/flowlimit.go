@@ -0,0 +1,59 @@
+package replay
+
+import (
+	"github.com/google/gopacket"
+)
+
+// flowLimit picks the first limit flows of the input, both directions of
+// a flow (a session) counting once, and non-IP frames by MAC pair as in
+// flow stats. The flows are picked on the first pass and kept, so every
+// loop replays the same sessions, each once per pass.
+type flowLimit struct {
+	limit int
+	flows map[flowKey]bool
+	// full is set once the first pass has ended or picked limit flows.
+	full bool
+}
+
+func newFlowLimit(limit int) *flowLimit {
+	return &flowLimit{limit: limit, flows: map[flowKey]bool{}}
+}
+
+func (l *flowLimit) allow(frame []byte) bool {
+	if len(frame) < 14 {
+		return false
+	}
+	k := frameKey(frame).session()
+	if l.flows[k] {
+		return true
+	}
+	if l.full || len(l.flows) >= l.limit {
+		l.full = true
+		return false
+	}
+	l.flows[k] = true
+	return true
+}
+
+// flowLimitSource passes on only the packets of the flows l allows.
+type flowLimitSource struct {
+	src   packetSource
+	limit *flowLimit
+}
+
+func (s *flowLimitSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		data, ci, err := s.src.ReadPacketData()
+		if err != nil {
+			s.limit.full = true
+			return data, ci, err
+		}
+		if s.limit.allow(data) {
+			return data, ci, nil
+		}
+	}
+}
+
+func (s *flowLimitSource) Close() error {
+	return s.src.Close()
+}
@@ -0,0 +1,162 @@
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+)
+
+// flowStats counts the packets and bytes sent per directional 5-tuple.
+// Frames that are not IP are counted per MAC address pair.
+type flowStats struct {
+	flows map[flowKey]*flowCount
+}
+
+type flowKey struct {
+	src, dst     [16]byte
+	sport, dport uint16
+	proto        byte
+	// addrLen is 4 or 16 for IP and 6 for MAC addresses.
+	addrLen byte
+}
+
+type flowCount struct {
+	packets int64
+	bytes   int64
+}
+
+// frameKey returns the flow of an Ethernet frame of at least 14 bytes.
+func frameKey(frame []byte) flowKey {
+	src, dst, sport, dport, proto := frameFlow(frame)
+	k := flowKey{proto: proto, addrLen: byte(len(src))}
+	copy(k.src[:], src)
+	copy(k.dst[:], dst)
+	if sport != nil {
+		k.sport, k.dport = binary.BigEndian.Uint16(sport), binary.BigEndian.Uint16(dport)
+	}
+	return k
+}
+
+// session returns the key of both directions of k's flow.
+func (k flowKey) session() flowKey {
+	if c := bytes.Compare(k.src[:], k.dst[:]); c > 0 || c == 0 && k.sport > k.dport {
+		k.src, k.dst, k.sport, k.dport = k.dst, k.src, k.dport, k.sport
+	}
+	return k
+}
+
+// less orders keys by their fields, for a stable order among flows of
+// equal weight.
+func (k flowKey) less(o flowKey) bool {
+	if k.addrLen != o.addrLen {
+		return k.addrLen < o.addrLen
+	}
+	if k.proto != o.proto {
+		return k.proto < o.proto
+	}
+	if c := bytes.Compare(k.src[:], o.src[:]); c != 0 {
+		return c < 0
+	}
+	if k.sport != o.sport {
+		return k.sport < o.sport
+	}
+	if c := bytes.Compare(k.dst[:], o.dst[:]); c != 0 {
+		return c < 0
+	}
+	return k.dport < o.dport
+}
+
+func newFlowStats() *flowStats {
+	return &flowStats{flows: map[flowKey]*flowCount{}}
+}
+
+func (s *flowStats) add(frame []byte) {
+	if len(frame) < 14 {
+		return
+	}
+	k := frameKey(frame)
+	c := s.flows[k]
+	if c == nil {
+		c = &flowCount{}
+		s.flows[k] = c
+	}
+	c.packets++
+	c.bytes += int64(len(frame))
+}
+
+// write prints one CSV row per flow, the heaviest by bytes first.
+func (s *flowStats) write(w io.Writer) error {
+	keys := make([]flowKey, 0, len(s.flows))
+	for k := range s.flows {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if a, b := s.flows[keys[i]].bytes, s.flows[keys[j]].bytes; a != b {
+			return a > b
+		}
+		return keys[i].less(keys[j])
+	})
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "proto,src,sport,dst,dport,packets,bytes")
+	for _, k := range keys {
+		c := s.flows[k]
+		fmt.Fprintf(bw, "%s,%d,%d\n", k, c.packets, c.bytes)
+	}
+	return bw.Flush()
+}
+
+// report writes the table to path ("-" for out) and a summary line to out.
+func (s *flowStats) report(path string, out io.Writer) error {
+	var packets int64
+	for _, c := range s.flows {
+		packets += c.packets
+	}
+	if path == "-" {
+		fmt.Fprintf(out, "Flows: %d 5-tuples, %d packets\n", len(s.flows), packets)
+		return s.write(out)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	if err := s.write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Flows: %d 5-tuples, %d packets, written to %s\n", len(s.flows), packets, path)
+	return nil
+}
+
+// String renders the key as the first five CSV columns.
+func (k flowKey) String() string {
+	var proto, src, dst string
+	switch k.addrLen {
+	case 6:
+		proto = "eth"
+		src, dst = net.HardwareAddr(k.src[:6]).String(), net.HardwareAddr(k.dst[:6]).String()
+	default:
+		src, dst = net.IP(k.src[:k.addrLen]).String(), net.IP(k.dst[:k.addrLen]).String()
+		switch k.proto {
+		case 6:
+			proto = "tcp"
+		case 17:
+			proto = "udp"
+		case 1:
+			proto = "icmp"
+		case 58:
+			proto = "icmpv6"
+		default:
+			proto = strconv.Itoa(int(k.proto))
+		}
+	}
+	return fmt.Sprintf("%s,%s,%d,%s,%d", proto, src, k.sport, dst, k.dport)
+}
@@ -0,0 +1,238 @@
+package replay
+
+import (
+	"container/heap"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+
+	"genflux/internal/pcapio"
+)
+
+// resolveInputs expands an --in value: a comma-separated list whose items
+// may be glob patterns. Glob matches are sorted so that generated_0000,
+// generated_0001, ... replay in order. A pattern without matches is an
+// error unless background mode is waiting for files to appear.
+func resolveInputs(spec string, background bool) ([]string, error) {
+	var paths []string
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if !strings.ContainsAny(item, "*?[") {
+			paths = append(paths, item)
+			continue
+		}
+		matches, err := filepath.Glob(item)
+		if err != nil {
+			return nil, fmt.Errorf("invalid input pattern %q: %v", item, err)
+		}
+		if len(matches) == 0 && !background {
+			return nil, fmt.Errorf("no input matches %q", item)
+		}
+		sort.Strings(matches)
+		paths = append(paths, matches...)
+	}
+	return paths, nil
+}
+
+// inputRetry is how long background mode waits before it looks for an
+// input again.
+const inputRetry = time.Second
+
+// inputError is an error reading the inputs, which background mode rides
+// out by opening them again.
+type inputError struct{ err error }
+
+func (e *inputError) Error() string { return e.err.Error() }
+func (e *inputError) Unwrap() error { return e.err }
+
+// readFailed marks err as an inputError. An interrupt while waiting for
+// an input is left as it is.
+func readFailed(err error) error {
+	if err == errInterrupted {
+		return err
+	}
+	return &inputError{err: err}
+}
+
+// packetSource yields the packets of one replay pass.
+type packetSource interface {
+	ReadPacketData() ([]byte, gopacket.CaptureInfo, error)
+	Close() error
+}
+
+type openFunc func(path string) (*os.File, error)
+
+// readOptions returns how the capture at path is read.
+type readOptions func(path string) pcapio.ReaderOptions
+
+// sequentialSource plays its inputs one after another. A file whose
+// timestamps start before the previous file ended is shifted to follow
+// it, so timestamp pacing stays monotonic across the whole pass.
+type sequentialSource struct {
+	paths  []string
+	open   openFunc
+	opts   readOptions
+	path   string
+	file   *os.File
+	reader pcapio.Reader
+	shift  time.Duration
+	first  bool
+	last   time.Time
+}
+
+func newSequentialSource(paths []string, open openFunc, opts readOptions) *sequentialSource {
+	return &sequentialSource{paths: paths, open: open, opts: opts}
+}
+
+func (s *sequentialSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for {
+		if s.reader == nil {
+			if len(s.paths) == 0 {
+				return nil, gopacket.CaptureInfo{}, io.EOF
+			}
+			file, err := s.open(s.paths[0])
+			if err != nil {
+				return nil, gopacket.CaptureInfo{}, err
+			}
+			reader, err := pcapio.NewReaderOptions(file, s.opts(s.paths[0]))
+			if err != nil {
+				file.Close()
+				return nil, gopacket.CaptureInfo{}, fmt.Errorf("%s: %v", s.paths[0], err)
+			}
+			s.path, s.paths = s.paths[0], s.paths[1:]
+			s.file, s.reader, s.first = file, reader, true
+		}
+		data, ci, err := s.reader.ReadPacketData()
+		if err == io.EOF {
+			s.file.Close()
+			s.file, s.reader = nil, nil
+			continue
+		}
+		if err != nil {
+			return nil, ci, fmt.Errorf("%s: %w", s.path, err)
+		}
+		if s.first {
+			s.first = false
+			s.shift = 0
+			if !s.last.IsZero() && ci.Timestamp.Before(s.last) {
+				s.shift = s.last.Sub(ci.Timestamp)
+			}
+		}
+		ci.Timestamp = ci.Timestamp.Add(s.shift)
+		s.last = ci.Timestamp
+		return data, ci, nil
+	}
+}
+
+func (s *sequentialSource) Close() error {
+	if s.file != nil {
+		return s.file.Close()
+	}
+	return nil
+}
+
+// mergeSource interleaves all inputs by timestamp, as if they had been
+// captured together.
+type mergeSource struct {
+	files []*os.File
+	heads mergeHeap
+}
+
+type mergeHead struct {
+	path   string
+	reader pcapio.Reader
+	data   []byte
+	ci     gopacket.CaptureInfo
+	order  int
+}
+
+func newMergeSource(paths []string, open openFunc, opts readOptions) (*mergeSource, error) {
+	m := &mergeSource{}
+	for i, path := range paths {
+		file, err := open(path)
+		if err != nil {
+			m.Close()
+			return nil, err
+		}
+		m.files = append(m.files, file)
+		reader, err := pcapio.NewReaderOptions(file, opts(path))
+		if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		h := &mergeHead{path: path, reader: reader, order: i}
+		if err := h.advance(); err == io.EOF {
+			continue
+		} else if err != nil {
+			m.Close()
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		m.heads = append(m.heads, h)
+	}
+	heap.Init(&m.heads)
+	return m, nil
+}
+
+func (h *mergeHead) advance() error {
+	data, ci, err := h.reader.ReadPacketData()
+	if err != nil {
+		return err
+	}
+	// The reader may reuse its buffer, and the head is held while other
+	// inputs are read.
+	h.data = append(h.data[:0], data...)
+	h.ci = ci
+	return nil
+}
+
+func (m *mergeSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if len(m.heads) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	h := m.heads[0]
+	data, ci := append([]byte(nil), h.data...), h.ci
+	if err := h.advance(); err == io.EOF {
+		heap.Pop(&m.heads)
+	} else if err != nil {
+		return nil, ci, fmt.Errorf("%s: %w", h.path, err)
+	} else {
+		heap.Fix(&m.heads, 0)
+	}
+	return data, ci, nil
+}
+
+func (m *mergeSource) Close() error {
+	for _, f := range m.files {
+		f.Close()
+	}
+	m.files = nil
+	return nil
+}
+
+// mergeHeap orders heads by timestamp, then by input order for ties.
+type mergeHeap []*mergeHead
+
+func (h mergeHeap) Len() int { return len(h) }
+func (h mergeHeap) Less(i, j int) bool {
+	if !h[i].ci.Timestamp.Equal(h[j].ci.Timestamp) {
+		return h[i].ci.Timestamp.Before(h[j].ci.Timestamp)
+	}
+	return h[i].order < h[j].order
+}
+func (h mergeHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *mergeHeap) Push(x any)   { *h = append(*h, x.(*mergeHead)) }
+func (h *mergeHeap) Pop() any {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,83 @@
+package replay
+
+import (
+	"context"
+	"errors"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"genflux/internal/clock"
+)
+
+// errInterrupted is returned when SIGINT, SIGTERM or the end of the
+// replay's context stops it.
+var errInterrupted = errors.New("replay interrupted")
+
+// interruptSlack is how long before a deadline wait hands over to the
+// sender's precise SleepUntil.
+const interruptSlack = 2 * time.Millisecond
+
+// interrupt turns SIGINT, SIGTERM and the end of ctx into a stop request
+// that the replay checks between packets and while it waits.
+type interrupt struct {
+	sig   chan os.Signal
+	stop  chan struct{}
+	clock clock.Clock
+	// busy spins through waits instead of sleeping, for SchedBusy.
+	busy bool
+}
+
+func watchInterrupt(ctx context.Context, clk clock.Clock) *interrupt {
+	i := &interrupt{sig: make(chan os.Signal, 1), stop: make(chan struct{}), clock: clk}
+	signal.Notify(i.sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case _, ok := <-i.sig:
+			if !ok {
+				return
+			}
+		case <-ctx.Done():
+		}
+		close(i.stop)
+	}()
+	return i
+}
+
+func (i *interrupt) stopped() bool {
+	select {
+	case <-i.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// wait sleeps until shortly before target and reports whether the replay
+// may go on.
+func (i *interrupt) wait(target time.Time) bool {
+	if i.busy {
+		for i.clock.Now().Before(target.Add(-interruptSlack)) {
+			if i.stopped() {
+				return false
+			}
+		}
+		return !i.stopped()
+	}
+	if !i.clock.WaitUntil(target.Add(-interruptSlack), i.stop) {
+		return false
+	}
+	return !i.stopped()
+}
+
+// after returns the time d from now.
+func (i *interrupt) after(d time.Duration) time.Time {
+	return i.clock.Now().Add(d)
+}
+
+// Close restores the default signal handling.
+func (i *interrupt) Close() {
+	signal.Stop(i.sig)
+	close(i.sig)
+}
@@ -0,0 +1,78 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+)
+
+// metricsServer serves the counters of a running replay at /metrics in
+// the Prometheus text format.
+type metricsServer struct {
+	run *replayRun
+	// ifaces are the sending interfaces whose tx_dropped counters could
+	// be read at the start, with those first readings.
+	ifaces   []string
+	dropBase []int64
+	srv      *http.Server
+}
+
+func serveMetrics(addr string, run *replayRun, ifaces []string, out io.Writer) (*metricsServer, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("metrics-listen: %v", err)
+	}
+	m := &metricsServer{run: run}
+	for _, name := range ifaces {
+		if slices.Contains(m.ifaces, name) {
+			continue
+		}
+		if n, err := ifaceCounter(name, "tx_dropped"); err == nil {
+			m.ifaces = append(m.ifaces, name)
+			m.dropBase = append(m.dropBase, n)
+		}
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	m.srv = &http.Server{Handler: mux}
+	go func() {
+		if err := m.srv.Serve(ln); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			fmt.Fprintf(out, "Metrics server stopped: %v\n", err)
+		}
+	}()
+	fmt.Fprintf(out, "Serving metrics at http://%s/metrics\n", ln.Addr())
+	return m, nil
+}
+
+func (m *metricsServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	total := m.run.total.Snapshot()
+	counter := func(name, help string) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", name, help, name)
+	}
+	counter("genflux_replay_packets_total", "Packets sent by the replay.")
+	fmt.Fprintf(w, "genflux_replay_packets_total %d\n", total.Packets)
+	counter("genflux_replay_bytes_total", "Bytes sent by the replay.")
+	fmt.Fprintf(w, "genflux_replay_bytes_total %d\n", total.Bytes)
+	counter("genflux_replay_send_errors_total", "Sends that failed, their packets dropped.")
+	fmt.Fprintf(w, "genflux_replay_send_errors_total %d\n", m.run.budget.failures())
+	counter("genflux_replay_send_retries_total", "Sends retried after failing for want of buffer space.")
+	fmt.Fprintf(w, "genflux_replay_send_retries_total %d\n", m.run.budget.retried.Load())
+	if len(m.ifaces) > 0 {
+		counter("genflux_replay_dropped_packets_total", "Packets the kernel dropped on the sending interface since the replay started (tx_dropped).")
+		for i, name := range m.ifaces {
+			n, err := ifaceCounter(name, "tx_dropped")
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(w, "genflux_replay_dropped_packets_total{iface=%q} %d\n", name, max(n-m.dropBase[i], 0))
+		}
+	}
+}
+
+func (m *metricsServer) Close() error {
+	return m.srv.Close()
+}
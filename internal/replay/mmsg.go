@@ -0,0 +1,175 @@
+//go:build linux
+
+package replay
+
+import (
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// defaultSendBatch is the Config.SendBatch of 0.
+	defaultSendBatch = 32
+	// batchSlack: when the next frame is due later than this, the frames
+	// already queued go out instead of waiting for a full batch.
+	batchSlack = 5 * time.Microsecond
+	// flushPatience is how long a flush waits out full device queues.
+	flushPatience = time.Second
+)
+
+// mmsghdr is struct mmsghdr of sendmmsg(2).
+type mmsghdr struct {
+	hdr unix.Msghdr
+	len uint32
+}
+
+// sendBatch sizes the sendmmsg batches of a socket backend sender for
+// cfg; 1 means every frame goes in a sendto of its own.
+func sendBatch(cfg Config) int {
+	switch {
+	case cfg.SendBatch > 0:
+		return cfg.SendBatch
+	case cfg.TxTime:
+		return 1
+	default:
+		return defaultSendBatch
+	}
+}
+
+// batch is the frames an afPacketSender has queued for sendmmsg: those
+// of bufs[start:pending], each due by the time it was queued.
+type batch struct {
+	bufs           [][]byte
+	iovs           []unix.Iovec
+	msgs           []mmsghdr
+	start, pending int
+	// maxLen is the longest frame the kernel takes on the interface: its
+	// MTU and an Ethernet header with a VLAN tag.
+	maxLen int
+	// refused holds the errors of the frames the kernel refused for good,
+	// until they are reported.
+	refused []error
+}
+
+func newBatch(size, mtu int) *batch {
+	return &batch{bufs: make([][]byte, size), iovs: make([]unix.Iovec, size), msgs: make([]mmsghdr, size), maxLen: mtu + 18}
+}
+
+// queue waits until data is due and queues it, sending the batch once it
+// is full or before a wait. On a transient error data is left out, so
+// that it may be sent again. Otherwise it reports a frame refused before,
+// if any, with a refusedError; data still goes, but counts as failed in
+// its place, so that the totals hold.
+func (s *afPacketSender) queue(data []byte, at time.Time) error {
+	b := s.batch
+	if len(data) > b.maxLen {
+		if err := s.sendQueued(); err != nil {
+			return err
+		}
+		s.sched.waitUntil(at)
+		if err := unix.Sendto(s.fd, data, 0, s.addr); err != nil {
+			return err
+		}
+		return b.report()
+	}
+	if b.start < b.pending && (b.pending == len(b.bufs) || time.Until(at) > batchSlack) {
+		// Nothing else is due before at, so let the queued frames go.
+		if err := s.sendQueued(); err != nil {
+			return err
+		}
+	}
+	s.sched.waitUntil(at)
+	b.compact()
+	b.bufs[b.pending] = append(b.bufs[b.pending][:0], data...)
+	b.pending++
+	if b.pending == len(b.bufs) {
+		// Frames the kernel has no room for stay queued for the next send.
+		s.sendQueued()
+	}
+	return b.report()
+}
+
+// sendQueued hands the queued frames to the kernel, dropping those it
+// refuses for good. A transient error stops it, leaving the frames not
+// yet taken queued.
+func (s *afPacketSender) sendQueued() error {
+	b := s.batch
+	for b.start < b.pending {
+		n, err := s.sendmmsg()
+		switch {
+		case err == unix.EINTR:
+		case transient(err):
+			return err
+		case err != nil:
+			b.refused = append(b.refused, err)
+			b.start++
+		default:
+			b.start += n
+		}
+	}
+	b.start, b.pending = 0, 0
+	return nil
+}
+
+// report returns the first refusal not yet reported.
+func (b *batch) report() error {
+	if len(b.refused) == 0 {
+		return nil
+	}
+	err := b.refused[0]
+	b.refused = b.refused[1:]
+	return &refusedError{err: err}
+}
+
+// compact moves the queued frames to the front of the batch.
+func (b *batch) compact() {
+	if b.start == 0 {
+		return
+	}
+	for i := b.start; i < b.pending; i++ {
+		// Swap, so that every slot keeps a buffer of its own.
+		b.bufs[i-b.start], b.bufs[i] = b.bufs[i], b.bufs[i-b.start]
+	}
+	b.start, b.pending = 0, b.pending-b.start
+}
+
+// sendmmsg sends what it can of the queued frames in one call and
+// returns how many it sent.
+func (s *afPacketSender) sendmmsg() (int, error) {
+	b := s.batch
+	for i := b.start; i < b.pending; i++ {
+		b.iovs[i].Base = unsafe.SliceData(b.bufs[i])
+		b.iovs[i].SetLen(len(b.bufs[i]))
+		// The socket is bound, so the frames need no address.
+		b.msgs[i] = mmsghdr{}
+		b.msgs[i].hdr.Iov = &b.iovs[i]
+		b.msgs[i].hdr.SetIovlen(1)
+	}
+	n, _, errno := unix.Syscall6(unix.SYS_SENDMMSG, uintptr(s.fd), uintptr(unsafe.Pointer(&b.msgs[b.start])), uintptr(b.pending-b.start), 0, 0, 0)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(n), nil
+}
+
+// flushBatch sends the frames still queued, waiting out full device
+// queues for up to flushPatience, and then reports the refusals one per
+// call, as refusedErrors.
+func (s *afPacketSender) flushBatch() error {
+	deadline := time.Now().Add(flushPatience)
+	for {
+		err := s.sendQueued()
+		if err == nil {
+			return s.batch.report()
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		fds := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLOUT}}
+		if _, err := unix.Poll(fds, 1); err != nil && err != unix.EINTR {
+			return err
+		}
+	}
+}
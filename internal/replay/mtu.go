@@ -0,0 +1,77 @@
+package replay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+
+	"genflux/internal/ipfrag"
+)
+
+// mtuChecker fails the send of a frame whose payload exceeds the MTU of
+// its interface, which a driver may otherwise truncate or drop without
+// a word. With fragment it sends an IP packet that does as fragments.
+type mtuChecker struct {
+	transmitter
+	iface    string
+	mtu      int
+	fragment bool
+	// id names the datagrams fragmented, IPv6 ones and IPv4 ones without
+	// an identification of their own.
+	id uint32
+}
+
+func newMTUChecker(t transmitter, name string, fragment bool) (*mtuChecker, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &mtuChecker{transmitter: t, iface: name, mtu: iface.MTU, fragment: fragment}, nil
+}
+
+func (m *mtuChecker) send(data []byte, at time.Time) error {
+	n := etherPayloadLen(data)
+	if n <= m.mtu {
+		return m.transmitter.send(data, at)
+	}
+	if !m.fragment {
+		return fmt.Errorf("frame of %d bytes carries %d over the %d byte MTU of %s", len(data), n, m.mtu, m.iface)
+	}
+	link, _, err := ipfrag.Headers(data)
+	if err != nil {
+		return fmt.Errorf("frame of %d bytes over the %d byte MTU of %s: %v", len(data), m.mtu, m.iface, err)
+	}
+	// MPLS labels take their share of the MTU from the IP packet.
+	mtu := m.mtu - (link - (len(data) - n))
+	count, err := ipfrag.Count(data, mtu)
+	if err != nil {
+		return fmt.Errorf("frame of %d bytes over the %d byte MTU of %s: %v", len(data), m.mtu, m.iface, err)
+	}
+	m.id++
+	frags, err := ipfrag.Split(data, count, mtu, m.id)
+	if err != nil {
+		return fmt.Errorf("frame of %d bytes over the %d byte MTU of %s: %v", len(data), m.mtu, m.iface, err)
+	}
+	for _, f := range frags {
+		if err := m.transmitter.send(f, at); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// etherPayloadLen returns the length of what an Ethernet frame carries
+// after its header and any VLAN tags, the part the MTU limits.
+func etherPayloadLen(frame []byte) int {
+	if len(frame) < 14 {
+		return 0
+	}
+	off := 12
+	etherType := binary.BigEndian.Uint16(frame[off:])
+	for (etherType == 0x8100 || etherType == 0x88a8) && len(frame) >= off+6 {
+		off += 4
+		etherType = binary.BigEndian.Uint16(frame[off:])
+	}
+	return len(frame) - off - 2
+}
@@ -0,0 +1,185 @@
+package replay
+
+import (
+	"math/rand"
+	"time"
+
+	"genflux/internal/microburst"
+)
+
+// Pacer decides when each packet of a pass is due. Implementations keep
+// their own count of what they have paced, so they can be driven by a
+// virtual clock: nothing here reads the time.
+type Pacer interface {
+	// Start begins a pass whose first packet, captured at first, is due
+	// at start.
+	Start(start, first time.Time)
+	// Next returns when a packet of n bytes captured at ts is due and
+	// counts it as sent.
+	Next(ts time.Time, n int) time.Time
+}
+
+// newPacer returns the pacer of cfg.Mode; pass is only read when bursts
+// are preserved. A rate schedule spans passes, so it is made once per
+// replay and handed in as sched.
+func newPacer(cfg Config, pass passTotals, sched *rateSchedule) Pacer {
+	switch {
+	case sched != nil:
+		return sched
+	case cfg.PreserveBursts && cfg.Mode == ModeMbps:
+		return &burstPreservingPacer{mbps: cfg.Mbps, pass: pass}
+	case cfg.PreserveBursts && cfg.Mode == ModePps:
+		return &burstPreservingPacer{pps: cfg.Pps, pass: pass}
+	}
+	switch cfg.Mode {
+	case ModeMbps:
+		return &bitRatePacer{mbps: cfg.Mbps}
+	case ModePps:
+		return &packetRatePacer{pps: cfg.Pps}
+	case ModeBurst:
+		return &burstPacer{pps: cfg.Pps, size: int64(cfg.Burst)}
+	case ModeTopSpeed:
+		return &topSpeedPacer{}
+	default:
+		return &timestampPacer{speed: cfg.Speed}
+	}
+}
+
+// timestampPacer keeps the capture's gaps, divided by speed.
+type timestampPacer struct {
+	speed        float64
+	start, first time.Time
+}
+
+func (p *timestampPacer) Start(start, first time.Time) { p.start, p.first = start, first }
+
+func (p *timestampPacer) Next(ts time.Time, n int) time.Time {
+	return p.start.Add(scaleGap(ts.Sub(p.first), p.speed))
+}
+
+// scaleGap divides an offset in the capture by the speed multiplier; 0
+// counts as 1.
+func scaleGap(d time.Duration, speed float64) time.Duration {
+	if speed == 0 || speed == 1 {
+		return d
+	}
+	return time.Duration(float64(d) / speed)
+}
+
+// bitRatePacer sends at a constant bit rate: a packet is due once those
+// before it have taken their time at mbps.
+type bitRatePacer struct {
+	mbps  float64
+	start time.Time
+	bits  int64
+}
+
+func (p *bitRatePacer) Start(start, first time.Time) { p.start, p.bits = start, 0 }
+
+func (p *bitRatePacer) Next(ts time.Time, n int) time.Time {
+	at := p.start.Add(time.Duration(float64(p.bits) / (p.mbps * 1e6) * float64(time.Second)))
+	p.bits += int64(n) * 8
+	return at
+}
+
+// packetRatePacer sends at a constant packet rate.
+type packetRatePacer struct {
+	pps     float64
+	start   time.Time
+	packets int64
+}
+
+func (p *packetRatePacer) Start(start, first time.Time) { p.start, p.packets = start, 0 }
+
+func (p *packetRatePacer) Next(ts time.Time, n int) time.Time {
+	at := p.start.Add(time.Duration(float64(p.packets) / p.pps * float64(time.Second)))
+	p.packets++
+	return at
+}
+
+// burstPreservingPacer keeps the capture's gaps, all scaled by one factor
+// so that the pass takes as long as its packets take at mbps, or pps when
+// mbps is 0. The factor comes from the totals of the whole pass, which
+// the replay reads ahead of it: a running average would follow the
+// capture's own rate, and end off the target when that rate drifts.
+type burstPreservingPacer struct {
+	mbps, pps    float64
+	pass         passTotals
+	scale        float64
+	start, first time.Time
+	at           time.Time
+}
+
+// passTotals sums up a pass for burstPreservingPacer. The last packet
+// is left out of bits and packets: the pass is over once it is sent.
+type passTotals struct {
+	bits, packets int64
+	span          time.Duration
+}
+
+func (p *burstPreservingPacer) Start(start, first time.Time) {
+	p.start, p.first, p.at = start, first, start
+	due := float64(p.pass.packets) / p.pps
+	if p.mbps > 0 {
+		due = float64(p.pass.bits) / (p.mbps * 1e6)
+	}
+	p.scale = 0
+	if p.pass.span > 0 {
+		p.scale = due / p.pass.span.Seconds()
+	}
+}
+
+func (p *burstPreservingPacer) Next(ts time.Time, n int) time.Time {
+	// Packets stamped earlier than the one before go with it.
+	if at := p.start.Add(time.Duration(float64(ts.Sub(p.first)) * p.scale)); at.After(p.at) {
+		p.at = at
+	}
+	return p.at
+}
+
+// burstPacer sends size packets back to back, with the bursts spaced so
+// the average rate is pps.
+type burstPacer struct {
+	pps     float64
+	size    int64
+	start   time.Time
+	packets int64
+}
+
+func (p *burstPacer) Start(start, first time.Time) { p.start, p.packets = start, 0 }
+
+func (p *burstPacer) Next(ts time.Time, n int) time.Time {
+	burstStart := p.packets / p.size * p.size
+	at := p.start.Add(time.Duration(float64(burstStart) / p.pps * float64(time.Second)))
+	p.packets++
+	return at
+}
+
+// topSpeedPacer makes every packet due at once, so the sender goes as
+// fast as it can.
+type topSpeedPacer struct {
+	start time.Time
+}
+
+func (p *topSpeedPacer) Start(start, first time.Time) { p.start = start }
+
+func (p *topSpeedPacer) Next(ts time.Time, n int) time.Time { return p.start }
+
+// microburstPacer moves the packets another pacer makes due into line-rate
+// microbursts. Each pass places its bursts from its own seed, so a replay
+// is repeatable.
+type microburstPacer struct {
+	Pacer
+	cfg    microburst.Config
+	seed   int64
+	shaper *microburst.Shaper
+}
+
+func (p *microburstPacer) Start(start, first time.Time) {
+	p.Pacer.Start(start, first)
+	p.shaper = microburst.New(p.cfg, rand.New(rand.NewSource(p.seed)), start)
+}
+
+func (p *microburstPacer) Next(ts time.Time, n int) time.Time {
+	return p.shaper.At(p.Pacer.Next(ts, n), n)
+}
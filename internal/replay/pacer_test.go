@@ -0,0 +1,97 @@
+package replay
+
+import (
+	"io"
+	"testing"
+	"time"
+)
+
+func TestPacers(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	ms := time.Millisecond
+	type packet struct {
+		ts   time.Duration // into the capture
+		n    int
+		want time.Duration // into the pass
+	}
+	tests := []struct {
+		name    string
+		pacer   Pacer
+		packets []packet
+	}{
+		{"timestamp", &timestampPacer{speed: 1}, []packet{
+			{0, 100, 0}, {10 * ms, 100, 10 * ms}, {15 * ms, 100, 15 * ms},
+		}},
+		{"timestamp speed 2", &timestampPacer{speed: 2}, []packet{
+			{0, 100, 0}, {10 * ms, 100, 5 * ms}, {30 * ms, 100, 15 * ms},
+		}},
+		// 1000 bytes take 8ms at 1 Mbps.
+		{"mbps", &bitRatePacer{mbps: 1}, []packet{
+			{0, 1000, 0}, {time.Second, 500, 8 * ms}, {time.Second, 1000, 12 * ms},
+		}},
+		{"pps", &packetRatePacer{pps: 100}, []packet{
+			{0, 100, 0}, {time.Hour, 1500, 10 * ms}, {time.Hour, 60, 20 * ms},
+		}},
+		{"burst", &burstPacer{pps: 100, size: 2}, []packet{
+			{0, 100, 0}, {0, 100, 0}, {0, 100, 20 * ms}, {0, 100, 20 * ms}, {0, 100, 40 * ms},
+		}},
+		{"topspeed", &topSpeedPacer{}, []packet{
+			{0, 100, 0}, {time.Second, 100, 0},
+		}},
+		// Three packets over 40ms of capture are due over 20ms at 100 pps:
+		// every gap is halved.
+		{"preserve bursts pps", &burstPreservingPacer{pps: 100, pass: passTotals{packets: 2, span: 40 * ms}}, []packet{
+			{0, 100, 0}, {2 * ms, 100, 1 * ms}, {40 * ms, 100, 20 * ms},
+		}},
+		{"preserve bursts mbps", &burstPreservingPacer{mbps: 1, pass: passTotals{bits: 16000, span: 8 * ms}}, []packet{
+			{0, 1000, 0}, {4 * ms, 1000, 8 * ms}, {8 * ms, 1000, 16 * ms},
+		}},
+		{"preserve bursts out of order", &burstPreservingPacer{pps: 100, pass: passTotals{packets: 2, span: 10 * ms}}, []packet{
+			{0, 100, 0}, {10 * ms, 100, 20 * ms}, {5 * ms, 100, 20 * ms},
+		}},
+		{"rate schedule", newRateSchedule(Config{Mode: ModePps, RateSchedule: []RatePoint{{0, 100}, {20 * ms, 1000}}}, io.Discard), []packet{
+			{0, 100, 0}, {0, 100, 10 * ms}, {0, 100, 20 * ms}, {0, 100, 21 * ms},
+		}},
+		{"rate schedule ramp", newRateSchedule(Config{Mode: ModePps, RateRamp: true, RateSchedule: []RatePoint{{0, 100}, {20 * ms, 300}}}, io.Discard), []packet{
+			{0, 100, 0}, {0, 100, 10 * ms}, {0, 100, 15 * ms}, {0, 100, 19 * ms},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.pacer.Start(start, first)
+			for i, p := range tt.packets {
+				got := tt.pacer.Next(first.Add(p.ts), p.n).Sub(start)
+				if got != p.want {
+					t.Errorf("packet %d due at %v, want %v", i, got, p.want)
+				}
+			}
+		})
+	}
+}
+
+func TestPacerRestart(t *testing.T) {
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	first := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	next := start.Add(time.Minute)
+
+	// A pass starts its pacer over.
+	p := &packetRatePacer{pps: 10}
+	p.Start(start, first)
+	p.Next(first, 100)
+	p.Next(first, 100)
+	p.Start(next, first)
+	if got := p.Next(first, 100); !got.Equal(next) {
+		t.Errorf("packet rate: first packet of the second pass due at %v, want %v", got, next)
+	}
+
+	// A rate schedule runs on from the pass before.
+	s := newRateSchedule(Config{Mode: ModePps, RateSchedule: []RatePoint{{0, 10}}}, io.Discard)
+	s.Start(start, first)
+	s.Next(first, 100)
+	s.Next(first, 100)
+	s.Start(next, first)
+	if got, want := s.Next(first, 100), start.Add(200*time.Millisecond); !got.Equal(want) {
+		t.Errorf("rate schedule: first packet of the second pass due at %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,283 @@
+package replay
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+const (
+	// pairLead is how far ahead the leader schedules the start of a
+	// pass, so that its message reaches the follower in time.
+	pairLead = 500 * time.Millisecond
+	// pairPings is how many round trips the follower times to estimate
+	// the offset between the clocks.
+	pairPings = 8
+)
+
+// pairMsg is one line of the control channel between paired replays.
+// Times are in Unix nanoseconds on the leader's clock.
+type pairMsg struct {
+	Type  string  `json:"type"` // hello, ping, pong, synced, ready, start, stop, error
+	Pass  int     `json:"pass,omitempty"`
+	Time  int64   `json:"time,omitempty"`
+	Speed float64 `json:"speed,omitempty"`
+	Error string  `json:"error,omitempty"`
+}
+
+// pair coordinates a replay with its peer on the other side of a device
+// under test, each sending its direction of the same capture. The leader
+// listens, times every pass, and decides when the replay ends; the
+// follower connects, works out the offset between their clocks, and
+// starts each pass when told. Both pace the pass from the first packet
+// of the capture as read, before any filter, so packets keep their
+// timing relative to the other side's.
+type pair struct {
+	leader bool
+	conn   net.Conn
+	enc    *json.Encoder
+	dec    *json.Decoder
+	// offset is the leader's clock less the follower's.
+	offset time.Duration
+	intr   *interrupt
+	done   chan struct{}
+
+	// start is when the current pass starts, on the local clock, and base
+	// the capture time of its first packet.
+	start time.Time
+	base  time.Time
+}
+
+// newPair sets up the control channel: as leader when cfg.PairListen is
+// set, waiting for the follower, else as follower connecting to
+// cfg.Pair, retrying until the leader is up.
+func newPair(cfg Config, intr *interrupt, out io.Writer) (*pair, error) {
+	p := &pair{leader: cfg.PairListen != "", intr: intr}
+	var conn net.Conn
+	if p.leader {
+		ln, err := net.Listen("tcp", cfg.PairListen)
+		if err != nil {
+			return nil, fmt.Errorf("pair-listen: %v", err)
+		}
+		fmt.Fprintf(out, "Waiting for peer on %s\n", ln.Addr())
+		stop := p.closeOnStop(ln)
+		conn, err = ln.Accept()
+		close(stop)
+		ln.Close()
+		if err != nil {
+			return nil, p.failed(err)
+		}
+	} else {
+		warned := false
+		for {
+			var err error
+			if conn, err = net.DialTimeout("tcp", cfg.Pair, time.Second); err == nil {
+				break
+			}
+			if !warned {
+				fmt.Fprintf(out, "Waiting for peer at %s: %v\n", cfg.Pair, err)
+				warned = true
+			}
+			if !intr.wait(intr.after(time.Second)) {
+				return nil, errInterrupted
+			}
+		}
+	}
+	p.conn = conn
+	p.enc = json.NewEncoder(conn)
+	p.dec = json.NewDecoder(bufio.NewReader(conn))
+	// An interrupt closes the channel so that no read waits on the peer
+	// for ever.
+	p.done = p.closeOnStop(conn)
+
+	if err := p.handshake(cfg, out); err != nil {
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// closeOnStop closes c once the replay is interrupted, until the
+// returned channel is closed.
+func (p *pair) closeOnStop(c io.Closer) chan struct{} {
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-p.intr.stop:
+			c.Close()
+		case <-done:
+		}
+	}()
+	return done
+}
+
+// failed turns an error of the control channel into errInterrupted when
+// the interrupt caused it.
+func (p *pair) failed(err error) error {
+	if p.intr.stopped() {
+		return errInterrupted
+	}
+	if errors.Is(err, io.EOF) {
+		return errors.New("peer left")
+	}
+	return fmt.Errorf("peer: %v", err)
+}
+
+func (p *pair) send(m pairMsg) error {
+	if err := p.enc.Encode(m); err != nil {
+		return p.failed(err)
+	}
+	return nil
+}
+
+// recv reads the next message, turning a peer's error into one here.
+func (p *pair) recv() (pairMsg, error) {
+	var m pairMsg
+	if err := p.dec.Decode(&m); err != nil {
+		return m, p.failed(err)
+	}
+	if m.Type == "error" {
+		return m, fmt.Errorf("peer: %s", m.Error)
+	}
+	return m, nil
+}
+
+// expect reads the next message and checks its type.
+func (p *pair) expect(typ string) (pairMsg, error) {
+	m, err := p.recv()
+	if err == nil && m.Type != typ {
+		err = fmt.Errorf("peer sent %s, expected %s", m.Type, typ)
+	}
+	return m, err
+}
+
+// handshake checks that both sides replay alike and, on the follower,
+// estimates the clock offset from the round trip with the least delay.
+func (p *pair) handshake(cfg Config, out io.Writer) error {
+	if p.leader {
+		m, err := p.expect("hello")
+		if err != nil {
+			return err
+		}
+		if m.Speed != cfg.Speed {
+			err := fmt.Errorf("peer replays at speed %g, here at %g", m.Speed, cfg.Speed)
+			p.send(pairMsg{Type: "error", Error: err.Error()})
+			return err
+		}
+		if err := p.send(pairMsg{Type: "hello"}); err != nil {
+			return err
+		}
+		for {
+			m, err := p.recv()
+			if err != nil {
+				return err
+			}
+			if m.Type == "synced" {
+				break
+			}
+			if m.Type != "ping" {
+				return fmt.Errorf("peer sent %s, expected ping", m.Type)
+			}
+			if err := p.send(pairMsg{Type: "pong", Time: time.Now().UnixNano()}); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintf(out, "Paired with %s as leader\n", p.conn.RemoteAddr())
+		return nil
+	}
+
+	if err := p.send(pairMsg{Type: "hello", Speed: cfg.Speed}); err != nil {
+		return err
+	}
+	if _, err := p.expect("hello"); err != nil {
+		return err
+	}
+	best := time.Duration(-1)
+	for i := 0; i < pairPings; i++ {
+		sent := time.Now()
+		if err := p.send(pairMsg{Type: "ping"}); err != nil {
+			return err
+		}
+		m, err := p.expect("pong")
+		if err != nil {
+			return err
+		}
+		recvd := time.Now()
+		if rtt := recvd.Sub(sent); best < 0 || rtt < best {
+			best = rtt
+			p.offset = time.Unix(0, m.Time).Sub(sent.Add(rtt / 2))
+		}
+	}
+	if err := p.send(pairMsg{Type: "synced"}); err != nil {
+		return err
+	}
+	fmt.Fprintf(out, "Paired with %s (clock offset %s, rtt %s)\n", p.conn.RemoteAddr(), p.offset.Round(time.Microsecond), best.Round(time.Microsecond))
+	return nil
+}
+
+// begin agrees with the peer on the start of pass n. It reports false on
+// the follower once the leader has ended the replay.
+func (p *pair) begin(n int, now time.Time) (bool, error) {
+	p.base = time.Time{}
+	if p.leader {
+		m, err := p.expect("ready")
+		if err != nil {
+			return false, err
+		}
+		if m.Pass != n {
+			return false, fmt.Errorf("peer is ready for pass %d, not %d", m.Pass, n)
+		}
+		p.start = now.Add(pairLead)
+		return true, p.send(pairMsg{Type: "start", Pass: n, Time: p.start.UnixNano()})
+	}
+	if err := p.send(pairMsg{Type: "ready", Pass: n}); err != nil {
+		return false, err
+	}
+	m, err := p.recv()
+	if err != nil || m.Type == "stop" {
+		return false, err
+	}
+	if m.Type != "start" || m.Pass != n {
+		return false, fmt.Errorf("peer sent %s of pass %d, expected start of pass %d", m.Type, m.Pass, n)
+	}
+	p.start = time.Unix(0, m.Time).Add(-p.offset)
+	return true, nil
+}
+
+// finish ends the replay on the follower too; the leader calls it once
+// its own replay is over.
+func (p *pair) finish() {
+	if p.leader {
+		p.send(pairMsg{Type: "stop"})
+	}
+}
+
+func (p *pair) Close() error {
+	close(p.done)
+	return p.conn.Close()
+}
+
+// pairSource notes the capture time of the first packet of a pass for
+// the pair, before any filter drops it.
+type pairSource struct {
+	src  packetSource
+	pair *pair
+}
+
+func (s *pairSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	data, ci, err := s.src.ReadPacketData()
+	if err == nil && s.pair.base.IsZero() {
+		s.pair.base = ci.Timestamp
+	}
+	return data, ci, err
+}
+
+func (s *pairSource) Close() error {
+	return s.src.Close()
+}
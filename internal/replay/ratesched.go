@@ -0,0 +1,111 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// RatePoint is one step of a rate schedule: from At into the replay the
+// rate is Rate, in Mbps or pps as the replay mode says.
+type RatePoint struct {
+	At   time.Duration
+	Rate float64
+}
+
+// validateRateSchedule checks cfg.RateSchedule against the mode it paces.
+func validateRateSchedule(cfg Config) error {
+	if cfg.Mode != ModeMbps && cfg.Mode != ModePps {
+		return errors.New("rate-schedule needs mode=mbps or mode=pps")
+	}
+	if cfg.LinkFraction > 0 {
+		return errors.New("rate-schedule and link-fraction cannot be combined")
+	}
+	for i, p := range cfg.RateSchedule {
+		if i == 0 && p.At != 0 {
+			return errors.New("rate-schedule must start at 0s")
+		}
+		if i > 0 && p.At <= cfg.RateSchedule[i-1].At {
+			return errors.New("rate-schedule times must increase")
+		}
+		if p.Rate <= 0 {
+			return errors.New("rate-schedule rates must be > 0")
+		}
+	}
+	return nil
+}
+
+// rateSchedule is the Pacer of a rate schedule, at a rate that changes
+// over the replay. It keeps its own clock, the time the packets sent so
+// far take at the scheduled rates, so the schedule spans loops and holds
+// under dry-run.
+type rateSchedule struct {
+	points []RatePoint
+	ramp   bool
+	pps    bool
+	out    io.Writer
+
+	start  time.Time
+	offset time.Duration
+	// step is the index of the point last announced.
+	step int
+}
+
+func newRateSchedule(cfg Config, out io.Writer) *rateSchedule {
+	return &rateSchedule{points: cfg.RateSchedule, ramp: cfg.RateRamp, pps: cfg.Mode == ModePps, out: out, step: -1}
+}
+
+// Start begins the schedule at the first pass; it runs on across the
+// passes after it.
+func (s *rateSchedule) Start(start, first time.Time) {
+	if s.start.IsZero() {
+		s.start = start
+	}
+}
+
+// Next returns the send time of a packet of n bytes and advances the clock
+// past it.
+func (s *rateSchedule) Next(ts time.Time, n int) time.Time {
+	at := s.start.Add(s.offset)
+	rate, i := s.rateAt(s.offset)
+	if i != s.step {
+		s.step = i
+		s.announce(i)
+	}
+	if s.pps {
+		s.offset += time.Duration(float64(time.Second) / rate)
+	} else {
+		s.offset += time.Duration(float64(n*8) / (rate * 1e6) * float64(time.Second))
+	}
+	return at
+}
+
+// rateAt returns the rate at offset d and the index of the point in force.
+func (s *rateSchedule) rateAt(d time.Duration) (float64, int) {
+	i := len(s.points) - 1
+	for i > 0 && s.points[i].At > d {
+		i--
+	}
+	p := s.points[i]
+	if !s.ramp || i == len(s.points)-1 {
+		return p.Rate, i
+	}
+	q := s.points[i+1]
+	frac := float64(d-p.At) / float64(q.At-p.At)
+	return p.Rate + (q.Rate-p.Rate)*frac, i
+}
+
+func (s *rateSchedule) announce(i int) {
+	unit := "Mbps"
+	if s.pps {
+		unit = "pps"
+	}
+	p := s.points[i]
+	fmt.Fprintf(s.out, "Rate schedule: %.2f %s at %s", p.Rate, unit, p.At)
+	if s.ramp && i+1 < len(s.points) {
+		q := s.points[i+1]
+		fmt.Fprintf(s.out, ", ramping to %.2f %s by %s", q.Rate, unit, q.At)
+	}
+	fmt.Fprintln(s.out)
+}
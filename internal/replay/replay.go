@@ -1,160 +1,822 @@
-//go:build linux
-
 package replay
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
-	"net"
 	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
 	"time"
 
-	"github.com/google/gopacket/pcapgo"
-	"golang.org/x/sys/unix"
+	"genflux/internal/clock"
+	"genflux/internal/filter"
+	"genflux/internal/pcapio"
+	"genflux/internal/stats"
 )
 
-func Replay(cfg Config) error {
-	if cfg.InPath == "" || cfg.Iface == "" {
+// Replay sends the inputs of cfg. When ctx ends it stops as on SIGINT,
+// printing its summary, and returns ctx.Err().
+func Replay(ctx context.Context, cfg Config) error {
+	if cfg.InPath == "" || cfg.Iface == "" && !cfg.DryRun {
 		return errors.New("input pcap and iface required")
 	}
 	if cfg.Mode == "" {
 		cfg.Mode = ModeTimestamp
 	}
+	if cfg.Speed == 0 {
+		cfg.Speed = 1
+	}
+	if cfg.Speed < 0 {
+		return errors.New("speed must be > 0")
+	}
 	if cfg.StatsInterval <= 0 {
 		cfg.StatsInterval = 1 * time.Second
 	}
-	if cfg.Mode == ModeMbps && cfg.Mbps <= 0 {
+	if cfg.LinkFraction < 0 || cfg.LinkFraction > 1 {
+		return errors.New("link-fraction must be within [0,1]")
+	}
+	ifaces := splitIfaces(cfg.Iface)
+	if len(ifaces) == 0 && !cfg.DryRun {
+		return errors.New("input pcap and iface required")
+	}
+	if cfg.Mode == ModeSearch {
+		if err := validateSearch(&cfg, ifaces); err != nil {
+			return err
+		}
+	}
+	if cfg.LinkFraction > 0 {
+		// With several interfaces the rate is a fraction of their sum, or
+		// of the slowest when each of them carries the whole stream.
+		var total float64
+		for i, name := range ifaces {
+			speed, err := LinkSpeedMbps(name)
+			if err != nil {
+				return fmt.Errorf("%v; use --mbps instead", err)
+			}
+			if cfg.Balance != BalanceTee {
+				total += speed
+			} else if i == 0 || speed < total {
+				total = speed
+			}
+		}
+		cfg.Mode = ModeMbps
+		cfg.Mbps = total * cfg.LinkFraction
+	}
+	if cfg.Speed != 1 && cfg.Mode != ModeTimestamp {
+		return errors.New("speed applies to mode=timestamp")
+	}
+	if cfg.TimeShiftSet || cfg.RebaseNow {
+		if cfg.TimeShiftSet && cfg.RebaseNow {
+			return errors.New("time-shift and rebase-now are mutually exclusive")
+		}
+		if cfg.Mode != ModeTimestamp || cfg.Speed != 1 {
+			return errors.New("time-shift and rebase-now need mode=timestamp at speed 1")
+		}
+		if !cfg.StartAt.IsZero() || cfg.DryRun {
+			return errors.New("time-shift and rebase-now cannot be combined with start-at or dry-run")
+		}
+	}
+	if cfg.Pair != "" || cfg.PairListen != "" {
+		if cfg.Pair != "" && cfg.PairListen != "" {
+			return errors.New("pair and pair-listen are mutually exclusive")
+		}
+		if cfg.Mode != ModeTimestamp || cfg.DryRun || cfg.TimeShiftSet || cfg.RebaseNow || cfg.LoopGap > 0 || cfg.ContinuousTimestamps || cfg.Tune != nil {
+			return errors.New("pairing needs mode=timestamp and cannot be combined with dry-run, time-shift, rebase-now, loop-gap, continuous-timestamps or tune")
+		}
+	}
+	if cfg.Background || cfg.Pair != "" {
+		// The leader of a pair decides when the follower is done.
+		cfg.Loop = 0
+	}
+	if cfg.DryRun && (cfg.Loop == 0 || cfg.Mode == ModeSearch) {
+		return errors.New("dry-run needs a finite loop count and cannot run a search")
+	}
+	if cfg.Shuffle < 0 {
+		return errors.New("shuffle window must be >= 0")
+	}
+	if cfg.LimitFlows < 0 || cfg.LimitPerLoop < 0 || cfg.Duration < 0 {
+		return errors.New("limit-flows, limit-per-loop and duration must be >= 0")
+	}
+	if cfg.LoopGap < 0 {
+		return errors.New("loop-gap must be >= 0")
+	}
+	if (cfg.LimitPerLoop > 0 || cfg.Duration > 0 || cfg.LoopGap > 0 || cfg.ContinuousTimestamps) && cfg.Mode == ModeSearch {
+		return errors.New("limit-per-loop, duration, loop-gap and continuous-timestamps do not apply to mode=search")
+	}
+	if (cfg.LoopGap > 0 || cfg.ContinuousTimestamps) && (cfg.TimeShiftSet || cfg.RebaseNow) {
+		return errors.New("loop-gap and continuous-timestamps cannot be combined with time-shift or rebase-now")
+	}
+	if cfg.MaxSendErrors < 0 || cfg.MaxSkipped < 0 || cfg.SendRetries < 0 || cfg.RetryBackoff < 0 {
+		return errors.New("max-send-errors, max-skipped, send-retries and retry-backoff must be >= 0")
+	}
+	if cfg.RetryBackoff == 0 {
+		cfg.RetryBackoff = 100 * time.Microsecond
+	}
+	if cfg.Direction == "" {
+		cfg.Direction = DirectionBoth
+	}
+	if len(cfg.ClientNets) > 0 && cfg.Direction == DirectionBoth {
+		return errors.New("client-net needs direction client or server")
+	}
+	if cfg.Tune != nil && cfg.Mode == ModeSearch {
+		return errors.New("tuning does not apply to mode=search")
+	}
+	if len(cfg.RateSchedule) > 0 {
+		if err := validateRateSchedule(cfg); err != nil {
+			return err
+		}
+	} else if cfg.Mode == ModeMbps && cfg.Mbps <= 0 {
 		return errors.New("mbps must be > 0 when mode=mbps")
+	} else if (cfg.Mode == ModePps || cfg.Mode == ModeBurst) && cfg.Pps <= 0 {
+		return fmt.Errorf("pps must be > 0 when mode=%s", cfg.Mode)
 	}
-	if cfg.Mode == ModePps && cfg.Pps <= 0 {
-		return errors.New("pps must be > 0 when mode=pps")
+	if cfg.PreserveBursts && (cfg.Mode != ModeMbps && cfg.Mode != ModePps || len(cfg.RateSchedule) > 0) {
+		return errors.New("preserve-bursts needs mode=mbps or mode=pps and no rate-schedule")
 	}
-
-	iface, err := net.InterfaceByName(cfg.Iface)
+	if cfg.Mode == ModeBurst && cfg.Burst <= 0 {
+		return errors.New("burst must be > 0 when mode=burst")
+	}
+	if err := cfg.Microbursts.Validate(); err != nil {
+		return err
+	}
+	if cfg.Microbursts.Enabled() && (cfg.Mode == ModeTopSpeed || cfg.Mode == ModeSearch) {
+		return fmt.Errorf("microbursts need a paced mode, not mode=%s", cfg.Mode)
+	}
+	if cfg.Verify != "" && (cfg.DryRun || cfg.Mode == ModeSearch) {
+		return errors.New("verify cannot be combined with dry-run or mode=search")
+	}
+	if cfg.VerifyWait < 0 {
+		return errors.New("verify-wait must be >= 0")
+	}
+	if cfg.SpinThreshold < 0 {
+		return errors.New("spin-threshold must be >= 0")
+	}
+	if cfg.SendBatch < 0 {
+		return errors.New("send-batch must be >= 0")
+	}
+	if cfg.SendBatch > 1 && cfg.TxBackend != "" && cfg.TxBackend != BackendSocket {
+		return fmt.Errorf("send-batch applies to the socket backend; %s batches on its own", cfg.TxBackend)
+	}
+	match, err := filter.Compile(cfg.Filter)
 	if err != nil {
 		return err
 	}
 
-	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	budget := &errorBudget{max: cfg.MaxSendErrors, retries: cfg.SendRetries, backoff: cfg.RetryBackoff}
+	var sender transmitter
+	var dry *dryRun
+	if cfg.DryRun {
+		dry = &dryRun{}
+		sender = dry
+	} else if len(ifaces) == 1 {
+		sender, err = newSender(cfg, ifaces[0])
+	} else {
+		sender, err = newFanout(cfg, ifaces, budget)
+	}
 	if err != nil {
 		return err
 	}
-	defer unix.Close(fd)
+	defer sender.Close()
 
-	// Increase socket buffer size for better throughput
-	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, 16*1024*1024); err != nil {
-		return err
+	var out io.Writer = os.Stdout
+	if cfg.Out != nil {
+		out = cfg.Out
+	}
+	if cfg.LogFile != "" {
+		rot, err := newDailyLog(cfg.LogFile)
+		if err != nil {
+			return err
+		}
+		defer rot.Close()
+		out = rot
+	}
+	if cfg.LinkFraction > 0 {
+		fmt.Fprintf(out, "Rate %.2f Mbps (%.4f of %s link speed)\n", cfg.Mbps, cfg.LinkFraction, cfg.Iface)
+	}
+	if d, ok := sender.(describer); ok {
+		fmt.Fprintln(out, d.describe())
 	}
-	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, 16*1024*1024); err != nil {
-		// SO_SNDBUFFORCE may fail due to permissions, ignore
+	if f, ok := sender.(*fanout); ok {
+		defer f.report(out)
+		fmt.Fprintf(out, "Replaying on %d interfaces (%s)\n", len(ifaces), cfg.Balance)
 	}
 
-	addr := &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: iface.Index}
-	if err := unix.Bind(fd, addr); err != nil {
-		return err
+	clk := cfg.Clock
+	if clk == nil {
+		clk = clock.Real
+		if cfg.DryRun {
+			clk = clock.NewVirtual(time.Now())
+		}
+	}
+	intr := watchInterrupt(ctx, clk)
+	defer intr.Close()
+	// A clock of the caller's may only move when waited on.
+	intr.busy = cfg.SchedPolicy == SchedBusy && clk == clock.Real
+	if !cfg.StartAt.IsZero() && !cfg.DryRun {
+		fmt.Fprintf(out, "Waiting until %s to start\n", cfg.StartAt.Format(time.RFC3339))
+		if !intr.wait(cfg.StartAt) {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return errInterrupted
+		}
+		SleepUntil(cfg.StartAt)
+	}
+
+	run := &replayRun{sender: sender, budget: budget, skipped: map[string]bool{}, format: cfg.StatsFormat, intr: intr, clock: clk, dry: dry != nil, start: clk.Now()}
+	if cfg.Duration > 0 {
+		run.end = run.start.Add(cfg.Duration)
+	}
+	if cfg.Pair != "" || cfg.PairListen != "" {
+		if run.pair, err = newPair(cfg, intr, out); err != nil {
+			if err == errInterrupted && ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		defer run.pair.Close()
+	}
+	if cfg.MetricsListen != "" {
+		var sending []string
+		if !cfg.DryRun {
+			sending = ifaces
+		}
+		metrics, err := serveMetrics(cfg.MetricsListen, run, sending, out)
+		if err != nil {
+			return err
+		}
+		defer metrics.Close()
+	}
+	if cfg.Tune != nil {
+		run.tuning = &Tuning{Mbps: cfg.Mbps, Pps: cfg.Pps, Speed: cfg.Speed, Limit: cfg.Limit, LimitPerLoop: cfg.LimitPerLoop, Duration: cfg.Duration}
+	}
+	if cfg.TimeShiftSet || cfg.RebaseNow {
+		run.shift = &absoluteShift{shift: cfg.TimeShift, rebase: cfg.RebaseNow, clock: clk}
+	}
+	if cfg.FlowStats != "" {
+		run.flows = newFlowStats()
+	}
+	if cfg.Tee != "" {
+		if run.tee, err = newTeeCapture(cfg.Tee); err != nil {
+			return err
+		}
+	}
+	if len(cfg.RateSchedule) > 0 {
+		run.sched = newRateSchedule(cfg, out)
+	}
+	if cfg.Verify != "" {
+		// Listen before the first frame goes out.
+		if run.verify, err = newVerifier(cfg); err != nil {
+			return err
+		}
+	}
+
+	lastInputs := map[string]os.FileInfo{}
+	open := func(path string) (*os.File, error) {
+		file, err := openInput(cfg, path, intr, out)
+		if err != nil {
+			return nil, err
+		}
+		if info, err := file.Stat(); err == nil {
+			if last := lastInputs[path]; last != nil && !os.SameFile(last, info) {
+				fmt.Fprintf(out, "Input %s was replaced, reopened\n", path)
+			}
+			lastInputs[path] = info
+		}
+		return file, nil
+	}
+	readOpts := func(path string) pcapio.ReaderOptions {
+		return pcapio.ReaderOptions{SkipCorrupt: cfg.SkipCorrupt || cfg.MaxSkipped > 0, OnCorrupt: func(e *pcapio.CorruptError) {
+			if !run.scanning {
+				fmt.Fprintf(out, "Skipped in %s: %v\n", path, e)
+			}
+			run.skipped[fmt.Sprintf("%s@%d/%d", path, e.Offset, e.Packet)] = true
+		}}
+	}
+	var flowLimit *flowLimit
+	if cfg.LimitFlows > 0 {
+		flowLimit = newFlowLimit(cfg.LimitFlows)
+	}
+	var sides *sessionSides
+	if cfg.Direction != DirectionBoth {
+		sides = newSessionSides(cfg.Direction, cfg.ClientNets)
+	}
+	// newPass builds the packet source of one pass over the inputs.
+	newPass := func() (packetSource, error) {
+		paths, err := inputPaths(cfg, intr, out)
+		if err != nil {
+			return nil, err
+		}
+		var src packetSource
+		if cfg.Merge {
+			if src, err = newMergeSource(paths, open, readOpts); err != nil {
+				return nil, readFailed(err)
+			}
+		} else {
+			src = newSequentialSource(paths, open, readOpts)
+		}
+		if run.pair != nil {
+			src = &pairSource{src: src, pair: run.pair}
+		}
+		if cfg.Filter != "" {
+			src = &filterSource{src: src, filter: match}
+		}
+		if flowLimit != nil {
+			src = &flowLimitSource{src: src, limit: flowLimit}
+		}
+		if sides != nil {
+			src = &directionSource{src: src, sides: sides}
+		}
+		if cfg.Shuffle > 1 {
+			src = newShuffleSource(src, cfg.Shuffle, cfg.ShuffleSeed)
+		}
+		return src, nil
+	}
+	if cfg.Mode == ModeSearch {
+		err = searchThroughput(run, cfg, newPass, out)
+	} else {
+		err = run.loop(cfg, newPass, out)
+	}
+	if run.tee != nil {
+		if terr := run.tee.Close(); terr != nil && err == nil {
+			err = terr
+		}
+	}
+	// The flow table covers a replay that ran to its end or was stopped.
+	flows := run.flows != nil && (err == nil || err == errInterrupted)
+	if err == nil {
+		err = run.partial()
+	}
+	if dry == nil {
+		run.summary(out, err == errInterrupted)
+	} else {
+		dry.report(out)
 	}
+	// After the summary, so that its rates leave out the time these take.
+	if flows {
+		if ferr := run.flows.report(cfg.FlowStats, out); ferr != nil && err == nil {
+			err = ferr
+		}
+	}
+	if run.verify != nil {
+		if verr := run.verify.finish(out); verr != nil && err == nil {
+			err = verr
+		}
+	}
+	if err == errInterrupted && ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// replayRun is the state shared by the passes of one replay.
+type replayRun struct {
+	sender    transmitter
+	remaining *int
+	flows     *flowStats
+	tee       *teeCapture
+	verify    *verifier
+	sched     *rateSchedule
+	shift     *absoluteShift
+	intr      *interrupt
+	clock     clock.Clock
+	// dry marks a dry run, which schedules without sending.
+	dry bool
+	// end, when set, is when Config.Duration is up; ended is set once
+	// a pass has stopped there.
+	end   time.Time
+	ended bool
+	// nextStart, when set, is when the next pass may start, for
+	// Config.LoopGap and Config.ContinuousTimestamps.
+	nextStart time.Time
+	// tuning, when Config.Tune is set, holds the settings in force.
+	tuning *Tuning
+	// budget counts the failed sends; skipped holds the damaged records
+	// stepped over, by file and position.
+	budget  *errorBudget
+	skipped map[string]bool
+	format  StatsFormat
+	// pair, when set, starts every pass together with the peer's.
+	pair *pair
+	// scanned holds the totals of the pass about to be sent, read ahead
+	// when Config.PreserveBursts is set; scanning is set while reading.
+	scanned  passTotals
+	scanning bool
 
-	loop := 0
-	var remaining *int
+	start  time.Time
+	total  stats.Counter
+	passes int
+}
+
+// loop replays the inputs for the configured number of passes, or until
+// the packet limit is reached.
+func (r *replayRun) loop(cfg Config, newPass func() (packetSource, error), out io.Writer) error {
 	if cfg.Limit > 0 {
-		remaining = &cfg.Limit
+		r.remaining = &cfg.Limit
+	}
+	passOut := out
+	if r.dry {
+		// Progress lines would report the dry run's own speed.
+		passOut = io.Discard
+	}
+	if r.pair != nil {
+		defer r.pair.finish()
 	}
 	for {
-		if cfg.Loop > 0 && loop >= cfg.Loop {
-			break
+		if cfg.Loop > 0 && r.passes >= cfg.Loop {
+			return nil
 		}
-		if remaining != nil && *remaining == 0 {
-			break
+		if r.remaining != nil && *r.remaining == 0 {
+			return nil
 		}
-		if err := replayOnce(fd, addr, cfg, remaining); err != nil {
-			return err
+		if r.pair != nil {
+			if ok, err := r.pair.begin(r.passes, r.clock.Now()); !ok || err != nil {
+				return err
+			}
+		}
+		if cfg.PreserveBursts {
+			scanned, err := r.scan(cfg, newPass)
+			if err != nil {
+				return err
+			}
+			r.scanned = scanned
+		}
+		src, err := newPass()
+		if err != nil {
+			if err = r.reopen(cfg, err, out); err != nil {
+				return err
+			}
+			continue
+		}
+		_, err = r.pass(cfg, src, passOut)
+		src.Close()
+		if err != nil {
+			if err = r.reopen(cfg, err, out); err != nil {
+				return err
+			}
+			continue
 		}
-		loop++
+		if r.ended {
+			fmt.Fprintf(out, "Duration %s reached\n", r.end.Sub(r.start))
+			return nil
+		}
+		r.passes++
 	}
-	return nil
 }
 
-func replayOnce(fd int, addr *unix.SockaddrLinklayer, cfg Config, remaining *int) error {
-	file, err := os.Open(cfg.InPath)
+// scan reads the next pass ahead of sending it and sums it up for the
+// pacer of Config.PreserveBursts. It stops where the packet limits would
+// stop the pass.
+func (r *replayRun) scan(cfg Config, newPass func() (packetSource, error)) (passTotals, error) {
+	src, err := newPass()
 	if err != nil {
-		return err
+		return passTotals{}, err
 	}
-	defer file.Close()
+	defer src.Close()
+	r.scanning = true
+	defer func() { r.scanning = false }()
 
-	reader, err := pcapgo.NewReader(file)
-	if err != nil {
+	limit := cfg.LimitPerLoop
+	if r.remaining != nil && (limit == 0 || *r.remaining < limit) {
+		limit = *r.remaining
+	}
+	var (
+		t           passTotals
+		read, n     int
+		first, last time.Time
+	)
+	for limit == 0 || read < limit {
+		data, ci, err := src.ReadPacketData()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return passTotals{}, err
+		}
+		if read == 0 {
+			first, last = ci.Timestamp, ci.Timestamp
+		} else {
+			// Sums up to the packet before this one.
+			t.bits += int64(n) * 8
+			t.packets++
+		}
+		if ci.Timestamp.After(last) {
+			last = ci.Timestamp
+		}
+		read, n = read+1, len(data)
+	}
+	t.span = last.Sub(first)
+	return t, nil
+}
+
+// reopen rides out an error reading the inputs in background mode: it
+// logs the error and waits before the next pass opens them again. It
+// returns the error to end the replay with otherwise, or errInterrupted
+// when the wait is.
+func (r *replayRun) reopen(cfg Config, err error, out io.Writer) error {
+	var ie *inputError
+	if !cfg.Background || !errors.As(err, &ie) {
 		return err
 	}
+	fmt.Fprintf(out, "Reading input failed, reopening in %s: %v\n", inputRetry, err)
+	if !r.intr.wait(r.intr.after(inputRetry)) {
+		return errInterrupted
+	}
+	return nil
+}
+
+// partial returns a *PartialError when the replay stepped over failed
+// sends or damaged records, nil otherwise.
+func (r *replayRun) partial() error {
+	sendErrors, first := r.budget.tolerated()
+	if sendErrors == 0 && len(r.skipped) == 0 {
+		return nil
+	}
+	return &PartialError{SendErrors: sendErrors, FirstSendError: first, Skipped: len(r.skipped)}
+}
+
+// summary prints the totals of the whole replay.
+func (r *replayRun) summary(out io.Writer, interrupted bool) {
+	now := r.clock.Now()
+	elapsed := now.Sub(r.start)
+	total := r.total.Snapshot()
+	rate := total.Rate(elapsed)
+	state := "completed"
+	if interrupted {
+		state = "interrupted"
+	}
+	newStatsSink(r.format, out).record(statsRecord{Type: "summary", Time: now, Elapsed: elapsed.Seconds(), Pass: r.passes,
+		Packets: total.Packets, Bytes: total.Bytes, Mbps: rate.Mbps, Pps: rate.Pps, SendErrors: r.budget.failures(), SendRetries: r.budget.retried.Load(), State: state})
+}
+
+// inputPaths resolves the inputs for the next pass. In background mode a
+// pattern is re-expanded every pass and waited on while nothing matches.
+func inputPaths(cfg Config, intr *interrupt, out io.Writer) ([]string, error) {
+	warned := false
+	for {
+		paths, err := resolveInputs(cfg.InPath, cfg.Background)
+		if err != nil || len(paths) > 0 {
+			return paths, err
+		}
+		if !cfg.Background {
+			return nil, errors.New("no input files")
+		}
+		if !warned {
+			fmt.Fprintf(out, "Waiting for input matching %s\n", cfg.InPath)
+			warned = true
+		}
+		if !intr.wait(intr.after(inputRetry)) {
+			return nil, errInterrupted
+		}
+	}
+}
+
+// openInput opens an input pcap. In background mode a missing file is
+// retried, since it may be in the middle of being replaced.
+func openInput(cfg Config, path string, intr *interrupt, out io.Writer) (*os.File, error) {
+	warned := false
+	for {
+		file, err := os.Open(path)
+		if err == nil || !cfg.Background {
+			return file, err
+		}
+		if !warned {
+			fmt.Fprintf(out, "Waiting for input %s: %v\n", path, err)
+			warned = true
+		}
+		if !intr.wait(intr.after(inputRetry)) {
+			return nil, errInterrupted
+		}
+	}
+}
+
+// pass sends one pass of reader and returns the number of packets sent.
+// An interrupt stops it after flushing what the sender already holds.
+func (r *replayRun) pass(cfg Config, reader packetSource, out io.Writer) (int64, error) {
+	if r.tuning != nil {
+		r.tuning.apply(&cfg)
+	}
+	rw := newRewriter(cfg.Rewrite)
+	var scrub *scrubber
+	if cfg.ScrubPayload != ScrubNone {
+		scrub = newScrubber(cfg.ScrubPayload)
+	}
+	pacer := r.pacer(cfg)
 
 	var (
-		startTime    = time.Now()
-		baseTS       time.Time
-		totalBits    int64
-		totalPackets int64
-		lastStats    = time.Now()
-		lastBits     int64
-		lastPackets  int64
+		startTime   = r.clock.Now()
+		baseTS      time.Time
+		first, last time.Time // when the pass's first and last packets were due
+		sent        stats.Counter
+		meter       = stats.NewMeter(cfg.StatsInterval, startTime)
 	)
+	sink := newStatsSink(r.format, out)
 	defer func() {
-		fmt.Printf("Done: elapsed=%.2fs total=%d packets bits=%d\n", time.Since(startTime).Seconds(), totalPackets, totalBits)
+		now := r.clock.Now()
+		total := sent.Snapshot()
+		rate := total.Rate(now.Sub(startTime))
+		sink.record(statsRecord{Type: "pass", Time: now, Elapsed: now.Sub(startTime).Seconds(), Pass: r.passes,
+			Packets: total.Packets, Bytes: total.Bytes, Mbps: rate.Mbps, Pps: rate.Pps, SendErrors: r.budget.failures(), SendRetries: r.budget.retried.Load()})
 	}()
 
 	for {
 		data, ci, err := reader.ReadPacketData()
+		if cfg.MaxSkipped > 0 && !cfg.SkipCorrupt && len(r.skipped) > cfg.MaxSkipped {
+			return sent.Snapshot().Packets, fmt.Errorf("%d damaged records skipped, more than max-skipped %d", len(r.skipped), cfg.MaxSkipped)
+		}
 		if err != nil {
 			if err == io.EOF {
 				break
 			}
-			return err
+			return sent.Snapshot().Packets, readFailed(err)
 		}
 		if baseTS.IsZero() {
 			baseTS = ci.Timestamp
-			startTime = time.Now()
+			startTime = r.clock.Now()
+			if r.nextStart.After(startTime) {
+				startTime = r.nextStart
+			}
+			if r.pair != nil {
+				baseTS, startTime = r.pair.base, r.pair.start
+			}
+			if r.shift != nil {
+				start, err := r.shift.passStart(baseTS, out)
+				if err != nil {
+					return sent.Snapshot().Packets, err
+				}
+				startTime = start
+			}
+			pacer.Start(startTime, baseTS)
+		}
+		if r.shift != nil {
+			r.shift.observe(ci.Timestamp)
+		}
+		if r.tuning != nil {
+			select {
+			case t := <-cfg.Tune:
+				if r.retune(&cfg, t, out) {
+					// Pace on from here at the new rate.
+					at := r.clock.Now()
+					if last.After(at) {
+						at = last
+					}
+					pacer = r.pacer(cfg)
+					pacer.Start(at, ci.Timestamp)
+				}
+			default:
+			}
 		}
 
-		if remaining != nil && *remaining == 0 {
-			return nil
+		if r.remaining != nil && *r.remaining == 0 {
+			// Ends the pass as its end does, flushing what the sender holds.
+			break
+		}
+		if cfg.LimitPerLoop > 0 && sent.Snapshot().Packets >= int64(cfg.LimitPerLoop) {
+			break
 		}
 
-		target := WaitForSchedule(cfg, startTime, baseTS, ci.Timestamp, totalBits, totalPackets)
-		SleepUntil(target)
+		if rw != nil {
+			rw.rewrite(data)
+		}
+		if scrub != nil {
+			scrub.scrub(data, ci.Length)
+		}
 
-		if err := unix.Sendto(fd, data, 0, addr); err != nil {
-			return err
+		target := pacer.Next(ci.Timestamp, len(data))
+		if !r.end.IsZero() && target.After(r.end) {
+			// Time is up before this packet is due.
+			if !r.intr.wait(r.end) {
+				r.sender.flush()
+				return sent.Snapshot().Packets, errInterrupted
+			}
+			r.ended = true
+			break
+		}
+		if !r.intr.wait(target) {
+			r.sender.flush()
+			return sent.Snapshot().Packets, errInterrupted
+		}
+		if err := r.budget.send(r.sender, data, target); err != nil {
+			if !r.budget.tolerate(err) {
+				return sent.Snapshot().Packets, err
+			}
+			continue
+		}
+
+		if first.IsZero() {
+			first = target
+		}
+		last = target
+		sent.Add(len(data))
+		r.total.Add(len(data))
+		if r.flows != nil {
+			r.flows.add(data)
+		}
+		if r.verify != nil {
+			r.verify.add(data)
+		}
+		if r.tee != nil {
+			at := r.clock.Now()
+			if at.Before(target) {
+				at = target
+			}
+			if err := r.tee.write(data, at); err != nil {
+				return sent.Snapshot().Packets, err
+			}
+		}
+		if r.remaining != nil && *r.remaining > 0 {
+			*r.remaining--
 		}
 
-		totalPackets++
-		totalBits += int64(len(data)) * 8
-		if remaining != nil && *remaining > 0 {
-			*remaining--
+		now := r.clock.Now()
+		so := sent.Snapshot()
+		if rate, ok := meter.Tick(now, so); ok {
+			total := r.total.Snapshot()
+			sink.record(statsRecord{Type: "interval", Time: now, Elapsed: now.Sub(startTime).Seconds(), Pass: r.passes,
+				Packets: so.Packets, Bytes: so.Bytes, Mbps: rate.Mbps, Pps: rate.Pps,
+				TotalPackets: total.Packets, TotalBytes: total.Bytes, SendErrors: r.budget.failures(), SendRetries: r.budget.retried.Load()})
+			if cfg.Progress != nil {
+				cfg.Progress(Progress{Elapsed: now.Sub(r.start), Pass: r.passes, Packets: total.Packets, Bytes: total.Bytes, Mbps: rate.Mbps, Pps: rate.Pps})
+			}
 		}
+	}
 
-		now := time.Now()
-		if now.Sub(lastStats) >= cfg.StatsInterval {
-			interval := now.Sub(lastStats).Seconds()
-			bps := float64(totalBits-lastBits) / interval
-			pps := float64(totalPackets-lastPackets) / interval
-			fmt.Printf("%.2fs: %.2f Mbps %.2f pps total=%d\n", now.Sub(startTime).Seconds(), bps/1e6, pps, totalPackets)
-			lastStats = now
-			lastBits = totalBits
-			lastPackets = totalPackets
+	if r.shift != nil {
+		r.shift.passDone(baseTS)
+	}
+	err := r.sender.flush()
+	// Frames the kernel refuses on the way out count as failed sends.
+	var refused *refusedError
+	for errors.As(err, &refused) && r.budget.tolerate(err) {
+		err = r.sender.flush()
+	}
+	if cfg.LoopGap > 0 || cfg.ContinuousTimestamps {
+		r.nextStart = r.clock.Now()
+		if n := sent.Snapshot().Packets; cfg.ContinuousTimestamps && n > 0 {
+			r.nextStart = last
+			if n > 1 {
+				r.nextStart = last.Add(last.Sub(first) / time.Duration(n-1))
+			}
 		}
+		r.nextStart = r.nextStart.Add(cfg.LoopGap)
 	}
+	return sent.Snapshot().Packets, err
+}
 
-	return nil
+// pacer returns the pacer of a pass with the settings cfg.
+func (r *replayRun) pacer(cfg Config) Pacer {
+	pacer := newPacer(cfg, r.scanned, r.sched)
+	if cfg.Microbursts.Enabled() {
+		pacer = &microburstPacer{Pacer: pacer, cfg: cfg.Microbursts, seed: int64(r.passes)}
+	}
+	return pacer
+}
+
+// absoluteShift maps capture timestamps onto the clock for --time-shift
+// and --rebase-now.
+type absoluteShift struct {
+	shift  time.Duration
+	rebase bool
+	// started is set once the first pass has begun; last is the latest
+	// timestamp of the current pass.
+	started bool
+	last    time.Time
+	clock   clock.Clock
+}
+
+// passStart returns when the pass whose first packet was captured at
+// first starts. The first pass refuses to start more than a second late,
+// since every packet would then be sent at once.
+func (a *absoluteShift) passStart(first time.Time, out io.Writer) (time.Time, error) {
+	a.last = first
+	if a.started {
+		return first.Add(a.shift), nil
+	}
+	a.started = true
+	if a.rebase {
+		a.shift = a.clock.Now().Sub(first)
+	}
+	start := first.Add(a.shift)
+	if late := a.clock.Now().Sub(start); late > time.Second {
+		return time.Time{}, fmt.Errorf("capture starts at %s, %s ago with this time-shift", start.Format(time.RFC3339), late.Round(time.Second))
+	}
+	fmt.Fprintf(out, "Capture time %s replays at %s (shift %s)\n", first.Format(time.RFC3339Nano), start.Format(time.RFC3339Nano), a.shift.Round(time.Millisecond))
+	return start, nil
+}
+
+func (a *absoluteShift) observe(ts time.Time) {
+	if ts.After(a.last) {
+		a.last = ts
+	}
 }
 
-func WaitForSchedule(cfg Config, startTime, baseTS, pktTS time.Time, totalBits, totalPackets int64) time.Time {
-	switch cfg.Mode {
-	case ModeTimestamp:
-		return startTime.Add(pktTS.Sub(baseTS))
-	case ModeMbps:
-		return startTime.Add(time.Duration(float64(totalBits) / (cfg.Mbps * 1e6) * float64(time.Second)))
-	case ModePps:
-		return startTime.Add(time.Duration(float64(totalPackets) / cfg.Pps * float64(time.Second)))
-	default:
-		return startTime.Add(pktTS.Sub(baseTS))
+// passDone moves the shift on so the next pass follows this one.
+func (a *absoluteShift) passDone(first time.Time) {
+	if !first.IsZero() {
+		a.shift += a.last.Sub(first)
 	}
 }
 
@@ -179,6 +841,16 @@ func SleepUntil(target time.Time) {
 	}
 }
 
-func htons(i uint16) uint16 {
-	return (i<<8)&0xff00 | i>>8
+// LinkSpeedMbps reads the negotiated link speed of iface from sysfs.
+// Callers add how to do without it to the error.
+func LinkSpeedMbps(iface string) (float64, error) {
+	data, err := os.ReadFile(filepath.Join("/sys/class/net", iface, "speed"))
+	if err != nil {
+		return 0, fmt.Errorf("read link speed of %s: %v", iface, err)
+	}
+	speed, err := strconv.ParseFloat(strings.TrimSpace(string(data)), 64)
+	if err != nil || speed <= 0 {
+		return 0, fmt.Errorf("link speed of %s is unknown", iface)
+	}
+	return speed, nil
 }
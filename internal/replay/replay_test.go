@@ -0,0 +1,151 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+	"github.com/google/gopacket/pcapgo"
+
+	"genflux/internal/clock"
+)
+
+// writeCapture writes n 60-byte frames, gap apart, to a pcap in dir.
+func writeCapture(t *testing.T, dir string, n int, gap time.Duration) string {
+	t.Helper()
+	path := filepath.Join(dir, "in.pcap")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := pcapgo.NewWriter(f)
+	if err := w.WriteFileHeader(65535, layers.LinkTypeEthernet); err != nil {
+		t.Fatal(err)
+	}
+	frame := make([]byte, 60)
+	ts := time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i := 0; i < n; i++ {
+		ci := gopacket.CaptureInfo{Timestamp: ts.Add(time.Duration(i) * gap), CaptureLength: len(frame), Length: len(frame)}
+		if err := w.WritePacket(ci, frame); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return path
+}
+
+// TestReplayVirtualClock runs hours of pacing on a virtual clock and
+// checks where the clock stands once the replay is done.
+func TestReplayVirtualClock(t *testing.T) {
+	tests := []struct {
+		name    string
+		packets int
+		gap     time.Duration
+		cfg     Config
+		want    time.Duration
+	}{
+		{"timestamp", 7, 30 * time.Minute, Config{Mode: ModeTimestamp, Loop: 2}, 6 * time.Hour},
+		{"timestamp speed", 7, 30 * time.Minute, Config{Mode: ModeTimestamp, Speed: 4, Loop: 1}, 45 * time.Minute},
+		{"pps", 3600, time.Millisecond, Config{Mode: ModePps, Pps: 1, Loop: 1}, 3599 * time.Second},
+		// 1800 packets take the first half hour at 1 pps; the other 3600
+		// go at 2 pps.
+		{"rate schedule", 5400, time.Millisecond, Config{Mode: ModePps, Loop: 1, RateSchedule: []RatePoint{{0, 1}, {30 * time.Minute, 2}}},
+			time.Hour - 500*time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+			clk := clock.NewVirtual(start)
+			var out bytes.Buffer
+			cfg := tt.cfg
+			cfg.InPath = writeCapture(t, t.TempDir(), tt.packets, tt.gap)
+			cfg.DryRun = true
+			cfg.Clock = clk
+			cfg.Out = &out
+			if err := Replay(context.Background(), cfg); err != nil {
+				t.Fatalf("replay: %v\n%s", err, out.String())
+			}
+			// Every pass leaves its last wait the slack short, for the
+			// sender to finish.
+			if got := clk.Now().Sub(start); got > tt.want || got < tt.want-time.Duration(cfg.Loop)*interruptSlack {
+				t.Errorf("replay ended %v in, want %v", got, tt.want)
+			}
+			if !strings.Contains(out.String(), "Projected duration: "+tt.want.String()) {
+				t.Errorf("dry run report does not project %v:\n%s", tt.want, out.String())
+			}
+		})
+	}
+}
+
+// batchSender holds frames until size of them are due, as the sendmmsg
+// sender does, and counts those handed on.
+type batchSender struct {
+	size      int
+	pending   int
+	delivered int64
+}
+
+func (b *batchSender) send(data []byte, at time.Time) error {
+	if b.pending++; b.pending == b.size {
+		b.delivered += int64(b.pending)
+		b.pending = 0
+	}
+	return nil
+}
+
+func (b *batchSender) flush() error {
+	b.delivered += int64(b.pending)
+	b.pending = 0
+	return nil
+}
+
+func (b *batchSender) Close() error { return nil }
+
+// sliceSource replays n 60-byte frames 1ms apart.
+type sliceSource struct {
+	n, i int
+	ts   time.Time
+}
+
+func (s *sliceSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if s.i == s.n {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	s.i++
+	ts := s.ts.Add(time.Duration(s.i) * time.Millisecond)
+	return make([]byte, 60), gopacket.CaptureInfo{Timestamp: ts, CaptureLength: 60, Length: 60}, nil
+}
+
+func (s *sliceSource) Close() error { return nil }
+
+// TestReplayLimitFlushes stops a replay on --limit part way through a
+// sender's batch and checks that every frame counted was handed on.
+func TestReplayLimitFlushes(t *testing.T) {
+	for _, limit := range []int{1, 31, 45, 100} {
+		clk := clock.NewVirtual(time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC))
+		intr := watchInterrupt(context.Background(), clk)
+		sender := &batchSender{size: 32}
+		run := &replayRun{sender: sender, budget: &errorBudget{}, skipped: map[string]bool{}, intr: intr, clock: clk, start: clk.Now()}
+		cfg := Config{Mode: ModeTopSpeed, Loop: 3, Limit: limit, StatsInterval: time.Second}
+		newPass := func() (packetSource, error) {
+			return &sliceSource{n: 40, ts: time.Date(2023, 6, 1, 12, 0, 0, 0, time.UTC)}, nil
+		}
+		if err := run.loop(cfg, newPass, io.Discard); err != nil {
+			t.Fatalf("limit %d: %v", limit, err)
+		}
+		intr.Close()
+		if got := run.total.Snapshot().Packets; got != int64(limit) {
+			t.Errorf("limit %d: %d frames counted", limit, got)
+		}
+		if sender.delivered != int64(limit) {
+			t.Errorf("limit %d: %d frames reached the sender, want %d", limit, sender.delivered, limit)
+		}
+	}
+}
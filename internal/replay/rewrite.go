@@ -0,0 +1,217 @@
+package replay
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Rewrite retargets packets at a device under test as they are sent:
+// addresses move into the test subnets and frames go to its MAC. IP and L4
+// checksums are updated to match.
+type Rewrite struct {
+	// SrcIP and DstIP map source and destination addresses; IP maps both,
+	// for addresses SrcIP or DstIP left alone. The first matching map
+	// applies.
+	SrcIP []IPMap
+	DstIP []IPMap
+	IP    []IPMap
+	// SrcMAC and DstMAC, when set, replace the Ethernet addresses of every
+	// frame.
+	SrcMAC net.HardwareAddr
+	DstMAC net.HardwareAddr
+}
+
+func (r Rewrite) enabled() bool {
+	return len(r.SrcIP)+len(r.DstIP)+len(r.IP) > 0 || r.SrcMAC != nil || r.DstMAC != nil
+}
+
+// IPMap moves the addresses within From into To, keeping the host bits To
+// leaves room for: 10.1.2.3 mapped from 10.0.0.0/8 to 198.18.0.0/15 is
+// 198.19.2.3, and every address mapped to a /32 becomes that address.
+type IPMap struct {
+	From *net.IPNet
+	To   *net.IPNet
+}
+
+// ParseIPMaps parses a comma-separated list of FROM=TO maps, where either
+// side is a CIDR or an address, or a lone address that every address of
+// its family maps to.
+func ParseIPMaps(value string) ([]IPMap, error) {
+	var maps []IPMap
+	for _, part := range strings.Split(value, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		from, to, ok := strings.Cut(part, "=")
+		if !ok {
+			from, to = "", part
+		}
+		var m IPMap
+		var err error
+		if m.To, err = parseIPNet(to); err != nil {
+			return nil, err
+		}
+		if from == "" {
+			m.From = &net.IPNet{IP: make(net.IP, len(m.To.IP)), Mask: net.CIDRMask(0, 8*len(m.To.IP))}
+		} else if m.From, err = parseIPNet(from); err != nil {
+			return nil, err
+		}
+		if len(m.From.IP) != len(m.To.IP) {
+			return nil, fmt.Errorf("%q maps between IPv4 and IPv6", part)
+		}
+		maps = append(maps, m)
+	}
+	if len(maps) == 0 {
+		return nil, errors.New("empty address map")
+	}
+	return maps, nil
+}
+
+// parseIPNet parses a CIDR or a single address, normalising IPv4 to four
+// bytes.
+func parseIPNet(value string) (*net.IPNet, error) {
+	value = strings.TrimSpace(value)
+	if strings.Contains(value, "/") {
+		ip, n, err := net.ParseCIDR(value)
+		if err != nil {
+			return nil, err
+		}
+		if ip4 := n.IP.To4(); ip4 != nil && ip.To4() != nil {
+			n.IP = ip4
+		}
+		return n, nil
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("invalid address %q", value)
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
+
+// mapAddr rewrites ip in place by the first of maps that contains it.
+func mapAddr(maps []IPMap, ip []byte) bool {
+	for _, m := range maps {
+		if len(m.From.IP) != len(ip) || !m.From.Contains(ip) {
+			continue
+		}
+		for i := range ip {
+			ip[i] = m.To.IP[i]&m.To.Mask[i] | ip[i]&^m.To.Mask[i]
+		}
+		return true
+	}
+	return false
+}
+
+// rewriter applies a Rewrite to frames in place.
+type rewriter struct {
+	cfg     Rewrite
+	parser  *gopacket.DecodingLayerParser
+	eth     layers.Ethernet
+	dot1q   layers.Dot1Q
+	ip4     layers.IPv4
+	ip6     layers.IPv6
+	decoded []gopacket.LayerType
+	old     [16]byte
+}
+
+func newRewriter(cfg Rewrite) *rewriter {
+	if !cfg.enabled() {
+		return nil
+	}
+	w := &rewriter{cfg: cfg}
+	w.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &w.eth, &w.dot1q, &w.ip4, &w.ip6)
+	w.parser.IgnoreUnsupported = true
+	return w
+}
+
+// rewrite retargets data in place. Only the outer IP header of a tunnel is
+// rewritten; frames without one only get their MACs replaced.
+func (w *rewriter) rewrite(data []byte) {
+	if len(data) < 14 {
+		return
+	}
+	if w.cfg.DstMAC != nil {
+		copy(data[0:6], w.cfg.DstMAC)
+	}
+	if w.cfg.SrcMAC != nil {
+		copy(data[6:12], w.cfg.SrcMAC)
+	}
+	w.decoded = w.decoded[:0]
+	_ = w.parser.DecodeLayers(data, &w.decoded)
+	for _, lt := range w.decoded {
+		switch lt {
+		case layers.LayerTypeIPv4:
+			hdr := w.ip4.Contents
+			var l4 []byte
+			if w.ip4.FragOffset == 0 {
+				l4 = w.ip4.Payload
+			}
+			w.address(hdr[12:16], w.cfg.SrcIP, hdr, l4, w.ip4.Protocol)
+			w.address(hdr[16:20], w.cfg.DstIP, hdr, l4, w.ip4.Protocol)
+			return
+		case layers.LayerTypeIPv6:
+			hdr := w.ip6.Contents
+			w.address(hdr[8:24], w.cfg.SrcIP, nil, w.ip6.Payload, w.ip6.NextHeader)
+			w.address(hdr[24:40], w.cfg.DstIP, nil, w.ip6.Payload, w.ip6.NextHeader)
+			return
+		}
+	}
+}
+
+// address maps the address at ip by maps, or failing them the maps of
+// both directions, and updates the IPv4 header checksum in hdr and the
+// checksum of the L4 segment l4 of proto, which covers the address too.
+// l4 is nil for non-first fragments, whose segment header is elsewhere.
+func (w *rewriter) address(ip []byte, maps []IPMap, hdr, l4 []byte, proto layers.IPProtocol) {
+	old := w.old[:len(ip)]
+	copy(old, ip)
+	if !mapAddr(maps, ip) && !mapAddr(w.cfg.IP, ip) {
+		return
+	}
+	if hdr != nil {
+		adjustChecksum(hdr[10:12], old, ip)
+	}
+	off := -1
+	switch proto {
+	case layers.IPProtocolTCP:
+		off = 16
+	case layers.IPProtocolUDP:
+		off = 6
+		if hdr != nil && len(l4) >= 8 && binary.BigEndian.Uint16(l4[6:8]) == 0 {
+			// An IPv4 UDP datagram without a checksum.
+			off = -1
+		}
+	case layers.IPProtocolICMPv6:
+		off = 2
+	}
+	if off >= 0 && len(l4) >= off+2 {
+		adjustChecksum(l4[off:off+2], old, ip)
+		if proto == layers.IPProtocolUDP && binary.BigEndian.Uint16(l4[off:]) == 0 {
+			binary.BigEndian.PutUint16(l4[off:], 0xffff)
+		}
+	}
+}
+
+// adjustChecksum updates the internet checksum in sum for a change of the
+// 16-bit words old to new elsewhere in the data it covers (RFC 1624).
+func adjustChecksum(sum []byte, old, new []byte) {
+	acc := uint32(^binary.BigEndian.Uint16(sum))
+	for i := 0; i+1 < len(old); i += 2 {
+		acc += uint32(^binary.BigEndian.Uint16(old[i:]))
+		acc += uint32(binary.BigEndian.Uint16(new[i:]))
+	}
+	for acc > 0xffff {
+		acc = (acc >> 16) + (acc & 0xffff)
+	}
+	binary.BigEndian.PutUint16(sum, ^uint16(acc))
+}
@@ -0,0 +1,171 @@
+//go:build linux
+
+package replay
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ringFrames    = 4096
+	ringBlockSize = 1 << 16
+	// ringBatch is how many frames are queued before the kernel is kicked.
+	ringBatch = 64
+	// ringKickSlack: when the next frame is due later than this, frames
+	// already queued are kicked out instead of waiting for a full batch.
+	ringKickSlack = 20 * time.Microsecond
+	// ringDataOffset is where frame data starts in a TPACKET_V2 TX slot:
+	// the aligned header, as the kernel expects without PACKET_TX_HAS_OFF.
+	ringDataOffset = (int(unsafe.Sizeof(unix.Tpacket2Hdr{})) + unix.TPACKET_ALIGNMENT - 1) &^ (unix.TPACKET_ALIGNMENT - 1)
+)
+
+// ringSender transmits through a PACKET_MMAP TX ring (TPACKET_V2): frames
+// are copied into shared slots and the kernel is kicked once per batch
+// rather than entered once per frame.
+type ringSender struct {
+	*afPacketSender
+	ring      []byte
+	frameSize int
+	head      int
+	pending   int
+}
+
+func newRingSender(cfg Config, name string) (*ringSender, error) {
+	if cfg.TxTime {
+		return nil, fmt.Errorf("txtime is not supported with the ring backend")
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	base, err := newAFPacketSender(cfg, name)
+	if err != nil {
+		return nil, err
+	}
+	s := &ringSender{afPacketSender: base, frameSize: ringFrameSize(iface.MTU)}
+	if err := unix.SetsockoptInt(s.fd, unix.SOL_PACKET, unix.PACKET_VERSION, unix.TPACKET_V2); err != nil {
+		base.Close()
+		return nil, fmt.Errorf("set TPACKET_V2: %v", err)
+	}
+	req := unix.TpacketReq{
+		Block_size: uint32(max(ringBlockSize, s.frameSize)),
+		Frame_size: uint32(s.frameSize),
+		Frame_nr:   ringFrames,
+	}
+	req.Block_nr = req.Frame_nr * req.Frame_size / req.Block_size
+	if err := unix.SetsockoptTpacketReq(s.fd, unix.SOL_PACKET, unix.PACKET_TX_RING, &req); err != nil {
+		base.Close()
+		return nil, fmt.Errorf("set PACKET_TX_RING: %v", err)
+	}
+	s.ring, err = unix.Mmap(s.fd, 0, int(req.Block_nr*req.Block_size), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED)
+	if err != nil {
+		base.Close()
+		return nil, fmt.Errorf("mmap TX ring: %v", err)
+	}
+	return s, nil
+}
+
+// ringFrameSize returns the smallest power-of-two slot that holds a
+// VLAN-tagged frame of the interface MTU.
+func ringFrameSize(mtu int) int {
+	size := 2048
+	for size < ringDataOffset+14+4+mtu {
+		size *= 2
+	}
+	return size
+}
+
+func (s *ringSender) status(slot int) *uint32 {
+	return (*uint32)(unsafe.Pointer(&s.ring[slot*s.frameSize]))
+}
+
+func (s *ringSender) send(data []byte, at time.Time) error {
+	if len(data) > s.frameSize-ringDataOffset {
+		return fmt.Errorf("frame of %d bytes does not fit a %d byte TX ring slot", len(data), s.frameSize)
+	}
+	if s.pending > 0 && time.Until(at) > ringKickSlack {
+		// Nothing else is due before at, so let the queued frames go.
+		if err := s.kick(unix.MSG_DONTWAIT); err != nil {
+			return err
+		}
+	}
+	s.sched.waitUntil(at)
+	if err := s.waitSlot(s.head); err != nil {
+		return err
+	}
+	off := s.head * s.frameSize
+	hdr := (*unix.Tpacket2Hdr)(unsafe.Pointer(&s.ring[off]))
+	hdr.Len = uint32(len(data))
+	copy(s.ring[off+ringDataOffset:], data)
+	atomic.StoreUint32(s.status(s.head), unix.TP_STATUS_SEND_REQUEST)
+	s.head = (s.head + 1) % ringFrames
+	s.pending++
+	if s.pending >= ringBatch {
+		return s.kick(unix.MSG_DONTWAIT)
+	}
+	return nil
+}
+
+// waitSlot waits until the kernel has released slot.
+func (s *ringSender) waitSlot(slot int) error {
+	for {
+		switch st := atomic.LoadUint32(s.status(slot)); {
+		case st == unix.TP_STATUS_AVAILABLE:
+			return nil
+		case st&unix.TP_STATUS_WRONG_FORMAT != 0:
+			return fmt.Errorf("kernel rejected a frame in the TX ring")
+		}
+		if s.pending > 0 {
+			if err := s.kick(unix.MSG_DONTWAIT); err != nil {
+				return err
+			}
+		}
+		fds := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLOUT}}
+		if _, err := unix.Poll(fds, 1); err != nil && err != unix.EINTR {
+			return err
+		}
+	}
+}
+
+// kick asks the kernel to transmit the queued slots.
+func (s *ringSender) kick(flags int) error {
+	s.pending = 0
+	for {
+		err := unix.Sendto(s.fd, nil, flags, nil)
+		switch err {
+		case nil, unix.EAGAIN:
+			return nil
+		case unix.EINTR:
+			continue
+		default:
+			return fmt.Errorf("kick TX ring: %v", err)
+		}
+	}
+}
+
+// flush transmits everything queued and waits for the ring to drain.
+func (s *ringSender) flush() error {
+	if err := s.kick(0); err != nil {
+		return err
+	}
+	for slot := 0; slot < ringFrames; slot++ {
+		if err := s.waitSlot(slot); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ringSender) Close() error {
+	if s.ring != nil {
+		unix.Munmap(s.ring)
+		s.ring = nil
+	}
+	return s.afPacketSender.Close()
+}
@@ -0,0 +1,76 @@
+package replay
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// SchedPolicy is how a replay waits for the time each packet is due.
+type SchedPolicy string
+
+const (
+	// SchedHybrid sleeps until Config.SpinThreshold before a packet is
+	// due and spins through the rest: precise, at the cost of spinning
+	// once per packet.
+	SchedHybrid SchedPolicy = "hybrid"
+	// SchedSleep only sleeps, until the packet is due; packets due within
+	// Config.SpinThreshold go at once, in a batch with the one before, so
+	// a low-rate replay barely uses the CPU.
+	SchedSleep SchedPolicy = "sleep"
+	// SchedBusy never sleeps, spinning through every wait for the least
+	// jitter. It keeps a core busy for the whole replay.
+	SchedBusy SchedPolicy = "busy"
+)
+
+// DefaultSpinThreshold is the Config.SpinThreshold of 0.
+const DefaultSpinThreshold = 150 * time.Microsecond
+
+func ParseSchedPolicy(value string) (SchedPolicy, error) {
+	switch p := SchedPolicy(strings.ToLower(strings.TrimSpace(value))); p {
+	case "":
+		return SchedHybrid, nil
+	case SchedHybrid, SchedSleep, SchedBusy:
+		return p, nil
+	default:
+		return "", fmt.Errorf("unknown sched policy %q (want sleep|hybrid|busy)", value)
+	}
+}
+
+// scheduler waits for the deadlines of packets by a policy. Deadlines are
+// absolute, so time lost oversleeping one is made up on the next ones.
+type scheduler struct {
+	policy SchedPolicy
+	spin   time.Duration
+}
+
+func newScheduler(cfg Config) scheduler {
+	s := scheduler{policy: cfg.SchedPolicy, spin: cfg.SpinThreshold}
+	if s.policy == "" {
+		s.policy = SchedHybrid
+	}
+	if s.spin == 0 {
+		s.spin = DefaultSpinThreshold
+	}
+	return s
+}
+
+// waitUntil returns once target is reached, or is within the spin
+// threshold with the sleep policy.
+func (s scheduler) waitUntil(target time.Time) {
+	d := time.Until(target)
+	switch s.policy {
+	case SchedBusy:
+	case SchedSleep:
+		if d > s.spin {
+			time.Sleep(d)
+		}
+		return
+	default:
+		if d > s.spin {
+			time.Sleep(d - s.spin)
+		}
+	}
+	for time.Until(target) > 0 {
+	}
+}
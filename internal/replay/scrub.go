@@ -0,0 +1,205 @@
+package replay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"strings"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// ScrubMode controls how L4 payloads are rewritten before transmission.
+type ScrubMode string
+
+const (
+	ScrubNone   ScrubMode = ""
+	ScrubZero   ScrubMode = "zero"
+	ScrubRandom ScrubMode = "random"
+)
+
+func ParseScrubMode(value string) (ScrubMode, error) {
+	switch ScrubMode(strings.ToLower(strings.TrimSpace(value))) {
+	case ScrubNone, "none":
+		return ScrubNone, nil
+	case ScrubZero:
+		return ScrubZero, nil
+	case ScrubRandom:
+		return ScrubRandom, nil
+	default:
+		return ScrubNone, fmt.Errorf("unknown scrub mode %q (want zero|random)", value)
+	}
+}
+
+// scrubber overwrites L4 payloads in place, keeping frame lengths, and
+// recomputes TCP/UDP/ICMP checksums.
+type scrubber struct {
+	mode    ScrubMode
+	rand    *rand.Rand
+	parser  *gopacket.DecodingLayerParser
+	eth     layers.Ethernet
+	dot1q   layers.Dot1Q
+	ip4     layers.IPv4
+	ip6     layers.IPv6
+	tcp     layers.TCP
+	udp     layers.UDP
+	icmp4   layers.ICMPv4
+	icmp6   layers.ICMPv6
+	payload gopacket.Payload
+	decoded []gopacket.LayerType
+}
+
+func newScrubber(mode ScrubMode) *scrubber {
+	s := &scrubber{mode: mode, rand: rand.New(rand.NewSource(1))}
+	s.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet,
+		&s.eth, &s.dot1q, &s.ip4, &s.ip6, &s.tcp, &s.udp, &s.icmp4, &s.icmp6, &s.payload)
+	s.parser.IgnoreUnsupported = true
+	return s
+}
+
+// scrub rewrites data, a frame of length bytes on the wire, in place.
+// Frames it cannot parse are left untouched.
+func (s *scrubber) scrub(data []byte, length int) {
+	s.decoded = s.decoded[:0]
+	_ = s.parser.DecodeLayers(data, &s.decoded)
+
+	var (
+		network   gopacket.LayerType
+		transport gopacket.LayerType
+		l4        []byte
+		fragment  bool
+	)
+	for _, lt := range s.decoded {
+		switch lt {
+		case layers.LayerTypeIPv4:
+			network = lt
+			fragment = s.ip4.Flags&layers.IPv4MoreFragments != 0 || s.ip4.FragOffset != 0
+		case layers.LayerTypeIPv6:
+			network = lt
+		case layers.LayerTypeTCP:
+			transport, l4 = lt, s.tcp.Contents
+		case layers.LayerTypeUDP:
+			transport, l4 = lt, s.udp.Contents
+		case layers.LayerTypeICMPv4:
+			transport, l4 = lt, s.icmp4.Contents
+		case layers.LayerTypeICMPv6:
+			transport, l4 = lt, s.icmp6.Contents
+		}
+	}
+	if network == 0 {
+		return
+	}
+	if fragment && s.ip4.FragOffset != 0 {
+		// Non-first fragment: everything after the IP header is payload.
+		s.fill(s.ip4.Payload)
+		return
+	}
+	if transport == 0 {
+		return
+	}
+
+	start := offsetIn(data, l4)
+	segment := data[start : start+len(l4)+payloadLen(transport, s)]
+	hdr := len(l4)
+	if transport == layers.LayerTypeICMPv6 && len(segment) >= 8 {
+		// Keep the echo identifier/sequence or message-specific header.
+		hdr = 8
+	}
+	s.fill(segment[hdr:])
+	if fragment || len(data) < length {
+		// The checksum covers the whole datagram, which we cannot see.
+		return
+	}
+
+	var pseudo []byte
+	switch network {
+	case layers.LayerTypeIPv4:
+		pseudo = pseudoHeader(s.ip4.SrcIP.To4(), s.ip4.DstIP.To4(), uint8(s.ip4.Protocol), len(segment))
+	case layers.LayerTypeIPv6:
+		pseudo = pseudoHeader(s.ip6.SrcIP, s.ip6.DstIP, uint8(s.ip6.NextHeader), len(segment))
+	}
+	switch transport {
+	case layers.LayerTypeTCP:
+		writeChecksum(segment, 16, pseudo)
+	case layers.LayerTypeUDP:
+		if network == layers.LayerTypeIPv4 && binary.BigEndian.Uint16(segment[6:8]) == 0 {
+			return
+		}
+		writeChecksum(segment, 6, pseudo)
+		if binary.BigEndian.Uint16(segment[6:8]) == 0 {
+			binary.BigEndian.PutUint16(segment[6:8], 0xffff)
+		}
+	case layers.LayerTypeICMPv4:
+		writeChecksum(segment, 2, nil)
+	case layers.LayerTypeICMPv6:
+		writeChecksum(segment, 2, pseudo)
+	}
+}
+
+func payloadLen(transport gopacket.LayerType, s *scrubber) int {
+	switch transport {
+	case layers.LayerTypeTCP:
+		return len(s.tcp.Payload)
+	case layers.LayerTypeUDP:
+		return len(s.udp.Payload)
+	case layers.LayerTypeICMPv4:
+		return len(s.icmp4.Payload)
+	case layers.LayerTypeICMPv6:
+		return len(s.icmp6.Payload)
+	}
+	return 0
+}
+
+func (s *scrubber) fill(b []byte) {
+	if s.mode == ScrubRandom {
+		s.rand.Read(b)
+		return
+	}
+	for i := range b {
+		b[i] = 0
+	}
+}
+
+// offsetIn returns the offset of sub within data; sub must be a subslice
+// of data, as gopacket layer contents are.
+func offsetIn(data, sub []byte) int {
+	return cap(data) - cap(sub)
+}
+
+func pseudoHeader(src, dst []byte, proto uint8, length int) []byte {
+	h := make([]byte, 0, 40)
+	h = append(h, src...)
+	h = append(h, dst...)
+	if len(src) == 4 {
+		h = append(h, 0, proto)
+		return binary.BigEndian.AppendUint16(h, uint16(length))
+	}
+	h = binary.BigEndian.AppendUint32(h, uint32(length))
+	return append(h, 0, 0, 0, proto)
+}
+
+// writeChecksum recomputes the internet checksum of segment (plus optional
+// pseudo header) and stores it at offset off.
+func writeChecksum(segment []byte, off int, pseudo []byte) {
+	if len(segment) < off+2 {
+		return
+	}
+	segment[off], segment[off+1] = 0, 0
+	sum := onesSum(0, pseudo)
+	sum = onesSum(sum, segment)
+	for sum > 0xffff {
+		sum = (sum >> 16) + (sum & 0xffff)
+	}
+	binary.BigEndian.PutUint16(segment[off:], ^uint16(sum))
+}
+
+func onesSum(sum uint32, b []byte) uint32 {
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	return sum
+}
@@ -0,0 +1,174 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+
+	"genflux/internal/clock"
+)
+
+// searchSettle is how long a trial waits after its last frame before the
+// receive counter is read, for frames still in flight.
+const searchSettle = 500 * time.Millisecond
+
+// validateSearch fills in the search defaults and checks the bounds.
+func validateSearch(cfg *Config, ifaces []string) error {
+	if cfg.MonitorIface == "" {
+		return errors.New("mode=search requires monitor-iface")
+	}
+	if cfg.LinkFraction > 0 {
+		return errors.New("link-fraction cannot be combined with mode=search")
+	}
+	if cfg.SearchMax <= 0 {
+		for _, name := range ifaces {
+			speed, err := LinkSpeedMbps(name)
+			if err != nil {
+				return fmt.Errorf("%v; set search-max", err)
+			}
+			cfg.SearchMax += speed
+		}
+	}
+	if cfg.SearchMin < 0 || cfg.SearchMin >= cfg.SearchMax {
+		return errors.New("search-min must be within [0, search-max)")
+	}
+	if cfg.SearchResolution <= 0 {
+		cfg.SearchResolution = cfg.SearchMax / 100
+	}
+	if cfg.LossTolerance < 0 || cfg.LossTolerance >= 1 {
+		return errors.New("loss-tolerance must be within [0,1)")
+	}
+	if cfg.TrialDuration <= 0 {
+		cfg.TrialDuration = 10 * time.Second
+	}
+	return nil
+}
+
+// searchThroughput finds the highest rate at which the monitored receiver
+// sees no more loss than LossTolerance. The maximum is tried first; after
+// that the rate is bisected until the bracket is narrower than the
+// resolution.
+func searchThroughput(run *replayRun, cfg Config, newPass func() (packetSource, error), out io.Writer) error {
+	fmt.Fprintf(out, "Searching %.2f-%.2f Mbps (resolution %.2f Mbps, loss tolerance %g, %s trials, monitor %s)\n",
+		cfg.SearchMin, cfg.SearchMax, cfg.SearchResolution, cfg.LossTolerance, cfg.TrialDuration, cfg.MonitorIface)
+	trials := 0
+	trial := func(mbps float64) (bool, error) {
+		trials++
+		sent, received, err := runTrial(run, cfg, mbps, newPass)
+		if err != nil {
+			return false, err
+		}
+		loss := 0.0
+		if received < sent {
+			loss = float64(sent-received) / float64(sent)
+		}
+		pass := sent > 0 && loss <= cfg.LossTolerance
+		verdict := "pass"
+		if !pass {
+			verdict = "loss"
+		}
+		fmt.Fprintf(out, "Trial %d: %.2f Mbps sent=%d received=%d loss=%.4f%% %s\n", trials, mbps, sent, received, loss*100, verdict)
+		return pass, nil
+	}
+
+	lo, hi := cfg.SearchMin, cfg.SearchMax
+	pass, err := trial(hi)
+	if err != nil {
+		return err
+	}
+	if pass {
+		fmt.Fprintf(out, "Throughput: %.2f Mbps (search-max, no loss)\n", hi)
+		return nil
+	}
+	found := false
+	for hi-lo > cfg.SearchResolution {
+		mid := (lo + hi) / 2
+		if pass, err = trial(mid); err != nil {
+			return err
+		}
+		if pass {
+			lo, found = mid, true
+		} else {
+			hi = mid
+		}
+	}
+	if !found {
+		lowest := hi
+		if lo > 0 {
+			if found, err = trial(lo); err != nil {
+				return err
+			}
+			lowest = lo
+		}
+		if !found {
+			return fmt.Errorf("loss at every rate tried, down to %.2f Mbps", lowest)
+		}
+	}
+	fmt.Fprintf(out, "Throughput: %.2f Mbps (loss at %.2f Mbps)\n", lo, hi)
+	return nil
+}
+
+// runTrial replays the input at mbps for the trial duration, looping it
+// as needed, and returns the frames sent and the frames the monitored
+// interface received meanwhile.
+func runTrial(run *replayRun, cfg Config, mbps float64, newPass func() (packetSource, error)) (sent, received int64, err error) {
+	cfg.Mode, cfg.Mbps = ModeMbps, mbps
+	before, err := ifaceCounter(cfg.MonitorIface, "rx_packets")
+	if err != nil {
+		return 0, 0, err
+	}
+	deadline := run.clock.Now().Add(cfg.TrialDuration)
+	for run.clock.Now().Before(deadline) {
+		src, err := newPass()
+		if err != nil {
+			return sent, 0, err
+		}
+		n, err := run.pass(cfg, &deadlineSource{packetSource: src, deadline: deadline, clock: run.clock}, io.Discard)
+		src.Close()
+		sent += n
+		if err != nil {
+			return sent, 0, err
+		}
+		run.passes++
+		if n == 0 {
+			break
+		}
+	}
+	time.Sleep(searchSettle)
+	after, err := ifaceCounter(cfg.MonitorIface, "rx_packets")
+	if err != nil {
+		return sent, 0, err
+	}
+	return sent, after - before, nil
+}
+
+// deadlineSource ends a pass early once deadline has passed.
+type deadlineSource struct {
+	packetSource
+	deadline time.Time
+	clock    clock.Clock
+}
+
+func (s *deadlineSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	if !s.clock.Now().Before(s.deadline) {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	return s.packetSource.ReadPacketData()
+}
+
+// ifaceCounter reads the statistics counter name of iface from sysfs,
+// e.g. rx_packets.
+func ifaceCounter(iface, name string) (int64, error) {
+	data, err := os.ReadFile(filepath.Join("/sys/class/net", iface, "statistics", name))
+	if err != nil {
+		return 0, fmt.Errorf("read %s counter of %s: %v", name, iface, err)
+	}
+	return strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+}
@@ -0,0 +1,175 @@
+//go:build linux
+
+package replay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// defaultSndBuf is the socket send buffer asked for when Config.SndBuf
+// is 0.
+const defaultSndBuf = 16 * 1024 * 1024
+
+// DefaultBackend is the TX backend of an empty Config.TxBackend.
+const DefaultBackend = BackendSocket
+
+// openBackend opens the configured backend on interface name.
+func openBackend(cfg Config, name string) (transmitter, error) {
+	switch cfg.TxBackend {
+	case BackendPcap:
+		return nil, fmt.Errorf("tx backend pcap is for macOS and Windows; use socket, ring or xdp on linux")
+	case BackendRing:
+		return newRingSender(cfg, name)
+	case BackendXDP:
+		return newXDPSender(cfg, name)
+	default:
+		return newAFPacketSender(cfg, name)
+	}
+}
+
+// afPacketSender transmits raw frames on an AF_PACKET socket bound to one
+// interface.
+type afPacketSender struct {
+	fd    int
+	addr  *unix.SockaddrLinklayer
+	sched scheduler
+
+	// With txtime the kernel (ETF qdisc) releases each frame at its
+	// scheduled time; userspace only has to hand it over lead early.
+	txtime    bool
+	lead      time.Duration
+	taiOffset time.Duration
+	oob       []byte
+
+	// batch, when set, queues frames for sendmmsg.
+	batch *batch
+}
+
+func newAFPacketSender(cfg Config, name string) (*afPacketSender, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+
+	fd, err := unix.Socket(unix.AF_PACKET, unix.SOCK_RAW, int(htons(unix.ETH_P_ALL)))
+	if err != nil {
+		return nil, err
+	}
+	s := &afPacketSender{fd: fd, sched: newScheduler(cfg)}
+
+	// Increase socket buffer size for better throughput
+	sndbuf := cfg.SndBuf
+	if sndbuf <= 0 {
+		sndbuf = defaultSndBuf
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUF, sndbuf); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("set SO_SNDBUF: %v", err)
+	}
+	if err := unix.SetsockoptInt(fd, unix.SOL_SOCKET, unix.SO_SNDBUFFORCE, sndbuf); err != nil {
+		// SO_SNDBUFFORCE may fail due to permissions, ignore; the buffer
+		// is then capped at net.core.wmem_max
+	}
+
+	if cfg.QdiscBypass {
+		if cfg.TxTime {
+			s.Close()
+			return nil, fmt.Errorf("qdisc-bypass skips the etf qdisc that txtime needs")
+		}
+		if err := unix.SetsockoptInt(fd, unix.SOL_PACKET, unix.PACKET_QDISC_BYPASS, 1); err != nil {
+			s.Close()
+			return nil, fmt.Errorf("set PACKET_QDISC_BYPASS: %v (requires Linux >= 3.14)", err)
+		}
+	}
+
+	s.addr = &unix.SockaddrLinklayer{Protocol: htons(unix.ETH_P_ALL), Ifindex: iface.Index}
+	if err := unix.Bind(fd, s.addr); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	if cfg.TxTime {
+		if cfg.SendBatch > 1 {
+			s.Close()
+			return nil, fmt.Errorf("send-batch does not apply with txtime, which sends every frame with its own deadline")
+		}
+		if err := s.enableTxTime(cfg.TxTimeLead); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	if n := sendBatch(cfg); n > 1 && (cfg.TxBackend == "" || cfg.TxBackend == BackendSocket) {
+		s.batch = newBatch(n, iface.MTU)
+	}
+	return s, nil
+}
+
+func (s *afPacketSender) enableTxTime(lead time.Duration) error {
+	// struct sock_txtime { __kernel_clockid_t clockid; __u32 flags; }
+	opt := make([]byte, 8)
+	binary.NativeEndian.PutUint32(opt[0:4], unix.CLOCK_TAI)
+	if err := unix.SetsockoptString(s.fd, unix.SOL_SOCKET, unix.SO_TXTIME, string(opt)); err != nil {
+		return fmt.Errorf("enable SO_TXTIME: %v (requires Linux >= 4.19)", err)
+	}
+
+	var tai, real unix.Timespec
+	if err := unix.ClockGettime(unix.CLOCK_TAI, &tai); err != nil {
+		return err
+	}
+	if err := unix.ClockGettime(unix.CLOCK_REALTIME, &real); err != nil {
+		return err
+	}
+	s.taiOffset = time.Duration(tai.Nano() - real.Nano()).Round(time.Second)
+
+	if lead <= 0 {
+		lead = 500 * time.Microsecond
+	}
+	s.txtime = true
+	s.lead = lead
+	s.oob = make([]byte, unix.CmsgSpace(8))
+	h := (*unix.Cmsghdr)(unsafe.Pointer(&s.oob[0]))
+	h.Level = unix.SOL_SOCKET
+	h.Type = unix.SCM_TXTIME
+	h.SetLen(unix.CmsgLen(8))
+	return nil
+}
+
+// send waits for the scheduled time and transmits data. With txtime it
+// only waits until lead before the deadline and passes the deadline to
+// the kernel; with a batch it queues data for sendmmsg.
+func (s *afPacketSender) send(data []byte, at time.Time) error {
+	if s.batch != nil {
+		return s.queue(data, at)
+	}
+	if !s.txtime {
+		s.sched.waitUntil(at)
+		return unix.Sendto(s.fd, data, 0, s.addr)
+	}
+	s.sched.waitUntil(at.Add(-s.lead))
+	txtime := uint64(at.UnixNano() + int64(s.taiOffset))
+	binary.NativeEndian.PutUint64(s.oob[unix.CmsgLen(0):], txtime)
+	return unix.Sendmsg(s.fd, data, s.oob, s.addr, 0)
+}
+
+// flush sends what the batch holds. Without one it is a no-op: send
+// returns once the frame is handed to the kernel.
+func (s *afPacketSender) flush() error {
+	if s.batch != nil {
+		return s.flushBatch()
+	}
+	return nil
+}
+
+func (s *afPacketSender) Close() error {
+	return unix.Close(s.fd)
+}
+
+func htons(i uint16) uint16 {
+	return (i<<8)&0xff00 | i>>8
+}
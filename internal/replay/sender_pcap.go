@@ -0,0 +1,109 @@
+//go:build windows || (!linux && cgo)
+
+package replay
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket/pcap"
+)
+
+// DefaultBackend is the TX backend of an empty Config.TxBackend.
+const DefaultBackend = BackendPcap
+
+// openBackend opens the configured backend on interface name. Without
+// AF_PACKET only pcap is there.
+func openBackend(cfg Config, name string) (transmitter, error) {
+	switch cfg.TxBackend {
+	case "", BackendPcap:
+		return newPcapSender(cfg, name)
+	default:
+		return nil, fmt.Errorf("tx backend %s needs linux (AF_PACKET); use pcap", cfg.TxBackend)
+	}
+}
+
+// pcapSender injects frames with libpcap, or Npcap on Windows, one
+// pcap_sendpacket per frame.
+type pcapSender struct {
+	handle *pcap.Handle
+	iface  string
+	device string
+	sched  scheduler
+}
+
+func newPcapSender(cfg Config, name string) (*pcapSender, error) {
+	if cfg.TxTime {
+		return nil, fmt.Errorf("txtime is not supported with the pcap backend")
+	}
+	if cfg.SndBuf > 0 || cfg.QdiscBypass {
+		return nil, fmt.Errorf("sndbuf and qdisc-bypass do not apply to the pcap backend")
+	}
+	device, err := pcapDevice(name)
+	if err != nil {
+		return nil, err
+	}
+	// Only sending, so the capture side needs no more than a header.
+	handle, err := pcap.OpenLive(device, 128, false, time.Millisecond)
+	if err != nil {
+		return nil, fmt.Errorf("open %s with pcap: %v", name, err)
+	}
+	return &pcapSender{handle: handle, iface: name, device: device, sched: newScheduler(cfg)}, nil
+}
+
+// pcapDevice returns the pcap device of interface name. On macOS they are
+// the same; Npcap names devices \Device\NPF_{GUID}, so there name may also
+// be the interface's name as net knows it ("Ethernet"), matched by its
+// addresses, or the device's description.
+func pcapDevice(name string) (string, error) {
+	devs, err := pcap.FindAllDevs()
+	if err != nil {
+		return "", fmt.Errorf("list pcap devices: %v (is libpcap or Npcap installed?)", err)
+	}
+	for _, d := range devs {
+		if d.Name == name {
+			return d.Name, nil
+		}
+	}
+	if ifi, err := net.InterfaceByName(name); err == nil {
+		addrs, _ := ifi.Addrs()
+		for _, d := range devs {
+			for _, da := range d.Addresses {
+				for _, a := range addrs {
+					if ipn, ok := a.(*net.IPNet); ok && ipn.IP.Equal(da.IP) {
+						return d.Name, nil
+					}
+				}
+			}
+		}
+	}
+	for _, d := range devs {
+		if strings.EqualFold(d.Description, name) {
+			return d.Name, nil
+		}
+	}
+	return "", fmt.Errorf("no pcap device for interface %s", name)
+}
+
+func (s *pcapSender) describe() string {
+	if s.device != s.iface {
+		return fmt.Sprintf("pcap on %s (%s)", s.iface, s.device)
+	}
+	return fmt.Sprintf("pcap on %s", s.iface)
+}
+
+// send waits for the scheduled time and injects data.
+func (s *pcapSender) send(data []byte, at time.Time) error {
+	s.sched.waitUntil(at)
+	return s.handle.WritePacketData(data)
+}
+
+// flush is a no-op: send returns once the frame is handed to pcap.
+func (s *pcapSender) flush() error { return nil }
+
+func (s *pcapSender) Close() error {
+	s.handle.Close()
+	return nil
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !windows && !cgo
+
+package replay
+
+import (
+	"errors"
+)
+
+// DefaultBackend is the TX backend of an empty Config.TxBackend.
+const DefaultBackend = BackendPcap
+
+// openBackend fails: away from linux frames go through libpcap, which
+// needs cgo.
+func openBackend(cfg Config, name string) (transmitter, error) {
+	_, _ = cfg, name
+	return nil, errors.New("replay needs a build with cgo and libpcap on this platform (AF_PACKET is linux only); dry-run works without")
+}
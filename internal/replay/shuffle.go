@@ -0,0 +1,65 @@
+package replay
+
+import (
+	"io"
+	"math/rand"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// shuffleSource reorders packets within a sliding window to simulate
+// out-of-order delivery. Each packet sent is picked at random from the
+// next window packets, so none moves ahead by more than window-1 places.
+// Timestamps are handed out in their original order, so pacing is
+// unchanged and only which frame fills each slot differs. The order
+// depends only on the seed.
+type shuffleSource struct {
+	src     packetSource
+	window  int
+	rand    *rand.Rand
+	pending []shuffled
+	stamps  []time.Time
+	eof     bool
+}
+
+type shuffled struct {
+	data []byte
+	ci   gopacket.CaptureInfo
+}
+
+func newShuffleSource(src packetSource, window int, seed int64) *shuffleSource {
+	return &shuffleSource{src: src, window: window, rand: rand.New(rand.NewSource(seed))}
+}
+
+func (s *shuffleSource) ReadPacketData() ([]byte, gopacket.CaptureInfo, error) {
+	for !s.eof && len(s.pending) < s.window {
+		data, ci, err := s.src.ReadPacketData()
+		if err == io.EOF {
+			s.eof = true
+			break
+		}
+		if err != nil {
+			return nil, ci, err
+		}
+		// Sources may reuse their buffer between reads.
+		s.pending = append(s.pending, shuffled{data: append([]byte(nil), data...), ci: ci})
+		s.stamps = append(s.stamps, ci.Timestamp)
+	}
+	if len(s.pending) == 0 {
+		return nil, gopacket.CaptureInfo{}, io.EOF
+	}
+	i := s.rand.Intn(len(s.pending))
+	p := s.pending[i]
+	last := len(s.pending) - 1
+	s.pending[i] = s.pending[last]
+	s.pending = s.pending[:last]
+
+	p.ci.Timestamp = s.stamps[0]
+	s.stamps = s.stamps[1:]
+	return p.data, p.ci, nil
+}
+
+func (s *shuffleSource) Close() error {
+	return s.src.Close()
+}
@@ -0,0 +1,106 @@
+package replay
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// StatsFormat is how a replay writes its progress lines and summary.
+type StatsFormat string
+
+const (
+	// StatsText writes them as lines for people to read.
+	StatsText StatsFormat = "text"
+	// StatsJSON writes one JSON object per record, with a type of
+	// interval, pass or summary. Other messages stay text lines.
+	StatsJSON StatsFormat = "json"
+)
+
+func ParseStatsFormat(value string) (StatsFormat, error) {
+	switch StatsFormat(strings.ToLower(strings.TrimSpace(value))) {
+	case "", StatsText:
+		return StatsText, nil
+	case StatsJSON:
+		return StatsJSON, nil
+	default:
+		return "", fmt.Errorf("unknown stats format %q (want text|json)", value)
+	}
+}
+
+// statsRecord is one record of a replay's stats: the progress over an
+// interval, the end of a pass, or the summary of the replay.
+type statsRecord struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	// Elapsed counts from the start of the pass, or of the replay in a
+	// summary.
+	Elapsed float64 `json:"elapsed_sec"`
+	// Pass counts from 0; a summary gives the number of passes done.
+	Pass int `json:"pass"`
+	// Packets and Bytes are those of the pass, or of the replay in a
+	// summary. Mbps and Pps are the rates over the interval, or the
+	// averages of the pass or replay.
+	Packets int64   `json:"packets"`
+	Bytes   int64   `json:"bytes"`
+	Mbps    float64 `json:"mbps"`
+	Pps     float64 `json:"pps"`
+	// TotalPackets and TotalBytes count the replay so far, in intervals.
+	TotalPackets int64 `json:"total_packets,omitempty"`
+	TotalBytes   int64 `json:"total_bytes,omitempty"`
+	// SendErrors counts the sends that failed, their packets dropped, and
+	// SendRetries the sends retried.
+	SendErrors  int   `json:"send_errors"`
+	SendRetries int64 `json:"send_retries"`
+	// State is completed or interrupted, in a summary.
+	State string `json:"state,omitempty"`
+}
+
+// statsSink writes the stats records of a replay.
+type statsSink interface {
+	record(rec statsRecord)
+}
+
+func newStatsSink(format StatsFormat, w io.Writer) statsSink {
+	if format == StatsJSON {
+		return jsonStats{w: w}
+	}
+	return textStats{w: w}
+}
+
+type textStats struct {
+	w io.Writer
+}
+
+func (s textStats) record(rec statsRecord) {
+	switch rec.Type {
+	case "interval":
+		fmt.Fprintf(s.w, "%.2fs: %.2f Mbps %.2f pps total=%d\n", rec.Elapsed, rec.Mbps, rec.Pps, rec.Packets)
+	case "pass":
+		fmt.Fprintf(s.w, "Done: elapsed=%.2fs total=%d packets bits=%d\n", rec.Elapsed, rec.Packets, rec.Bytes*8)
+	case "summary":
+		fmt.Fprintf(s.w, "Summary (%s): packets=%d bytes=%d elapsed=%.2fs avg=%.2f Mbps %.2f pps loops=%d",
+			rec.State, rec.Packets, rec.Bytes, rec.Elapsed, rec.Mbps, rec.Pps, rec.Pass)
+		if rec.SendErrors > 0 {
+			fmt.Fprintf(s.w, " dropped=%d", rec.SendErrors)
+		}
+		if rec.SendRetries > 0 {
+			fmt.Fprintf(s.w, " retries=%d", rec.SendRetries)
+		}
+		fmt.Fprintln(s.w)
+	}
+}
+
+type jsonStats struct {
+	w io.Writer
+}
+
+func (s jsonStats) record(rec statsRecord) {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	fmt.Fprintf(s.w, "%s\n", data)
+}
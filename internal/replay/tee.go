@@ -0,0 +1,60 @@
+package replay
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+
+	"genflux/internal/pcapio"
+)
+
+// teeCapture records every frame the replay sends, as sent: after payload
+// scrubbing, on every pass, and once per frame however many interfaces it
+// goes out on. A path ending in .pcapng is written as pcapng.
+type teeCapture struct {
+	file   *os.File
+	writer pcapio.Writer
+}
+
+func newTeeCapture(path string) (*teeCapture, error) {
+	format := pcapio.FormatPcap
+	if strings.HasSuffix(strings.ToLower(path), pcapio.FormatPcapNG.Ext()) {
+		format = pcapio.FormatPcapNG
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := pcapio.NewWriter(f, format, pcapio.WriterOptions{LinkType: layers.LinkTypeEthernet})
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &teeCapture{file: f, writer: w}, nil
+}
+
+// write records data as sent at. The time is when the sender took the
+// frame, or its deadline if later, as with txtime.
+func (t *teeCapture) write(data []byte, at time.Time) error {
+	ci := gopacket.CaptureInfo{Timestamp: at, CaptureLength: len(data), Length: len(data)}
+	if err := t.writer.WritePacket(ci, data, pcapio.PacketMeta{Direction: pcapio.DirectionOutbound}); err != nil {
+		return fmt.Errorf("tee: %v", err)
+	}
+	return nil
+}
+
+// Close flushes the capture; it stays valid if the replay stopped early.
+func (t *teeCapture) Close() error {
+	err := t.writer.Flush()
+	if cerr := t.file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return fmt.Errorf("tee: %v", err)
+	}
+	return nil
+}
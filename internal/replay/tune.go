@@ -0,0 +1,87 @@
+package replay
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+// validate checks t against cfg, the settings of the running pass. A rate
+// that does not apply to the mode may still be given unchanged.
+func (t Tuning) validate(cfg Config, scheduled bool) error {
+	if t.Mbps < 0 || t.Pps < 0 || t.Speed < 0 || t.Limit < 0 || t.LimitPerLoop < 0 || t.Duration < 0 {
+		return errors.New("values must be >= 0")
+	}
+	if t.Mbps != 0 && t.Mbps != cfg.Mbps && (cfg.Mode != ModeMbps || scheduled) {
+		return errors.New("mbps applies to mode=mbps without a rate schedule")
+	}
+	if t.Pps != 0 && t.Pps != cfg.Pps && (cfg.Mode != ModePps && cfg.Mode != ModeBurst || scheduled) {
+		return errors.New("pps applies to mode=pps or burst without a rate schedule")
+	}
+	if t.Speed != 0 && t.Speed != cfg.Speed && (cfg.Mode != ModeTimestamp || cfg.TimeShiftSet || cfg.RebaseNow) {
+		return errors.New("speed applies to mode=timestamp without time-shift")
+	}
+	return nil
+}
+
+// retune applies t to the running replay and to cfg, the settings of its
+// current pass, and reports whether the pass must be paced anew. A
+// Tuning that does not fit is reported and ignored.
+func (r *replayRun) retune(cfg *Config, t Tuning, out io.Writer) bool {
+	if err := t.validate(*cfg, r.sched != nil); err != nil {
+		fmt.Fprintf(out, "Tuning rejected: %v\n", err)
+		return false
+	}
+	var changes []string
+	note := func(name string, from, to any) {
+		changes = append(changes, fmt.Sprintf("%s %v -> %v", name, from, to))
+	}
+	repace := false
+	for _, rate := range []struct {
+		name     string
+		from, to *float64
+	}{
+		{"mbps", &r.tuning.Mbps, &t.Mbps},
+		{"pps", &r.tuning.Pps, &t.Pps},
+		{"speed", &r.tuning.Speed, &t.Speed},
+	} {
+		if *rate.to != 0 && *rate.to != *rate.from {
+			note(rate.name, *rate.from, *rate.to)
+			*rate.from = *rate.to
+			repace = true
+		}
+	}
+	if t.Limit != r.tuning.Limit {
+		note("limit", r.tuning.Limit, t.Limit)
+		r.remaining = nil
+		if t.Limit > 0 {
+			left := max(t.Limit-int(r.total.Snapshot().Packets), 0)
+			r.remaining = &left
+		}
+	}
+	if t.LimitPerLoop != r.tuning.LimitPerLoop {
+		note("limit-per-loop", r.tuning.LimitPerLoop, t.LimitPerLoop)
+	}
+	if t.Duration != r.tuning.Duration {
+		note("duration", r.tuning.Duration, t.Duration)
+		r.end = time.Time{}
+		if t.Duration > 0 {
+			r.end = r.start.Add(t.Duration)
+		}
+	}
+	r.tuning.Limit, r.tuning.LimitPerLoop, r.tuning.Duration = t.Limit, t.LimitPerLoop, t.Duration
+	r.tuning.apply(cfg)
+
+	if len(changes) == 0 {
+		changes = []string{"no changes"}
+	}
+	fmt.Fprintf(out, "Retuned: %s\n", strings.Join(changes, ", "))
+	return repace
+}
+
+// apply sets the settings of a pass that t governs.
+func (t *Tuning) apply(cfg *Config) {
+	cfg.Mbps, cfg.Pps, cfg.Speed, cfg.LimitPerLoop = t.Mbps, t.Pps, t.Speed, t.LimitPerLoop
+}
@@ -1,6 +1,15 @@
 package replay
 
-import "time"
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"genflux/internal/clock"
+	"genflux/internal/microburst"
+)
 
 type Mode string
 
@@ -8,15 +17,231 @@ const (
 	ModeTimestamp Mode = "timestamp"
 	ModeMbps      Mode = "mbps"
 	ModePps       Mode = "pps"
+	// ModeBurst sends Burst packets back to back, with the bursts spaced
+	// for an average of Pps.
+	ModeBurst Mode = "burst"
+	// ModeTopSpeed sends every packet as soon as the sender takes it.
+	ModeTopSpeed Mode = "topspeed"
+	// ModeSearch runs an RFC 2544 style throughput search: trials at
+	// fixed Mbps rates, judged by the receive counter of MonitorIface.
+	ModeSearch Mode = "search"
 )
 
 type Config struct {
-	InPath        string
+	InPath string
+	Merge  bool
+	// Iface is one interface or a comma-separated list; with several,
+	// Balance spreads the packets over them.
 	Iface         string
+	Balance       Balance
 	Mode          Mode
 	Mbps          float64
 	Pps           float64
 	Loop          int
 	Limit         int
 	StatsInterval time.Duration
+	StartAt       time.Time
+	Background    bool
+	LinkFraction  float64
+	LogFile       string
+	// DryRun reads and schedules the packets without sending them and
+	// reports the projected duration and rates; no interface is needed.
+	DryRun       bool
+	TxBackend    TxBackend
+	TxTime       bool
+	TxTimeLead   time.Duration
+	ScrubPayload ScrubMode
+	// Shuffle reorders packets within a window of this many; 0 disables.
+	Shuffle     int
+	ShuffleSeed int64
+	// FlowStats, when set, is where per-flow counters are written after
+	// the replay ("-" for the stats output).
+	FlowStats string
+	// RateSchedule, when set, replaces Mbps or Pps with a rate that
+	// steps at the given offsets into the replay, or with RateRamp moves
+	// linearly between them.
+	RateSchedule []RatePoint
+	RateRamp     bool
+	// TimeShift, when TimeShiftSet, makes timestamp-mode replay absolute:
+	// a packet captured at T is sent when the clock reads T+TimeShift.
+	// RebaseNow picks the shift that makes the first packet due now.
+	// Either way later passes follow on from the end of the previous one.
+	TimeShift    time.Duration
+	TimeShiftSet bool
+	RebaseNow    bool
+	// Speed scales the capture's timing in mode=timestamp: 2 replays
+	// twice as fast, 0.5 at half speed. 0 means 1.
+	Speed float64
+	// Burst is the number of packets per burst in ModeBurst.
+	Burst int
+	// SkipCorrupt steps over damaged records of the inputs, reporting
+	// each, instead of stopping the replay.
+	SkipCorrupt bool
+	// Out receives the progress lines and summary; nil is stdout. LogFile
+	// takes precedence.
+	Out io.Writer
+	// Progress, when set, is called with the totals at every stats
+	// interval, from the goroutine running the replay.
+	Progress func(Progress)
+	// Clock, when set, paces the replay instead of the system clock. Dry
+	// runs default to a virtual clock, so their passes take no time.
+	Clock clock.Clock
+
+	// Throughput search (ModeSearch). Rates are in Mbps; SearchMax 0
+	// means the link speed of the sending interfaces.
+	MonitorIface     string
+	SearchMin        float64
+	SearchMax        float64
+	SearchResolution float64
+	LossTolerance    float64
+	TrialDuration    time.Duration
+
+	// Tee, when set, is a capture file that records every frame sent,
+	// stamped with the time it went out.
+	Tee string
+	// Microbursts squeezes the paced packets into line-rate bursts now
+	// and then; see microburst.Shaper.
+	Microbursts microburst.Config
+	// Rewrite retargets the packets at a device under test.
+	Rewrite Rewrite
+	// Filter, when set, is a capture filter in tcpdump syntax; only the
+	// packets it matches are replayed.
+	Filter string
+	// LimitFlows, when > 0, replays only the packets of the first this
+	// many flows, both directions of a flow counting once; every loop
+	// replays the same flows.
+	LimitFlows int
+	// LimitPerLoop, when > 0, ends every pass after this many packets.
+	LimitPerLoop int
+	// Duration, when > 0, ends the replay this long after it started,
+	// as completed; packets due later are not sent.
+	Duration time.Duration
+	// LoopGap pauses between passes. ContinuousTimestamps starts each
+	// pass after the previous one as if the capture went on: its first
+	// packet follows the last by their mean gap, so rates do not jump at
+	// the loop boundary. LoopGap then adds to that gap.
+	LoopGap              time.Duration
+	ContinuousTimestamps bool
+	// Tune, when set, retunes the running replay: every Tuning received
+	// replaces its rate and limits from the next packet on, so a soak
+	// test can be adjusted without restarting it.
+	Tune <-chan Tuning
+	// MaxSendErrors is how many failed sends the replay steps over,
+	// dropping those packets, before it aborts; 0 aborts on the first.
+	// MaxSkipped, when > 0, steps over up to this many damaged records of
+	// the inputs, as SkipCorrupt does over any number. Either way a
+	// replay that completes after stepping over something returns a
+	// *PartialError.
+	MaxSendErrors int
+	MaxSkipped    int
+	// StatsFormat is how the progress lines and summary are written;
+	// empty is text.
+	StatsFormat StatsFormat
+	// MetricsListen, when set, is the address (e.g. ":9090") where the
+	// replay serves its counters to Prometheus at /metrics while it runs.
+	MetricsListen string
+	// Direction, when client or server, sends only that side of every
+	// session; ClientNets, when set, are where the clients are, before
+	// the heuristics of sessionSides.
+	Direction  Direction
+	ClientNets []*net.IPNet
+	// SendRetries retries a send that fails for want of buffer space
+	// (ENOBUFS, EAGAIN) up to this many times before it counts as failed,
+	// waiting RetryBackoff, 100µs if 0, and twice as long each time.
+	SendRetries  int
+	RetryBackoff time.Duration
+	// PairListen or Pair pairs the replay with another on the far side
+	// of a device under test, over a control channel: the leader listens
+	// at PairListen and the follower connects to it at Pair. Each sends
+	// its direction of the same capture in mode=timestamp, passes
+	// starting together, so the two halves of every session keep their
+	// timing; the leader's loop count and limits end both.
+	PairListen string
+	Pair       string
+	// SndBuf is the send buffer of the AF_PACKET socket in bytes; 0 is
+	// 16 MiB. Without CAP_NET_ADMIN the kernel caps it at
+	// net.core.wmem_max. QdiscBypass hands frames straight to the driver
+	// (PACKET_QDISC_BYPASS), skipping the qdisc and its drops and
+	// shaping. MTUCheck fails the send of a frame too large for the MTU
+	// of its interface, with a send error that names both.
+	SndBuf      int
+	QdiscBypass bool
+	MTUCheck    bool
+	// Verify, when set, is an interface to capture on while replaying,
+	// across the wiring or DUT from Iface. The frames received there are
+	// matched against those sent, by their IP and transport headers, and
+	// the loss and reordering reported; frames lost fail the replay.
+	// VerifyWait is how long to listen on after the last send; 0 is one
+	// second. VerifyPayload also compares the payloads of the frames
+	// matched, failing the replay on any that differ.
+	Verify        string
+	VerifyWait    time.Duration
+	VerifyPayload bool
+	// PreserveBursts, in mode mbps or pps, keeps the capture's gaps
+	// between packets, scaled to bring the average to the rate, instead
+	// of spacing the packets evenly, so bursts keep their shape. Each
+	// pass is read twice: once ahead for its totals.
+	PreserveBursts bool
+	// SchedPolicy is how the sender waits for each packet's time; "" is
+	// SchedHybrid. SpinThreshold is how long before a deadline hybrid
+	// stops sleeping to spin, and how close to it sleep sends at once;
+	// 0 is DefaultSpinThreshold.
+	SchedPolicy   SchedPolicy
+	SpinThreshold time.Duration
+	// SendBatch is how many frames the socket backend hands to the kernel
+	// in one sendmmsg call at most. Frames are only held back while the
+	// next one is due within a few microseconds, so pacing is kept. 0 is
+	// 32, or 1 with TxTime; 1 sends every frame with a sendto of its own.
+	SendBatch int
+	// Fragment sends an IP packet too large for the MTU of its interface
+	// as IP fragments that fit it, as its sender's stack would have,
+	// instead of leaving it to the driver or failing it with MTUCheck.
+	Fragment bool
+}
+
+// PartialError is returned by a replay that completed but left packets
+// out: those whose send failed within Config.MaxSendErrors, and the
+// damaged records it skipped.
+type PartialError struct {
+	SendErrors int
+	// FirstSendError is the first of the failed sends.
+	FirstSendError error
+	// Skipped counts distinct damaged records; one skipped on every loop
+	// counts once.
+	Skipped int
+}
+
+func (e *PartialError) Error() string {
+	var parts []string
+	if e.SendErrors > 0 {
+		parts = append(parts, fmt.Sprintf("%d send errors (first: %v)", e.SendErrors, e.FirstSendError))
+	}
+	if e.Skipped > 0 {
+		parts = append(parts, fmt.Sprintf("%d damaged records skipped", e.Skipped))
+	}
+	return "replay completed partially: " + strings.Join(parts, ", ")
+}
+
+// Tuning is the part of a Config a running replay can change. Mbps, Pps
+// and Speed of 0 keep the current value; the limits are taken as given,
+// 0 lifting them. Limit counts from the start of the replay and Duration
+// from when it started.
+type Tuning struct {
+	Mbps         float64
+	Pps          float64
+	Speed        float64
+	Limit        int
+	LimitPerLoop int
+	Duration     time.Duration
+}
+
+// Progress is the state of a replay at one stats interval. Mbps and Pps
+// are the rates over the interval; the rest count from the start.
+type Progress struct {
+	Elapsed time.Duration
+	Pass    int
+	Packets int64
+	Bytes   int64
+	Mbps    float64
+	Pps     float64
 }
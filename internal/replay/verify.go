@@ -0,0 +1,262 @@
+//go:build linux
+
+package replay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/gopacket/layers"
+
+	"genflux/internal/capture"
+)
+
+// verifier captures on Config.Verify while the replay sends and matches
+// the frames received there against those sent.
+//
+// Frames are matched by their IP and transport headers, leaving out the
+// MAC addresses, the TTL or hop limit, the DSCP and ECN bits and the IPv4
+// header checksum, which a DUT forwarding the frames may change; frames
+// that are not IP are matched by everything after the MAC addresses.
+type verifier struct {
+	listener *capture.Listener
+	iface    string
+	wait     time.Duration
+	payload  bool
+
+	sent     []verifyFrame
+	received []verifyFrame
+	hash     hash.Hash64
+	stop     atomic.Bool
+	done     chan error
+}
+
+// verifyFrame identifies a frame: key hashes its headers and payload its
+// payload, when payloads are compared.
+type verifyFrame struct {
+	key, payload uint64
+}
+
+// verifyResult is how the frames received compare with those sent.
+type verifyResult struct {
+	sent, received int64
+	// lost counts the frames sent but never received and unmatched those
+	// received but not sent, or received more often than sent.
+	lost, unmatched int64
+	// reordered counts the frames received after one sent later than
+	// them, the latest of them late by lateBy frames.
+	reordered, lateBy int64
+	// mismatched counts frames received with a payload other than sent.
+	mismatched int64
+	// dropped counts the frames the receiving socket dropped.
+	dropped int64
+}
+
+// newVerifier starts capturing on iface.
+func newVerifier(cfg Config) (*verifier, error) {
+	l, err := capture.Listen(cfg.Verify, true)
+	if err != nil {
+		return nil, fmt.Errorf("verify: %v", err)
+	}
+	v := &verifier{listener: l, iface: cfg.Verify, wait: cfg.VerifyWait, payload: cfg.VerifyPayload, hash: fnv.New64a(), done: make(chan error, 1)}
+	if v.wait == 0 {
+		v.wait = time.Second
+	}
+	go v.receive()
+	return v, nil
+}
+
+// receive records the frames arriving until stopped.
+func (v *verifier) receive() {
+	h := fnv.New64a()
+	raw := v.listener.LinkType() == layers.LinkTypeRaw
+	buf := make([]byte, 1<<18)
+	for !v.stop.Load() {
+		n, frame, err := v.listener.Read(buf)
+		if err == capture.ErrIdle {
+			continue
+		}
+		if err != nil {
+			v.done <- err
+			return
+		}
+		// The frames sent out of this interface are not the ones that
+		// came through.
+		if frame.Outgoing {
+			continue
+		}
+		off := 0
+		if !raw {
+			off = l3Offset(buf[:n])
+		}
+		v.received = append(v.received, identify(h, buf[:n], off, v.payload))
+	}
+	v.done <- nil
+}
+
+// add records a frame as sent.
+func (v *verifier) add(frame []byte) {
+	v.sent = append(v.sent, identify(v.hash, frame, l3Offset(frame), v.payload))
+}
+
+// finish listens on for the frames still in flight, then stops and
+// reports how those received compare with those sent. It returns an
+// error when frames were lost or arrived with other payloads.
+func (v *verifier) finish(out io.Writer) error {
+	time.Sleep(v.wait)
+	v.stop.Store(true)
+	err := <-v.done
+	res := v.match()
+	res.dropped = v.listener.Dropped()
+	v.listener.Close()
+	if err != nil {
+		return fmt.Errorf("verify: %v", err)
+	}
+
+	fmt.Fprintf(out, "Verify on %s: %d sent, %d received, %d lost (%.2f%%), %d reordered",
+		v.iface, res.sent, res.received, res.lost, percent(res.lost, res.sent), res.reordered)
+	if res.reordered > 0 {
+		fmt.Fprintf(out, " (up to %d frames late)", res.lateBy)
+	}
+	if v.payload {
+		fmt.Fprintf(out, ", %d payload mismatches", res.mismatched)
+	}
+	fmt.Fprintf(out, ", %d unmatched", res.unmatched)
+	if res.dropped > 0 {
+		fmt.Fprintf(out, ", %d dropped by the receiving socket", res.dropped)
+	}
+	fmt.Fprintln(out)
+	switch {
+	case res.mismatched > 0:
+		return fmt.Errorf("verify failed: %d of %d frames lost, %d received with other payloads", res.lost, res.sent, res.mismatched)
+	case res.lost > 0:
+		return fmt.Errorf("verify failed: %d of %d frames lost", res.lost, res.sent)
+	}
+	return nil
+}
+
+// match pairs every frame received with the earliest unmatched frame
+// sent that it matches, preferring one with the same payload.
+func (v *verifier) match() verifyResult {
+	res := verifyResult{sent: int64(len(v.sent)), received: int64(len(v.received))}
+	pending := map[uint64][]int{}
+	for i, f := range v.sent {
+		pending[f.key] = append(pending[f.key], i)
+	}
+	highest := -1
+	for _, f := range v.received {
+		queue := pending[f.key]
+		if len(queue) == 0 {
+			res.unmatched++
+			continue
+		}
+		j := 0
+		if v.payload {
+			for k, i := range queue {
+				if v.sent[i].payload == f.payload {
+					j = k
+					break
+				}
+			}
+			if v.sent[queue[j]].payload != f.payload {
+				res.mismatched++
+			}
+		}
+		i := queue[j]
+		pending[f.key] = append(queue[:j], queue[j+1:]...)
+		if i < highest {
+			res.reordered++
+			res.lateBy = max(res.lateBy, int64(highest-i))
+		} else {
+			highest = i
+		}
+	}
+	for _, queue := range pending {
+		res.lost += int64(len(queue))
+	}
+	return res
+}
+
+// l3Offset returns where the network header of an Ethernet frame starts,
+// past any VLAN tags; for a frame too short to tell it is the length.
+func l3Offset(frame []byte) int {
+	off := 12
+	for len(frame) >= off+6 {
+		if t := binary.BigEndian.Uint16(frame[off:]); t != 0x8100 && t != 0x88a8 {
+			break
+		}
+		off += 4
+	}
+	return min(off+2, len(frame))
+}
+
+// identify hashes the frame whose network header starts at off, the
+// payload too when payload is set.
+func identify(h hash.Hash64, frame []byte, off int, payload bool) verifyFrame {
+	pkt := frame[off:]
+	var hdr [60]byte
+	var n, l4 int
+	var proto byte
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4 && int(pkt[0]&0x0f)*4 >= 20 && len(pkt) >= int(pkt[0]&0x0f)*4:
+		n = int(pkt[0]&0x0f) * 4
+		copy(hdr[:], pkt[:n])
+		hdr[1], hdr[8], hdr[10], hdr[11] = 0, 0, 0, 0
+		if total := int(binary.BigEndian.Uint16(pkt[2:])); total >= n && total < len(pkt) {
+			// Leave out the padding of short frames.
+			pkt = pkt[:total]
+		}
+		proto, l4 = pkt[9], n
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		n = 40
+		copy(hdr[:], pkt[:n])
+		hdr[0], hdr[1], hdr[7] = 0x60, hdr[1]&0x0f, 0
+		if total := 40 + int(binary.BigEndian.Uint16(pkt[4:])); total < len(pkt) {
+			pkt = pkt[:total]
+		}
+		proto, l4 = pkt[6], n
+	default:
+		// Not IP: the EtherType and all after it, without the padding.
+		end := len(frame)
+		for end > off && frame[end-1] == 0 {
+			end--
+		}
+		h.Reset()
+		h.Write(frame[max(off-2, 0):end])
+		return verifyFrame{key: h.Sum64()}
+	}
+	// The transport header belongs to the key, what follows it to the
+	// payload.
+	end := l4
+	switch proto {
+	case 6:
+		if len(pkt) >= l4+13 {
+			end = l4 + int(pkt[l4+12]>>4)*4
+		}
+	case 17, 1, 58:
+		end = l4 + 8
+	}
+	end = min(end, len(pkt))
+	h.Reset()
+	h.Write(hdr[:n])
+	h.Write(pkt[n:end])
+	f := verifyFrame{key: h.Sum64()}
+	if payload {
+		h.Reset()
+		h.Write(pkt[end:])
+		f.payload = h.Sum64()
+	}
+	return f
+}
+
+func percent(n, of int64) float64 {
+	if of == 0 {
+		return 0
+	}
+	return 100 * float64(n) / float64(of)
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package replay
+
+import (
+	"errors"
+	"io"
+)
+
+// verifier needs the AF_PACKET capture of package capture.
+type verifier struct{}
+
+func newVerifier(cfg Config) (*verifier, error) {
+	_ = cfg
+	return nil, errors.New("verify is only supported on linux (requires AF_PACKET raw sockets)")
+}
+
+func (v *verifier) add(frame []byte) {}
+
+func (v *verifier) finish(out io.Writer) error { return nil }
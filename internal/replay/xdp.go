@@ -0,0 +1,260 @@
+//go:build linux
+
+package replay
+
+import (
+	"fmt"
+	"net"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// xdpFrames chunks of xdpChunkSize make up the UMEM; each holds one
+	// frame in flight.
+	xdpFrames    = 4096
+	xdpChunkSize = 4096
+	xdpTxEntries = 2048
+	// The fill ring is never used for transmit-only sockets, but the
+	// kernel will not bind a UMEM without one.
+	xdpFillEntries = 64
+	// xdpDrainTimeout bounds how long flush waits for completions.
+	xdpDrainTimeout = time.Second
+)
+
+// xdpSender transmits through an AF_XDP socket: frames are copied into a
+// registered UMEM and handed to the driver through the TX ring, bypassing
+// the kernel's network stack. It binds in zero-copy mode where the driver
+// supports it and falls back to copy mode otherwise.
+type xdpSender struct {
+	fd       int
+	iface    string
+	zeroCopy bool
+	sched    scheduler
+	umem     []byte
+	free     []uint64
+	inFlight int
+	pending  int
+
+	txMap    []byte
+	txProd   *uint32
+	txCons   *uint32
+	txDescs  []unix.XDPDesc
+	compMap  []byte
+	compProd *uint32
+	compCons *uint32
+	compRing []uint64
+}
+
+func newXDPSender(cfg Config, name string) (*xdpSender, error) {
+	if cfg.TxTime {
+		return nil, fmt.Errorf("txtime is not supported with the xdp backend")
+	}
+	if cfg.SndBuf > 0 || cfg.QdiscBypass {
+		return nil, fmt.Errorf("sndbuf and qdisc-bypass do not apply to the xdp backend")
+	}
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	if iface.MTU+14+4 > xdpChunkSize {
+		return nil, fmt.Errorf("MTU %d does not fit a %d byte UMEM chunk", iface.MTU, xdpChunkSize)
+	}
+	fd, err := unix.Socket(unix.AF_XDP, unix.SOCK_RAW, 0)
+	if err != nil {
+		return nil, fmt.Errorf("open AF_XDP socket: %v (requires Linux >= 4.18)", err)
+	}
+	s := &xdpSender{fd: fd, iface: name, sched: newScheduler(cfg)}
+	if err := s.setup(); err != nil {
+		s.Close()
+		return nil, err
+	}
+	if err := s.bind(iface.Index); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// setup registers the UMEM and maps the TX and completion rings.
+func (s *xdpSender) setup() error {
+	var err error
+	s.umem, err = unix.Mmap(-1, 0, xdpFrames*xdpChunkSize, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_PRIVATE|unix.MAP_ANONYMOUS|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("allocate UMEM: %v", err)
+	}
+	reg := unix.XDPUmemReg{
+		Addr: uint64(uintptr(unsafe.Pointer(&s.umem[0]))),
+		Len:  uint64(len(s.umem)),
+		Size: xdpChunkSize,
+	}
+	if err := setsockopt(s.fd, unix.XDP_UMEM_REG, unsafe.Pointer(&reg), unsafe.Sizeof(reg)); err != nil {
+		return fmt.Errorf("register UMEM: %v", err)
+	}
+	for opt, n := range map[int]int{
+		unix.XDP_UMEM_FILL_RING:       xdpFillEntries,
+		unix.XDP_UMEM_COMPLETION_RING: xdpFrames,
+		unix.XDP_TX_RING:              xdpTxEntries,
+	} {
+		if err := unix.SetsockoptInt(s.fd, unix.SOL_XDP, opt, n); err != nil {
+			return fmt.Errorf("size XDP ring: %v", err)
+		}
+	}
+
+	var off unix.XDPMmapOffsets
+	size := uint32(unsafe.Sizeof(off))
+	_, _, errno := unix.Syscall6(unix.SYS_GETSOCKOPT, uintptr(s.fd), unix.SOL_XDP, unix.XDP_MMAP_OFFSETS, uintptr(unsafe.Pointer(&off)), uintptr(unsafe.Pointer(&size)), 0)
+	if errno != 0 {
+		return fmt.Errorf("read XDP ring offsets: %v", errno)
+	}
+
+	s.txMap, err = unix.Mmap(s.fd, unix.XDP_PGOFF_TX_RING, int(off.Tx.Desc)+xdpTxEntries*int(unsafe.Sizeof(unix.XDPDesc{})), unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("mmap XDP TX ring: %v", err)
+	}
+	s.txProd = (*uint32)(unsafe.Pointer(&s.txMap[off.Tx.Producer]))
+	s.txCons = (*uint32)(unsafe.Pointer(&s.txMap[off.Tx.Consumer]))
+	s.txDescs = unsafe.Slice((*unix.XDPDesc)(unsafe.Pointer(&s.txMap[off.Tx.Desc])), xdpTxEntries)
+
+	s.compMap, err = unix.Mmap(s.fd, unix.XDP_UMEM_PGOFF_COMPLETION_RING, int(off.Cr.Desc)+xdpFrames*8, unix.PROT_READ|unix.PROT_WRITE, unix.MAP_SHARED|unix.MAP_POPULATE)
+	if err != nil {
+		return fmt.Errorf("mmap XDP completion ring: %v", err)
+	}
+	s.compProd = (*uint32)(unsafe.Pointer(&s.compMap[off.Cr.Producer]))
+	s.compCons = (*uint32)(unsafe.Pointer(&s.compMap[off.Cr.Consumer]))
+	s.compRing = unsafe.Slice((*uint64)(unsafe.Pointer(&s.compMap[off.Cr.Desc])), xdpFrames)
+
+	s.free = make([]uint64, 0, xdpFrames)
+	for i := xdpFrames - 1; i >= 0; i-- {
+		s.free = append(s.free, uint64(i*xdpChunkSize))
+	}
+	return nil
+}
+
+// bind attaches the socket to queue 0 of the interface, zero-copy first.
+func (s *xdpSender) bind(ifindex int) error {
+	err := unix.Bind(s.fd, &unix.SockaddrXDP{Flags: unix.XDP_ZEROCOPY | unix.XDP_USE_NEED_WAKEUP, Ifindex: uint32(ifindex)})
+	if err == nil {
+		s.zeroCopy = true
+		return nil
+	}
+	if err := unix.Bind(s.fd, &unix.SockaddrXDP{Flags: unix.XDP_COPY | unix.XDP_USE_NEED_WAKEUP, Ifindex: uint32(ifindex)}); err != nil {
+		return fmt.Errorf("bind AF_XDP socket: %v", err)
+	}
+	return nil
+}
+
+func (s *xdpSender) describe() string {
+	mode := "copy"
+	if s.zeroCopy {
+		mode = "zero-copy"
+	}
+	return fmt.Sprintf("AF_XDP on %s in %s mode", s.iface, mode)
+}
+
+func setsockopt(fd, opt int, val unsafe.Pointer, size uintptr) error {
+	_, _, errno := unix.Syscall6(unix.SYS_SETSOCKOPT, uintptr(fd), unix.SOL_XDP, uintptr(opt), uintptr(val), size, 0)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+func (s *xdpSender) send(data []byte, at time.Time) error {
+	if len(data) > xdpChunkSize {
+		return fmt.Errorf("frame of %d bytes does not fit a %d byte UMEM chunk", len(data), xdpChunkSize)
+	}
+	if s.pending > 0 && time.Until(at) > ringKickSlack {
+		if err := s.kick(); err != nil {
+			return err
+		}
+	}
+	s.sched.waitUntil(at)
+	for len(s.free) == 0 || s.txFull() {
+		if err := s.kick(); err != nil {
+			return err
+		}
+		if s.reclaim() == 0 {
+			fds := []unix.PollFd{{Fd: int32(s.fd), Events: unix.POLLOUT}}
+			if _, err := unix.Poll(fds, 1); err != nil && err != unix.EINTR {
+				return err
+			}
+		}
+	}
+	addr := s.free[len(s.free)-1]
+	s.free = s.free[:len(s.free)-1]
+	copy(s.umem[addr:], data)
+
+	prod := atomic.LoadUint32(s.txProd)
+	s.txDescs[prod%xdpTxEntries] = unix.XDPDesc{Addr: addr, Len: uint32(len(data))}
+	atomic.StoreUint32(s.txProd, prod+1)
+	s.inFlight++
+	s.pending++
+	if s.pending >= ringBatch {
+		return s.kick()
+	}
+	return nil
+}
+
+func (s *xdpSender) txFull() bool {
+	return atomic.LoadUint32(s.txProd)-atomic.LoadUint32(s.txCons) >= xdpTxEntries
+}
+
+// reclaim returns completed chunks to the free list.
+func (s *xdpSender) reclaim() int {
+	cons := atomic.LoadUint32(s.compCons)
+	n := int(atomic.LoadUint32(s.compProd) - cons)
+	for i := 0; i < n; i++ {
+		s.free = append(s.free, s.compRing[(cons+uint32(i))%xdpFrames])
+	}
+	atomic.StoreUint32(s.compCons, cons+uint32(n))
+	s.inFlight -= n
+	return n
+}
+
+// kick asks the kernel to transmit the queued descriptors.
+func (s *xdpSender) kick() error {
+	s.pending = 0
+	for {
+		err := unix.Sendto(s.fd, nil, unix.MSG_DONTWAIT, nil)
+		switch err {
+		case nil, unix.EAGAIN, unix.EBUSY, unix.ENOBUFS:
+			return nil
+		case unix.EINTR:
+			continue
+		default:
+			return fmt.Errorf("kick XDP TX ring: %v", err)
+		}
+	}
+}
+
+// flush transmits everything queued and waits for its completions.
+func (s *xdpSender) flush() error {
+	deadline := time.Now().Add(xdpDrainTimeout)
+	for {
+		s.reclaim()
+		if s.inFlight == 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%d frames still queued in the XDP TX ring", s.inFlight)
+		}
+		if err := s.kick(); err != nil {
+			return err
+		}
+		time.Sleep(10 * time.Microsecond)
+	}
+}
+
+func (s *xdpSender) Close() error {
+	for _, m := range [][]byte{s.txMap, s.compMap, s.umem} {
+		if m != nil {
+			unix.Munmap(m)
+		}
+	}
+	s.txMap, s.compMap, s.umem = nil, nil, nil
+	return unix.Close(s.fd)
+}
@@ -0,0 +1,117 @@
+// Package stats counts packets and bytes from any number of goroutines
+// and turns the counts into rates.
+package stats
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Counter counts packets and their bytes. It is safe for concurrent use;
+// the zero value is ready.
+type Counter struct {
+	packets atomic.Int64
+	bytes   atomic.Int64
+}
+
+// Add counts one packet of n bytes.
+func (c *Counter) Add(n int) {
+	c.packets.Add(1)
+	c.bytes.Add(int64(n))
+}
+
+// Snapshot returns the counts so far.
+func (c *Counter) Snapshot() Snapshot {
+	return Snapshot{Packets: c.packets.Load(), Bytes: c.bytes.Load()}
+}
+
+// Sharded is a counter split into one shard per worker, each on its own
+// cache line, so workers counting at high rates do not contend.
+type Sharded struct {
+	shards []shard
+}
+
+type shard struct {
+	Counter
+	_ [64 - 16]byte
+}
+
+// NewSharded returns a counter of n shards.
+func NewSharded(n int) *Sharded {
+	return &Sharded{shards: make([]shard, n)}
+}
+
+// Shard returns the counter of worker i.
+func (s *Sharded) Shard(i int) *Counter {
+	return &s.shards[i].Counter
+}
+
+// Snapshot returns the counts of all shards together.
+func (s *Sharded) Snapshot() Snapshot {
+	var total Snapshot
+	for i := range s.shards {
+		total = total.Add(s.shards[i].Snapshot())
+	}
+	return total
+}
+
+// Snapshot is the counts at one moment.
+type Snapshot struct {
+	Packets int64
+	Bytes   int64
+}
+
+func (s Snapshot) Add(o Snapshot) Snapshot {
+	return Snapshot{Packets: s.Packets + o.Packets, Bytes: s.Bytes + o.Bytes}
+}
+
+// Sub returns what was counted between o and s.
+func (s Snapshot) Sub(o Snapshot) Snapshot {
+	return Snapshot{Packets: s.Packets - o.Packets, Bytes: s.Bytes - o.Bytes}
+}
+
+// Bits is the byte count in bits.
+func (s Snapshot) Bits() int64 {
+	return s.Bytes * 8
+}
+
+// Rate is a packet and bit rate.
+type Rate struct {
+	Mbps float64
+	Pps  float64
+}
+
+// Rate returns the rate of counting s in elapsed; zero when no time has
+// passed.
+func (s Snapshot) Rate(elapsed time.Duration) Rate {
+	secs := elapsed.Seconds()
+	if secs <= 0 {
+		return Rate{}
+	}
+	return Rate{Mbps: float64(s.Bits()) / secs / 1e6, Pps: float64(s.Packets) / secs}
+}
+
+// Meter reports the rate of a counter over successive intervals. It is
+// meant for the goroutine that prints progress.
+type Meter struct {
+	every  time.Duration
+	last   Snapshot
+	lastAt time.Time
+}
+
+// NewMeter returns a meter reporting at most every interval from start.
+func NewMeter(every time.Duration, start time.Time) *Meter {
+	return &Meter{every: every, lastAt: start}
+}
+
+// Tick returns the rate since the last report when at least one interval
+// has passed by now, given the counts cur.
+func (m *Meter) Tick(now time.Time, cur Snapshot) (Rate, bool) {
+	elapsed := now.Sub(m.lastAt)
+	if elapsed < m.every {
+		return Rate{}, false
+	}
+	r := cur.Sub(m.last).Rate(elapsed)
+	m.last, m.lastAt = cur, now
+	return r, true
+}
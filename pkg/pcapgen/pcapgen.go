@@ -0,0 +1,195 @@
+// Package pcapgen generates synthetic captures. It is the library behind
+// "genflux pcap gen": every flag of the command is a field of Config, and
+// the same Config and seed give the same bytes.
+//
+// Config and the types of its fields are shared with the command, so they
+// only ever gain fields; zero values keep the behaviour they had.
+package pcapgen
+
+import (
+	"context"
+	"net"
+
+	"genflux/internal/microburst"
+	gen "genflux/internal/pcapgen"
+	"genflux/internal/pcapio"
+)
+
+type (
+	Config   = gen.Config
+	Progress = gen.Progress
+
+	ProtoDist        = gen.ProtoDist
+	WeightedProto    = gen.WeightedProto
+	PortDist         = gen.PortDist
+	PortRange        = gen.PortRange
+	WeightedPort     = gen.WeightedPort
+	SizeDist         = gen.SizeDist
+	WeightedSize     = gen.WeightedSize
+	SessionModel     = gen.SessionModel
+	VLANConfig       = gen.VLANConfig
+	TenantConfig     = gen.TenantConfig
+	TenantEncap      = gen.TenantEncap
+	LossConfig       = gen.LossConfig
+	EvasionConfig    = gen.EvasionConfig
+	EvasionTechnique = gen.EvasionTechnique
+	Link             = gen.Link
+	Format           = pcapio.Format
+	PayloadTemplates = gen.PayloadTemplates
+	Wordlists        = gen.Wordlists
+	MACConfig        = gen.MACConfig
+	TrafficModel     = gen.TrafficModel
+	TrafficModelKind = gen.TrafficModelKind
+	Manifest         = gen.Manifest
+	SizeSplit        = gen.SizeSplit
+	NoiseConfig      = gen.NoiseConfig
+	TunnelConfig     = gen.TunnelConfig
+	Tunnel           = gen.Tunnel
+	Persona          = gen.Persona
+	PersonaMix       = gen.PersonaMix
+	WeightedPersona  = gen.WeightedPersona
+	HostPersona      = gen.HostPersona
+	SampleConfig     = gen.SampleConfig
+	SampleFormat     = gen.SampleFormat
+	SampleReport     = gen.SampleReport
+	Profile          = gen.Profile
+	DNSConfig        = gen.DNSConfig
+	ScenarioConfig   = gen.ScenarioConfig
+	Scenario         = gen.Scenario
+	ScenarioLabel    = gen.ScenarioLabel
+	LabelFormat      = gen.LabelFormat
+	FlowLabel        = gen.FlowLabel
+	FlowExportConfig = gen.FlowExportConfig
+	FlowExportFormat = gen.FlowExportFormat
+	PacketsDist      = gen.PacketsDist
+	PacketsModel     = gen.PacketsModel
+	EncapConfig      = gen.EncapConfig
+	Encap            = gen.Encap
+	Background       = gen.Background
+	// MicroburstConfig is shared with the replay package.
+	MicroburstConfig = microburst.Config
+)
+
+const (
+	FormatPcap   = pcapio.FormatPcap
+	FormatPcapNG = pcapio.FormatPcapNG
+
+	LinkEthernet = gen.LinkEthernet
+	LinkWiFi     = gen.LinkWiFi
+
+	SessionNone      = gen.SessionNone
+	SessionHandshake = gen.SessionHandshake
+	SessionFull      = gen.SessionFull
+
+	TenantVLAN  = gen.TenantVLAN
+	TenantVXLAN = gen.TenantVXLAN
+
+	EvasionOverlap   = gen.EvasionOverlap
+	EvasionUrgent    = gen.EvasionUrgent
+	EvasionTTLInsert = gen.EvasionTTLInsert
+
+	TrafficFlat    = gen.TrafficFlat
+	TrafficDiurnal = gen.TrafficDiurnal
+	TrafficCustom  = gen.TrafficCustom
+
+	SplitEven    = gen.SplitEven
+	SplitTraffic = gen.SplitTraffic
+
+	Tunnel6in4   = gen.Tunnel6in4
+	TunnelTeredo = gen.TunnelTeredo
+	TunnelISATAP = gen.TunnelISATAP
+
+	PersonaWindows = gen.PersonaWindows
+	PersonaLinux   = gen.PersonaLinux
+	PersonaMacOS   = gen.PersonaMacOS
+	PersonaIoT     = gen.PersonaIoT
+
+	SamplePcap  = gen.SamplePcap
+	SampleSFlow = gen.SampleSFlow
+
+	ProfileNone = gen.ProfileNone
+	ProfileDNS  = gen.ProfileDNS
+
+	ScenarioPortScan   = gen.ScenarioPortScan
+	ScenarioSweep      = gen.ScenarioSweep
+	ScenarioBruteForce = gen.ScenarioBruteForce
+
+	LabelsNone = gen.LabelsNone
+	LabelsJSON = gen.LabelsJSON
+	LabelsCSV  = gen.LabelsCSV
+
+	LabelBenign = gen.LabelBenign
+	LabelNoise  = gen.LabelNoise
+
+	FlowExportNone     = gen.FlowExportNone
+	FlowExportNetFlow9 = gen.FlowExportNetFlow9
+	FlowExportIPFIX    = gen.FlowExportIPFIX
+
+	PacketsFixed     = gen.PacketsFixed
+	PacketsLognormal = gen.PacketsLognormal
+	PacketsPareto    = gen.PacketsPareto
+
+	EncapNone   = gen.EncapNone
+	EncapGRE    = gen.EncapGRE
+	EncapVXLAN  = gen.EncapVXLAN
+	EncapGeneve = gen.EncapGeneve
+
+	BackgroundARP  = gen.BackgroundARP
+	BackgroundDHCP = gen.BackgroundDHCP
+	BackgroundNDP  = gen.BackgroundNDP
+)
+
+// StdoutPath as Config.OutFile streams the capture to stdout.
+const StdoutPath = gen.StdoutPath
+
+// DefaultConfig returns the defaults of "genflux pcap gen". Its seed is
+// taken from the clock; set Seed for repeatable output.
+func DefaultConfig() Config { return gen.DefaultConfig() }
+
+// Generate writes the captures cfg describes. Once ctx ends it stops
+// within a few thousand packets, removes the file it was writing and
+// returns ctx.Err(). cfg.Progress, when set, is called as the files fill
+// up.
+func Generate(ctx context.Context, cfg Config) error {
+	return gen.Generate(ctx, cfg)
+}
+
+// The parsers below accept the values of the flags of the same names.
+
+func ParseProtoDist(value string) (ProtoDist, error)       { return gen.ParseProtoDist(value) }
+func ParseProtocols(value string) (ProtoDist, error)       { return gen.ParseProtocols(value) }
+func ParsePortDist(value string) (PortDist, error)         { return gen.ParsePortDist(value) }
+func ParsePortRange(value string) (PortRange, error)       { return gen.ParsePortRange(value) }
+func ParseSizeDist(value string) (SizeDist, error)         { return gen.ParseSizeDist(value) }
+func ParseSizeModel(value string) (SizeDist, error)        { return gen.ParseSizeModel(value) }
+func ParseSessionModel(value string) (SessionModel, error) { return gen.ParseSessionModel(value) }
+func ParseTrafficModel(value string) (TrafficModel, error) { return gen.ParseTrafficModel(value) }
+func ParseFormat(value string) (Format, error)             { return pcapio.ParseFormat(value) }
+func ParseLink(value string) (Link, error)                 { return gen.ParseLink(value) }
+func ParseSizeSplit(value string) (SizeSplit, error)       { return gen.ParseSizeSplit(value) }
+func ParseTunnels(value string) ([]Tunnel, error)          { return gen.ParseTunnels(value) }
+func ParsePersonaMix(value string) (PersonaMix, error)     { return gen.ParsePersonaMix(value) }
+func ParseSampleFormat(value string) (SampleFormat, error) { return gen.ParseSampleFormat(value) }
+func ParseProfile(value string) (Profile, error)           { return gen.ParseProfile(value) }
+func ParseScenarios(value string) ([]Scenario, error)      { return gen.ParseScenarios(value) }
+func ParseTargets(value string) ([]net.IP, error)          { return gen.ParseTargets(value) }
+func ParsePortList(value string) ([]uint16, error)         { return gen.ParsePortList(value) }
+func ParseLabelFormat(value string) (LabelFormat, error)   { return gen.ParseLabelFormat(value) }
+func ParseFlowExportFormat(value string) (FlowExportFormat, error) {
+	return gen.ParseFlowExportFormat(value)
+}
+func ParsePacketsDist(value string) (PacketsDist, error) { return gen.ParsePacketsDist(value) }
+func ParseEncap(value string) (Encap, error)             { return gen.ParseEncap(value) }
+func ParseMPLSLabels(value string) ([]uint32, error)     { return gen.ParseMPLSLabels(value) }
+func ParseBackground(value string) ([]Background, error) { return gen.ParseBackground(value) }
+
+// ParseServices parses a --services mix into a protocol mix and the TCP
+// and UDP port mixes.
+func ParseServices(value string) (ProtoDist, PortDist, PortDist, error) {
+	return gen.ParseServices(value)
+}
+
+// LoadPayloadTemplates parses "builtin" or APP=FILE templates.
+func LoadPayloadTemplates(value string) (PayloadTemplates, error) {
+	return gen.LoadPayloadTemplates(value)
+}
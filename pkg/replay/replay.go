@@ -0,0 +1,105 @@
+// Package replay sends captures out of network interfaces at controlled
+// rates. It is the library behind "genflux replay" and, like it, needs
+// root or CAP_NET_RAW unless Config.DryRun is set. It sends with AF_PACKET
+// on Linux and with libpcap (Npcap on Windows) elsewhere.
+//
+// Config and the types of its fields are shared with the command, so they
+// only ever gain fields; zero values keep the behaviour they had.
+package replay
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"genflux/internal/clock"
+	"genflux/internal/microburst"
+	rp "genflux/internal/replay"
+)
+
+type (
+	Config      = rp.Config
+	Progress    = rp.Progress
+	Mode        = rp.Mode
+	Balance     = rp.Balance
+	TxBackend   = rp.TxBackend
+	ScrubMode   = rp.ScrubMode
+	StatsFormat = rp.StatsFormat
+	Direction   = rp.Direction
+	SchedPolicy = rp.SchedPolicy
+	RatePoint   = rp.RatePoint
+	Rewrite     = rp.Rewrite
+	IPMap       = rp.IPMap
+	// Tuning retunes a running replay; see Config.Tune.
+	Tuning = rp.Tuning
+	// PartialError is returned by a replay that completed but stepped
+	// over failed sends or damaged records.
+	PartialError = rp.PartialError
+	// MicroburstConfig is shared with the pcapgen package.
+	MicroburstConfig = microburst.Config
+
+	// Clock paces a replay; see Config.Clock.
+	Clock = clock.Clock
+	// VirtualClock only moves when waited on, so a replay paced by it
+	// takes no time.
+	VirtualClock = clock.Virtual
+)
+
+// SystemClock is the clock replays use by default.
+var SystemClock = clock.Real
+
+// NewVirtualClock returns a virtual clock reading start.
+func NewVirtualClock(start time.Time) *VirtualClock { return clock.NewVirtual(start) }
+
+const (
+	ModeTimestamp = rp.ModeTimestamp
+	ModeMbps      = rp.ModeMbps
+	ModePps       = rp.ModePps
+	ModeBurst     = rp.ModeBurst
+	ModeTopSpeed  = rp.ModeTopSpeed
+	ModeSearch    = rp.ModeSearch
+
+	BalanceFlowHash   = rp.BalanceFlowHash
+	BalanceRoundRobin = rp.BalanceRoundRobin
+	BalanceTee        = rp.BalanceTee
+
+	BackendSocket = rp.BackendSocket
+	BackendRing   = rp.BackendRing
+	BackendXDP    = rp.BackendXDP
+	BackendPcap   = rp.BackendPcap
+
+	ScrubNone   = rp.ScrubNone
+	ScrubZero   = rp.ScrubZero
+	ScrubRandom = rp.ScrubRandom
+
+	StatsText = rp.StatsText
+	StatsJSON = rp.StatsJSON
+
+	DirectionBoth   = rp.DirectionBoth
+	DirectionClient = rp.DirectionClient
+	DirectionServer = rp.DirectionServer
+
+	SchedHybrid = rp.SchedHybrid
+	SchedSleep  = rp.SchedSleep
+	SchedBusy   = rp.SchedBusy
+
+	DefaultSpinThreshold = rp.DefaultSpinThreshold
+	DefaultBackend       = rp.DefaultBackend
+)
+
+// Replay sends the inputs of cfg. Progress lines go to cfg.Out (stdout
+// when nil) and, when set, to cfg.Progress. Once ctx ends the replay
+// stops as on SIGINT, flushing what the sender holds and printing its
+// summary, and returns ctx.Err().
+func Replay(ctx context.Context, cfg Config) error {
+	return rp.Replay(ctx, cfg)
+}
+
+func ParseBalance(value string) (Balance, error)         { return rp.ParseBalance(value) }
+func ParseTxBackend(value string) (TxBackend, error)     { return rp.ParseTxBackend(value) }
+func ParseScrubMode(value string) (ScrubMode, error)     { return rp.ParseScrubMode(value) }
+func ParseStatsFormat(value string) (StatsFormat, error) { return rp.ParseStatsFormat(value) }
+func ParseIPMaps(value string) ([]IPMap, error)          { return rp.ParseIPMaps(value) }
+func ParseDirection(value string) (Direction, error)     { return rp.ParseDirection(value) }
+func ParseNets(value string) ([]*net.IPNet, error)       { return rp.ParseNets(value) }
+func ParseSchedPolicy(value string) (SchedPolicy, error) { return rp.ParseSchedPolicy(value) }